@@ -150,6 +150,17 @@ def get_site_config():
 @app.route('/api/update-cache', methods=['POST'])
 def update_cache():
     try:
+        # The Go relay names the cache domains that changed; engagement is
+        # not cached here, so a notification about it alone needs no update
+        hint = request.get_json(silent=True) or {}
+        domains = hint.get('domains')
+        if domains is not None and not hint.get('full') and not set(domains) & {'profile', 'notes', 'articles'}:
+            return jsonify({
+                'success': True,
+                'message': 'Nothing cached changed',
+                'processed': {'posts': 0, 'quips': 0, 'images': 0}
+            })
+
         print('Manual cache update requested')
         result = nostr_client.update_cache()
         return jsonify({
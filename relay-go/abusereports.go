@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Visitors without a Nostr key can flag abusive comments through
+// /api/report. Each submission becomes a NIP-56 report (kind 1984) signed by
+// the relay key, so it lands in the moderation queue next to the
+// reports Nostr users publish themselves.
+
+// reportSchema indexes NIP-56 reports by what they report, so the moderation
+// queue can be summed up per event or per pubkey; it is one of the
+// eventIndexes
+const reportSchema = `
+	CREATE TABLE IF NOT EXISTS event_reports (
+		event_id TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target TEXT NOT NULL,
+		reporter TEXT NOT NULL,
+		type TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (event_id, target_type, target)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_reports_target ON event_reports(target_type, target);
+`
+
+// reportDismissalSchema records the events and pubkeys a moderator looked at
+// and kept or acted on; reports published after that reopen them
+const reportDismissalSchema = `
+	CREATE TABLE IF NOT EXISTS report_dismissals (
+		event_id TEXT PRIMARY KEY,
+		dismissed_by TEXT NOT NULL,
+		dismissed_at INTEGER NOT NULL
+	);
+`
+
+// reportTypes are the NIP-56 report types
+var reportTypes = map[string]bool{
+	"nudity": true, "malware": true, "profanity": true, "illegal": true,
+	"spam": true, "impersonation": true, "other": true,
+}
+
+// maxReportReason bounds the free-text reason of a submitted report
+const maxReportReason = 1000
+
+// reportLimiter counts submissions per IP in fixed hourly windows
+type reportLimiter struct {
+	perHour int
+	mu      sync.Mutex
+	window  time.Time
+	counts  map[string]int
+}
+
+// allow records a submission from ip, reporting whether it is within the limit
+func (l *reportLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.window) >= time.Hour {
+		l.window = time.Now()
+		l.counts = map[string]int{}
+	}
+	if l.counts[ip] >= l.perHour {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// abuseReports signs visitor reports with the relay key
+type abuseReports struct {
+	key     string
+	pubkey  string
+	limiter *reportLimiter
+}
+
+// newAbuseReports sets up report submission signed by the relay key
+func newAbuseReports(cfg *Config, identity *relayIdentity) *abuseReports {
+	return &abuseReports{
+		key:     identity.key,
+		pubkey:  identity.pubkey,
+		limiter: &reportLimiter{perHour: cfg.ReportsPerHour},
+	}
+}
+
+// handleSubmitReport turns a visitor's report of a stored event into a signed
+// kind 1984 event. The body is {"event_id": "...", "type": "spam",
+// "reason": "..."}; the type defaults to other.
+func handleSubmitReport(c *gin.Context) {
+	if relay.reports == nil {
+		c.JSON(404, gin.H{"error": "reports are not configured"})
+		return
+	}
+
+	var req struct {
+		EventID string `json:"event_id"`
+		Type    string `json:"type"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	req.EventID = strings.ToLower(req.EventID)
+	if req.Type == "" {
+		req.Type = "other"
+	}
+	if !isHex64(req.EventID) {
+		c.JSON(400, gin.H{"error": "event_id must be a hex event id"})
+		return
+	}
+	if !reportTypes[req.Type] {
+		c.JSON(400, gin.H{"error": "type must be one of nudity, malware, profanity, illegal, spam, impersonation or other"})
+		return
+	}
+	if utf8.RuneCountInString(req.Reason) > maxReportReason {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("reason is limited to %d characters", maxReportReason)})
+		return
+	}
+
+	// Only events stored here can be reported, so the endpoint cannot be
+	// used to publish reports about anything else
+	author := relay.eventAuthor(req.EventID)
+	if author == "" {
+		c.JSON(404, gin.H{"error": "event not found"})
+		return
+	}
+	if !relay.reports.limiter.allow(c.ClientIP()) {
+		c.Header("Retry-After", "3600")
+		c.JSON(429, gin.H{"error": "too many reports; try again later"})
+		return
+	}
+
+	event := nostr.NewEvent(1984, req.Reason,
+		[]string{"e", req.EventID, req.Type},
+		[]string{"p", author, req.Type})
+	if err := event.Sign(relay.reports.key); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := relay.publishLocal(event); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("🚩 Visitor reported event %s as %s", req.EventID[:8], req.Type)
+	c.JSON(200, gin.H{"id": event.ID, "reported": req.EventID})
+}
+
+// indexReport records what a NIP-56 report (kind 1984) reports: one row per
+// reported event (e tag) and one per reported pubkey (p tag), each with the
+// report type given in the tag
+func indexReport(db sqlExecer, event *Event) error {
+	if event.Kind != 1984 {
+		return nil
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || (tag[0] != "e" && tag[0] != "p") || !isHex64(tag[1]) {
+			continue
+		}
+		targetType := "event"
+		if tag[0] == "p" {
+			targetType = "pubkey"
+		}
+		typ := "other"
+		if len(tag) >= 3 && reportTypes[tag[2]] {
+			typ = tag[2]
+		}
+		if _, err := db.Exec(`INSERT OR IGNORE INTO event_reports
+			(event_id, target_type, target, reporter, type, reason, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			event.ID, targetType, strings.ToLower(tag[1]), event.PubKey, typ, event.Content, event.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReportTags returns why a kind 1984 event is refused, or "": NIP-56 reports
+// must name the reported pubkey
+func checkReportTags(event *Event) string {
+	if event.Kind != 1984 {
+		return ""
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && isHex64(tag[1]) {
+			return ""
+		}
+	}
+	return "invalid: reports need a p tag with the reported pubkey"
+}
+
+// reportTally sums up the reports against one target
+type reportTally struct {
+	Reports   int            `json:"reports"`
+	Reporters int            `json:"reporters"`
+	Types     map[string]int `json:"types"`
+	Reasons   []string       `json:"reasons"`
+	Latest    int64          `json:"latest"`
+
+	reporters map[string]bool
+}
+
+// reportedEvent is one entry of the moderation queue: an event and the
+// reports against it
+type reportedEvent struct {
+	EventID string `json:"event_id"`
+	Author  string `json:"author"`
+	Event   *Event `json:"event,omitempty"`
+	*reportTally
+}
+
+// reportedPubkey is one entry of the moderation queue by pubkey: everything
+// reported about one author, their events included
+type reportedPubkey struct {
+	Pubkey string `json:"pubkey"`
+	*reportTally
+}
+
+// tallyReports sums up the indexed reports against each event or pubkey
+func (r *Relay) tallyReports(targetType string) (map[string]*reportTally, error) {
+	tallies := map[string]*reportTally{}
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query("SELECT target, reporter, type, reason, created_at FROM event_reports WHERE target_type = ?", targetType)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var target, reporter, typ, reason string
+			var createdAt int64
+			if rows.Scan(&target, &reporter, &typ, &reason, &createdAt) != nil {
+				continue
+			}
+			t := tallies[target]
+			if t == nil {
+				t = &reportTally{Types: map[string]int{}, Reasons: []string{}, reporters: map[string]bool{}}
+				tallies[target] = t
+			}
+			t.Reports++
+			t.Types[typ]++
+			t.reporters[reporter] = true
+			t.Reporters = len(t.reporters)
+			if reason != "" {
+				t.Reasons = append(t.Reasons, reason)
+			}
+			if createdAt > t.Latest {
+				t.Latest = createdAt
+			}
+		}
+		rows.Close()
+	}
+	return tallies, nil
+}
+
+// reportDismissals returns when each dismissed target was dismissed
+func (r *Relay) reportDismissals() (map[string]int64, error) {
+	dismissed := map[string]int64{}
+	rows, err := r.db.Query("SELECT event_id, dismissed_at FROM report_dismissals")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var at int64
+		if rows.Scan(&id, &at) == nil {
+			dismissed[id] = at
+		}
+	}
+	return dismissed, rows.Err()
+}
+
+// moreReported orders queue entries by distinct reporters, then latest report
+func moreReported(a, b *reportTally) bool {
+	if a.Reporters != b.Reporters {
+		return a.Reporters > b.Reporters
+	}
+	return a.Latest > b.Latest
+}
+
+// reportQueue gathers the kind 1984 reports against stored events. Targets
+// that were deleted, whose author is banned, or that were dismissed before
+// their latest report are left out.
+func (r *Relay) reportQueue() ([]*reportedEvent, error) {
+	dismissed, err := r.reportDismissals()
+	if err != nil {
+		return nil, err
+	}
+	tallies, err := r.tallyReports("event")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(tallies))
+	for id := range tallies {
+		ids = append(ids, id)
+	}
+	stored := r.eventsByID(ids)
+
+	queue := []*reportedEvent{}
+	for id, t := range tallies {
+		event, ok := stored[id]
+		if !ok || r.isBanned(event.PubKey) || dismissed[id] >= t.Latest {
+			continue
+		}
+		queue = append(queue, &reportedEvent{EventID: id, Author: event.PubKey, Event: &event, reportTally: t})
+	}
+	sort.Slice(queue, func(i, j int) bool { return moreReported(queue[i].reportTally, queue[j].reportTally) })
+	return queue, nil
+}
+
+// pubkeyReportQueue gathers the reports against each pubkey. Banned pubkeys,
+// and those dismissed or acted on before their latest report, are left out.
+func (r *Relay) pubkeyReportQueue() ([]*reportedPubkey, error) {
+	dismissed, err := r.reportDismissals()
+	if err != nil {
+		return nil, err
+	}
+	tallies, err := r.tallyReports("pubkey")
+	if err != nil {
+		return nil, err
+	}
+
+	queue := []*reportedPubkey{}
+	for pubkey, t := range tallies {
+		if r.isBanned(pubkey) || dismissed[pubkey] >= t.Latest {
+			continue
+		}
+		queue = append(queue, &reportedPubkey{Pubkey: pubkey, reportTally: t})
+	}
+	sort.Slice(queue, func(i, j int) bool { return moreReported(queue[i].reportTally, queue[j].reportTally) })
+	return queue, nil
+}
+
+// handleListReports returns the moderation queue, most-reported first;
+// ?by=pubkey groups the reports by reported pubkey instead of event
+func handleListReports(c *gin.Context) {
+	if c.Query("by") == "pubkey" {
+		queue, err := relay.pubkeyReportQueue()
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"reports": queue})
+		return
+	}
+
+	queue, err := relay.reportQueue()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"reports": queue})
+}
+
+// dismissReports takes a reported event or pubkey off the queue until it is
+// reported again
+func (r *Relay) dismissReports(id string, admin *adminIdentity) error {
+	_, err := r.db.Exec("INSERT OR REPLACE INTO report_dismissals (event_id, dismissed_by, dismissed_at) VALUES (?, ?, ?)",
+		id, admin.Name, time.Now().Unix())
+	return err
+}
+
+// handleDismissReports keeps a reported event or pubkey and takes it off the
+// queue until it is reported again
+func handleDismissReports(c *gin.Context) {
+	id := strings.ToLower(c.Param("id"))
+	if !isHex64(id) {
+		c.JSON(400, gin.H{"error": "id must be a hex event id or pubkey"})
+		return
+	}
+	admin := currentAdmin(c)
+	if err := relay.dismissReports(id, admin); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if author := relay.eventAuthor(id); author != "" {
+		relay.audit(admin, "dismiss_reports", []string{id}, []string{author}, "")
+	} else {
+		relay.audit(admin, "dismiss_reports", nil, []string{id}, "")
+	}
+	c.JSON(200, gin.H{"event_id": id, "dismissed": true})
+}
+
+// handleReportAction acts on a queue entry: {"action": "delete"} removes a
+// reported event, or every event of a reported pubkey; {"action": "ban"}
+// bans the event's author or the pubkey, and "purge" also removes their
+// events. The entry leaves the queue until it is reported again.
+func handleReportAction(c *gin.Context) {
+	id := strings.ToLower(c.Param("id"))
+	if !isHex64(id) {
+		c.JSON(400, gin.H{"error": "id must be a hex event id or pubkey"})
+		return
+	}
+	var req struct {
+		Action string `json:"action"`
+		Reason string `json:"reason"`
+		Purge  bool   `json:"purge"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Action != "delete" && req.Action != "ban") {
+		c.JSON(400, gin.H{"error": "body must be {\"action\": \"delete\"|\"ban\"}"})
+		return
+	}
+
+	// An id that is not a stored event is taken as a reported pubkey
+	var eventIDs []string
+	pubkey := id
+	if author := relay.eventAuthor(id); author != "" {
+		eventIDs = []string{id}
+		pubkey = author
+	}
+	admin := currentAdmin(c)
+	response := gin.H{"id": id, "action": req.Action, "pubkey": pubkey}
+	details := req.Reason
+
+	if req.Action == "ban" {
+		if _, isAdmin := relay.admins.byPubkey[pubkey]; isAdmin {
+			c.JSON(409, gin.H{"error": "admins cannot be banned"})
+			return
+		}
+		if err := relay.banPubkey(pubkey, req.Reason, admin.Name); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Action == "delete" || req.Purge {
+		condition, arg := "pubkey = ?", pubkey
+		if req.Action == "delete" && eventIDs != nil {
+			condition, arg = "id = ?", id
+		}
+		removed, err := relay.deleteEvents(condition, arg)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		response["events_removed"] = removed
+		details = strings.TrimSpace(fmt.Sprintf("%s (removed %d events)", req.Reason, removed))
+	}
+	if err := relay.dismissReports(id, admin); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	relay.audit(admin, "report_"+req.Action, eventIDs, []string{pubkey}, details)
+	log.Printf("🚩 %s acted on reports against %s: %s", admin.Name, id[:8], req.Action)
+	c.JSON(200, response)
+}
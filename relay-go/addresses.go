@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// addressSchema indexes the `a` tags of events; it is one of the eventIndexes
+const addressSchema = `
+	CREATE TABLE IF NOT EXISTS event_atags (
+		kind INTEGER NOT NULL,
+		pubkey TEXT NOT NULL,
+		d TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (kind, pubkey, d, event_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_atags_event ON event_atags(event_id);
+`
+
+// address identifies an addressable or replaceable event as kind:pubkey:d
+type address struct {
+	Kind   int
+	Pubkey string
+	D      string
+}
+
+// String formats an address as kind:pubkey:d
+func (a address) String() string {
+	return strconv.Itoa(a.Kind) + ":" + a.Pubkey + ":" + a.D
+}
+
+// parseAddress parses an `a` tag value; the d part may itself contain colons.
+// It does not allocate for lowercase pubkeys, since live events are matched
+// against #a filters with it.
+func parseAddress(value string) (address, bool) {
+	first := strings.IndexByte(value, ':')
+	if first < 0 {
+		return address{}, false
+	}
+	second := strings.IndexByte(value[first+1:], ':')
+	if second < 0 {
+		return address{}, false
+	}
+	second += first + 1
+	kind, err := strconv.Atoi(value[:first])
+	pubkey := value[first+1 : second]
+	if err != nil || kind < 0 || !isHex64(pubkey) {
+		return address{}, false
+	}
+	return address{Kind: kind, Pubkey: strings.ToLower(pubkey), D: value[second+1:]}, true
+}
+
+// isHex64 reports whether s is a 32-byte hex string such as a pubkey
+func isHex64(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexAddressTags records the addresses an event references in its `a` tags
+func indexAddressTags(db sqlExecer, event *Event) error {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "a" {
+			continue
+		}
+		addr, ok := parseAddress(tag[1])
+		if !ok {
+			continue
+		}
+		if _, err := db.Exec(`INSERT OR IGNORE INTO event_atags (kind, pubkey, d, event_id, created_at)
+			VALUES (?, ?, ?, ?, ?)`, addr.Kind, addr.Pubkey, addr.D, event.ID, event.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addressConditions builds the WHERE clause for a filter's #a values. Values
+// that are not valid addresses cannot match an indexed tag.
+func addressConditions(values []string) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	for _, value := range values {
+		addr, ok := parseAddress(value)
+		if !ok {
+			continue
+		}
+		clauses = append(clauses, "(kind = ? AND pubkey = ? AND d = ?)")
+		args = append(args, addr.Kind, addr.Pubkey, addr.D)
+	}
+	if len(clauses) == 0 {
+		return "0", nil
+	}
+	return "id IN (SELECT event_id FROM event_atags WHERE " + strings.Join(clauses, " OR ") + ")", args
+}
+
+// handleAddressReferences lists events referencing an addressable event, such
+// as comments, replies and reactions to a long-form article. The address is
+// passed as ?a=kind:pubkey:d since d may contain slashes; ?kinds= narrows the
+// result, e.g. to kind 1111 comments.
+func handleAddressReferences(c *gin.Context) {
+	value := c.Query("a")
+	if _, ok := parseAddress(value); !ok {
+		c.JSON(400, gin.H{"error": "a must be kind:pubkey:d"})
+		return
+	}
+
+	filter := Filter{Tags: map[string][]string{"a": {value}}}
+	if kinds := c.Query("kinds"); kinds != "" {
+		for _, k := range strings.Split(kinds, ",") {
+			kind, err := strconv.Atoi(strings.TrimSpace(k))
+			if err != nil {
+				c.JSON(400, gin.H{"error": "kinds must be comma-separated integers"})
+				return
+			}
+			filter.Kinds = append(filter.Kinds, kind)
+		}
+	}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil {
+		filter.Limit = &limit
+	}
+
+	events := relay.getMatchingEvents([]Filter{filter})
+	c.JSON(200, gin.H{"address": value, "events": relay.publicEvents(events)})
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminRole gates admin API capabilities; higher roles include lower ones
+type adminRole int
+
+const (
+	// roleAuditor can read admin data but not change anything
+	roleAuditor adminRole = iota + 1
+	// roleModerator can delete events and ban pubkeys
+	roleModerator
+	// roleOwner can also change relay configuration
+	roleOwner
+)
+
+var roleNames = map[string]adminRole{
+	"auditor":   roleAuditor,
+	"moderator": roleModerator,
+	"owner":     roleOwner,
+}
+
+func (role adminRole) String() string {
+	for name, r := range roleNames {
+		if r == role {
+			return name
+		}
+	}
+	return "none"
+}
+
+// adminIdentity is one admin, identified by a NIP-98 pubkey or a bearer token
+type adminIdentity struct {
+	Name   string `json:"name"`
+	Pubkey string `json:"pubkey,omitempty"`
+	Token  string `json:"token,omitempty"`
+	Role   string `json:"role"`
+
+	role adminRole
+}
+
+// adminSet is the configured admins; the NOSTR_NPUB owner is always included
+type adminSet struct {
+	byPubkey map[string]*adminIdentity
+	tokens   []*adminIdentity
+}
+
+// loadAdmins reads the admin list from path (optional) and adds the relay owner
+func loadAdmins(path, ownerPubkey string) (*adminSet, error) {
+	admins := &adminSet{byPubkey: make(map[string]*adminIdentity)}
+
+	var identities []adminIdentity
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &identities); err != nil {
+			return nil, fmt.Errorf("invalid admin config: %v", err)
+		}
+	}
+
+	for i := range identities {
+		admin := &identities[i]
+		role, ok := roleNames[strings.ToLower(admin.Role)]
+		if !ok {
+			return nil, fmt.Errorf("admin %q has unknown role %q", admin.Name, admin.Role)
+		}
+		admin.role = role
+
+		switch {
+		case admin.Pubkey != "":
+			pubkey, err := nostr.DecodePublicKey(admin.Pubkey)
+			if err != nil {
+				return nil, fmt.Errorf("admin %q: %v", admin.Name, err)
+			}
+			admin.Pubkey = pubkey
+			admins.byPubkey[pubkey] = admin
+		case len(admin.Token) >= 16:
+			admins.tokens = append(admins.tokens, admin)
+		default:
+			return nil, fmt.Errorf("admin %q needs a pubkey or a token of at least 16 characters", admin.Name)
+		}
+	}
+
+	if ownerPubkey != "" {
+		admins.byPubkey[ownerPubkey] = &adminIdentity{Name: "owner", Pubkey: ownerPubkey, Role: "owner", role: roleOwner}
+	}
+
+	if len(identities) > 0 {
+		log.Printf("🛡️  Loaded %d admin identities", len(identities))
+	}
+	return admins, nil
+}
+
+// authenticate resolves the admin behind a request from a bearer token or a NIP-98 header
+func (a *adminSet) authenticate(c *gin.Context) (*adminIdentity, error) {
+	header := c.GetHeader("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := []byte(strings.TrimPrefix(header, "Bearer "))
+		for _, admin := range a.tokens {
+			if subtle.ConstantTimeCompare(token, []byte(admin.Token)) == 1 {
+				return admin, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown admin token")
+	}
+
+	pubkey, err := verifyHTTPAuth(c)
+	if err != nil {
+		return nil, err
+	}
+	admin, ok := a.byPubkey[pubkey]
+	if !ok {
+		return nil, fmt.Errorf("%s is not an admin", pubkey)
+	}
+	return admin, nil
+}
+
+// requireRole rejects requests whose admin identity lacks the given role and
+// stores the admin under "admin" (and its pubkey under "pubkey" when known)
+func requireRole(role adminRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin, err := relay.admins.authenticate(c)
+		if err != nil {
+			c.Header("WWW-Authenticate", "Nostr")
+			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+			return
+		}
+		if admin.role < role {
+			c.AbortWithStatusJSON(403, gin.H{"error": fmt.Sprintf("this endpoint requires the %s role", role)})
+			return
+		}
+
+		c.Set("admin", admin)
+		if admin.Pubkey != "" {
+			c.Set("pubkey", admin.Pubkey)
+		}
+	}
+}
+
+// currentAdmin returns the admin stored by requireRole
+func currentAdmin(c *gin.Context) *adminIdentity {
+	admin, _ := c.MustGet("admin").(*adminIdentity)
+	return admin
+}
+
+const banSchema = `
+	CREATE TABLE IF NOT EXISTS banned_pubkeys (
+		pubkey TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		banned_by TEXT NOT NULL,
+		banned_at INTEGER NOT NULL
+	);
+`
+
+// loadBans reads banned pubkeys into memory for the EVENT hot path
+func (r *Relay) loadBans() error {
+	rows, err := r.db.Query("SELECT pubkey FROM banned_pubkeys")
+	if missingTable(err) {
+		r.bans = make(map[string]bool)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	r.bansMutex.Lock()
+	defer r.bansMutex.Unlock()
+	r.bans = make(map[string]bool)
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return err
+		}
+		r.bans[pubkey] = true
+	}
+	return rows.Err()
+}
+
+// isBanned reports whether events from a pubkey are refused
+func (r *Relay) isBanned(pubkey string) bool {
+	r.bansMutex.RLock()
+	defer r.bansMutex.RUnlock()
+	return r.bans[pubkey]
+}
+
+// banPubkey refuses future events from a pubkey
+func (r *Relay) banPubkey(pubkey, reason, by string) error {
+	_, err := r.db.Exec(
+		"INSERT OR REPLACE INTO banned_pubkeys (pubkey, reason, banned_by, banned_at) VALUES (?, ?, ?, ?)",
+		pubkey, reason, by, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	r.bansMutex.Lock()
+	r.bans[pubkey] = true
+	r.bansMutex.Unlock()
+	return nil
+}
+
+// unbanPubkey lifts a ban, reporting whether one existed
+func (r *Relay) unbanPubkey(pubkey string) (bool, error) {
+	result, err := r.db.Exec("DELETE FROM banned_pubkeys WHERE pubkey = ?", pubkey)
+	if err != nil {
+		return false, err
+	}
+
+	r.bansMutex.Lock()
+	delete(r.bans, pubkey)
+	r.bansMutex.Unlock()
+
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// deleteEvents removes events matching a condition from every event database
+// and the owner's duplicate index, returning the number of events removed
+func (r *Relay) deleteEvents(condition string, args ...interface{}) (int64, error) {
+	r.writes.RLock()
+	defer r.writes.RUnlock()
+	return r.removeEvents(condition, args...)
+}
+
+// removeEvents does the work of deleteEvents; the caller must hold r.writes
+func (r *Relay) removeEvents(condition string, args ...interface{}) (int64, error) {
+	var removed int64
+	for _, db := range r.eventDBs(nil, nil) {
+		ids, err := db.Query("SELECT id FROM relay_events WHERE "+condition, args...)
+		if err != nil {
+			return removed, err
+		}
+		var eventIDs []string
+		for ids.Next() {
+			var id string
+			if ids.Scan(&id) == nil {
+				eventIDs = append(eventIDs, id)
+			}
+		}
+		ids.Close()
+
+		for _, id := range eventIDs {
+			if err := removeVersion(db, id); err != nil {
+				return removed, err
+			}
+			r.forgetEvent(id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// handleWhoAmI reports the authenticated admin and role
+func handleWhoAmI(c *gin.Context) {
+	admin := currentAdmin(c)
+	c.JSON(200, gin.H{"name": admin.Name, "pubkey": admin.Pubkey, "role": admin.role.String()})
+}
+
+// handleListAdmins lists the configured admins without their tokens
+func handleListAdmins(c *gin.Context) {
+	admins := []gin.H{}
+	for _, admin := range relay.admins.byPubkey {
+		admins = append(admins, gin.H{"name": admin.Name, "pubkey": admin.Pubkey, "role": admin.role.String()})
+	}
+	for _, admin := range relay.admins.tokens {
+		admins = append(admins, gin.H{"name": admin.Name, "token": true, "role": admin.role.String()})
+	}
+	c.JSON(200, gin.H{"admins": admins})
+}
+
+// handleListBans lists banned pubkeys
+func handleListBans(c *gin.Context) {
+	rows, err := relay.db.Query("SELECT pubkey, reason, banned_by, banned_at FROM banned_pubkeys ORDER BY banned_at DESC")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	bans := []gin.H{}
+	for rows.Next() {
+		var pubkey, reason, by string
+		var at int64
+		if rows.Scan(&pubkey, &reason, &by, &at) == nil {
+			bans = append(bans, gin.H{"pubkey": pubkey, "reason": reason, "banned_by": by, "banned_at": at})
+		}
+	}
+	c.JSON(200, gin.H{"bans": bans})
+}
+
+// handleBanPubkey bans a pubkey and optionally purges its stored events
+func handleBanPubkey(c *gin.Context) {
+	var req struct {
+		Pubkey string `json:"pubkey"`
+		Reason string `json:"reason"`
+		Purge  bool   `json:"purge"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	pubkey, err := nostr.DecodePublicKey(req.Pubkey)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if _, isAdmin := relay.admins.byPubkey[pubkey]; isAdmin {
+		c.JSON(409, gin.H{"error": "admins cannot be banned"})
+		return
+	}
+
+	admin := currentAdmin(c)
+	if err := relay.banPubkey(pubkey, req.Reason, admin.Name); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"pubkey": pubkey, "banned": true}
+	details := req.Reason
+	if req.Purge {
+		removed, err := relay.deleteEvents("pubkey = ?", pubkey)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		response["events_removed"] = removed
+		details = strings.TrimSpace(fmt.Sprintf("%s (purged %d events)", req.Reason, removed))
+	}
+	relay.audit(admin, "ban", nil, []string{pubkey}, details)
+
+	log.Printf("🚫 %s banned %s", admin.Name, pubkey[:8])
+	c.JSON(200, response)
+}
+
+// handleUnbanPubkey lifts a ban
+func handleUnbanPubkey(c *gin.Context) {
+	pubkey, err := nostr.DecodePublicKey(c.Param("pubkey"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	found, err := relay.unbanPubkey(pubkey)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"error": "pubkey is not banned"})
+		return
+	}
+
+	relay.audit(currentAdmin(c), "unban", nil, []string{pubkey}, "")
+	c.JSON(200, gin.H{"pubkey": pubkey, "banned": false})
+}
+
+// eventAuthor returns the pubkey of a stored event, or "" when it is not stored
+func (r *Relay) eventAuthor(id string) string {
+	for _, db := range r.eventDBs(nil, nil) {
+		var pubkey string
+		if db.QueryRow("SELECT pubkey FROM relay_events WHERE id = ?", id).Scan(&pubkey) == nil {
+			return pubkey
+		}
+	}
+	return ""
+}
+
+// handleAdminDeleteEvent removes a single event
+func handleAdminDeleteEvent(c *gin.Context) {
+	author := relay.eventAuthor(c.Param("id"))
+	removed, err := relay.deleteEvents("id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if removed == 0 {
+		c.JSON(404, gin.H{"error": "event not found"})
+		return
+	}
+
+	relay.audit(currentAdmin(c), "delete_event", []string{c.Param("id")}, []string{author}, "")
+	log.Printf("🗑️  %s deleted event %s", currentAdmin(c).Name, c.Param("id"))
+	c.JSON(200, gin.H{"id": c.Param("id"), "deleted": true})
+}
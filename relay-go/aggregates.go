@@ -0,0 +1,410 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aggregateSchema holds per-day event counts by (kind, author) and zap totals
+// by recipient, updated as events arrive and reconciled nightly
+const aggregateSchema = `
+	CREATE TABLE IF NOT EXISTS daily_aggregates (
+		day INTEGER NOT NULL,
+		kind INTEGER NOT NULL,
+		pubkey TEXT NOT NULL,
+		events INTEGER NOT NULL,
+		bytes INTEGER NOT NULL,
+		PRIMARY KEY (day, kind, pubkey)
+	);
+	CREATE TABLE IF NOT EXISTS daily_zaps (
+		day INTEGER NOT NULL,
+		recipient TEXT NOT NULL,
+		zaps INTEGER NOT NULL,
+		msats INTEGER NOT NULL,
+		PRIMARY KEY (day, recipient)
+	);
+`
+
+// aggregateKey identifies one daily_aggregates row
+type aggregateKey struct {
+	kind   int
+	pubkey string
+}
+
+// aggregateRow is the counters of one daily_aggregates row
+type aggregateRow struct {
+	events int64
+	bytes  int64
+}
+
+// zapRow is the counters of one daily_zaps row
+type zapRow struct {
+	zaps  int64
+	msats int64
+}
+
+// dayAggregates is everything aggregated for one day
+type dayAggregates struct {
+	events map[aggregateKey]aggregateRow
+	zaps   map[string]zapRow
+}
+
+func newDayAggregates() *dayAggregates {
+	return &dayAggregates{events: make(map[aggregateKey]aggregateRow), zaps: make(map[string]zapRow)}
+}
+
+// add counts one event
+func (d *dayAggregates) add(event *Event) {
+	key := aggregateKey{event.Kind, event.PubKey}
+	row := d.events[key]
+	row.events++
+	row.bytes += storedSize(event)
+	d.events[key] = row
+
+	if event.Kind == 9735 {
+		if recipient := event.TagValue("p"); recipient != "" {
+			zap := d.zaps[recipient]
+			zap.zaps++
+			zap.msats += zapAmountMsat(event)
+			d.zaps[recipient] = zap
+		}
+	}
+}
+
+// equal reports whether two days aggregated to the same counters
+func (d *dayAggregates) equal(other *dayAggregates) bool {
+	if len(d.events) != len(other.events) || len(d.zaps) != len(other.zaps) {
+		return false
+	}
+	for key, row := range d.events {
+		if other.events[key] != row {
+			return false
+		}
+	}
+	for recipient, zap := range d.zaps {
+		if other.zaps[recipient] != zap {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregate adds a newly stored event to its day's aggregates
+func (r *Relay) aggregate(db sqlExecer, event *Event) error {
+	day := eventDay(event.CreatedAt)
+
+	_, err := db.Exec(`
+		INSERT INTO daily_aggregates (day, kind, pubkey, events, bytes) VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT (day, kind, pubkey) DO UPDATE SET events = events + 1, bytes = bytes + excluded.bytes`,
+		day, event.Kind, event.PubKey, storedSize(event),
+	)
+	if err == nil && event.Kind == 9735 {
+		if recipient := event.TagValue("p"); recipient != "" {
+			_, err = db.Exec(`
+				INSERT INTO daily_zaps (day, recipient, zaps, msats) VALUES (?, ?, 1, ?)
+				ON CONFLICT (day, recipient) DO UPDATE SET zaps = zaps + 1, msats = msats + excluded.msats`,
+				day, recipient, zapAmountMsat(event),
+			)
+		}
+	}
+	return err
+}
+
+// computeDay aggregates a day directly from the stored events
+func (r *Relay) computeDay(day int64) *dayAggregates {
+	computed := newDayAggregates()
+	for _, event := range r.scanRange(day*86400, day*86400+86399, "") {
+		computed.add(&event)
+	}
+	return computed
+}
+
+// storedDay reads a day's aggregates as currently stored
+func (r *Relay) storedDay(day int64) (*dayAggregates, error) {
+	stored := newDayAggregates()
+
+	rows, err := r.db.Query("SELECT kind, pubkey, events, bytes FROM daily_aggregates WHERE day = ?", day)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key aggregateKey
+		var row aggregateRow
+		if err := rows.Scan(&key.kind, &key.pubkey, &row.events, &row.bytes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored.events[key] = row
+	}
+	rows.Close()
+
+	rows, err = r.db.Query("SELECT recipient, zaps, msats FROM daily_zaps WHERE day = ?", day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var recipient string
+		var zap zapRow
+		if err := rows.Scan(&recipient, &zap.zaps, &zap.msats); err != nil {
+			return nil, err
+		}
+		stored.zaps[recipient] = zap
+	}
+	return stored, rows.Err()
+}
+
+// replaceDay overwrites a day's aggregates
+func (r *Relay) replaceDay(day int64, computed *dayAggregates) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tx.Exec("DELETE FROM daily_aggregates WHERE day = ?", day)
+	tx.Exec("DELETE FROM daily_zaps WHERE day = ?", day)
+	for key, row := range computed.events {
+		if _, err := tx.Exec("INSERT INTO daily_aggregates (day, kind, pubkey, events, bytes) VALUES (?, ?, ?, ?, ?)",
+			day, key.kind, key.pubkey, row.events, row.bytes); err != nil {
+			return err
+		}
+	}
+	for recipient, zap := range computed.zaps {
+		if _, err := tx.Exec("INSERT INTO daily_zaps (day, recipient, zaps, msats) VALUES (?, ?, ?, ?)",
+			day, recipient, zap.zaps, zap.msats); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// reconcileDays recomputes aggregates for [firstDay, lastDay] from the stored
+// events, fixing drift from replaced or deleted events. With sketches set, the
+// COUNT sketches of corrected days are rebuilt too since sketches cannot
+// forget events. It returns the number of days that had to be corrected.
+func (r *Relay) reconcileDays(firstDay, lastDay int64, sketches bool) (int, error) {
+	corrected := 0
+	for day := firstDay; day <= lastDay; day++ {
+		computed := r.computeDay(day)
+		stored, err := r.storedDay(day)
+		if err != nil {
+			return corrected, err
+		}
+		if computed.equal(stored) {
+			continue
+		}
+
+		if err := r.replaceDay(day, computed); err != nil {
+			return corrected, err
+		}
+		if sketches && r.cfg.CountApproxDays > 0 {
+			since, until := day*86400, day*86400+86399
+			r.db.Exec("DELETE FROM count_sketches WHERE day = ?", day)
+			for _, db := range r.eventDBs(&since, &until) {
+				if _, err := r.rebuildSketches(db, "created_at >= ? AND created_at <= ?", since, until); err != nil {
+					return corrected, err
+				}
+			}
+		}
+		corrected++
+	}
+	return corrected, nil
+}
+
+// eventDayRange returns the first and last day holding stored events
+func (r *Relay) eventDayRange() (int64, int64, bool) {
+	var first, last int64
+	found := false
+	for _, db := range r.eventDBs(nil, nil) {
+		var minAt, maxAt sql.NullInt64
+		db.QueryRow("SELECT MIN(created_at), MAX(created_at) FROM relay_events").Scan(&minAt, &maxAt)
+		if !minAt.Valid {
+			continue
+		}
+		if !found || eventDay(minAt.Int64) < first {
+			first = eventDay(minAt.Int64)
+		}
+		if !found || eventDay(maxAt.Int64) > last {
+			last = eventDay(maxAt.Int64)
+		}
+		found = true
+	}
+	return first, last, found
+}
+
+// reconcileAggregates builds aggregates for all history the first time, then
+// every night at RELAY_RECONCILE_HOUR (UTC) reconciles the last RELAY_RECONCILE_DAYS.
+// It runs after backfillSketches, so the first build leaves sketches alone.
+func (r *Relay) reconcileAggregates() {
+	var existing int
+	r.db.QueryRow("SELECT COUNT(*) FROM daily_aggregates").Scan(&existing)
+	if first, last, ok := r.eventDayRange(); ok && existing == 0 {
+		start := time.Now()
+		days, err := r.reconcileDays(first, last, false)
+		if err != nil {
+			log.Printf("❌ Failed to build daily aggregates: %v", err)
+		} else {
+			log.Printf("📊 Built daily aggregates for %d days in %s", days, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	for {
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), r.cfg.ReconcileHour, 0, 0, 0, time.UTC)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		time.Sleep(time.Until(next))
+
+		today := eventDay(time.Now().Unix())
+		days, err := r.reconcileDays(today-int64(r.cfg.ReconcileDays), today, true)
+		if err != nil {
+			log.Printf("❌ Nightly aggregate reconciliation failed: %v", err)
+		} else if days > 0 {
+			log.Printf("📊 Nightly reconciliation corrected %d days of aggregates", days)
+		}
+	}
+}
+
+// dayDate formats a day number as YYYY-MM-DD
+func dayDate(day int64) string {
+	return time.Unix(day*86400, 0).UTC().Format("2006-01-02")
+}
+
+// parseDayParam parses a YYYY-MM-DD query parameter into a day number
+func parseDayParam(value string, fallback int64) (int64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return 0, err
+	}
+	return eventDay(t.Unix()), nil
+}
+
+// handleDailyAnalytics returns per-day event counts, optionally for one kind
+// and author, and zap totals received by a pubkey (default: the owner)
+func handleDailyAnalytics(c *gin.Context) {
+	today := eventDay(time.Now().Unix())
+	first, err := parseDayParam(c.Query("since"), today-29)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "since must be YYYY-MM-DD"})
+		return
+	}
+	last, err := parseDayParam(c.Query("until"), today)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "until must be YYYY-MM-DD"})
+		return
+	}
+	if last-first > 3660 {
+		c.JSON(400, gin.H{"error": "range is limited to ten years"})
+		return
+	}
+
+	query := "SELECT day, SUM(events), SUM(bytes) FROM daily_aggregates WHERE day BETWEEN ? AND ?"
+	args := []interface{}{first, last}
+	if kind, err := strconv.Atoi(c.Query("kind")); err == nil {
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	if c.Query("pubkey") != "" {
+		pubkey, err := nostr.DecodePublicKey(c.Query("pubkey"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		query += " AND pubkey = ?"
+		args = append(args, pubkey)
+	}
+
+	days := make(map[int64]gin.H)
+	rows, err := relay.db.Query(query+" GROUP BY day", args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	for rows.Next() {
+		var day, events, bytes int64
+		if rows.Scan(&day, &events, &bytes) == nil {
+			days[day] = gin.H{"events": events, "bytes": bytes}
+		}
+	}
+	rows.Close()
+
+	recipient := relay.cfg.OwnerPubkey
+	if c.Query("zaps_for") != "" {
+		if recipient, err = nostr.DecodePublicKey(c.Query("zaps_for")); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	zaps := make(map[int64]zapRow)
+	rows, err = relay.db.Query("SELECT day, zaps, msats FROM daily_zaps WHERE recipient = ? AND day BETWEEN ? AND ?", recipient, first, last)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	for rows.Next() {
+		var day int64
+		var zap zapRow
+		if rows.Scan(&day, &zap.zaps, &zap.msats) == nil {
+			zaps[day] = zap
+		}
+	}
+	rows.Close()
+
+	series := []gin.H{}
+	for day := first; day <= last; day++ {
+		entry := gin.H{"date": dayDate(day), "events": int64(0), "bytes": int64(0)}
+		if counts, ok := days[day]; ok {
+			entry["events"], entry["bytes"] = counts["events"], counts["bytes"]
+		}
+		entry["zaps"], entry["zap_msats"] = zaps[day].zaps, zaps[day].msats
+		series = append(series, entry)
+	}
+
+	c.JSON(200, gin.H{"days": series})
+}
+
+// handleReconcileAggregates reconciles aggregates on demand for the last
+// ?days=N days, or for all history with ?days=all
+func handleReconcileAggregates(c *gin.Context) {
+	today := eventDay(time.Now().Unix())
+	first := today - 6
+
+	switch days := c.DefaultQuery("days", "7"); days {
+	case "all":
+		oldest, _, ok := relay.eventDayRange()
+		if !ok {
+			c.JSON(200, gin.H{"days": 0, "corrected": 0})
+			return
+		}
+		first = oldest
+	default:
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			c.JSON(400, gin.H{"error": "days must be a positive number or all"})
+			return
+		}
+		first = today - int64(n) + 1
+	}
+
+	corrected, err := relay.reconcileDays(first, today, true)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	details := fmt.Sprintf("%s to %s, %d days corrected", dayDate(first), dayDate(today), corrected)
+	relay.audit(currentAdmin(c), "reconcile_aggregates", nil, nil, details)
+	c.JSON(200, gin.H{"days": today - first + 1, "corrected": corrected})
+}
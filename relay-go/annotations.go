@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// annotationSchema holds the owner's private labels and notes on stored
+// events. They are never served over the websocket, only through the
+// owner-authenticated /api/annotations endpoints.
+const annotationSchema = `
+	CREATE TABLE IF NOT EXISTS event_labels (
+		event_id TEXT NOT NULL,
+		label TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (event_id, label)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_event_labels_label ON event_labels(label, created_at);
+
+	CREATE TABLE IF NOT EXISTS event_notes (
+		event_id TEXT PRIMARY KEY,
+		note TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+`
+
+// Annotation limits
+const (
+	maxAnnotationLabels = 32
+	maxLabelLength      = 64
+	maxNoteLength       = 10000
+)
+
+// annotation is the owner's labels and note on one event
+type annotation struct {
+	Labels    []string `json:"labels"`
+	Note      string   `json:"note"`
+	UpdatedAt int64    `json:"updated_at"`
+}
+
+// annotations loads the annotations of the given events; events without any
+// are left out
+func (r *Relay) annotations(ids []string) (map[string]*annotation, error) {
+	found := make(map[string]*annotation, len(ids))
+	if len(ids) == 0 {
+		return found, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	get := func(id string) *annotation {
+		if found[id] == nil {
+			found[id] = &annotation{Labels: []string{}}
+		}
+		return found[id]
+	}
+
+	rows, err := r.db.Query("SELECT event_id, label, created_at FROM event_labels WHERE event_id IN ("+placeholders+") ORDER BY created_at, label", args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, label string
+		var createdAt int64
+		if rows.Scan(&id, &label, &createdAt) != nil {
+			continue
+		}
+		a := get(id)
+		a.Labels = append(a.Labels, label)
+		if createdAt > a.UpdatedAt {
+			a.UpdatedAt = createdAt
+		}
+	}
+	rows.Close()
+
+	rows, err = r.db.Query("SELECT event_id, note, updated_at FROM event_notes WHERE event_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, note string
+		var updatedAt int64
+		if rows.Scan(&id, &note, &updatedAt) != nil {
+			continue
+		}
+		a := get(id)
+		a.Note = note
+		if updatedAt > a.UpdatedAt {
+			a.UpdatedAt = updatedAt
+		}
+	}
+	return found, nil
+}
+
+// setAnnotation replaces the labels and note of an event; labels already set
+// keep their original time
+func (r *Relay) setAnnotation(eventID string, labels []string, note string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(labels)), ",")
+	args := []interface{}{eventID}
+	for _, label := range labels {
+		args = append(args, label)
+	}
+	query := "DELETE FROM event_labels WHERE event_id = ?"
+	if len(labels) > 0 {
+		query += " AND label NOT IN (" + placeholders + ")"
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	for _, label := range labels {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO event_labels (event_id, label, created_at) VALUES (?, ?, ?)", eventID, label, now); err != nil {
+			return err
+		}
+	}
+
+	if note == "" {
+		_, err = tx.Exec("DELETE FROM event_notes WHERE event_id = ?", eventID)
+	} else {
+		_, err = tx.Exec(`INSERT INTO event_notes (event_id, note, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT(event_id) DO UPDATE SET note = excluded.note, updated_at = excluded.updated_at
+			WHERE note != excluded.note`, eventID, note, now)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// normalizeLabels trims and deduplicates labels, rejecting empty or overlong ones
+func normalizeLabels(labels []string) ([]string, bool) {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || len(label) > maxLabelLength {
+			return nil, false
+		}
+		if !seen[label] {
+			seen[label] = true
+			normalized = append(normalized, label)
+		}
+	}
+	return normalized, len(normalized) <= maxAnnotationLabels
+}
+
+// handleListAnnotations lists annotated events, most recently annotated first,
+// with each event included when it is still stored. ?label= narrows the list
+// to one label, e.g. the owner's favorites.
+func handleListAnnotations(c *gin.Context) {
+	limit := relay.cfg.DefaultLimit
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n >= 0 && n <= relay.cfg.MaxLimit {
+		limit = n
+	}
+
+	var rows *sql.Rows
+	var err error
+	if label := c.Query("label"); label != "" {
+		rows, err = relay.db.Query("SELECT event_id FROM event_labels WHERE label = ? ORDER BY created_at DESC LIMIT ?", label, limit)
+	} else {
+		rows, err = relay.db.Query(`SELECT event_id FROM (
+				SELECT event_id, created_at AS at FROM event_labels
+				UNION ALL SELECT event_id, updated_at FROM event_notes
+			) GROUP BY event_id ORDER BY MAX(at) DESC LIMIT ?`, limit)
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	annotations, err := relay.annotations(ids)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	stored := relay.eventsByID(ids)
+	list := []gin.H{}
+	for _, id := range ids {
+		entry := gin.H{"event_id": id, "annotation": annotations[id]}
+		if event, ok := stored[id]; ok {
+			entry["event"] = event
+		}
+		list = append(list, entry)
+	}
+	c.JSON(200, gin.H{"annotations": list})
+}
+
+// handleListLabels lists the labels in use with how many events carry each
+func handleListLabels(c *gin.Context) {
+	rows, err := relay.db.Query("SELECT label, COUNT(*) FROM event_labels GROUP BY label ORDER BY COUNT(*) DESC, label")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	labels := []gin.H{}
+	for rows.Next() {
+		var label string
+		var count int
+		if rows.Scan(&label, &count) == nil {
+			labels = append(labels, gin.H{"label": label, "events": count})
+		}
+	}
+	c.JSON(200, gin.H{"labels": labels})
+}
+
+// handleGetAnnotation returns the owner's annotation on one event
+func handleGetAnnotation(c *gin.Context) {
+	eventID := strings.ToLower(c.Param("id"))
+	annotations, err := relay.annotations([]string{eventID})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	a := annotations[eventID]
+	if a == nil {
+		a = &annotation{Labels: []string{}}
+	}
+	c.JSON(200, gin.H{"event_id": eventID, "annotation": a})
+}
+
+// handleSetAnnotation replaces the owner's labels and note on a stored event
+func handleSetAnnotation(c *gin.Context) {
+	eventID := strings.ToLower(c.Param("id"))
+	var req struct {
+		Labels []string `json:"labels"`
+		Note   string   `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "body must be {\"labels\": [...], \"note\": \"...\"}"})
+		return
+	}
+	labels, ok := normalizeLabels(req.Labels)
+	if !ok {
+		c.JSON(400, gin.H{"error": "labels must be 1 to 64 characters, at most 32 per event"})
+		return
+	}
+	if len(req.Note) > maxNoteLength {
+		c.JSON(400, gin.H{"error": "note is too long"})
+		return
+	}
+
+	if !isHex64(eventID) {
+		c.JSON(400, gin.H{"error": "invalid event id"})
+		return
+	}
+	stored, err := relay.storedEventIDs([]string{eventID})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !stored[eventID] {
+		c.JSON(404, gin.H{"error": "event not found"})
+		return
+	}
+
+	if err := relay.setAnnotation(eventID, labels, strings.TrimSpace(req.Note)); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(currentAdmin(c), "annotate", []string{eventID}, nil, "")
+	handleGetAnnotation(c)
+}
+
+// handleDeleteAnnotation removes the owner's labels and note from an event
+func handleDeleteAnnotation(c *gin.Context) {
+	eventID := strings.ToLower(c.Param("id"))
+	if err := relay.setAnnotation(eventID, nil, ""); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(currentAdmin(c), "annotation_delete", []string{eventID}, nil, "")
+	c.JSON(200, gin.H{"deleted": true})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+)
+
+// The relay announces itself so friends can find and add it: its kind 0
+// profile and a NIP-66 discovery event (kind 30166) for its own URL, holding
+// the NIP-11 document, are published to a few well-read relays at startup and
+// once a day. Both are signed with the relay key. RELAY_ANNOUNCE=false opts
+// out; a relay without a public RELAY_URL is never announced.
+
+// defaultAnnounceRelays are used when RELAY_ANNOUNCE_RELAYS is unset
+var defaultAnnounceRelays = []string{
+	"wss://purplepag.es",
+	"wss://relay.damus.io",
+	"wss://nos.lol",
+}
+
+// announceRelays returns the relays the announcements are sent to
+func (r *Relay) announceRelays() []string {
+	if len(r.cfg.AnnounceRelays) > 0 {
+		return r.cfg.AnnounceRelays
+	}
+	return defaultAnnounceRelays
+}
+
+// runAnnouncements publishes the relay profile, then announces the relay
+// every RELAY_ANNOUNCE_INTERVAL (only once when it is 0)
+func (r *Relay) runAnnouncements() {
+	profile := r.publishRelayProfile()
+	if !r.cfg.Announce {
+		return
+	}
+	if r.cfg.RelayURL == "" {
+		log.Printf("⚠️  Not announcing the relay: RELAY_URL is not set")
+		return
+	}
+
+	for {
+		r.announce(profile)
+		if r.cfg.AnnounceInterval <= 0 {
+			return
+		}
+		time.Sleep(r.cfg.AnnounceInterval)
+		profile = r.publishRelayProfile()
+	}
+}
+
+// selfDiscovery is the NIP-66 discovery event for the relay's own URL, with
+// the NIP-11 document as its content
+func (r *Relay) selfDiscovery() *Event {
+	info := r.relayInfo()
+	content, _ := json.Marshal(info)
+
+	network := "clearnet"
+	if u, err := url.Parse(r.cfg.RelayURL); err == nil && strings.HasSuffix(u.Hostname(), ".onion") {
+		network = "tor"
+	}
+	tags := [][]string{
+		{"d", normalizeRelayURL(r.cfg.RelayURL)},
+		{"n", network},
+	}
+	for _, nip := range info.SupportedNIPs {
+		tags = append(tags, []string{"N", strconv.Itoa(nip)})
+	}
+	if r.auth.writes || r.auth.reads {
+		tags = append(tags, []string{"R", "auth"})
+	} else {
+		tags = append(tags, []string{"R", "!auth"})
+	}
+	if info.Limitation.MinPowDifficulty > 0 {
+		tags = append(tags, []string{"R", "pow"})
+	}
+	return nostr.NewEvent(30166, string(content), tags...)
+}
+
+// announce sends the relay profile and its discovery event to the announce
+// relays. The discovery event is only re-signed when the document changes.
+func (r *Relay) announce(profile *Event) {
+	discovery, err := r.publishIfChanged(r.selfDiscovery())
+	if err != nil {
+		log.Printf("❌ Failed to publish the relay's discovery event: %v", err)
+		return
+	}
+	events := []Event{*discovery}
+	if profile != nil {
+		events = append(events, *profile)
+	}
+
+	announced := 0
+	for _, target := range r.announceRelays() {
+		acks, err := publishToRelay(target, events)
+		if err != nil {
+			log.Printf("❌ Announcing the relay to %s failed: %v", target, err)
+			continue
+		}
+		for _, ack := range acks {
+			if !ack.Accepted {
+				log.Printf("⚠️  %s rejected announcement %s: %s", target, ack.EventID[:8], ack.Message)
+			}
+		}
+		announced++
+	}
+	log.Printf("📣 Announced the relay to %d of %d relays", announced, len(r.announceRelays()))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditSchema is an append-only log of admin actions; triggers refuse edits
+const auditSchema = `
+	CREATE TABLE IF NOT EXISTS admin_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at INTEGER NOT NULL,
+		admin TEXT NOT NULL,
+		admin_pubkey TEXT NOT NULL DEFAULT '',
+		role TEXT NOT NULL,
+		action TEXT NOT NULL,
+		event_ids TEXT NOT NULL DEFAULT '[]',
+		pubkeys TEXT NOT NULL DEFAULT '[]',
+		details TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_admin_audit_created ON admin_audit(created_at);
+	CREATE TRIGGER IF NOT EXISTS admin_audit_no_update BEFORE UPDATE ON admin_audit
+	BEGIN SELECT RAISE(ABORT, 'admin_audit is append-only'); END;
+	CREATE TRIGGER IF NOT EXISTS admin_audit_no_delete BEFORE DELETE ON admin_audit
+	BEGIN SELECT RAISE(ABORT, 'admin_audit is append-only'); END;
+`
+
+// auditEntry is one recorded admin action
+type auditEntry struct {
+	ID          int64    `json:"id"`
+	CreatedAt   int64    `json:"created_at"`
+	Admin       string   `json:"admin"`
+	AdminPubkey string   `json:"admin_pubkey,omitempty"`
+	Role        string   `json:"role"`
+	Action      string   `json:"action"`
+	EventIDs    []string `json:"event_ids"`
+	Pubkeys     []string `json:"pubkeys"`
+	Details     string   `json:"details,omitempty"`
+}
+
+// audit records an admin action; failures are logged but never block the action
+func (r *Relay) audit(admin *adminIdentity, action string, eventIDs, pubkeys []string, details string) {
+	if eventIDs == nil {
+		eventIDs = []string{}
+	}
+	if pubkeys == nil {
+		pubkeys = []string{}
+	}
+	ids, _ := json.Marshal(eventIDs)
+	keys, _ := json.Marshal(pubkeys)
+
+	_, err := r.db.Exec(
+		`INSERT INTO admin_audit (created_at, admin, admin_pubkey, role, action, event_ids, pubkeys, details)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().Unix(), admin.Name, admin.Pubkey, admin.role.String(), action, string(ids), string(keys), details,
+	)
+	if err != nil {
+		log.Printf("❌ Failed to record audit entry for %s by %s: %v", action, admin.Name, err)
+	}
+}
+
+// auditEntries returns entries in id order, filtered by time range and action
+func (r *Relay) auditEntries(since, until int64, action string) ([]auditEntry, error) {
+	query := "SELECT id, created_at, admin, admin_pubkey, role, action, event_ids, pubkeys, details FROM admin_audit WHERE created_at >= ?"
+	args := []interface{}{since}
+	if until > 0 {
+		query += " AND created_at <= ?"
+		args = append(args, until)
+	}
+	if action != "" {
+		query += " AND action = ?"
+		args = append(args, action)
+	}
+
+	rows, err := r.db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var ids, keys string
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Admin, &e.AdminPubkey, &e.Role, &e.Action, &ids, &keys, &e.Details); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(ids), &e.EventIDs)
+		json.Unmarshal([]byte(keys), &e.Pubkeys)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// handleAuditExport exports the audit log as JSON, JSON lines or CSV
+func handleAuditExport(c *gin.Context) {
+	since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+	until, _ := strconv.ParseInt(c.Query("until"), 10, 64)
+
+	entries, err := relay.auditEntries(since, until, c.Query("action"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(200, gin.H{"entries": entries})
+	case "jsonl":
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", `attachment; filename="admin-audit.jsonl"`)
+		enc := json.NewEncoder(c.Writer)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+	case "csv":
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", `attachment; filename="admin-audit.csv"`)
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"id", "created_at", "admin", "admin_pubkey", "role", "action", "event_ids", "pubkeys", "details"})
+		for _, e := range entries {
+			w.Write([]string{
+				strconv.FormatInt(e.ID, 10),
+				time.Unix(e.CreatedAt, 0).UTC().Format(time.RFC3339),
+				e.Admin, e.AdminPubkey, e.Role, e.Action,
+				strings.Join(e.EventIDs, " "), strings.Join(e.Pubkeys, " "), e.Details,
+			})
+		}
+		w.Flush()
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("unknown format %q (json, jsonl or csv)", c.Query("format"))})
+	}
+}
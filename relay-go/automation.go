@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// automationSchema records every action taken by an automation rule; it
+// prevents acting twice on one event and enforces the hourly caps
+const automationSchema = `
+	CREATE TABLE IF NOT EXISTS automation_actions (
+		rule TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		action_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (rule, target_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_automation_rule_time ON automation_actions(rule, created_at);
+`
+
+// automationMaxAge skips events that were created long before they arrived,
+// such as imports and backfills, so old posts are not suddenly liked
+const automationMaxAge = 10 * time.Minute
+
+// automationRule reacts to or reposts events matching all of its conditions
+type automationRule struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"`  // "react" or "repost"
+	Content string `json:"content"` // reaction content, "+" by default
+	Kinds   []int  `json:"kinds"`   // kind 1 by default
+
+	Hashtags       []string `json:"hashtags"`         // any of these t tags
+	RepliesToOwner bool     `json:"replies_to_owner"` // replies tagging the owner
+	FromFollows    bool     `json:"from_follows"`     // authors in the owner's kind 3 list
+
+	MaxPerHour int `json:"max_per_hour"` // 10 by default
+}
+
+// automation runs the AUTOMATION_CONFIG rules with the owner's key
+type automation struct {
+	owner *ownerSigner
+	rules []automationRule
+	mu    sync.Mutex // serializes cap checks and actions
+}
+
+// loadAutomation reads the automation rules; they sign as the owner, so
+// OWNER_SIGNING_KEY is required
+func loadAutomation(cfg *Config) (*automation, error) {
+	data, err := os.ReadFile(cfg.AutomationConfig)
+	if err != nil {
+		return nil, err
+	}
+	var rules []automationRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid automation config: %v", err)
+	}
+
+	names := map[string]bool{}
+	for i := range rules {
+		rule := &rules[i]
+		switch {
+		case rule.Name == "" || names[rule.Name]:
+			return nil, fmt.Errorf("automation rules need unique names")
+		case rule.Action != "react" && rule.Action != "repost":
+			return nil, fmt.Errorf("rule %s: action must be react or repost", rule.Name)
+		case len(rule.Hashtags) == 0 && !rule.RepliesToOwner && !rule.FromFollows:
+			return nil, fmt.Errorf("rule %s needs hashtags, replies_to_owner or from_follows", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Content == "" {
+			rule.Content = "+"
+		}
+		if len(rule.Kinds) == 0 {
+			rule.Kinds = []int{1}
+		}
+		if rule.MaxPerHour <= 0 {
+			rule.MaxPerHour = 10
+		}
+		for j, tag := range rule.Hashtags {
+			rule.Hashtags[j] = strings.ToLower(strings.TrimPrefix(tag, "#"))
+		}
+	}
+
+	owner, err := loadOwnerSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("AUTOMATION_CONFIG needs the owner's key: %v", err)
+	}
+	return &automation{owner: owner, rules: rules}, nil
+}
+
+// ownerFollows returns the pubkeys in the owner's latest kind 3 contact list
+func (r *Relay) ownerFollows() map[string]bool {
+	follows := map[string]bool{}
+	for _, db := range r.eventDBs(nil, nil) {
+		var tagsJSON string
+		err := db.QueryRow(
+			"SELECT tags FROM relay_events WHERE pubkey = ? AND kind = 3 ORDER BY created_at DESC LIMIT 1",
+			r.cfg.OwnerPubkey,
+		).Scan(&tagsJSON)
+		if err != nil {
+			continue
+		}
+
+		var tags [][]string
+		json.Unmarshal([]byte(tagsJSON), &tags)
+		for _, tag := range tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				follows[strings.ToLower(tag[1])] = true
+			}
+		}
+		break
+	}
+	return follows
+}
+
+// matches reports whether an event meets every condition of a rule
+func (rule *automationRule) matches(event *Event, owner string, follows func() map[string]bool) bool {
+	kindMatch := false
+	for _, kind := range rule.Kinds {
+		kindMatch = kindMatch || kind == event.Kind
+	}
+	if !kindMatch {
+		return false
+	}
+
+	if len(rule.Hashtags) > 0 {
+		tagged := false
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != "t" {
+				continue
+			}
+			for _, want := range rule.Hashtags {
+				tagged = tagged || strings.ToLower(tag[1]) == want
+			}
+		}
+		if !tagged {
+			return false
+		}
+	}
+
+	if rule.RepliesToOwner {
+		var reply, mentionsOwner bool
+		for _, tag := range event.Tags {
+			reply = reply || (len(tag) >= 2 && tag[0] == "e")
+			mentionsOwner = mentionsOwner || (len(tag) >= 2 && tag[0] == "p" && tag[1] == owner)
+		}
+		if !reply || !mentionsOwner {
+			return false
+		}
+	}
+
+	return !rule.FromFollows || follows()[event.PubKey]
+}
+
+// buildAction creates the reaction or repost for an event
+func (rule *automationRule) buildAction(event *Event) *Event {
+	tags := [][]string{{"e", event.ID}, {"p", event.PubKey}}
+	if rule.Action == "react" {
+		return &Event{CreatedAt: time.Now().Unix(), Kind: 7, Content: rule.Content,
+			Tags: append(tags, []string{"k", strconv.Itoa(event.Kind)})}
+	}
+
+	// NIP-18: kind 6 reposts notes, kind 16 anything else
+	embedded, _ := json.Marshal(event)
+	repost := &Event{CreatedAt: time.Now().Unix(), Kind: 6, Content: string(embedded), Tags: tags}
+	if event.Kind != 1 {
+		repost.Kind = 16
+		repost.Tags = append(repost.Tags, []string{"k", strconv.Itoa(event.Kind)})
+	}
+	return repost
+}
+
+// runAutomation applies the automation rules to a newly stored event
+func (r *Relay) runAutomation(event *Event) {
+	a := r.automation
+	if event.PubKey == r.cfg.OwnerPubkey || time.Since(time.Unix(event.CreatedAt, 0)) > automationMaxAge {
+		return
+	}
+
+	var follows map[string]bool
+	loadFollows := func() map[string]bool {
+		if follows == nil {
+			follows = r.ownerFollows()
+		}
+		return follows
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.matches(event, r.cfg.OwnerPubkey, loadFollows) {
+			continue
+		}
+
+		var done, lastHour int
+		r.db.QueryRow("SELECT COUNT(*) FROM automation_actions WHERE rule = ? AND target_id = ?", rule.Name, event.ID).Scan(&done)
+		if done > 0 {
+			continue
+		}
+		r.db.QueryRow("SELECT COUNT(*) FROM automation_actions WHERE rule = ? AND created_at > ?",
+			rule.Name, time.Now().Add(-time.Hour).Unix()).Scan(&lastHour)
+		if lastHour >= rule.MaxPerHour {
+			log.Printf("⏸️  Automation rule %s reached %d actions this hour; skipping %s", rule.Name, rule.MaxPerHour, event.ID[:8])
+			continue
+		}
+
+		action := rule.buildAction(event)
+		if err := a.owner.sign(action); err != nil {
+			log.Printf("❌ Automation rule %s failed to sign: %v", rule.Name, err)
+			continue
+		}
+		if err := r.publishLocal(action); err != nil {
+			log.Printf("❌ Automation rule %s failed to publish: %v", rule.Name, err)
+			continue
+		}
+
+		r.db.Exec(`INSERT INTO automation_actions (rule, target_id, action, action_id, created_at) VALUES (?, ?, ?, ?, ?)`,
+			rule.Name, event.ID, rule.Action, action.ID, time.Now().Unix())
+		r.audit(&adminIdentity{Name: "automation", role: roleOwner}, "automation_"+rule.Action,
+			[]string{event.ID, action.ID}, []string{event.PubKey}, rule.Name)
+		log.Printf("🤖 Automation rule %s: %s %s as %s", rule.Name, rule.Action, event.ID[:8], action.ID[:8])
+	}
+}
+
+// handleAutomationLog lists the rules with their actions in the last hour,
+// and the most recent actions
+func handleAutomationLog(c *gin.Context) {
+	if relay.automation == nil {
+		c.JSON(404, gin.H{"error": "automation is not configured"})
+		return
+	}
+
+	hourAgo := time.Now().Add(-time.Hour).Unix()
+	rules := []gin.H{}
+	for _, rule := range relay.automation.rules {
+		var lastHour int
+		relay.db.QueryRow("SELECT COUNT(*) FROM automation_actions WHERE rule = ? AND created_at > ?", rule.Name, hourAgo).Scan(&lastHour)
+		rules = append(rules, gin.H{"rule": rule, "last_hour": lastHour})
+	}
+
+	rows, err := relay.db.Query("SELECT rule, target_id, action, action_id, created_at FROM automation_actions ORDER BY created_at DESC LIMIT 100")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	actions := []gin.H{}
+	for rows.Next() {
+		var rule, target, action, actionID string
+		var createdAt int64
+		if rows.Scan(&rule, &target, &action, &actionID, &createdAt) == nil {
+			actions = append(actions, gin.H{"rule": rule, "target_id": target, "action": action, "action_id": actionID, "created_at": createdAt})
+		}
+	}
+	c.JSON(200, gin.H{"rules": rules, "actions": actions})
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"text/template"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+)
+
+// The owner can have DMs answered while they are away. When someone sends the
+// owner a DM and the owner has not answered within AUTOREPLY_DELAY, the relay
+// sends AUTOREPLY_MESSAGE back, signed with the owner's key and encrypted the
+// way the DM arrived: NIP-04 for kind 4, a NIP-17 gift wrap for kind 1059.
+// A NIP-17 reply is also wrapped for the owner, so their client shows it in
+// the conversation. Each sender gets at most one auto-reply per
+// AUTOREPLY_COOLDOWN, and at most AUTOREPLY_MAX_PER_HOUR senders are answered
+// an hour, however many fresh keys write in.
+
+// autoReplySchema tracks each conversation the auto-responder watches
+const autoReplySchema = `
+	CREATE TABLE IF NOT EXISTS autoreply_conversations (
+		pubkey TEXT PRIMARY KEY,
+		protocol TEXT NOT NULL,
+		received_at INTEGER NOT NULL,
+		replied_at INTEGER NOT NULL,
+		autoreplied_at INTEGER NOT NULL
+	);
+`
+
+// autoReplyCheckInterval is how often conversations are checked for replies due
+const autoReplyCheckInterval = time.Minute
+
+// autoReply answers the owner's DMs with a template, as the owner
+type autoReply struct {
+	owner      *ownerSigner
+	message    *template.Template
+	delay      time.Duration
+	cooldown   time.Duration
+	maxPerHour int
+}
+
+// autoReplyData is what AUTOREPLY_MESSAGE is rendered with
+type autoReplyData struct {
+	Sender   string // the sender's npub
+	Received time.Time
+}
+
+// loadAutoReply compiles AUTOREPLY_MESSAGE; replies sign as the owner, so
+// OWNER_SIGNING_KEY is required
+func loadAutoReply(cfg *Config) (*autoReply, error) {
+	message, err := template.New("autoreply").Option("missingkey=zero").Parse(cfg.AutoReplyMessage)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUTOREPLY_MESSAGE: %v", err)
+	}
+	if cfg.AutoReplyMaxPerHour <= 0 {
+		return nil, fmt.Errorf("AUTOREPLY_MAX_PER_HOUR must be positive")
+	}
+	owner, err := loadOwnerSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("AUTOREPLY_MESSAGE needs the owner's key: %v", err)
+	}
+	return &autoReply{owner: owner, message: message, delay: cfg.AutoReplyDelay, cooldown: cfg.AutoReplyCooldown,
+		maxPerHour: cfg.AutoReplyMaxPerHour}, nil
+}
+
+// unwrapGiftWrap opens a NIP-17 gift wrap addressed to the owner and returns
+// the rumor inside, whose pubkey is checked against the seal's signer
+func unwrapGiftWrap(owner *ownerSigner, wrap *Event) (*Event, error) {
+	conversation, err := owner.conversationKey(wrap.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	sealJSON, err := nostr.DecryptNIP44(conversation, wrap.Content)
+	if err != nil {
+		return nil, err
+	}
+	var seal Event
+	if err := json.Unmarshal([]byte(sealJSON), &seal); err != nil {
+		return nil, err
+	}
+	if seal.Kind != 13 {
+		return nil, fmt.Errorf("gift wrap holds kind %d, not a seal", seal.Kind)
+	}
+	if err := seal.Verify(); err != nil {
+		return nil, err
+	}
+
+	conversation, err = owner.conversationKey(seal.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	rumorJSON, err := nostr.DecryptNIP44(conversation, seal.Content)
+	if err != nil {
+		return nil, err
+	}
+	var rumor Event
+	if err := json.Unmarshal([]byte(rumorJSON), &rumor); err != nil {
+		return nil, err
+	}
+	if rumor.PubKey != seal.PubKey {
+		return nil, fmt.Errorf("rumor author does not match the seal")
+	}
+	return &rumor, nil
+}
+
+// randomPast returns a time up to two days ago, as NIP-59 asks of seals and
+// wraps so their timestamps do not reveal when a message was sent
+func randomPast() int64 {
+	return time.Now().Unix() - rand.Int63n(2*24*60*60)
+}
+
+// giftWrap seals an unsigned rumor from the owner for receiver and wraps it
+// with a one-time key (NIP-17, NIP-59). NIP-17 wraps the same rumor once for
+// each recipient and once for the sender.
+func giftWrap(owner *ownerSigner, rumor *Event, receiver string) (*Event, error) {
+	rumorJSON, _ := json.Marshal(rumor)
+
+	conversation, err := owner.conversationKey(receiver)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := nostr.EncryptNIP44(conversation, string(rumorJSON))
+	if err != nil {
+		return nil, err
+	}
+	seal := nostr.NewEvent(13, sealed)
+	seal.CreatedAt = randomPast()
+	if err := owner.sign(seal); err != nil {
+		return nil, err
+	}
+	sealJSON, _ := json.Marshal(seal)
+
+	oneTime, err := nostr.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	conversation, err = nostr.ConversationKey(oneTime, receiver)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := nostr.EncryptNIP44(conversation, string(sealJSON))
+	if err != nil {
+		return nil, err
+	}
+	wrap := nostr.NewEvent(1059, wrapped, []string{"p", receiver})
+	wrap.CreatedAt = randomPast()
+	return wrap, wrap.Sign(oneTime)
+}
+
+// observeDM records a DM to or from the owner. DMs from others start the
+// auto-reply clock; the owner's DMs, including the copies of NIP-17 messages
+// their client wraps for them, count as replies.
+func (r *Relay) observeDM(event *Event) {
+	owner := r.cfg.OwnerPubkey
+	if owner == "" || (event.Kind != 4 && event.Kind != 1059) {
+		return
+	}
+
+	from, protocol, createdAt, to := event.PubKey, "nip04", event.CreatedAt, []string{event.TagValue("p")}
+	if event.Kind == 1059 {
+		if event.TagValue("p") != owner {
+			return
+		}
+		rumor, err := unwrapGiftWrap(r.autoReply.owner, event)
+		if err != nil || (rumor.Kind != 14 && rumor.Kind != 15) {
+			return
+		}
+		from, protocol, createdAt = rumor.PubKey, "nip17", rumor.CreatedAt
+		to = nil
+		for _, tag := range rumor.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				to = append(to, tag[1])
+			}
+		}
+	}
+	if time.Since(time.Unix(createdAt, 0)) > automationMaxAge {
+		return // imports and backfills are not conversations
+	}
+
+	now := time.Now().Unix()
+	if from == owner {
+		for _, pubkey := range to {
+			if pubkey == owner {
+				continue
+			}
+			r.db.Exec(`INSERT INTO autoreply_conversations (pubkey, protocol, received_at, replied_at, autoreplied_at)
+				VALUES (?, ?, 0, ?, 0) ON CONFLICT(pubkey) DO UPDATE SET replied_at = excluded.replied_at`,
+				strings.ToLower(pubkey), protocol, now)
+		}
+		return
+	}
+	if len(to) == 0 || to[0] != owner || r.isBanned(from) {
+		return
+	}
+	r.db.Exec(`INSERT INTO autoreply_conversations (pubkey, protocol, received_at, replied_at, autoreplied_at)
+		VALUES (?, ?, ?, 0, 0) ON CONFLICT(pubkey) DO UPDATE SET protocol = excluded.protocol, received_at = excluded.received_at`,
+		from, protocol, now)
+}
+
+// runAutoReplies answers the DMs the owner has left unanswered for
+// AUTOREPLY_DELAY, once per sender per AUTOREPLY_COOLDOWN. Replies beyond the
+// hourly cap wait for a later pass.
+func (r *Relay) runAutoReplies() {
+	a := r.autoReply
+	for {
+		now := time.Now()
+		rows, err := r.db.Query(`SELECT pubkey, protocol, received_at FROM autoreply_conversations
+			WHERE received_at > 0 AND received_at <= ? AND replied_at < received_at
+			AND autoreplied_at < received_at AND autoreplied_at <= ?`,
+			now.Add(-a.delay).Unix(), now.Add(-a.cooldown).Unix())
+		if err == nil {
+			type due struct {
+				pubkey, protocol string
+				received         int64
+			}
+			var pending []due
+			for rows.Next() {
+				var d due
+				if rows.Scan(&d.pubkey, &d.protocol, &d.received) == nil {
+					pending = append(pending, d)
+				}
+			}
+			rows.Close()
+
+			var lastHour int
+			r.db.QueryRow("SELECT COUNT(*) FROM autoreply_conversations WHERE autoreplied_at > ?",
+				now.Add(-time.Hour).Unix()).Scan(&lastHour)
+			if room := max(a.maxPerHour-lastHour, 0); len(pending) > room {
+				log.Printf("⏸️  Auto-replies reached %d this hour; %d senders wait", a.maxPerHour, len(pending)-room)
+				pending = pending[:room]
+			}
+
+			for _, d := range pending {
+				if err := r.sendAutoReply(d.pubkey, d.protocol, time.Unix(d.received, 0)); err != nil {
+					log.Printf("❌ Auto-reply to %s failed: %v", d.pubkey[:8], err)
+					continue
+				}
+				r.db.Exec("UPDATE autoreply_conversations SET autoreplied_at = ? WHERE pubkey = ?", time.Now().Unix(), d.pubkey)
+				log.Printf("💬 Auto-replied to %s (%s)", d.pubkey[:8], d.protocol)
+			}
+		}
+		time.Sleep(autoReplyCheckInterval)
+	}
+}
+
+// sendAutoReply renders the message for a sender and publishes it encrypted
+// with the protocol their DM used
+func (r *Relay) sendAutoReply(pubkey, protocol string, received time.Time) error {
+	a := r.autoReply
+	npub, _ := nostr.EncodePublicKey(pubkey)
+	var message strings.Builder
+	if err := a.message.Execute(&message, autoReplyData{Sender: npub, Received: received}); err != nil {
+		return err
+	}
+	if message.Len() == 0 {
+		return fmt.Errorf("AUTOREPLY_MESSAGE rendered empty")
+	}
+
+	if protocol == "nip17" {
+		rumor := nostr.NewEvent(14, message.String(), []string{"p", pubkey})
+		rumor.PubKey = a.owner.pubkey
+		rumor.ID = rumor.ComputeID()
+		// the sender's copy goes first; the owner's copy keeps the reply in
+		// their client's thread
+		for _, receiver := range []string{pubkey, a.owner.pubkey} {
+			wrap, err := giftWrap(a.owner, rumor, receiver)
+			if err != nil {
+				return err
+			}
+			if err := r.publishLocal(wrap); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	content, err := a.owner.encryptNIP04(pubkey, message.String())
+	if err != nil {
+		return err
+	}
+	event := nostr.NewEvent(4, content, []string{"p", pubkey})
+	if err := a.owner.sign(event); err != nil {
+		return err
+	}
+	return r.publishLocal(event)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/bootstrap hands the home page everything it renders at startup in
+// one response: the owner's profile, the relay's NIP-11 document, the latest
+// notes, the article index, the pinned items and a few counts. The ETag is a
+// digest of the body, so a front end polling with If-None-Match gets a 304
+// until something it shows changes, instead of waiting for NOTIFY_URL.
+
+// articleEntry is one long-form article in the index, without its body
+type articleEntry struct {
+	ID             string   `json:"id"`
+	D              string   `json:"d"`
+	Naddr          string   `json:"naddr,omitempty"`
+	Title          string   `json:"title"`
+	Summary        string   `json:"summary,omitempty"`
+	Image          string   `json:"image,omitempty"`
+	Topics         []string `json:"topics"`
+	PublishedAt    int64    `json:"published_at"`
+	UpdatedAt      int64    `json:"updated_at"`
+	ContentWarning *string  `json:"content_warning,omitempty"`
+}
+
+// ownerProfile returns the owner's latest kind 0 event and its parsed content
+func (r *Relay) ownerProfile() gin.H {
+	owner := r.cfg.OwnerPubkey
+	if owner == "" {
+		return nil
+	}
+	profile := gin.H{"pubkey": owner}
+	if npub, err := nostr.EncodePublicKey(owner); err == nil {
+		profile["npub"] = npub
+	}
+	limit := 1
+	if events := r.getMatchingEvents([]Filter{{Authors: []string{owner}, Kinds: []int{0}, Limit: &limit}}); len(events) > 0 {
+		var metadata map[string]interface{}
+		json.Unmarshal([]byte(events[0].Content), &metadata)
+		profile["metadata"] = metadata
+		profile["event"] = events[0]
+	}
+	return profile
+}
+
+// articleIndex lists the owner's articles, newest first by publication
+func (r *Relay) articleIndex() []articleEntry {
+	articles := []articleEntry{}
+	if r.cfg.OwnerPubkey == "" {
+		return articles
+	}
+	limit := r.cfg.MaxLimit
+	for _, event := range r.getMatchingEvents([]Filter{{Authors: []string{r.cfg.OwnerPubkey}, Kinds: []int{30023}, Limit: &limit}}) {
+		public, ok := r.publicEvent(event)
+		if !ok {
+			continue
+		}
+		d := event.TagValue("d")
+		entry := articleEntry{
+			ID:             event.ID,
+			D:              d,
+			Title:          event.TagValue("title"),
+			Summary:        event.TagValue("summary"),
+			Image:          event.TagValue("image"),
+			Topics:         []string{},
+			PublishedAt:    event.CreatedAt,
+			UpdatedAt:      event.CreatedAt,
+			ContentWarning: public.ContentWarning,
+		}
+		if naddr, err := nostr.EncodeAddress(nostr.AddressPointer{Kind: event.Kind, PubKey: event.PubKey, Identifier: d}); err == nil {
+			entry.Naddr = naddr
+		}
+		if published, err := strconv.ParseInt(event.TagValue("published_at"), 10, 64); err == nil && published > 0 {
+			entry.PublishedAt = published
+		}
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "t" {
+				entry.Topics = append(entry.Topics, strings.ToLower(tag[1]))
+			}
+		}
+		articles = append(articles, entry)
+	}
+	sort.SliceStable(articles, func(i, j int) bool { return articles[i].PublishedAt > articles[j].PublishedAt })
+	return articles
+}
+
+// ownerCounts counts the owner's notes and articles and every stored event
+func (r *Relay) ownerCounts() gin.H {
+	var events, notes, articles int64
+	for _, db := range r.eventDBs(nil, nil) {
+		var n, ownerNotes, ownerArticles int64
+		db.QueryRow(`SELECT COUNT(*),
+			COALESCE(SUM(CASE WHEN pubkey = ? AND kind = 1 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN pubkey = ? AND kind = 30023 THEN 1 ELSE 0 END), 0)
+			FROM relay_events`, r.cfg.OwnerPubkey, r.cfg.OwnerPubkey).Scan(&n, &ownerNotes, &ownerArticles)
+		events += n
+		notes += ownerNotes
+		articles += ownerArticles
+	}
+	return gin.H{"events": events, "notes": notes, "articles": articles}
+}
+
+// bootstrap builds the startup payload with the latest n notes
+func (r *Relay) bootstrap(n int) gin.H {
+	notes := []publicEvent{}
+	if r.cfg.OwnerPubkey != "" {
+		notes = r.publicEvents(r.getMatchingEvents([]Filter{{Authors: []string{r.cfg.OwnerPubkey}, Kinds: []int{1}, Limit: &n}}))
+	}
+
+	pinned := []gin.H{}
+	if pins, err := r.pins(); err == nil {
+		for _, entry := range r.resolvePins(pins) {
+			if event, ok := r.publicEvent(entry["event"].(Event)); ok {
+				entry["event"] = event
+				pinned = append(pinned, entry)
+			}
+		}
+	}
+
+	return gin.H{
+		"owner":    r.ownerProfile(),
+		"relay":    r.relayInfo(),
+		"notes":    notes,
+		"articles": r.articleIndex(),
+		"pinned":   pinned,
+		"stats":    r.ownerCounts(),
+	}
+}
+
+// handleBootstrap serves the startup payload (?notes=N overrides
+// RELAY_BOOTSTRAP_NOTES), or 304 when the client's ETag is current
+func handleBootstrap(c *gin.Context) {
+	n := relay.cfg.BootstrapNotes
+	if v, err := strconv.Atoi(c.Query("notes")); err == nil && v >= 0 && v <= relay.cfg.MaxLimit {
+		n = v
+	}
+
+	body, err := json.Marshal(relay.bootstrap(n))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	digest := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(digest[:16]) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	for _, candidate := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		if candidate = strings.TrimSpace(candidate); candidate == etag || candidate == "*" {
+			c.Status(304)
+			return
+		}
+	}
+	c.Data(200, "application/json; charset=utf-8", body)
+}
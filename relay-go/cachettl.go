@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Besides the owner's archive, the relay holds copies of other people's
+// events: profiles, relay lists and the like that clients publish or that
+// mirrors bring in. RELAY_CACHE_TTL treats them as a cache per kind, e.g.
+// "0:7d" keeps the kind 0 profiles of pubkeys the owner does not follow for a
+// week after they were received. The owner's events and those of the pubkeys
+// in the owner's contact list are never expired this way. Expired copies are
+// removed like deleted events but not tombstoned, so a fresh copy is accepted.
+
+// cachedKind is a kind whose copies expire
+type cachedKind struct {
+	Kind int
+	TTL  time.Duration
+}
+
+// parseCacheTTLs parses "kind:ttl" entries; the TTL is a Go duration or a
+// number of days such as "30d"
+func parseCacheTTLs(specs []string) ([]cachedKind, error) {
+	var kinds []cachedKind
+	seen := map[int]bool{}
+	for _, spec := range specs {
+		kindPart, ttlPart, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not kind:ttl", spec)
+		}
+		kind, err := strconv.Atoi(strings.TrimSpace(kindPart))
+		if err != nil || kind < 0 {
+			return nil, fmt.Errorf("%q has an invalid kind", spec)
+		}
+		ttl, err := parseTTL(strings.TrimSpace(ttlPart))
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("%q has an invalid ttl", spec)
+		}
+		if seen[kind] {
+			return nil, fmt.Errorf("kind %d is listed twice", kind)
+		}
+		seen[kind] = true
+		kinds = append(kinds, cachedKind{Kind: kind, TTL: ttl})
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Kind < kinds[j].Kind })
+	return kinds, nil
+}
+
+// parseTTL parses a duration, accepting whole days as "Nd"
+func parseTTL(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// cachedKindFor returns the TTL setting of a kind
+func (r *Relay) cachedKindFor(kind int) (cachedKind, bool) {
+	for _, k := range r.cacheTTLs {
+		if k.Kind == kind {
+			return k, true
+		}
+	}
+	return cachedKind{}, false
+}
+
+// cacheCondition selects the cached copies of a kind, or only the expired
+// ones. The owner's contact list is read once per call.
+func (r *Relay) cacheCondition(k cachedKind, expiredOnly bool) (string, []interface{}) {
+	condition := "kind = ?"
+	args := []interface{}{k.Kind}
+	if expiredOnly {
+		condition += " AND received_at <= ?"
+		args = append(args, time.Now().Add(-k.TTL).Unix())
+	}
+	if r.cfg.OwnerPubkey == "" {
+		return condition, args
+	}
+
+	kept := []interface{}{r.cfg.OwnerPubkey}
+	for pubkey := range r.ownerFollows() {
+		kept = append(kept, pubkey)
+	}
+	condition += " AND pubkey NOT IN (" + strings.TrimSuffix(strings.Repeat("?,", len(kept)), ",") + ")"
+	return condition, append(args, kept...)
+}
+
+// purgeCache removes the expired cached copies of the given kinds and returns
+// how many each kind lost
+func (r *Relay) purgeCache(kinds []cachedKind) (map[int]int64, error) {
+	removed := map[int]int64{}
+	for _, k := range kinds {
+		condition, args := r.cacheCondition(k, true)
+		n, err := r.deleteEvents(condition, args...)
+		removed[k.Kind] = n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// sweepCache removes expired cached copies; it runs with the expiration sweep
+func (r *Relay) sweepCache() {
+	if len(r.cacheTTLs) == 0 {
+		return
+	}
+	removed, err := r.purgeCache(r.cacheTTLs)
+	if err != nil {
+		log.Printf("❌ Cache sweep failed: %v", err)
+		return
+	}
+	var total int64
+	for _, n := range removed {
+		total += n
+	}
+	if total > 0 {
+		log.Printf("🗑️  Removed %d expired cached events: %v", total, removed)
+	}
+}
+
+// inspectCache reports what each cached kind holds
+func (r *Relay) inspectCache() []gin.H {
+	report := []gin.H{}
+	for _, k := range r.cacheTTLs {
+		var count, expired, bytes int64
+		var oldest *int64
+		for _, db := range r.eventDBs(nil, nil) {
+			condition, args := r.cacheCondition(k, false)
+			var n, size int64
+			var first *int64
+			if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(content) + LENGTH(tags)), 0), MIN(received_at) FROM relay_events WHERE "+condition,
+				args...).Scan(&n, &size, &first); err != nil {
+				continue
+			}
+			count += n
+			bytes += size
+			if first != nil && (oldest == nil || *first < *oldest) {
+				oldest = first
+			}
+			condition, args = r.cacheCondition(k, true)
+			if db.QueryRow("SELECT COUNT(*) FROM relay_events WHERE "+condition, args...).Scan(&n) == nil {
+				expired += n
+			}
+		}
+		report = append(report, gin.H{
+			"kind":               k.Kind,
+			"ttl":                k.TTL.String(),
+			"events":             count,
+			"expired":            expired,
+			"bytes":              bytes,
+			"oldest_received_at": oldest,
+		})
+	}
+	return report
+}
+
+// handleCacheStatus reports the cached kinds, their TTLs and what they hold
+func handleCacheStatus(c *gin.Context) {
+	c.JSON(200, gin.H{"kinds": relay.inspectCache(), "sweep_interval": relay.cfg.ExpirationSweep.String()})
+}
+
+// handlePurgeCache removes expired cached copies now, of one kind with
+// ?kind=N or of every cached kind
+func handlePurgeCache(c *gin.Context) {
+	kinds := relay.cacheTTLs
+	if value := c.Query("kind"); value != "" {
+		kind, err := strconv.Atoi(value)
+		k, ok := relay.cachedKindFor(kind)
+		if err != nil || !ok {
+			c.JSON(404, gin.H{"error": fmt.Sprintf("kind %s has no cache ttl", value)})
+			return
+		}
+		kinds = []cachedKind{k}
+	}
+	removed, err := relay.purgeCache(kinds)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error(), "removed": removed})
+		return
+	}
+	var details []string
+	for _, k := range kinds {
+		details = append(details, fmt.Sprintf("kind %d: %d", k.Kind, removed[k.Kind]))
+	}
+	relay.audit(currentAdmin(c), "cache_purge", nil, nil, strings.Join(details, ", "))
+	c.JSON(200, gin.H{"removed": removed})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// icsHistory is how far back /calendar.ics reaches, so calendar apps keep
+// showing recent past events
+const icsHistory = 90 * 24 * time.Hour
+
+// icsEscape escapes a TEXT value as RFC 5545 requires
+var icsEscape = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICSLine writes a content line, folded into lines of at most 75 octets
+// (counting the leading space of continuations) without splitting UTF-8
+// sequences
+func writeICSLine(b *strings.Builder, line string) {
+	width := 75
+	for len(line) > width {
+		cut := width
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		width = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// calendarICS renders calendar events as an iCalendar feed. All-day events
+// use DATE values; timed events are given in UTC, which needs no VTIMEZONE.
+func calendarICS(events []calendarInfo, name string) string {
+	const utc = "20060102T150405Z"
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//nostr-home//relay//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "X-WR-CALNAME:"+icsEscape.Replace(name))
+
+	for _, e := range events {
+		kind := 31923
+		if e.AllDay {
+			kind = 31922
+		}
+		addr := address{Kind: kind, Pubkey: e.PubKey, D: e.D}
+
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, "UID:"+icsEscape.Replace(addr.String()))
+		writeICSLine(&b, "DTSTAMP:"+time.Unix(e.CreatedAt, 0).UTC().Format(utc))
+		if e.AllDay {
+			writeICSLine(&b, "DTSTART;VALUE=DATE:"+time.Unix(e.Start, 0).UTC().Format("20060102"))
+			writeICSLine(&b, "DTEND;VALUE=DATE:"+time.Unix(e.End, 0).UTC().Format("20060102"))
+		} else {
+			writeICSLine(&b, "DTSTART:"+time.Unix(e.Start, 0).UTC().Format(utc))
+			if e.End > e.Start {
+				writeICSLine(&b, "DTEND:"+time.Unix(e.End, 0).UTC().Format(utc))
+			}
+		}
+		writeICSLine(&b, "SUMMARY:"+icsEscape.Replace(e.Title))
+		if e.Summary != "" {
+			writeICSLine(&b, "DESCRIPTION:"+icsEscape.Replace(e.Summary))
+		}
+		if e.Location != "" {
+			writeICSLine(&b, "LOCATION:"+icsEscape.Replace(e.Location))
+		}
+		if naddr, err := nostr.EncodeAddress(nostr.AddressPointer{Kind: kind, PubKey: e.PubKey, Identifier: e.D}); err == nil {
+			writeICSLine(&b, "URL:nostr:"+naddr)
+		}
+		writeICSLine(&b, "END:VEVENT")
+	}
+
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// handleCalendarICS serves the owner's NIP-52 calendar events as an iCalendar
+// feed that calendar apps can subscribe to; without an owner it has every
+// stored calendar event
+func handleCalendarICS(c *gin.Context) {
+	from := time.Now().Add(-icsHistory).Unix()
+	events, err := calendarRange(from, 0, relay.cfg.OwnerPubkey)
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	if len(events) > relay.cfg.MaxLimit {
+		events = events[:relay.cfg.MaxLimit]
+	}
+
+	name := "Nostr calendar"
+	if relay.cfg.OwnerPubkey != "" {
+		if npub, err := nostr.EncodePublicKey(relay.cfg.OwnerPubkey); err == nil {
+			name = "Nostr calendar of " + npub[:16] + "…"
+		}
+	}
+	c.Header("Content-Disposition", `inline; filename="calendar.ics"`)
+	c.Data(200, "text/calendar; charset=utf-8", []byte(calendarICS(events, name)))
+}
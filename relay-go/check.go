@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+)
+
+// checkReport collects the results of `relay-go check`
+type checkReport struct {
+	failures int
+	warnings int
+}
+
+func (cr *checkReport) ok(format string, args ...interface{}) {
+	fmt.Printf("  ✅ %s\n", fmt.Sprintf(format, args...))
+}
+
+func (cr *checkReport) warn(format string, args ...interface{}) {
+	cr.warnings++
+	fmt.Printf("  ⚠️  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (cr *checkReport) fail(format string, args ...interface{}) {
+	cr.failures++
+	fmt.Printf("  ❌ %s\n", fmt.Sprintf(format, args...))
+}
+
+// secretSetting reports whether a setting's value must not be printed
+func secretSetting(key string) bool {
+	return strings.Contains(key, "TOKEN") || strings.Contains(key, "PASSWORD") ||
+		strings.Contains(key, "SECRET") || strings.HasSuffix(key, "_KEY")
+}
+
+// runCheck validates the configuration without starting the relay and prints
+// the effective settings; it returns the process exit code
+func runCheck(cfg *Config) int {
+	cr := &checkReport{}
+
+	fmt.Println("Effective configuration:")
+	for _, s := range effectiveSettings {
+		value := s.Value
+		if secretSetting(s.Key) && value != "" {
+			value = "<redacted>"
+		}
+		value = redactDSN(value)
+		fmt.Printf("  %-28s %-40s (%s)\n", s.Key, value, s.Source)
+		if s.Source == "invalid" {
+			cr.failures++
+		}
+	}
+
+	fmt.Println("\nChecks:")
+	checkListen(cr, cfg.ListenAddr)
+	checkWritableDir(cr, "data dir", cfg.DataDir)
+	if cfg.LitestreamReplica != "" {
+		if err := validateReplicaURL(cfg.LitestreamReplica); err != nil {
+			cr.fail("RELAY_LITESTREAM_REPLICA: %v", err)
+		} else if path, err := exec.LookPath(cfg.LitestreamBin); err != nil {
+			cr.fail("litestream binary %q not found", cfg.LitestreamBin)
+		} else {
+			cr.ok("litestream %s replicates to %s", path, cfg.LitestreamReplica)
+		}
+	}
+
+	if pow, err := newPowPolicy(cfg); err != nil {
+		cr.fail("%v", err)
+	} else if pow != nil {
+		cr.ok("events need a proof of work of %d bits; %d pubkeys are exempt", pow.min, len(pow.exempt))
+	}
+
+	if _, err := newConnectionGate(cfg); err != nil {
+		cr.fail("%v", err)
+	} else if cfg.MaxConnections > 0 {
+		cr.ok("at most %d connections; overflow is %s", cfg.MaxConnections, cfg.ConnectionOverflow)
+	}
+
+	if kinds, err := parseCacheTTLs(cfg.CacheTTL); err != nil {
+		cr.fail("RELAY_CACHE_TTL: %v", err)
+	} else if len(kinds) > 0 && cfg.ExpirationSweep <= 0 {
+		cr.warn("RELAY_CACHE_TTL is set but RELAY_EXPIRATION_SWEEP is off, so cached events are only removed on demand")
+	} else if len(kinds) > 0 {
+		cr.ok("cached copies of %d kinds expire", len(kinds))
+	}
+
+	if cfg.Faults {
+		cr.warn("fault injection is on (RELAY_FAULTS); it is meant for integration tests only")
+	} else if cfg.FaultDBLatency > 0 || cfg.FaultDBJitter > 0 || cfg.FaultWebhookDrop > 0 || cfg.FaultDisconnect > 0 {
+		cr.warn("RELAY_FAULT_* settings are ignored without RELAY_FAULTS=true")
+	}
+	for name, pct := range map[string]int{"RELAY_FAULT_WEBHOOK_DROP": cfg.FaultWebhookDrop, "RELAY_FAULT_DISCONNECT": cfg.FaultDisconnect} {
+		if pct < 0 || pct > 100 {
+			cr.fail("%s must be a percentage from 0 to 100", name)
+		}
+	}
+
+	if cfg.VerifySecondary != "" {
+		if v, err := newReadVerifier(cfg); err != nil {
+			cr.fail("%v", err)
+		} else if _, err := v.store.query(&Relay{cfg: cfg}, []Filter{{Limit: new(int)}}); err != nil {
+			cr.fail("secondary %s is not readable: %v", v.target, err)
+		} else {
+			cr.ok("secondary %s is readable; %d%% of REQs are compared", v.target, cfg.VerifyPercent)
+		}
+	}
+
+	if cfg.BackupDir != "" {
+		if info, err := os.Stat(cfg.BackupDir); err != nil || !info.IsDir() {
+			cr.fail("backup dir %s is not a directory", cfg.BackupDir)
+		} else {
+			cr.ok("backup dir %s exists", cfg.BackupDir)
+		}
+	}
+	checkDatabases(cr, cfg)
+	checkKeys(cr, cfg)
+	checkUpstreams(cr, cfg)
+	checkClock(cr, cfg)
+
+	fmt.Printf("\n%d problems, %d warnings\n", cr.failures, cr.warnings)
+	if cr.failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkListen verifies the listen address is free
+func checkListen(cr *checkReport, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		cr.fail("cannot listen on %s: %v", addr, err)
+		return
+	}
+	listener.Close()
+	cr.ok("listen address %s is free", addr)
+}
+
+// checkWritableDir verifies a directory exists (or can be created) and is writable
+func checkWritableDir(cr *checkReport, name, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		cr.fail("%s %s cannot be created: %v", name, dir, err)
+		return
+	}
+	probe, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		cr.fail("%s %s is not writable: %v", name, dir, err)
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	cr.ok("%s %s is writable", name, dir)
+}
+
+// checkDatabases runs the startup integrity check against existing databases
+func checkDatabases(cr *checkReport, cfg *Config) {
+	switch cfg.Partitioning {
+	case "", "monthly":
+	default:
+		cr.fail("RELAY_PARTITIONING must be empty or \"monthly\", got %q", cfg.Partitioning)
+	}
+
+	paths := []string{filepath.Join(cfg.DataDir, "relay.db")}
+	partitions, _ := filepath.Glob(filepath.Join(cfg.DataDir, "partitions", "events-*.db"))
+	paths = append(paths, partitions...)
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := checkDatabaseFile(path); err != nil {
+			cr.fail("database %s failed its integrity check: %v", path, err)
+		} else {
+			cr.ok("database %s passes its integrity check", path)
+		}
+	}
+}
+
+// checkKeys parses every key, credential and config file the relay would load
+func checkKeys(cr *checkReport, cfg *Config) {
+	if npub, _ := lookupSetting("NOSTR_NPUB"); npub == "" {
+		cr.warn("NOSTR_NPUB is not set; owner features and the owner admin are disabled")
+	} else if _, err := nostr.DecodePublicKey(npub); err != nil {
+		cr.fail("NOSTR_NPUB: %v", err)
+	} else {
+		cr.ok("owner pubkey parses")
+	}
+
+	if _, err := loadAdmins(cfg.AdminConfig, cfg.OwnerPubkey); err != nil {
+		cr.fail("ADMIN_CONFIG: %v", err)
+	} else if cfg.AdminConfig != "" {
+		cr.ok("admin config %s parses", cfg.AdminConfig)
+	}
+	if cfg.PublicStats {
+		cr.warn("RELAY_PUBLIC_STATS serves /stats, with client and subscription details, to anyone")
+	}
+
+	identity, err := loadRelayIdentity(cfg, false)
+	switch {
+	case err != nil:
+		cr.fail("%v", err)
+	case identity.source == "generated":
+		cr.ok("a relay key will be generated in %s on first run", filepath.Join(cfg.DataDir, relayKeyFile))
+	default:
+		cr.ok("relay key %s is from %s", identity.pubkey[:8], identity.source)
+	}
+
+	switch {
+	case !cfg.Announce:
+	case cfg.RelayURL == "":
+		cr.warn("RELAY_ANNOUNCE is on but RELAY_URL is not set, so the relay will not be announced")
+	case len(cfg.AnnounceRelays) > 0:
+		cr.ok("the relay is announced to %d relays every %s", len(cfg.AnnounceRelays), cfg.AnnounceInterval)
+	default:
+		cr.ok("the relay is announced to %d default relays every %s", len(defaultAnnounceRelays), cfg.AnnounceInterval)
+	}
+
+	if cfg.IngestConfig != "" && identity != nil {
+		if _, err := loadWebhookIngest(cfg.IngestConfig, cfg.IngestBotKey, identity.key); err != nil {
+			cr.fail("INGEST_CONFIG: %v", err)
+		} else {
+			cr.ok("ingest config %s parses and its templates compile", cfg.IngestConfig)
+		}
+	}
+
+	if cfg.OwnerSigningKey != "" {
+		if _, err := loadOwnerSigner(cfg); err != nil {
+			cr.fail("%v", err)
+		} else {
+			cr.ok("owner signing key belongs to the owner")
+		}
+	} else if cfg.NIP65AutoPublish {
+		cr.fail("NIP65_AUTO_PUBLISH needs OWNER_SIGNING_KEY")
+	}
+
+	if cfg.CrossPostConfig != "" {
+		if _, err := loadCrossPostTargets(cfg.CrossPostConfig); err != nil {
+			cr.fail("CROSSPOST_CONFIG: %v", err)
+		} else {
+			cr.ok("cross-post config %s parses", cfg.CrossPostConfig)
+		}
+	}
+
+	switch cfg.SendOverflow {
+	case overflowDisconnect, overflowDropOldest:
+	default:
+		cr.fail("RELAY_SEND_OVERFLOW must be disconnect or drop_oldest, not %q", cfg.SendOverflow)
+	}
+	if cfg.ClientSendBuffer < cfg.MaxEventBytes+sendOverhead {
+		cr.fail("RELAY_CLIENT_SEND_BUFFER (%d) cannot hold an event of RELAY_MAX_EVENT_BYTES (%d)", cfg.ClientSendBuffer, cfg.MaxEventBytes)
+	}
+
+	if cfg.CreatedAtMaxFuture < 0 || cfg.CreatedAtMaxAge < 0 {
+		cr.fail("RELAY_CREATED_AT_MAX_FUTURE and RELAY_CREATED_AT_MAX_AGE cannot be negative")
+	} else if cfg.CreatedAtMaxFuture > 0 && cfg.CreatedAtMaxFuture < cfg.MaxClockSkew {
+		cr.warn("RELAY_CREATED_AT_MAX_FUTURE (%s) is below RELAY_MAX_CLOCK_SKEW (%s); clients with a drifting clock will be refused", cfg.CreatedAtMaxFuture, cfg.MaxClockSkew)
+	}
+	if cfg.CreatedAtMaxAge > 0 && cfg.CreatedAtMaxAge < 48*time.Hour {
+		cr.warn("RELAY_CREATED_AT_MAX_AGE (%s) refuses NIP-59 gift wraps, which are backdated by up to two days", cfg.CreatedAtMaxAge)
+	}
+
+	switch cfg.ContentWarnings {
+	case contentWarningsHide, contentWarningsFlag, contentWarningsShow:
+	default:
+		cr.fail("RELAY_CONTENT_WARNINGS must be hide, flag or show, not %q", cfg.ContentWarnings)
+	}
+
+	if _, err := parseFeatures(cfg); err != nil {
+		cr.fail("%v", err)
+	} else if len(cfg.Features) > 0 {
+		cr.ok("%d feature flags set", len(cfg.Features))
+	}
+
+	if cfg.AutomationConfig != "" {
+		if a, err := loadAutomation(cfg); err != nil {
+			cr.fail("AUTOMATION_CONFIG: %v", err)
+		} else {
+			cr.ok("automation config %s has %d rules", cfg.AutomationConfig, len(a.rules))
+		}
+	}
+
+	if cfg.AutoReplyMessage != "" {
+		if _, err := loadAutoReply(cfg); err != nil {
+			cr.fail("%v", err)
+		} else {
+			cr.ok("auto-replying to DMs after %s, once per sender per %s, to at most %d senders an hour",
+				cfg.AutoReplyDelay, cfg.AutoReplyCooldown, cfg.AutoReplyMaxPerHour)
+		}
+	}
+
+	if gw, err := newPushGateway(cfg); err != nil {
+		cr.fail("push: %v", err)
+	} else if gw != nil {
+		cr.ok("push credentials load")
+	}
+
+	if policy, err := newAuthPolicy(cfg); err != nil {
+		cr.fail("%v", err)
+	} else if policy.required() {
+		cr.ok("NIP-42 auth required for writes=%v reads=%v kinds=%d", policy.writes, policy.reads, len(policy.kinds))
+	}
+
+	if policy, err := newEndpointPolicy(cfg); err != nil {
+		cr.fail("%v", err)
+	} else if policy.restricted() {
+		cr.ok("public endpoints serve %d kinds (0 is all), read-only=%v; /ws-private has full access", len(policy.kinds), policy.readOnly)
+	}
+
+	if policy, err := newKindPolicy(cfg); err != nil {
+		cr.fail("%v", err)
+	} else if len(cfg.KindClasses) > 0 {
+		cr.ok("%d kind class overrides parse", len(policy.ranges)-len(nip01Kinds))
+	}
+}
+
+// checkClock compares the system clock with the NTP server
+func checkClock(cr *checkReport, cfg *Config) {
+	if cfg.NTPServer == "" {
+		return
+	}
+	skew, err := queryNTP(cfg.NTPServer)
+	switch {
+	case err != nil:
+		cr.warn("clock: cannot reach NTP server %s: %v", cfg.NTPServer, err)
+	case absDuration(skew) > cfg.MaxClockSkew:
+		cr.warn("clock is off by %v compared to %s (tolerance %v)", skew.Round(time.Millisecond), cfg.NTPServer, cfg.MaxClockSkew)
+	default:
+		cr.ok("clock is within %v of %s", skew.Round(time.Millisecond), cfg.NTPServer)
+	}
+}
+
+// checkUpstreams dials every remote service the relay talks to; unreachable
+// services are warnings since they may only resolve inside the deployment
+func checkUpstreams(cr *checkReport, cfg *Config) {
+	upstreams := map[string]string{}
+	if cfg.NotifyURL != "" {
+		upstreams["notify"] = cfg.NotifyURL
+	}
+	if cfg.NtfyURL != "" {
+		upstreams["ntfy"] = cfg.NtfyURL
+	}
+	if cfg.UnifiedPushEndpoint != "" {
+		upstreams["unifiedpush"] = cfg.UnifiedPushEndpoint
+	}
+	if cfg.CrossPostConfig != "" {
+		targets, _ := loadCrossPostTargets(cfg.CrossPostConfig)
+		for _, t := range targets {
+			if t.Type == "bluesky" {
+				upstreams["crosspost "+t.Name] = t.PDS
+			} else {
+				upstreams["crosspost "+t.Name] = t.URL
+			}
+		}
+	}
+
+	for _, mirror := range cfg.MirrorRelays {
+		upstreams["mirror "+mirror] = mirror
+	}
+
+	for name, rawURL := range upstreams {
+		if err := dialURL(rawURL); err != nil {
+			cr.warn("%s (%s) is unreachable: %v", name, rawURL, err)
+		} else {
+			cr.ok("%s (%s) is reachable", name, rawURL)
+		}
+	}
+}
+
+// dialURL opens and closes a TCP connection to a URL's host
+func dialURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid URL")
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" || u.Scheme == "wss" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
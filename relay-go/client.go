@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientPage is the embedded protocol test client served at /client
+//
+//go:embed web/client.html
+var clientPage []byte
+
+// handleClientPage serves the test client; it talks to the relay from the
+// browser and signs with the visitor's NIP-07 extension, so it needs no auth
+func handleClientPage(c *gin.Context) {
+	c.Data(200, "text/html; charset=utf-8", clientPage)
+}
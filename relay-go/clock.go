@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between 1900 and 1970
+const ntpEpochOffset = 2208988800
+
+// clockMonitor holds the latest comparison of the system clock with NTP
+type clockMonitor struct {
+	mu        sync.RWMutex
+	skew      time.Duration // NTP time minus system time
+	checkedAt time.Time
+	err       string
+}
+
+// queryNTP asks an NTP server for the offset of the system clock, using a
+// single SNTP exchange
+func queryNTP(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // version 4, client mode
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	if n < 48 || resp[0]&0x07 != 4 {
+		return 0, fmt.Errorf("invalid NTP response")
+	}
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("NTP server is not synchronized")
+	}
+
+	serverReceive := ntpTime(resp[32:40])
+	serverTransmit := ntpTime(resp[40:48])
+	return (serverReceive.Sub(sent) + serverTransmit.Sub(received)) / 2, nil
+}
+
+// ntpTime decodes a 64-bit NTP timestamp
+func ntpTime(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(b[4:])) * int64(time.Second) >> 32
+	return time.Unix(seconds, fraction)
+}
+
+// checkClock compares the system clock with RELAY_NTP_SERVER and logs when
+// the skew crosses RELAY_MAX_CLOCK_SKEW in either direction
+func (r *Relay) checkClock() {
+	skew, err := queryNTP(r.cfg.NTPServer)
+
+	r.clock.mu.Lock()
+	wasSkewed := absDuration(r.clock.skew) > r.cfg.MaxClockSkew
+	r.clock.checkedAt = time.Now()
+	if err != nil {
+		r.clock.err = err.Error()
+		r.clock.mu.Unlock()
+		log.Printf("⚠️  Clock check against %s failed: %v", r.cfg.NTPServer, err)
+		return
+	}
+	r.clock.skew, r.clock.err = skew, ""
+	r.clock.mu.Unlock()
+
+	skewed := absDuration(skew) > r.cfg.MaxClockSkew
+	switch {
+	case skewed:
+		log.Printf("⏰ SYSTEM CLOCK IS OFF BY %v (compared to %s). Timestamp checks are widened by this much; fix NTP on the host.",
+			skew.Round(time.Millisecond), r.cfg.NTPServer)
+	case wasSkewed:
+		log.Printf("✅ System clock is back within %v of %s", r.cfg.MaxClockSkew, r.cfg.NTPServer)
+	}
+}
+
+// runClockChecks checks the clock at startup and every RELAY_CLOCK_CHECK_INTERVAL
+func (r *Relay) runClockChecks() {
+	if r.cfg.NTPServer == "" {
+		return
+	}
+	for {
+		r.checkClock()
+		if r.cfg.ClockCheckInterval <= 0 {
+			return
+		}
+		time.Sleep(r.cfg.ClockCheckInterval)
+	}
+}
+
+// clockSlack is how much timestamp checks are widened: the measured skew
+// when it exceeds RELAY_MAX_CLOCK_SKEW, otherwise nothing
+func (r *Relay) clockSlack() time.Duration {
+	if r == nil || r.clock == nil {
+		return 0
+	}
+	r.clock.mu.RLock()
+	defer r.clock.mu.RUnlock()
+	if skew := absDuration(r.clock.skew); skew > r.cfg.MaxClockSkew {
+		return skew
+	}
+	return 0
+}
+
+// clockStatus reports the last clock check for /health, and whether the
+// clock is within tolerance
+func (r *Relay) clockStatus() (map[string]interface{}, bool) {
+	r.clock.mu.RLock()
+	defer r.clock.mu.RUnlock()
+	if r.clock.checkedAt.IsZero() {
+		return nil, true
+	}
+
+	ok := absDuration(r.clock.skew) <= r.cfg.MaxClockSkew
+	status := map[string]interface{}{
+		"server":     r.cfg.NTPServer,
+		"skew_ms":    r.clock.skew.Milliseconds(),
+		"checked_at": r.clock.checkedAt.Unix(),
+		"ok":         ok,
+	}
+	if r.clock.err != "" {
+		status["error"] = r.clock.err
+	}
+	return status, ok
+}
+
+// absDuration returns the magnitude of a duration
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
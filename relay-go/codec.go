@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// cborSubprotocol is the WebSocket subprotocol clients request to exchange
+// CBOR-encoded message arrays in binary frames instead of JSON text frames
+const cborSubprotocol = "nostr.cbor"
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// cborToJSON transcodes a binary CBOR message into the JSON form the message
+// handlers expect
+func cborToJSON(data []byte) ([]byte, error) {
+	var message interface{}
+	if err := cborDecMode.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	return json.Marshal(message)
+}
+
+// jsonToCBOR transcodes an outgoing JSON message for binary clients
+func jsonToCBOR(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var message interface{}
+	if err := decoder.Decode(&message); err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(normalizeNumbers(message))
+}
+
+// normalizeNumbers replaces json.Number values with integers where possible so
+// they are encoded as CBOR numbers rather than strings
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = normalizeNumbers(v[k])
+		}
+	}
+	return value
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+)
+
+// eventTemplate is the operator-facing description of how to build an event
+// from a JSON payload. Every string is a Go text/template evaluated with the
+// payload as dot, e.g. "{{.release.tag_name}}".
+type eventTemplate struct {
+	// Kind is a fixed kind; KindTemplate, when set, renders the kind instead
+	Kind         int    `json:"kind"`
+	KindTemplate string `json:"kind_template"`
+
+	Content string `json:"content"`
+
+	// Tags are rendered element by element; tags whose name renders empty are dropped
+	Tags [][]string `json:"tags"`
+	// TagsJSON renders a JSON array of extra tags, for tags generated with range
+	TagsJSON string `json:"tags_json"`
+}
+
+// templateFuncs are the helpers available to event templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	},
+	"join": func(sep string, items []interface{}) string {
+		parts := make([]string, 0, len(items))
+		for _, item := range items {
+			parts = append(parts, fmt.Sprint(item))
+		}
+		return strings.Join(parts, sep)
+	},
+	"lower": func(v interface{}) string { return strings.ToLower(templateString(v)) },
+	"upper": func(v interface{}) string { return strings.ToUpper(templateString(v)) },
+	"trim":  func(v interface{}) string { return strings.TrimSpace(templateString(v)) },
+	"truncate": func(max int, v interface{}) string {
+		s := templateString(v)
+		if max < 1 || utf8.RuneCountInString(s) <= max {
+			return s
+		}
+		return string([]rune(s)[:max-1]) + "…"
+	},
+	"default": func(fallback, value interface{}) interface{} {
+		if value == nil || value == "" {
+			return fallback
+		}
+		return value
+	},
+	"now": func() int64 { return time.Now().Unix() },
+	// orEmpty is appended to every action by emptyMissing
+	"orEmpty": func(v interface{}) interface{} {
+		if v == nil {
+			return ""
+		}
+		return v
+	},
+}
+
+// emptyMissing makes every action in a template print missing payload keys
+// as nothing. missingkey=zero alone is not enough: JSON payloads are
+// map[string]interface{}, whose zero value still prints as "<no value>".
+func emptyMissing(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			emptyMissing(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Args:     []parse.Node{parse.NewIdentifier("orEmpty")},
+			})
+		}
+	case *parse.IfNode:
+		emptyMissing(n.List)
+		emptyMissing(n.ElseList)
+	case *parse.RangeNode:
+		emptyMissing(n.List)
+		emptyMissing(n.ElseList)
+	case *parse.WithNode:
+		emptyMissing(n.List)
+		emptyMissing(n.ElseList)
+	}
+}
+
+// templateString renders a payload value as text, with missing values empty
+func templateString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// eventComposer is a compiled eventTemplate
+type eventComposer struct {
+	kind         int
+	kindTemplate *template.Template
+	content      *template.Template
+	tags         [][]*template.Template
+	tagsJSON     *template.Template
+}
+
+// compileEventTemplate parses every template up front so config errors surface at startup
+func compileEventTemplate(name string, t eventTemplate) (*eventComposer, error) {
+	parse := func(field, text string) (*template.Template, error) {
+		tmpl, err := template.New(name + "." + field).Option("missingkey=zero").Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+		for _, t := range tmpl.Templates() {
+			emptyMissing(t.Tree.Root)
+		}
+		return tmpl, nil
+	}
+
+	ec := &eventComposer{kind: t.Kind}
+	if ec.kind == 0 {
+		ec.kind = 1
+	}
+
+	var err error
+	if t.KindTemplate != "" {
+		if ec.kindTemplate, err = parse("kind", t.KindTemplate); err != nil {
+			return nil, err
+		}
+	}
+	if ec.content, err = parse("content", t.Content); err != nil {
+		return nil, err
+	}
+	for i, tag := range t.Tags {
+		compiled := make([]*template.Template, len(tag))
+		for j, value := range tag {
+			if compiled[j], err = parse(fmt.Sprintf("tags.%d.%d", i, j), value); err != nil {
+				return nil, err
+			}
+		}
+		ec.tags = append(ec.tags, compiled)
+	}
+	if t.TagsJSON != "" {
+		if ec.tagsJSON, err = parse("tags_json", t.TagsJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	return ec, nil
+}
+
+// render executes a template against the payload
+func render(tmpl *template.Template, payload interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, payload); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// compose builds an unsigned event from a payload
+func (ec *eventComposer) compose(payload interface{}) (*Event, error) {
+	event := &Event{
+		CreatedAt: time.Now().Unix(),
+		Kind:      ec.kind,
+		Tags:      [][]string{},
+	}
+
+	if ec.kindTemplate != nil {
+		rendered, err := render(ec.kindTemplate, payload)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := strconv.Atoi(strings.TrimSpace(rendered))
+		if err != nil || kind < 0 || kind > 65535 {
+			return nil, fmt.Errorf("kind template produced %q", rendered)
+		}
+		event.Kind = kind
+	}
+
+	content, err := render(ec.content, payload)
+	if err != nil {
+		return nil, err
+	}
+	event.Content = content
+
+	for _, tag := range ec.tags {
+		values := make([]string, len(tag))
+		for i, tmpl := range tag {
+			if values[i], err = render(tmpl, payload); err != nil {
+				return nil, err
+			}
+		}
+		if len(values) > 0 && values[0] != "" {
+			event.Tags = append(event.Tags, values)
+		}
+	}
+
+	if ec.tagsJSON != nil {
+		rendered, err := render(ec.tagsJSON, payload)
+		if err != nil {
+			return nil, err
+		}
+		var extra [][]string
+		if err := json.Unmarshal([]byte(rendered), &extra); err != nil {
+			return nil, fmt.Errorf("tags_json did not produce a tag array: %v", err)
+		}
+		event.Tags = append(event.Tags, extra...)
+	}
+
+	return event, nil
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the relay settings read from the environment
+type Config struct {
+	DataDir   string
+	NotifyURL string
+
+	// ListenAddr is the HTTP/WebSocket listen address
+	ListenAddr string
+
+	// OwnerPubkey is the hex pubkey of the relay owner (from NOSTR_NPUB)
+	OwnerPubkey string
+
+	// RelayName, RelayDescription and RelayContact are advertised in the NIP-11 document
+	RelayName        string
+	RelayDescription string
+	RelayContact     string
+	// RelayPubkey is the NIP-11 admin pubkey (hex or npub); it defaults to the owner
+	RelayPubkey string
+
+	// RelayURL is the public ws:// or wss:// URL of the relay, which NIP-42
+	// AUTH events must name; by default the host clients connect to is used
+	RelayURL string
+
+	// AuthWrites and AuthReads require NIP-42 authentication before
+	// publishing events or running REQ and COUNT
+	AuthWrites bool
+	AuthReads  bool
+	// AuthKinds are kinds that need authentication to publish and are only
+	// served to authenticated connections, e.g. ["4", "1059"]
+	AuthKinds []string
+
+	// PublicKinds narrows the public WebSocket endpoints (/ and /ws) to these
+	// kinds, and PublicReadOnly refuses events there; /ws-private needs AUTH
+	// and has full access
+	PublicKinds    []string
+	PublicReadOnly bool
+
+	// MaxMessageBytes caps the size of a WebSocket message from a client
+	MaxMessageBytes int
+	// MaxSubscriptions caps the open subscriptions per connection (0 is unlimited)
+	MaxSubscriptions int
+	// MaxConnections caps concurrent WebSocket connections (0 is unlimited)
+	MaxConnections int
+	// ConnectionOverflow is what happens over the cap: "reject" answers 503
+	// with Retry-After, "queue" holds the upgrade until a slot frees up
+	ConnectionOverflow string
+	// ConnectionQueueSize and ConnectionQueueWait bound the queue: how many
+	// upgrades may wait, and for how long before they get the 503
+	ConnectionQueueSize int
+	ConnectionQueueWait time.Duration
+	// ConnectionRetryAfter is the Retry-After sent with a 503
+	ConnectionRetryAfter time.Duration
+	// ConnectionExempt lists IPs and CIDRs that bypass the cap
+	ConnectionExempt []string
+
+	// DefaultLimit is applied to filters that omit "limit"
+	DefaultLimit int
+	// MaxLimit caps any client-provided limit
+	MaxLimit int
+
+	// BinaryProtocol offers the CBOR WebSocket subprotocol to clients that request it
+	BinaryProtocol bool
+	// Features turns feature flags on or off, e.g. ["binary_protocol=off"]
+	Features []string
+
+	// ProtocolErrorBudget is how many malformed messages a connection may send
+	// before it is disconnected (0 disables)
+	ProtocolErrorBudget int
+	// ProtocolBlock is how long the IP of a disconnected client is turned away
+	ProtocolBlock time.Duration
+	// Tarpit delays the 429 sent to blocked IPs (0 rejects immediately)
+	Tarpit time.Duration
+	// TarpitMax caps how many blocked requests are held at once
+	TarpitMax int
+
+	// ClientSendBuffer caps the bytes queued for one client
+	ClientSendBuffer int
+	// SendMemory caps the bytes queued for all clients together (0 is unlimited)
+	SendMemory int64
+	// SendOverflow is what happens when a client's queue is full: disconnect or drop_oldest
+	SendOverflow string
+	// OwnerSendBuffer caps the bytes queued for a connection the owner
+	// authenticated on, which is never shed (see sendQueue.prioritize)
+	OwnerSendBuffer int
+
+	// SessionWindow is how long a dropped session can be resumed
+	SessionWindow time.Duration
+	// SessionReplayLimit bounds the events replayed per resumed subscription
+	SessionReplayLimit int
+
+	// PersistSessions keeps resumable sessions across relay restarts
+	PersistSessions bool
+	// RestartGrace is how long sessions live after a restart or shutdown
+	RestartGrace time.Duration
+
+	// DuplicateThreshold is the simhash Hamming distance at which notes count as near-duplicates
+	DuplicateThreshold int
+
+	// CrossPostConfig is a JSON file listing Mastodon/Bluesky/webhook cross-posting targets
+	CrossPostConfig string
+
+	// ContentWarnings is how public endpoints treat events with a content
+	// warning: hide, flag or show
+	ContentWarnings string
+
+	// ServiceKey is the relay's own key (nsec or hex); empty uses DATA_DIR/relay.key,
+	// generated on first run
+	ServiceKey string
+	// ReportsPerHour caps the reports one IP may submit per hour; the default
+	// 0 disables visitor reports
+	ReportsPerHour int
+
+	// AutoReplyMessage is a text/template answering DMs the owner left
+	// unanswered for AutoReplyDelay, at most once per sender per
+	// AutoReplyCooldown and to at most AutoReplyMaxPerHour senders an hour
+	// (empty disables it)
+	AutoReplyMessage    string
+	AutoReplyDelay      time.Duration
+	AutoReplyCooldown   time.Duration
+	AutoReplyMaxPerHour int
+
+	// AutomationConfig is a JSON file of rules that react to or repost events as the owner
+	AutomationConfig string
+
+	// IngestConfig is a JSON file describing webhook ingest sources and templates
+	IngestConfig string
+	// IngestBotKey overrides the bot signing key from the ingest config (nsec or hex)
+	IngestBotKey string
+
+	// AdminConfig is a JSON file listing extra admin identities and their roles
+	AdminConfig string
+	// PublicStats serves /stats without authentication, as before it required
+	// the auditor role
+	PublicStats bool
+	// NIP98RequirePayload makes NIP-98 requests with a body carry a payload
+	// tag hashing it
+	NIP98RequirePayload bool
+
+	// Latency SLOs per stage; a p95 above the threshold logs a warning (0 disables)
+	SLOEvent     time.Duration
+	SLOReq       time.Duration
+	SLOBroadcast time.Duration
+
+	// CountApproxDays is the COUNT window (in days) from which sketches give an
+	// approximate answer instead of scanning events (0 always counts exactly)
+	CountApproxDays int
+
+	// Nightly reconciliation of the daily aggregates: the UTC hour it runs at
+	// and how many recent days it recomputes from stored events
+	ReconcileHour int
+	ReconcileDays int
+
+	// MirrorRelays are upstream relays the owner's events are copied to
+	MirrorRelays []string
+
+	// ProbeInterval is how often mirrors and the owner's NIP-65 relays are probed (0 disables)
+	ProbeInterval time.Duration
+
+	// Announce publishes the relay's profile and NIP-11 document to
+	// AnnounceRelays (or the defaults) at startup and every AnnounceInterval
+	Announce         bool
+	AnnounceRelays   []string
+	AnnounceInterval time.Duration
+
+	// OwnerSigningKey is the owner's key (nsec or hex), for everything the
+	// relay publishes as the owner (see ownerSigner); NIP65AutoPublish
+	// consents to publishing suggested relay lists with it unattended
+	OwnerSigningKey  string
+	NIP65AutoPublish bool
+
+	// AdaptiveIndexes lets the index advisor create the indexes it recommends
+	// and drop its own once they go unused for AdaptiveIndexIdle
+	AdaptiveIndexes   bool
+	AdaptiveIndexIdle time.Duration
+	// IndexAdvisorMinQueries and IndexAdvisorSlow are how often and how slowly
+	// a filter shape must run before an index is recommended for it
+	IndexAdvisorMinQueries int
+	IndexAdvisorSlow       time.Duration
+
+	// GCInterval is how often derived rows of vanished events are removed (0 disables)
+	GCInterval time.Duration
+	// ExpirationSweep is how often NIP-40 expired events are deleted (0
+	// disables; they are still never served)
+	ExpirationSweep time.Duration
+	// BootstrapNotes is how many of the owner's notes GET /api/bootstrap returns
+	BootstrapNotes int
+	// CacheTTL lists "kind:ttl" entries for kinds whose copies from pubkeys
+	// outside the owner's follows expire (see cachettl.go)
+	CacheTTL []string
+
+	// NTPServer, when set, is compared with the system clock at startup and
+	// every ClockCheckInterval; a skew above MaxClockSkew is reported and widens
+	// timestamp checks. The check is opt-in so a home relay contacts no one.
+	NTPServer          string
+	ClockCheckInterval time.Duration
+	MaxClockSkew       time.Duration
+
+	// UpgradeDrain is how long the old process keeps its connections after a
+	// SIGHUP upgrade before handing their sessions to the new one
+	UpgradeDrain time.Duration
+
+	// DebugRequestIDs appends each message's request ID to OK replies
+	DebugRequestIDs bool
+
+	// KindClasses declare kinds NIP-01 does not cover, or override it, as
+	// "class:kind" or "class:from-to" entries, e.g. "replaceable:40000-40999"
+	KindClasses []string
+	// UnknownKinds is the policy for kinds no range covers: "regular" or "reject"
+	UnknownKinds string
+	// VersionHistory is how many superseded versions of each of the owner's
+	// replaceable and addressable events are kept (0 keeps none)
+	VersionHistory int
+
+	// Partitioning selects the event storage layout: "" (single database) or "monthly"
+	Partitioning string
+	// RetentionMonths drops monthly partitions older than this many months (0 keeps everything)
+	RetentionMonths int
+
+	// CreatedAtMaxFuture and CreatedAtMaxAge bound how far ahead of and behind
+	// the relay's clock an event's created_at may be (0 disables each bound)
+	CreatedAtMaxFuture time.Duration
+	CreatedAtMaxAge    time.Duration
+
+	// MaxEventBytes rejects events whose JSON exceeds this size (0 disables the check)
+	MaxEventBytes int
+	// PubkeyQuotaBytes caps the stored bytes per author (0 is unlimited)
+	PubkeyQuotaBytes int64
+	// MinPowDifficulty is the NIP-13 proof of work events need, in leading
+	// zero bits of the ID (0 disables the requirement)
+	MinPowDifficulty int
+	// PowExempt lists the pubkeys (hex or npub) that need no proof of work,
+	// besides the owner
+	PowExempt []string
+
+	// LitestreamReplica is the Litestream replica URL every database is
+	// continuously replicated to, e.g. s3://bucket/relay (empty disables)
+	LitestreamReplica string
+	// LitestreamBin is the litestream executable
+	LitestreamBin string
+	// LitestreamSync, LitestreamSnapshot and LitestreamRetention are the
+	// replica's sync interval, snapshot interval and retention
+	LitestreamSync      time.Duration
+	LitestreamSnapshot  time.Duration
+	LitestreamRetention time.Duration
+	// LitestreamRestore restores a fresh data directory from the replica
+	LitestreamRestore bool
+
+	// VerifySecondary is a store REQ results are compared against in the
+	// background: a SQLite file or data directory
+	VerifySecondary string
+	// VerifyPercent is the share of REQs compared, 0-100
+	VerifyPercent int
+	// VerifyRecheck is how long a divergence waits to be re-read before it is
+	// reported, giving a replicated secondary time to catch up
+	VerifyRecheck time.Duration
+
+	// Faults arms fault injection for integration tests; never set it in production
+	Faults bool
+	// FaultSeed seeds the fault generators, so the same traffic sees the same faults
+	FaultSeed int64
+	// FaultDBLatency and FaultDBJitter are added to every event query and
+	// write: the latency always, plus a random share of the jitter
+	FaultDBLatency time.Duration
+	FaultDBJitter  time.Duration
+	// FaultWebhookDrop is the percent of webhook deliveries that fail
+	FaultWebhookDrop int
+	// FaultDisconnect is the percent of client messages that drop the connection
+	FaultDisconnect int
+
+	// BackupDir holds database backups used for automatic recovery at startup
+	BackupDir string
+
+	// APNs token authentication for the owner's iOS client
+	APNsKeyFile string
+	APNsKeyID   string
+	APNsTeamID  string
+	APNsTopic   string
+	APNsSandbox bool
+	// FCMCredentialsFile is a Firebase service account JSON for Android pushes
+	FCMCredentialsFile string
+
+	// Self-hosted owner notifications
+	NtfyURL             string
+	NtfyToken           string
+	UnifiedPushEndpoint string
+	// NIP-96 uploads: the largest file accepted (0 disables uploads), the
+	// accepted MIME types and the public URL prefix files are served under
+	// (default: /media on the host the upload came to)
+	MediaMaxBytes int
+	MediaTypes    []string
+	MediaURL      string
+
+	// KeywordAlertsPerHour caps pushed keyword alerts; later matches are only
+	// recorded (0 is unlimited)
+	KeywordAlertsPerHour int
+}
+
+// LoadConfig reads the relay configuration from environment variables
+func LoadConfig() *Config {
+	cfg := &Config{
+		DataDir:          getEnv("DATA_DIR", "/app/data"),
+		ListenAddr:       getEnv("RELAY_LISTEN", ":7447"),
+		NotifyURL:        getEnv("NOTIFY_URL", "http://nostr-home:3000/api/update-cache"), // Default to docker service name
+		RelayName:        getEnv("RELAY_NAME", "nostr-home relay"),
+		RelayDescription: getEnv("RELAY_DESCRIPTION", ""),
+		RelayContact:     getEnv("RELAY_CONTACT", ""),
+		RelayURL:         getEnv("RELAY_URL", ""),
+
+		AuthWrites: getEnvBool("RELAY_AUTH_WRITES", false),
+		AuthReads:  getEnvBool("RELAY_AUTH_READS", false),
+		AuthKinds:  getEnvList("RELAY_AUTH_KINDS"),
+
+		PublicKinds:    getEnvList("RELAY_PUBLIC_KINDS"),
+		PublicReadOnly: getEnvBool("RELAY_PUBLIC_READ_ONLY", false),
+
+		MaxMessageBytes:  getEnvInt("RELAY_MAX_MESSAGE_BYTES", 1024*1024),
+		MaxSubscriptions: getEnvInt("RELAY_MAX_SUBSCRIPTIONS", 50),
+
+		MaxConnections:       getEnvInt("RELAY_MAX_CONNECTIONS", 0),
+		ConnectionOverflow:   getEnv("RELAY_CONNECTION_OVERFLOW", "reject"),
+		ConnectionQueueSize:  getEnvInt("RELAY_CONNECTION_QUEUE_SIZE", 100),
+		ConnectionQueueWait:  getEnvDuration("RELAY_CONNECTION_QUEUE_WAIT", 10*time.Second),
+		ConnectionRetryAfter: getEnvDuration("RELAY_CONNECTION_RETRY_AFTER", 30*time.Second),
+		ConnectionExempt:     getEnvList("RELAY_CONNECTION_EXEMPT"),
+
+		DefaultLimit: getEnvInt("RELAY_DEFAULT_LIMIT", 500),
+		MaxLimit:     getEnvInt("RELAY_MAX_LIMIT", 5000),
+
+		BinaryProtocol: getEnvBool("RELAY_BINARY_PROTOCOL", true),
+		Features:       getEnvList("RELAY_FEATURES"),
+
+		ProtocolErrorBudget: getEnvInt("RELAY_PROTOCOL_ERROR_BUDGET", 20),
+		ProtocolBlock:       getEnvDuration("RELAY_PROTOCOL_BLOCK", 10*time.Minute),
+		Tarpit:              getEnvDuration("RELAY_TARPIT", 0),
+		TarpitMax:           getEnvInt("RELAY_TARPIT_MAX", 64),
+
+		ClientSendBuffer: getEnvInt("RELAY_CLIENT_SEND_BUFFER", 4<<20),
+		SendMemory:       int64(getEnvInt("RELAY_SEND_MEMORY", 256<<20)),
+		SendOverflow:     getEnv("RELAY_SEND_OVERFLOW", overflowDisconnect),
+		OwnerSendBuffer:  getEnvInt("RELAY_OWNER_SEND_BUFFER", 32<<20),
+
+		SessionWindow:      getEnvDuration("RELAY_SESSION_WINDOW", 10*time.Minute),
+		SessionReplayLimit: getEnvInt("RELAY_SESSION_REPLAY_LIMIT", 1000),
+
+		PersistSessions: getEnvBool("RELAY_PERSIST_SESSIONS", false),
+		RestartGrace:    getEnvDuration("RELAY_RESTART_GRACE", 15*time.Minute),
+
+		DuplicateThreshold: getEnvInt("RELAY_DUPLICATE_THRESHOLD", 3),
+
+		CrossPostConfig: getEnv("CROSSPOST_CONFIG", ""),
+
+		ContentWarnings: getEnv("RELAY_CONTENT_WARNINGS", contentWarningsHide),
+
+		ServiceKey:     getEnv("RELAY_SERVICE_KEY", ""),
+		ReportsPerHour: getEnvInt("RELAY_REPORTS_PER_HOUR", 0),
+
+		AutoReplyMessage:    getEnv("AUTOREPLY_MESSAGE", ""),
+		AutoReplyDelay:      getEnvDuration("AUTOREPLY_DELAY", 30*time.Minute),
+		AutoReplyCooldown:   getEnvDuration("AUTOREPLY_COOLDOWN", 24*time.Hour),
+		AutoReplyMaxPerHour: getEnvInt("AUTOREPLY_MAX_PER_HOUR", 20),
+
+		AutomationConfig: getEnv("AUTOMATION_CONFIG", ""),
+
+		IngestConfig: getEnv("INGEST_CONFIG", ""),
+		IngestBotKey: getEnv("INGEST_BOT_KEY", ""),
+
+		AdminConfig:         getEnv("ADMIN_CONFIG", ""),
+		PublicStats:         getEnvBool("RELAY_PUBLIC_STATS", false),
+		NIP98RequirePayload: getEnvBool("RELAY_NIP98_REQUIRE_PAYLOAD", false),
+
+		SLOEvent:     getEnvDuration("RELAY_SLO_EVENT", 50*time.Millisecond),
+		SLOReq:       getEnvDuration("RELAY_SLO_REQ", 500*time.Millisecond),
+		SLOBroadcast: getEnvDuration("RELAY_SLO_BROADCAST", 25*time.Millisecond),
+
+		CountApproxDays: getEnvInt("RELAY_COUNT_APPROX_DAYS", 90),
+
+		ReconcileHour: getEnvInt("RELAY_RECONCILE_HOUR", 3),
+		ReconcileDays: getEnvInt("RELAY_RECONCILE_DAYS", 7),
+
+		MirrorRelays:  getEnvList("RELAY_MIRRORS"),
+		ProbeInterval: getEnvDuration("RELAY_PROBE_INTERVAL", 15*time.Minute),
+
+		Announce:         getEnvBool("RELAY_ANNOUNCE", true),
+		AnnounceRelays:   getEnvList("RELAY_ANNOUNCE_RELAYS"),
+		AnnounceInterval: getEnvDuration("RELAY_ANNOUNCE_INTERVAL", 24*time.Hour),
+
+		OwnerSigningKey:  getEnv("OWNER_SIGNING_KEY", getEnv("NIP65_SIGNING_KEY", "")),
+		NIP65AutoPublish: getEnvBool("NIP65_AUTO_PUBLISH", false),
+
+		GCInterval: getEnvDuration("RELAY_GC_INTERVAL", 24*time.Hour),
+
+		ExpirationSweep: getEnvDuration("RELAY_EXPIRATION_SWEEP", 10*time.Minute),
+		CacheTTL:        getEnvList("RELAY_CACHE_TTL"),
+		BootstrapNotes:  getEnvInt("RELAY_BOOTSTRAP_NOTES", 20),
+
+		AdaptiveIndexes:        getEnvBool("RELAY_ADAPTIVE_INDEXES", false),
+		AdaptiveIndexIdle:      getEnvDuration("RELAY_ADAPTIVE_INDEX_IDLE", 7*24*time.Hour),
+		IndexAdvisorMinQueries: getEnvInt("RELAY_INDEX_ADVISOR_MIN_QUERIES", 100),
+		IndexAdvisorSlow:       getEnvDuration("RELAY_INDEX_ADVISOR_SLOW", 5*time.Millisecond),
+
+		NTPServer:          getEnv("RELAY_NTP_SERVER", ""),
+		ClockCheckInterval: getEnvDuration("RELAY_CLOCK_CHECK_INTERVAL", time.Hour),
+		MaxClockSkew:       getEnvDuration("RELAY_MAX_CLOCK_SKEW", 5*time.Second),
+
+		UpgradeDrain: getEnvDuration("RELAY_UPGRADE_DRAIN", 5*time.Minute),
+
+		DebugRequestIDs: getEnvBool("RELAY_DEBUG_REQUEST_IDS", false),
+
+		KindClasses:  getEnvList("RELAY_KIND_CLASSES"),
+		UnknownKinds: getEnv("RELAY_UNKNOWN_KINDS", "regular"),
+
+		VersionHistory: getEnvInt("RELAY_VERSION_HISTORY", 20),
+
+		Partitioning:    getEnv("RELAY_PARTITIONING", ""),
+		RetentionMonths: getEnvInt("RELAY_RETENTION_MONTHS", 0),
+
+		CreatedAtMaxFuture: getEnvDuration("RELAY_CREATED_AT_MAX_FUTURE", 15*time.Minute),
+		CreatedAtMaxAge:    getEnvDuration("RELAY_CREATED_AT_MAX_AGE", 0),
+
+		MaxEventBytes:    getEnvInt("RELAY_MAX_EVENT_BYTES", 256*1024),
+		PubkeyQuotaBytes: int64(getEnvInt("RELAY_PUBKEY_QUOTA_BYTES", 0)),
+		MinPowDifficulty: getEnvInt("RELAY_MIN_POW_DIFFICULTY", 0),
+		PowExempt:        getEnvList("RELAY_POW_EXEMPT"),
+
+		BackupDir: getEnv("RELAY_BACKUP_DIR", ""),
+
+		LitestreamReplica:   getEnv("RELAY_LITESTREAM_REPLICA", ""),
+		LitestreamBin:       getEnv("RELAY_LITESTREAM_BIN", "litestream"),
+		LitestreamSync:      getEnvDuration("RELAY_LITESTREAM_SYNC", time.Second),
+		LitestreamSnapshot:  getEnvDuration("RELAY_LITESTREAM_SNAPSHOT", 24*time.Hour),
+		LitestreamRetention: getEnvDuration("RELAY_LITESTREAM_RETENTION", 7*24*time.Hour),
+		LitestreamRestore:   getEnvBool("RELAY_LITESTREAM_RESTORE", true),
+
+		VerifySecondary: getEnv("RELAY_VERIFY_SECONDARY", ""),
+		VerifyPercent:   getEnvInt("RELAY_VERIFY_PERCENT", 100),
+		VerifyRecheck:   getEnvDuration("RELAY_VERIFY_RECHECK", 30*time.Second),
+
+		Faults:           getEnvBool("RELAY_FAULTS", false),
+		FaultSeed:        int64(getEnvInt("RELAY_FAULT_SEED", 1)),
+		FaultDBLatency:   getEnvDuration("RELAY_FAULT_DB_LATENCY", 0),
+		FaultDBJitter:    getEnvDuration("RELAY_FAULT_DB_JITTER", 0),
+		FaultWebhookDrop: getEnvInt("RELAY_FAULT_WEBHOOK_DROP", 0),
+		FaultDisconnect:  getEnvInt("RELAY_FAULT_DISCONNECT", 0),
+
+		APNsKeyFile:        getEnv("PUSH_APNS_KEY_FILE", ""),
+		APNsKeyID:          getEnv("PUSH_APNS_KEY_ID", ""),
+		APNsTeamID:         getEnv("PUSH_APNS_TEAM_ID", ""),
+		APNsTopic:          getEnv("PUSH_APNS_TOPIC", ""),
+		APNsSandbox:        getEnvBool("PUSH_APNS_SANDBOX", false),
+		FCMCredentialsFile: getEnv("PUSH_FCM_CREDENTIALS", ""),
+
+		NtfyURL:             getEnv("NTFY_URL", ""),
+		NtfyToken:           getEnv("NTFY_TOKEN", ""),
+		UnifiedPushEndpoint: getEnv("UNIFIEDPUSH_ENDPOINT", ""),
+
+		KeywordAlertsPerHour: getEnvInt("RELAY_KEYWORD_ALERTS_PER_HOUR", 20),
+
+		MediaMaxBytes: getEnvInt("RELAY_MEDIA_MAX_BYTES", 20<<20),
+		MediaTypes:    getEnvList("RELAY_MEDIA_TYPES"),
+		MediaURL:      getEnv("RELAY_MEDIA_URL", ""),
+	}
+
+	if npub := getEnv("NOSTR_NPUB", ""); npub != "" {
+		owner, err := nostr.DecodePublicKey(npub)
+		if err != nil {
+			log.Printf("⚠️  Invalid NOSTR_NPUB: %v", err)
+		} else {
+			cfg.OwnerPubkey = owner
+		}
+	}
+
+	if pubkey := getEnv("RELAY_PUBKEY", ""); pubkey != "" {
+		decoded, err := nostr.DecodePublicKey(pubkey)
+		if err != nil {
+			log.Printf("⚠️  Invalid RELAY_PUBKEY: %v", err)
+		} else {
+			cfg.RelayPubkey = decoded
+		}
+	}
+
+	// "off" was how the check used to be disabled
+	if cfg.NTPServer == "off" {
+		cfg.NTPServer = ""
+	}
+
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 5000
+	}
+	if cfg.DefaultLimit <= 0 || cfg.DefaultLimit > cfg.MaxLimit {
+		cfg.DefaultLimit = cfg.MaxLimit
+	}
+
+	return cfg
+}
+
+// fileSettings holds values from the --config YAML file, keyed by environment
+// variable name; the environment takes precedence over the file
+var fileSettings = map[string]string{}
+
+// setting is one configuration value as LoadConfig resolved it
+type setting struct {
+	Key    string
+	Value  string
+	Source string // env, file, default or invalid
+}
+
+// effectiveSettings records every setting LoadConfig read, in order
+var effectiveSettings []setting
+
+// loadConfigFile reads a flat YAML file whose keys are environment variable names
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	for key, value := range values {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return fmt.Errorf("config key %s must be a scalar", key)
+		case nil:
+			continue
+		}
+		fileSettings[strings.ToUpper(key)] = fmt.Sprint(value)
+	}
+	return nil
+}
+
+// lookupSetting returns a setting from the environment or the config file
+func lookupSetting(key string) (string, string) {
+	if value := os.Getenv(key); value != "" {
+		return value, "env"
+	}
+	if value := fileSettings[key]; value != "" {
+		return value, "file"
+	}
+	return "", "default"
+}
+
+// recordSetting remembers the value a setting resolved to
+func recordSetting(key, value, source string) {
+	for i := range effectiveSettings {
+		if effectiveSettings[i].Key == key {
+			effectiveSettings[i] = setting{key, value, source}
+			return
+		}
+	}
+	effectiveSettings = append(effectiveSettings, setting{key, value, source})
+}
+
+// getEnv returns the value of a setting or a fallback
+func getEnv(key, fallback string) string {
+	value, source := lookupSetting(key)
+	if value == "" {
+		value = fallback
+	}
+	recordSetting(key, value, source)
+	return value
+}
+
+// getEnvBool returns a boolean setting or a fallback
+func getEnvBool(key string, fallback bool) bool {
+	value, source := lookupSetting(key)
+	if value == "" {
+		recordSetting(key, strconv.FormatBool(fallback), source)
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("⚠️  Invalid value for %s (%q), using %t", key, value, fallback)
+		recordSetting(key, value, "invalid")
+		return fallback
+	}
+	recordSetting(key, value, source)
+	return b
+}
+
+// getEnvDuration returns a duration setting (e.g. "90s", "10m") or a fallback
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, source := lookupSetting(key)
+	if value == "" {
+		recordSetting(key, fallback.String(), source)
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("⚠️  Invalid value for %s (%q), using %s", key, value, fallback)
+		recordSetting(key, value, "invalid")
+		return fallback
+	}
+	recordSetting(key, value, source)
+	return d
+}
+
+// getEnvList returns a comma-separated setting as a list, skipping blanks
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvInt returns an integer setting or a fallback
+func getEnvInt(key string, fallback int) int {
+	value, source := lookupSetting(key)
+	if value == "" {
+		recordSetting(key, strconv.Itoa(fallback), source)
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("⚠️  Invalid value for %s (%q), using %d", key, value, fallback)
+		recordSetting(key, value, "invalid")
+		return fallback
+	}
+	recordSetting(key, value, source)
+	return n
+}
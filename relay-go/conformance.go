@@ -0,0 +1,740 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+	"nostr-relay/pkg/nostrclient"
+
+	"github.com/gorilla/websocket"
+)
+
+// `relay-server conformance` runs protocol checks against a relay and reports
+// pass/fail per NIP, so a regression in protocol behavior shows up before a
+// release. Without --url it starts this binary on a scratch data directory.
+// NIPs the relay does not advertise in its NIP-11 document are skipped.
+// External suites, such as nostr-relay-tester or nak, run after the built-in
+// checks when asked for.
+
+// conformanceTimeout bounds each check
+const conformanceTimeout = 10 * time.Second
+
+// conformanceOptions are the `conformance` flags
+type conformanceOptions struct {
+	url    string
+	nips   string
+	tester string
+	nak    bool
+	json   bool
+}
+
+// conformanceFlags registers the `conformance` flags on a command's flag set
+func conformanceFlags(flags *flag.FlagSet) *conformanceOptions {
+	opts := &conformanceOptions{}
+	flags.StringVar(&opts.url, "url", "", "relay to test, e.g. ws://localhost:7447 (default: start a scratch relay)")
+	flags.StringVar(&opts.nips, "nips", "", "only run checks for these NIPs, e.g. 1,9,45")
+	flags.StringVar(&opts.tester, "tester", "", `external test suite command; {url} and {nsec} are substituted, e.g. "relay-tester {url} {nsec}"`)
+	flags.BoolVar(&opts.nak, "nak", false, "also publish and query with the nak CLI to check interoperability")
+	flags.BoolVar(&opts.json, "json", false, "print the results as JSON")
+	return opts
+}
+
+// conformanceResult is the outcome of one check
+type conformanceResult struct {
+	NIP    int    `json:"nip"`
+	Check  string `json:"check"`
+	Status string `json:"status"` // pass, fail or skip
+	Detail string `json:"detail,omitempty"`
+}
+
+// conformanceCheck is one protocol check
+type conformanceCheck struct {
+	nip  int
+	name string
+	run  func(t *conformanceRun) error
+}
+
+// conformanceRun is the state shared by the checks of one run. Each check
+// signs with a fresh key, so checks do not see each other's events.
+type conformanceRun struct {
+	url     string
+	httpURL string
+	info    map[string]interface{}
+	// pow is the relay's min_pow_difficulty, which every event is mined to
+	pow    int
+	ctx    context.Context
+	sk     string
+	pk     string
+	client *nostrclient.Relay
+}
+
+// newKey gives the run a fresh signing key
+func (t *conformanceRun) newKey() error {
+	sk, err := nostr.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	pk, err := nostr.PublicKey(sk)
+	if err != nil {
+		return err
+	}
+	t.sk, t.pk = sk, pk
+	return nil
+}
+
+// event builds and signs an event with the run's key
+func (t *conformanceRun) event(kind int, content string, createdAt int64, tags ...[]string) nostr.Event {
+	event := nostr.NewEvent(kind, content, tags...)
+	if createdAt != 0 {
+		event.CreatedAt = createdAt
+	}
+	if t.pow > 0 {
+		event.PubKey = t.pk
+		event.Mine(t.pow)
+	}
+	event.Sign(t.sk)
+	return *event
+}
+
+// publish sends an event and fails unless the relay accepts it
+func (t *conformanceRun) publish(event nostr.Event) error {
+	ok, err := t.client.Publish(t.ctx, event)
+	if err != nil {
+		return err
+	}
+	if !ok.Accepted {
+		return fmt.Errorf("event rejected: %s", ok.Message)
+	}
+	return nil
+}
+
+// query returns the IDs of the stored events matching a filter, in order
+func (t *conformanceRun) query(filter nostrclient.Filter) ([]string, error) {
+	events, err := t.client.Query(t.ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids, nil
+}
+
+// expectIDs compares query results with the expected IDs, in order
+func expectIDs(got []string, want ...string) error {
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("expected %d events %v, got %d %v", len(want), shortIDs(want), len(got), shortIDs(got))
+	}
+	return nil
+}
+
+// shortIDs abbreviates event IDs for messages
+func shortIDs(ids []string) []string {
+	short := make([]string, len(ids))
+	for i, id := range ids {
+		short[i] = id[:min(8, len(id))]
+	}
+	return short
+}
+
+// conformanceChecks are the built-in checks, in the order they run
+var conformanceChecks = []conformanceCheck{
+	{1, "a valid event is accepted", func(t *conformanceRun) error {
+		return t.publish(t.event(1, "conformance", 0))
+	}},
+	{1, "an event with a bad signature is rejected", func(t *conformanceRun) error {
+		event := t.event(1, "bad signature", 0)
+		event.Sig = strings.Repeat("0", 128)
+		if ok, err := t.client.Publish(t.ctx, event); err != nil || ok.Accepted {
+			return fmt.Errorf("accepted (err %v)", err)
+		}
+		return nil
+	}},
+	{1, "an event with a bad id is rejected", func(t *conformanceRun) error {
+		event := t.event(1, "bad id", 0)
+		event.Content = "changed after signing"
+		if ok, err := t.client.Publish(t.ctx, event); err != nil || ok.Accepted {
+			return fmt.Errorf("accepted (err %v)", err)
+		}
+		return nil
+	}},
+	{1, "ids filters return only those events", func(t *conformanceRun) error {
+		first, second := t.event(1, "first", 0), t.event(1, "second", 0)
+		for _, event := range []nostr.Event{first, second} {
+			if err := t.publish(event); err != nil {
+				return err
+			}
+		}
+		got, err := t.query(nostrclient.Filter{"ids": []string{second.ID}})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got, second.ID)
+	}},
+	{1, "results are newest first and respect limit", func(t *conformanceRun) error {
+		now := time.Now().Unix()
+		var ids []string
+		for i := 0; i < 3; i++ {
+			event := t.event(1, fmt.Sprintf("note %d", i), now-int64(3-i))
+			if err := t.publish(event); err != nil {
+				return err
+			}
+			ids = append(ids, event.ID)
+		}
+		got, err := t.query(nostrclient.Filter{"authors": []string{t.pk}, "kinds": []int{1}, "limit": 2})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got, ids[2], ids[1])
+	}},
+	{1, "since and until bound created_at", func(t *conformanceRun) error {
+		now := time.Now().Unix()
+		var ids []string
+		for i := 0; i < 3; i++ {
+			event := t.event(1, fmt.Sprintf("at %d", i), now-300+int64(i)*100)
+			if err := t.publish(event); err != nil {
+				return err
+			}
+			ids = append(ids, event.ID)
+		}
+		got, err := t.query(nostrclient.Filter{"authors": []string{t.pk}, "since": now - 250, "until": now - 150})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got, ids[1])
+	}},
+	{1, "live events reach open subscriptions", func(t *conformanceRun) error {
+		sub, err := t.client.Subscribe(t.ctx, nostrclient.Filter{"authors": []string{t.pk}})
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+		select {
+		case <-sub.EOSE:
+		case <-t.ctx.Done():
+			return fmt.Errorf("no EOSE")
+		}
+		event := t.event(1, "live", 0)
+		if err := t.publish(event); err != nil {
+			return err
+		}
+		select {
+		case got := <-sub.Events:
+			return expectIDs([]string{got.ID}, event.ID)
+		case <-t.ctx.Done():
+			return fmt.Errorf("the event was not delivered")
+		}
+	}},
+	{1, "replaceable events keep only the newest version", func(t *conformanceRun) error {
+		now := time.Now().Unix()
+		older, newer := t.event(0, `{"name":"old"}`, now-10), t.event(0, `{"name":"new"}`, now)
+		for _, event := range []nostr.Event{older, newer} {
+			if err := t.publish(event); err != nil {
+				return err
+			}
+		}
+		got, err := t.query(nostrclient.Filter{"authors": []string{t.pk}, "kinds": []int{0}})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got, newer.ID)
+	}},
+	{1, "addressable events are replaced per d tag and #d filters work", func(t *conformanceRun) error {
+		now := time.Now().Unix()
+		older := t.event(30023, "draft", now-10, []string{"d", "article"})
+		newer := t.event(30023, "edited", now, []string{"d", "article"})
+		other := t.event(30023, "other", now, []string{"d", "other"})
+		for _, event := range []nostr.Event{older, newer, other} {
+			if err := t.publish(event); err != nil {
+				return err
+			}
+		}
+		got, err := t.query(nostrclient.Filter{"authors": []string{t.pk}, "#d": []string{"article"}})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got, newer.ID)
+	}},
+	{1, "#e, #p and #t tag filters select tagged events", func(t *conformanceRun) error {
+		target := t.event(1, "target", 0)
+		reply := t.event(1, "reply", 0, []string{"e", target.ID}, []string{"p", target.PubKey}, []string{"t", "conformance"})
+		other := t.event(1, "other", 0, []string{"t", "elsewhere"})
+		for _, event := range []nostr.Event{target, reply, other} {
+			if err := t.publish(event); err != nil {
+				return err
+			}
+		}
+		for _, filter := range []nostrclient.Filter{
+			{"#e": []string{target.ID}},
+			{"authors": []string{t.pk}, "#p": []string{target.PubKey}},
+			{"authors": []string{t.pk}, "#t": []string{"conformance"}},
+			{"#e": []string{target.ID}, "#t": []string{"conformance", "other"}},
+		} {
+			got, err := t.query(filter)
+			if err != nil {
+				return err
+			}
+			if err := expectIDs(got, reply.ID); err != nil {
+				return fmt.Errorf("%v: %v", filter, err)
+			}
+		}
+		return nil
+	}},
+	{1, "ephemeral events are not stored", func(t *conformanceRun) error {
+		if err := t.publish(t.event(20001, "ephemeral", 0)); err != nil {
+			return err
+		}
+		got, err := t.query(nostrclient.Filter{"authors": []string{t.pk}})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got)
+	}},
+	{9, "a deletion removes the author's event", func(t *conformanceRun) error {
+		note := t.event(1, "to delete", 0)
+		if err := t.publish(note); err != nil {
+			return err
+		}
+		if err := t.publish(t.event(5, "", 0, []string{"e", note.ID})); err != nil {
+			return err
+		}
+		got, err := t.query(nostrclient.Filter{"ids": []string{note.ID}})
+		if err != nil {
+			return err
+		}
+		if err := expectIDs(got); err != nil {
+			return err
+		}
+		if ok, err := t.client.Publish(t.ctx, note); err != nil || ok.Accepted {
+			return fmt.Errorf("the deleted event was accepted again (err %v)", err)
+		}
+		return nil
+	}},
+	{26, "a delegated event is served under the delegator", func(t *conformanceRun) error {
+		delegatorKey, err := nostr.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		delegator, err := nostr.PublicKey(delegatorKey)
+		if err != nil {
+			return err
+		}
+		tag, err := nostr.CreateDelegation(delegatorKey, t.pk, fmt.Sprintf("kind=1&created_at>%d", time.Now().Unix()-3600))
+		if err != nil {
+			return err
+		}
+		event := t.event(1, "delegated", 0, tag)
+		if err := t.publish(event); err != nil {
+			return err
+		}
+		got, err := t.query(nostrclient.Filter{"authors": []string{delegator}})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got, event.ID)
+	}},
+	{40, "an expired event is rejected", func(t *conformanceRun) error {
+		event := t.event(1, "expired", 0, []string{"expiration", fmt.Sprint(time.Now().Unix() - 60)})
+		if ok, err := t.client.Publish(t.ctx, event); err != nil || ok.Accepted {
+			return fmt.Errorf("accepted (err %v)", err)
+		}
+		return nil
+	}},
+	{40, "an event is no longer served once it expires", func(t *conformanceRun) error {
+		event := t.event(1, "expiring", 0, []string{"expiration", fmt.Sprint(time.Now().Unix() + 2)})
+		if err := t.publish(event); err != nil {
+			return err
+		}
+		if got, err := t.query(nostrclient.Filter{"ids": []string{event.ID}}); err != nil || len(got) != 1 {
+			return fmt.Errorf("not served before expiring (err %v)", err)
+		}
+		time.Sleep(3 * time.Second)
+		got, err := t.query(nostrclient.Filter{"ids": []string{event.ID}})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got)
+	}},
+	{11, "the relay information document is served", func(t *conformanceRun) error {
+		if t.info == nil {
+			return fmt.Errorf("no NIP-11 document at %s", t.httpURL)
+		}
+		if _, ok := t.info["supported_nips"].([]interface{}); !ok {
+			return fmt.Errorf("supported_nips is missing")
+		}
+		return nil
+	}},
+	{13, "an event without the required proof of work is rejected", func(t *conformanceRun) error {
+		if t.pow == 0 {
+			return fmt.Errorf("min_pow_difficulty is missing from the NIP-11 limitation")
+		}
+		event := nostr.NewEvent(1, "no work")
+		event.Sign(t.sk)
+		for nostr.Difficulty(event.ID) >= t.pow {
+			event.CreatedAt--
+			event.Sign(t.sk)
+		}
+		ok, err := t.client.Publish(t.ctx, *event)
+		if err != nil {
+			return err
+		}
+		if ok.Accepted || !strings.HasPrefix(ok.Message, "pow:") {
+			return fmt.Errorf("expected a pow: rejection, got accepted=%v %q", ok.Accepted, ok.Message)
+		}
+		return nil
+	}},
+	{42, "AUTH with a signed challenge is accepted", func(t *conformanceRun) error {
+		conn, _, err := websocket.DefaultDialer.DialContext(t.ctx, t.url, nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(conformanceTimeout))
+
+		challenge := ""
+		for challenge == "" {
+			var message []json.RawMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return fmt.Errorf("no AUTH challenge: %v", err)
+			}
+			var label string
+			if len(message) >= 2 && json.Unmarshal(message[0], &label) == nil && label == "AUTH" {
+				json.Unmarshal(message[1], &challenge)
+			}
+		}
+		auth := t.event(22242, "", 0, []string{"relay", t.url}, []string{"challenge", challenge})
+		if err := conn.WriteJSON([]interface{}{"AUTH", auth}); err != nil {
+			return err
+		}
+		for {
+			var message []interface{}
+			if err := conn.ReadJSON(&message); err != nil {
+				return fmt.Errorf("no OK for AUTH: %v", err)
+			}
+			if len(message) >= 3 && message[0] == "OK" && message[1] == auth.ID {
+				if accepted, _ := message[2].(bool); !accepted {
+					return fmt.Errorf("AUTH rejected: %v", message[3:])
+				}
+				return nil
+			}
+		}
+	}},
+	{45, "COUNT matches the stored events", func(t *conformanceRun) error {
+		for i := 0; i < 3; i++ {
+			if err := t.publish(t.event(1, fmt.Sprintf("counted %d", i), 0)); err != nil {
+				return err
+			}
+		}
+		conn, _, err := websocket.DefaultDialer.DialContext(t.ctx, t.url, nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(conformanceTimeout))
+		if err := conn.WriteJSON([]interface{}{"COUNT", "conformance", map[string]interface{}{"authors": []string{t.pk}}}); err != nil {
+			return err
+		}
+		for {
+			var message []interface{}
+			if err := conn.ReadJSON(&message); err != nil {
+				return fmt.Errorf("no COUNT answer: %v", err)
+			}
+			if len(message) >= 3 && message[0] == "COUNT" && message[1] == "conformance" {
+				result, _ := message[2].(map[string]interface{})
+				if count, _ := result["count"].(float64); count != 3 {
+					return fmt.Errorf("expected a count of 3, got %v", result["count"])
+				}
+				return nil
+			}
+			if len(message) >= 2 && message[0] == "CLOSED" {
+				return fmt.Errorf("COUNT refused: %v", message[1:])
+			}
+		}
+	}},
+	{50, "search returns events containing the words", func(t *conformanceRun) error {
+		word := "conformance" + t.pk[:12]
+		match := t.event(1, "a note about "+word+" search", 0)
+		other := t.event(1, "a note about something else", 0)
+		for _, event := range []nostr.Event{match, other} {
+			if err := t.publish(event); err != nil {
+				return err
+			}
+		}
+		got, err := t.query(nostrclient.Filter{"authors": []string{t.pk}, "search": strings.ToUpper(word)})
+		if err != nil {
+			return err
+		}
+		return expectIDs(got, match.ID)
+	}},
+	{70, "a protected event is refused without AUTH", func(t *conformanceRun) error {
+		ok, err := t.client.Publish(t.ctx, t.event(1, "protected", 0, []string{"-"}))
+		if err != nil {
+			return err
+		}
+		if ok.Accepted || !strings.HasPrefix(ok.Message, "auth-required:") {
+			return fmt.Errorf("expected an auth-required: rejection, got accepted=%v %q", ok.Accepted, ok.Message)
+		}
+		return nil
+	}},
+}
+
+// runConformance runs the checks and prints the report; it returns the
+// process exit code
+func runConformance(cfg *Config, opts *conformanceOptions) int {
+	url := opts.url
+	if url == "" {
+		scratch, stop, err := startScratchRelay()
+		if err != nil {
+			fmt.Printf("Failed to start a scratch relay: %v\n", err)
+			return 2
+		}
+		defer stop()
+		url = scratch
+	}
+	t := &conformanceRun{url: url, httpURL: "http" + strings.TrimPrefix(url, "ws")}
+	t.info = fetchRelayInfo(t.httpURL)
+	if limitation, ok := t.info["limitation"].(map[string]interface{}); ok {
+		if pow, ok := limitation["min_pow_difficulty"].(float64); ok {
+			t.pow = int(pow)
+		}
+	}
+
+	only := map[int]bool{}
+	for _, field := range strings.Split(opts.nips, ",") {
+		var nip int
+		if _, err := fmt.Sscan(strings.TrimSpace(field), &nip); err == nil {
+			only[nip] = true
+		}
+	}
+	advertised := map[int]bool{1: true, 11: true}
+	if nips, ok := t.info["supported_nips"].([]interface{}); ok {
+		for _, nip := range nips {
+			if n, ok := nip.(float64); ok {
+				advertised[int(n)] = true
+			}
+		}
+	}
+
+	var results []conformanceResult
+	for _, check := range conformanceChecks {
+		result := conformanceResult{NIP: check.nip, Check: check.name, Status: "pass"}
+		switch {
+		case len(only) > 0 && !only[check.nip]:
+			continue
+		case !advertised[check.nip]:
+			result.Status, result.Detail = "skip", "not in supported_nips"
+		default:
+			if err := t.runCheck(check); err != nil {
+				result.Status, result.Detail = "fail", err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	if opts.nak {
+		results = append(results, t.runNak())
+	}
+	if opts.tester != "" {
+		results = append(results, t.runTester(opts.tester))
+	}
+	return printConformance(results, opts.json)
+}
+
+// runCheck runs one check with a fresh key and connection
+func (t *conformanceRun) runCheck(check conformanceCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), conformanceTimeout)
+	defer cancel()
+	t.ctx = ctx
+	if err := t.newKey(); err != nil {
+		return err
+	}
+	client, err := nostrclient.Connect(ctx, t.url, nostrclient.Options{})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	t.client = client
+	return check.run(t)
+}
+
+// fetchRelayInfo returns the relay's NIP-11 document, or nil
+func fetchRelayInfo(httpURL string) map[string]interface{} {
+	req, err := http.NewRequest("GET", httpURL, nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Accept", "application/nostr+json")
+	var info map[string]interface{}
+	if doJSON(&http.Client{Timeout: conformanceTimeout}, req, &info) != nil {
+		return nil
+	}
+	return info
+}
+
+// runNak publishes with the nak CLI and reads the event back with it
+func (t *conformanceRun) runNak() conformanceResult {
+	result := conformanceResult{NIP: 1, Check: "nak publishes and queries", Status: "pass"}
+	if _, err := exec.LookPath("nak"); err != nil {
+		result.Status, result.Detail = "skip", "nak is not installed"
+		return result
+	}
+	if err := t.newKey(); err != nil {
+		result.Status, result.Detail = "fail", err.Error()
+		return result
+	}
+	published, err := exec.Command("nak", "event", "--sec", t.sk, "-c", "conformance via nak", t.url).Output()
+	if err != nil {
+		result.Status, result.Detail = "fail", fmt.Sprintf("nak event: %v", err)
+		return result
+	}
+	var event nostr.Event
+	if err := json.Unmarshal([]byte(firstLine(string(published))), &event); err != nil {
+		result.Status, result.Detail = "fail", fmt.Sprintf("nak event printed no event: %v", err)
+		return result
+	}
+	found, err := exec.Command("nak", "req", "-i", event.ID, t.url).Output()
+	if err != nil {
+		result.Status, result.Detail = "fail", fmt.Sprintf("nak req: %v", err)
+	} else if !strings.Contains(string(found), event.ID) {
+		result.Status, result.Detail = "fail", "nak req did not return the published event"
+	}
+	return result
+}
+
+// firstLine returns the first line of command output
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+// runTester runs an external test suite; it passes when the command exits 0
+func (t *conformanceRun) runTester(command string) conformanceResult {
+	result := conformanceResult{Check: "external suite: " + command, Status: "pass"}
+	if err := t.newKey(); err != nil {
+		result.Status, result.Detail = "fail", err.Error()
+		return result
+	}
+	nsec, _ := nostr.EncodePrivateKey(t.sk)
+	args := strings.Fields(command)
+	for i, arg := range args {
+		args[i] = strings.NewReplacer("{url}", t.url, "{nsec}", nsec).Replace(arg)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		result.Status, result.Detail = "fail", err.Error()
+	}
+	return result
+}
+
+// startScratchRelay runs this binary on a temporary data directory and a free
+// local port, returning its URL and a function that stops it
+func startScratchRelay() (string, func(), error) {
+	dir, err := os.MkdirTemp("", "relay-conformance-")
+	if err != nil {
+		return "", nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := exec.Command(self, "serve")
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"DATA_DIR=" + dir,
+		"RELAY_LISTEN=" + addr,
+		"RELAY_NTP_SERVER=off",
+	}
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	for deadline := time.Now().Add(conformanceTimeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if resp, err := http.Get("http://" + addr + "/health"); err == nil {
+			resp.Body.Close()
+			return "ws://" + addr, stop, nil
+		}
+	}
+	stop()
+	return "", nil, fmt.Errorf("the relay did not come up on %s", addr)
+}
+
+// printConformance prints the results grouped by NIP and returns 1 when a
+// check failed
+func printConformance(results []conformanceResult, asJSON bool) int {
+	passed, failed, skipped := 0, 0, 0
+	for _, result := range results {
+		switch result.Status {
+		case "pass":
+			passed++
+		case "fail":
+			failed++
+		default:
+			skipped++
+		}
+	}
+
+	if asJSON {
+		out, _ := json.MarshalIndent(map[string]interface{}{
+			"results": results, "passed": passed, "failed": failed, "skipped": skipped,
+		}, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		// External suites, which have no NIP, come last
+		order := func(nip int) int {
+			if nip == 0 {
+				return 1 << 30
+			}
+			return nip
+		}
+		sort.SliceStable(results, func(i, j int) bool { return order(results[i].NIP) < order(results[j].NIP) })
+		nip := -1
+		for _, result := range results {
+			if result.NIP != nip {
+				nip = result.NIP
+				if nip == 0 {
+					fmt.Println("\nExternal")
+				} else {
+					fmt.Printf("\nNIP-%02d\n", nip)
+				}
+			}
+			switch result.Status {
+			case "pass":
+				fmt.Printf("  ✅ %s\n", result.Check)
+			case "fail":
+				fmt.Printf("  ❌ %s: %s\n", result.Check, result.Detail)
+			default:
+				fmt.Printf("  ⏭️  %s (%s)\n", result.Check, result.Detail)
+			}
+		}
+		fmt.Printf("\n%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
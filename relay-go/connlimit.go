@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// connectionGate caps concurrent WebSocket connections, so a traffic spike
+// from the home page cannot exhaust the relay. A connection over the cap is
+// refused with 503 and Retry-After, or, in queue mode, its upgrade is held
+// until a slot frees up. Addresses in RELAY_CONNECTION_EXEMPT, such as the
+// owner's home network or the Python app on the same host, bypass the cap.
+type connectionGate struct {
+	max        int
+	queue      bool
+	queueSize  int64
+	queueWait  time.Duration
+	retryAfter time.Duration
+	exempt     []*net.IPNet
+	slots      chan struct{}
+
+	waiting  int64
+	exempted int64
+	peak     int64
+	admitted int64
+	queued   int64
+	rejected int64
+	timedOut int64
+}
+
+// newConnectionGate returns the gate, or nil when connections are unlimited
+func newConnectionGate(cfg *Config) (*connectionGate, error) {
+	if cfg.MaxConnections <= 0 {
+		return nil, nil
+	}
+	g := &connectionGate{
+		max:        cfg.MaxConnections,
+		queueSize:  int64(cfg.ConnectionQueueSize),
+		queueWait:  cfg.ConnectionQueueWait,
+		retryAfter: cfg.ConnectionRetryAfter,
+		slots:      make(chan struct{}, cfg.MaxConnections),
+	}
+	switch cfg.ConnectionOverflow {
+	case "", "reject":
+	case "queue":
+		g.queue = true
+	default:
+		return nil, fmt.Errorf("RELAY_CONNECTION_OVERFLOW must be reject or queue, not %q", cfg.ConnectionOverflow)
+	}
+	for _, entry := range cfg.ConnectionExempt {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_CONNECTION_EXEMPT entry %q", entry)
+		}
+		g.exempt = append(g.exempt, network)
+	}
+	return g, nil
+}
+
+// isExempt reports whether an address bypasses the cap
+func (g *connectionGate) isExempt(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, network := range g.exempt {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit takes a connection slot for a request, waiting for one in queue mode.
+// It answers the request itself when no slot is available; otherwise the
+// returned release must be called once the connection ends.
+func (g *connectionGate) admit(c *gin.Context) (release func(), ok bool) {
+	if g == nil {
+		return func() {}, true
+	}
+	if g.isExempt(c.ClientIP()) {
+		atomic.AddInt64(&g.exempted, 1)
+		return func() { atomic.AddInt64(&g.exempted, -1) }, true
+	}
+
+	select {
+	case g.slots <- struct{}{}:
+		return g.take(), true
+	default:
+	}
+
+	if g.queue {
+		if atomic.AddInt64(&g.waiting, 1) <= g.queueSize {
+			atomic.AddInt64(&g.queued, 1)
+			timer := time.NewTimer(g.queueWait)
+			defer timer.Stop()
+			select {
+			case g.slots <- struct{}{}:
+				atomic.AddInt64(&g.waiting, -1)
+				return g.take(), true
+			case <-timer.C:
+				atomic.AddInt64(&g.timedOut, 1)
+			case <-c.Request.Context().Done():
+			}
+		}
+		atomic.AddInt64(&g.waiting, -1)
+	}
+
+	atomic.AddInt64(&g.rejected, 1)
+	c.Header("Retry-After", strconv.Itoa(int(g.retryAfter.Seconds())))
+	c.JSON(503, gin.H{"error": "relay is at its connection limit; try again later"})
+	return nil, false
+}
+
+// take records an admitted connection and returns its release
+func (g *connectionGate) take() func() {
+	atomic.AddInt64(&g.admitted, 1)
+	if open := int64(len(g.slots)); open > atomic.LoadInt64(&g.peak) {
+		atomic.StoreInt64(&g.peak, open)
+	}
+	var once int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			<-g.slots
+		}
+	}
+}
+
+// stats reports how saturated the connection cap is
+func (g *connectionGate) stats() map[string]interface{} {
+	if g == nil {
+		return map[string]interface{}{"limited": false}
+	}
+	open := len(g.slots)
+	return map[string]interface{}{
+		"limited":    true,
+		"max":        g.max,
+		"open":       open,
+		"exempt":     atomic.LoadInt64(&g.exempted),
+		"saturation": float64(open) / float64(g.max),
+		"peak":       atomic.LoadInt64(&g.peak),
+		"waiting":    atomic.LoadInt64(&g.waiting),
+		"admitted":   atomic.LoadInt64(&g.admitted),
+		"queued":     atomic.LoadInt64(&g.queued),
+		"rejected":   atomic.LoadInt64(&g.rejected),
+		"timed_out":  atomic.LoadInt64(&g.timedOut),
+	}
+}
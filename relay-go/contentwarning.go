@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+)
+
+// How public endpoints treat events with a content warning
+// (RELAY_CONTENT_WARNINGS). WebSocket subscriptions are never affected:
+// clients there apply their own settings.
+const (
+	contentWarningsHide = "hide" // leave them out
+	contentWarningsFlag = "flag" // serve them with content_warning set, for the page to blur
+	contentWarningsShow = "show" // serve them as they are
+)
+
+// publicEvent is an event as public endpoints serve it. ContentWarning is set
+// in flag mode for events the page should blur; it is the NIP-36 reason, or
+// "nsfw" for events tagged #nsfw.
+type publicEvent struct {
+	Event
+	ContentWarning *string `json:"content_warning,omitempty"`
+}
+
+// contentWarning reports whether an event carries a NIP-36 content-warning
+// tag or the #nsfw hashtag, with the reason given
+func contentWarning(event *Event) (string, bool) {
+	for _, tag := range event.Tags {
+		if len(tag) == 0 {
+			continue
+		}
+		switch {
+		case tag[0] == "content-warning":
+			if len(tag) >= 2 {
+				return tag[1], true
+			}
+			return "", true
+		case tag[0] == "t" && len(tag) >= 2 && strings.EqualFold(tag[1], "nsfw"):
+			return "nsfw", true
+		}
+	}
+	return "", false
+}
+
+// publicEvent prepares an event for a public endpoint; ok is false when it
+// must be left out, as events of private groups always are
+func (r *Relay) publicEvent(event Event) (publicEvent, bool) {
+	if !r.canReadGroup(&event, "") {
+		return publicEvent{}, false
+	}
+	if r.cfg.ContentWarnings == contentWarningsShow {
+		return publicEvent{Event: event}, true
+	}
+	reason, warned := contentWarning(&event)
+	if !warned {
+		return publicEvent{Event: event}, true
+	}
+	if r.cfg.ContentWarnings == contentWarningsFlag {
+		return publicEvent{Event: event, ContentWarning: &reason}, true
+	}
+	return publicEvent{}, false
+}
+
+// publicEvents prepares a list of events for a public endpoint
+func (r *Relay) publicEvents(events []Event) []publicEvent {
+	list := make([]publicEvent, 0, len(events))
+	for _, event := range events {
+		if e, ok := r.publicEvent(event); ok {
+			list = append(list, e)
+		}
+	}
+	return list
+}
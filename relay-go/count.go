@@ -0,0 +1,501 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hllPrecision gives sketches of 1024 one-byte registers, about 3% standard error
+const hllPrecision = 10
+
+const hllRegisters = 1 << hllPrecision
+
+// Sketch keys for "any kind" and "any author"
+const (
+	sketchAllKinds   = -1
+	sketchAllAuthors = ""
+)
+
+// sketchSchema holds one HyperLogLog sketch of event IDs per UTC day and
+// (kind, author), plus roll-ups across kinds and authors for broad filters
+const sketchSchema = `
+	CREATE TABLE IF NOT EXISTS count_sketches (
+		day INTEGER NOT NULL,
+		kind INTEGER NOT NULL,
+		pubkey TEXT NOT NULL,
+		sketch BLOB NOT NULL,
+		PRIMARY KEY (day, kind, pubkey)
+	);
+`
+
+// hyperLogLog is a dense HLL sketch
+type hyperLogLog []byte
+
+func newHyperLogLog() hyperLogLog {
+	return make(hyperLogLog, hllRegisters)
+}
+
+// add records a 64-bit hash
+func (h hyperLogLog) add(hash uint64) {
+	index := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h[index] {
+		h[index] = rank
+	}
+}
+
+// merge folds another sketch into this one (set union)
+func (h hyperLogLog) merge(other []byte) {
+	if len(other) != hllRegisters {
+		return
+	}
+	for i, rank := range other {
+		if rank > h[i] {
+			h[i] = rank
+		}
+	}
+}
+
+// estimate returns the approximate number of distinct hashes added
+func (h hyperLogLog) estimate() float64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small sets
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// eventHash derives a sketch hash from an event ID, which is already a
+// sha256. It takes the last 64 bits: NIP-13 proof of work zeroes the leading
+// ones, which would crowd mined events into a few registers.
+func eventHash(id string) uint64 {
+	if len(id) < 16 {
+		return 0
+	}
+	b, _ := hex.DecodeString(id[len(id)-16:])
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// eventDay returns the UTC day number of a timestamp
+func eventDay(createdAt int64) int64 {
+	return int64(math.Floor(float64(createdAt) / 86400))
+}
+
+// sketchKey identifies one sketch row
+type sketchKey struct {
+	day    int64
+	kind   int
+	pubkey string
+}
+
+// sketchKeys are the rows an event contributes to; a delegated event (NIP-26)
+// also counts for its delegator
+func sketchKeys(day int64, kind int, pubkey, delegator string) []sketchKey {
+	keys := []sketchKey{
+		{day, kind, pubkey},
+		{day, kind, sketchAllAuthors},
+		{day, sketchAllKinds, pubkey},
+		{day, sketchAllKinds, sketchAllAuthors},
+	}
+	if delegator != "" {
+		keys = append(keys, sketchKey{day, kind, delegator}, sketchKey{day, sketchAllKinds, delegator})
+	}
+	return keys
+}
+
+// sketchStore serializes read-modify-write updates of sketch rows
+type sketchStore struct {
+	mu    sync.Mutex
+	ready bool
+}
+
+// mergeSketches folds in-memory sketches into their stored rows
+func (r *Relay) mergeSketches(sketches map[sketchKey]hyperLogLog) error {
+	r.sketches.mu.Lock()
+	defer r.sketches.mu.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := mergeSketchRows(tx, sketches); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mergeSketchRows does the read-merge-write of mergeSketches inside a caller's
+// transaction; the caller must hold r.sketches.mu
+func mergeSketchRows(db sqlExecer, sketches map[sketchKey]hyperLogLog) error {
+	for key, sketch := range sketches {
+		var stored []byte
+		db.QueryRow("SELECT sketch FROM count_sketches WHERE day = ? AND kind = ? AND pubkey = ?",
+			key.day, key.kind, key.pubkey).Scan(&stored)
+		sketch.merge(stored)
+
+		if _, err := db.Exec("INSERT OR REPLACE INTO count_sketches (day, kind, pubkey, sketch) VALUES (?, ?, ?, ?)",
+			key.day, key.kind, key.pubkey, []byte(sketch)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addToSketches records a newly stored event in the COUNT sketches; the
+// caller must hold r.sketches.mu
+func (r *Relay) addToSketches(db sqlExecer, event *Event) error {
+	if r.cfg.CountApproxDays <= 0 {
+		return nil
+	}
+
+	hash := eventHash(event.ID)
+	sketches := make(map[sketchKey]hyperLogLog)
+	for _, key := range sketchKeys(eventDay(event.CreatedAt), event.Kind, event.PubKey, validDelegator(event)) {
+		sketch := newHyperLogLog()
+		sketch.add(hash)
+		sketches[key] = sketch
+	}
+	return mergeSketchRows(db, sketches)
+}
+
+// backfillSketches builds sketches for stored events the first time approximate
+// COUNT is enabled; adding an event twice is harmless, so live inserts may overlap
+func (r *Relay) backfillSketches() {
+	if r.cfg.CountApproxDays <= 0 {
+		return
+	}
+
+	var existing int
+	r.db.QueryRow("SELECT COUNT(*) FROM count_sketches").Scan(&existing)
+	if existing == 0 {
+		start := time.Now()
+		total := 0
+		for _, db := range r.eventDBs(nil, nil) {
+			n, err := r.rebuildSketches(db, "1=1")
+			if err != nil {
+				log.Printf("❌ Failed to backfill count sketches: %v", err)
+				return
+			}
+			total += n
+		}
+		log.Printf("📐 Built count sketches for %d events in %s", total, time.Since(start).Round(time.Millisecond))
+	}
+
+	r.sketches.mu.Lock()
+	r.sketches.ready = true
+	r.sketches.mu.Unlock()
+}
+
+// rebuildSketches adds the events of one database matching a condition to
+// the sketches, one day at a time to bound memory, and returns how many it read
+func (r *Relay) rebuildSketches(db *sql.DB, condition string, args ...interface{}) (int, error) {
+	rows, err := db.Query(`SELECT id, pubkey, kind, created_at,
+		COALESCE((SELECT delegator FROM event_delegations WHERE event_id = relay_events.id LIMIT 1), '')
+		FROM relay_events WHERE `+condition+" ORDER BY created_at", args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	sketches := make(map[sketchKey]hyperLogLog)
+	currentDay := int64(math.MinInt64)
+	count := 0
+
+	for rows.Next() {
+		var id, pubkey, delegator string
+		var kind int
+		var createdAt int64
+		if err := rows.Scan(&id, &pubkey, &kind, &createdAt, &delegator); err != nil {
+			return count, err
+		}
+
+		day := eventDay(createdAt)
+		if day != currentDay && len(sketches) > 0 {
+			if err := r.mergeSketches(sketches); err != nil {
+				return count, err
+			}
+			sketches = make(map[sketchKey]hyperLogLog)
+		}
+		currentDay = day
+
+		hash := eventHash(id)
+		for _, key := range sketchKeys(day, kind, pubkey, delegator) {
+			sketch, ok := sketches[key]
+			if !ok {
+				sketch = newHyperLogLog()
+				sketches[key] = sketch
+			}
+			sketch.add(hash)
+		}
+		count++
+	}
+
+	if len(sketches) > 0 {
+		if err := r.mergeSketches(sketches); err != nil {
+			return count, err
+		}
+	}
+	return count, rows.Err()
+}
+
+// handleCount answers NIP-45 COUNT requests
+func (c *Client) handleCount(raw []json.RawMessage) {
+	if len(raw) < 3 {
+		c.protocolError("COUNT without filters")
+		return
+	}
+
+	var subID string
+	if err := json.Unmarshal(raw[1], &subID); err != nil {
+		c.protocolError("Invalid subscription id: %v", err)
+		return
+	}
+	if subID == "" || len(subID) > maxSubIDLength {
+		c.protocolError("Subscription id must be 1-%d characters", maxSubIDLength)
+		c.sendJSON([]interface{}{"CLOSED", subID, fmt.Sprintf("invalid: subscription id must be 1-%d characters", maxSubIDLength)})
+		return
+	}
+
+	var filters []Filter
+	for i := 2; i < len(raw); i++ {
+		var filter Filter
+		if err := json.Unmarshal(raw[i], &filter); err != nil {
+			c.protocolError("Invalid filter: %v", err)
+			continue
+		}
+		filters = append(filters, filter)
+	}
+
+	filters, reason := c.endpointFilters(filters)
+	if reason == "" {
+		reason = c.authRequiredToRead(filters)
+	}
+	if reason != "" {
+		c.sendJSON([]interface{}{"CLOSED", subID, reason})
+		return
+	}
+
+	count, approximate := c.Relay.countEvents(filters)
+	result := map[string]interface{}{"count": count}
+	if approximate {
+		result["approximate"] = true
+	}
+	c.sendJSON([]interface{}{"COUNT", subID, result})
+}
+
+// countEvents counts events matching any of the filters, approximately when
+// the filters span more than RELAY_COUNT_APPROX_DAYS and sketches can answer them
+func (r *Relay) countEvents(filters []Filter) (int64, bool) {
+	if r.canApproximate(filters) {
+		count, err := r.approximateCount(filters)
+		if err == nil {
+			return count, true
+		}
+		log.Printf("⚠️  Approximate count failed, counting exactly: %v", err)
+	}
+	return r.exactCount(filters), false
+}
+
+// canApproximate reports whether sketches can answer the filters and any of
+// them is wide enough to be worth it
+func (r *Relay) canApproximate(filters []Filter) bool {
+	r.sketches.mu.Lock()
+	ready := r.sketches.ready
+	r.sketches.mu.Unlock()
+	if r.cfg.CountApproxDays <= 0 || !ready || len(filters) == 0 {
+		return false
+	}
+
+	wide := false
+	for _, filter := range filters {
+		if len(filter.IDs) > 0 || len(filter.Tags) > 0 || filter.Search != "" {
+			return false
+		}
+		since, until := filterRange(filter)
+		if until-since >= int64(r.cfg.CountApproxDays)*86400 {
+			wide = true
+		}
+	}
+	return wide
+}
+
+// filterRange returns a filter's time window, open ends as epoch and now
+func filterRange(filter Filter) (int64, int64) {
+	since, until := int64(0), time.Now().Unix()
+	if filter.Since != nil {
+		since = *filter.Since
+	}
+	if filter.Until != nil {
+		until = *filter.Until
+	}
+	return since, until
+}
+
+// approximateCount merges the sketches of whole days inside each filter's
+// window with the exact IDs from its partial first and last days
+func (r *Relay) approximateCount(filters []Filter) (int64, error) {
+	merged := newHyperLogLog()
+
+	for _, filter := range filters {
+		since, until := filterRange(filter)
+		firstDay := eventDay(since + 86399) // first day starting at or after since
+		lastDay := eventDay(until+1) - 1    // last day ending at or before until
+
+		if firstDay > lastDay {
+			if err := r.addExactIDs(merged, filter, since, until); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if err := r.mergeDaySketches(merged, filter, firstDay, lastDay); err != nil {
+			return 0, err
+		}
+		if err := r.addExactIDs(merged, filter, since, firstDay*86400-1); err != nil {
+			return 0, err
+		}
+		if err := r.addExactIDs(merged, filter, (lastDay+1)*86400, until); err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(math.Round(merged.estimate())), nil
+}
+
+// mergeDaySketches folds the stored sketches for a filter's kinds and authors
+// over a range of whole days into merged
+func (r *Relay) mergeDaySketches(merged hyperLogLog, filter Filter, firstDay, lastDay int64) error {
+	query := "SELECT sketch FROM count_sketches WHERE day BETWEEN ? AND ?"
+	args := []interface{}{firstDay, lastDay}
+
+	if len(filter.Kinds) > 0 {
+		query += " AND kind IN (" + strings.TrimSuffix(strings.Repeat("?,", len(filter.Kinds)), ",") + ")"
+		for _, kind := range filter.Kinds {
+			args = append(args, kind)
+		}
+	} else {
+		query += " AND kind = ?"
+		args = append(args, sketchAllKinds)
+	}
+
+	if len(filter.Authors) > 0 {
+		query += " AND pubkey IN (" + strings.TrimSuffix(strings.Repeat("?,", len(filter.Authors)), ",") + ")"
+		for _, author := range filter.Authors {
+			args = append(args, author)
+		}
+	} else {
+		query += " AND pubkey = ?"
+		args = append(args, sketchAllAuthors)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sketch []byte
+		if err := rows.Scan(&sketch); err != nil {
+			return err
+		}
+		merged.merge(sketch)
+	}
+	return rows.Err()
+}
+
+// addExactIDs adds the IDs of events matching a filter within [since, until]
+func (r *Relay) addExactIDs(merged hyperLogLog, filter Filter, since, until int64) error {
+	if since > until {
+		return nil
+	}
+	filter.Since, filter.Until = &since, &until
+
+	where, args := r.filterConditions(filter)
+	for _, db := range r.eventDBs(filter.Since, filter.Until) {
+		rows, err := db.Query("SELECT id FROM relay_events WHERE "+where, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id string
+			if rows.Scan(&id) == nil {
+				merged.add(eventHash(id))
+			}
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+// exactCount counts events matching any of the filters with one SQL COUNT
+// per event database. The filters are ORed in a single WHERE clause, so an
+// event matching several of them is counted once; each event lives in exactly
+// one partition, so the per-database counts add up.
+func (r *Relay) exactCount(filters []Filter) int64 {
+	if len(filters) == 0 {
+		return 0
+	}
+
+	clauses := make([]string, len(filters))
+	var args []interface{}
+	for i, filter := range filters {
+		where, filterArgs := r.filterConditions(filter)
+		clauses[i] = "(" + where + ")"
+		args = append(args, filterArgs...)
+	}
+	query := "SELECT COUNT(*) FROM relay_events WHERE " + strings.Join(clauses, " OR ")
+
+	var total int64
+	for _, db := range r.countDBs(filters) {
+		r.faults.dbDelay()
+		var n int64
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			log.Printf("Count error: %v", err)
+			continue
+		}
+		total += n
+	}
+	return total
+}
+
+// countDBs returns the event databases any of the filters may match, each once
+func (r *Relay) countDBs(filters []Filter) []*sql.DB {
+	var dbs []*sql.DB
+	seen := map[*sql.DB]bool{}
+	for _, filter := range filters {
+		for _, db := range r.eventDBs(filter.Since, filter.Until) {
+			if !seen[db] {
+				seen[db] = true
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	return dbs
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const crosspostSchema = `
+	CREATE TABLE IF NOT EXISTS crossposts (
+		event_id TEXT NOT NULL,
+		target TEXT NOT NULL,
+		external_id TEXT,
+		external_url TEXT,
+		status TEXT NOT NULL,
+		error TEXT,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (event_id, target)
+	);
+`
+
+// crossPostTarget is one destination in the cross-posting config file
+type crossPostTarget struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // mastodon, bluesky or webhook
+
+	// Mastodon: instance URL and access token; webhook: endpoint URL
+	URL   string `json:"url"`
+	Token string `json:"token"`
+
+	// Bluesky: PDS host, account handle and app password
+	PDS         string `json:"pds"`
+	Handle      string `json:"handle"`
+	AppPassword string `json:"app_password"`
+
+	// Formatting rules
+	Kinds       []int  `json:"kinds"`        // event kinds to cross-post (default 1 and 30023)
+	MaxLength   int    `json:"max_length"`   // truncate text to this many characters
+	SkipReplies *bool  `json:"skip_replies"` // ignore notes that reply to others (default true)
+	LinkFormat  string `json:"link_format"`  // e.g. https://home.example/post/{id}; appended when truncated
+	AlwaysLink  bool   `json:"always_link"`  // append the link even when text fits
+	Prefix      string `json:"prefix"`
+	Suffix      string `json:"suffix"`
+}
+
+// loadCrossPostTargets reads the cross-posting targets from a JSON file
+func loadCrossPostTargets(path string) ([]crossPostTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []crossPostTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("invalid cross-post config: %v", err)
+	}
+
+	for i := range targets {
+		t := &targets[i]
+		if t.Name == "" {
+			t.Name = t.Type
+		}
+		if len(t.Kinds) == 0 {
+			t.Kinds = []int{1, 30023}
+		}
+		if t.Type == "bluesky" && t.PDS == "" {
+			t.PDS = "https://bsky.social"
+		}
+		if t.MaxLength == 0 {
+			switch t.Type {
+			case "mastodon":
+				t.MaxLength = 500
+			case "bluesky":
+				t.MaxLength = 300
+			}
+		}
+	}
+	return targets, nil
+}
+
+// accepts reports whether the target cross-posts this event
+func (t *crossPostTarget) accepts(event *Event) bool {
+	kindMatch := false
+	for _, kind := range t.Kinds {
+		if kind == event.Kind {
+			kindMatch = true
+			break
+		}
+	}
+	if !kindMatch {
+		return false
+	}
+
+	skipReplies := t.SkipReplies == nil || *t.SkipReplies
+	return !(skipReplies && event.Kind == 1 && isReply(event))
+}
+
+// format renders an event as plain text according to the target's rules
+func (t *crossPostTarget) format(event *Event) string {
+	text := event.Content
+	if event.Kind == 30023 {
+		parts := []string{}
+		if title := event.TagValue("title"); title != "" {
+			parts = append(parts, title)
+		}
+		if summary := event.TagValue("summary"); summary != "" {
+			parts = append(parts, summary)
+		}
+		text = strings.Join(parts, "\n\n")
+	}
+	text = t.Prefix + text + t.Suffix
+
+	link := ""
+	if t.LinkFormat != "" {
+		link = strings.ReplaceAll(t.LinkFormat, "{id}", event.ID)
+		if d := event.TagValue("d"); d != "" {
+			link = strings.ReplaceAll(link, "{d}", d)
+		}
+	}
+
+	// Articles and truncated notes always link back to the original
+	withLink := link != "" && (t.AlwaysLink || event.Kind == 30023)
+	if t.MaxLength > 0 && utf8.RuneCountInString(text) > t.MaxLength {
+		withLink = link != ""
+	}
+	if !withLink {
+		return truncateRunes(text, t.MaxLength)
+	}
+
+	suffix := "\n\n" + link
+	if t.MaxLength <= 0 {
+		return text + suffix
+	}
+	return truncateRunes(text, t.MaxLength-utf8.RuneCountInString(suffix)) + suffix
+}
+
+// truncateRunes shortens text to max characters, ending with an ellipsis
+func truncateRunes(text string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
+
+// crossPostResult is the external identity of a cross-posted copy
+type crossPostResult struct {
+	ID  string
+	URL string
+}
+
+// crossPost copies an owner event to every configured target that accepts
+// it. Protected events (NIP-70) stay on the relay.
+func (r *Relay) crossPost(event *Event) {
+	if event.PubKey != r.cfg.OwnerPubkey || isProtected(event) {
+		return
+	}
+
+	for i := range r.crossPostTargets {
+		target := &r.crossPostTargets[i]
+		if !target.accepts(event) {
+			continue
+		}
+
+		var existing int
+		r.db.QueryRow("SELECT COUNT(*) FROM crossposts WHERE event_id = ? AND target = ? AND status = 'posted'",
+			event.ID, target.Name).Scan(&existing)
+		if existing > 0 {
+			continue
+		}
+
+		result, err := r.sendCrossPost(target, event)
+		status, errText := "posted", ""
+		if err != nil {
+			status, errText = "failed", err.Error()
+			log.Printf("❌ Cross-post of %s to %s failed: %v", event.ID[:8], target.Name, err)
+		} else {
+			log.Printf("🔀 Cross-posted %s to %s (%s)", event.ID[:8], target.Name, result.ID)
+		}
+
+		r.db.Exec(`INSERT OR REPLACE INTO crossposts
+			(event_id, target, external_id, external_url, status, error, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			event.ID, target.Name, result.ID, result.URL, status, errText, time.Now().Unix())
+	}
+}
+
+// sendCrossPost publishes one event to one target
+func (r *Relay) sendCrossPost(target *crossPostTarget, event *Event) (crossPostResult, error) {
+	client := &http.Client{Timeout: 15 * time.Second}
+	text := target.format(event)
+
+	switch target.Type {
+	case "mastodon":
+		return postToMastodon(client, target, text)
+	case "bluesky":
+		return postToBluesky(client, target, text)
+	case "webhook":
+		if r.faults.dropWebhook() {
+			return crossPostResult{}, errInjectedDrop
+		}
+		return postToWebhook(client, target, event, text)
+	default:
+		return crossPostResult{}, fmt.Errorf("unknown target type %q", target.Type)
+	}
+}
+
+// doJSON performs a request and decodes a JSON response, failing on non-2xx
+func doJSON(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, truncateRunes(string(body), 200))
+	}
+	if out != nil && len(body) > 0 {
+		return json.Unmarshal(body, out)
+	}
+	return nil
+}
+
+func postToMastodon(client *http.Client, target *crossPostTarget, text string) (crossPostResult, error) {
+	form := url.Values{"status": {text}}
+	req, _ := http.NewRequest("POST", strings.TrimSuffix(target.URL, "/")+"/api/v1/statuses", strings.NewReader(form.Encode()))
+	req.Header.Set("Authorization", "Bearer "+target.Token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var status struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := doJSON(client, req, &status); err != nil {
+		return crossPostResult{}, err
+	}
+	return crossPostResult{ID: status.ID, URL: status.URL}, nil
+}
+
+func postToBluesky(client *http.Client, target *crossPostTarget, text string) (crossPostResult, error) {
+	pds := strings.TrimSuffix(target.PDS, "/")
+
+	login, _ := json.Marshal(map[string]string{"identifier": target.Handle, "password": target.AppPassword})
+	req, _ := http.NewRequest("POST", pds+"/xrpc/com.atproto.server.createSession", bytes.NewReader(login))
+	req.Header.Set("Content-Type", "application/json")
+
+	var session struct {
+		AccessJwt string `json:"accessJwt"`
+		DID       string `json:"did"`
+	}
+	if err := doJSON(client, req, &session); err != nil {
+		return crossPostResult{}, fmt.Errorf("login failed: %v", err)
+	}
+
+	record, _ := json.Marshal(map[string]interface{}{
+		"repo":       session.DID,
+		"collection": "app.bsky.feed.post",
+		"record": map[string]interface{}{
+			"$type":     "app.bsky.feed.post",
+			"text":      text,
+			"createdAt": time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	req, _ = http.NewRequest("POST", pds+"/xrpc/com.atproto.repo.createRecord", bytes.NewReader(record))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+session.AccessJwt)
+
+	var created struct {
+		URI string `json:"uri"`
+	}
+	if err := doJSON(client, req, &created); err != nil {
+		return crossPostResult{}, err
+	}
+
+	// at://did/app.bsky.feed.post/<rkey> → https://bsky.app/profile/<handle>/post/<rkey>
+	postURL := ""
+	if idx := strings.LastIndex(created.URI, "/"); idx >= 0 {
+		postURL = "https://bsky.app/profile/" + target.Handle + "/post/" + created.URI[idx+1:]
+	}
+	return crossPostResult{ID: created.URI, URL: postURL}, nil
+}
+
+func postToWebhook(client *http.Client, target *crossPostTarget, event *Event, text string) (crossPostResult, error) {
+	payload, _ := json.Marshal(map[string]interface{}{"event": event, "text": text})
+	req, _ := http.NewRequest("POST", target.URL, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if target.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+target.Token)
+	}
+
+	var response struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := doJSON(client, req, &response); err != nil {
+		return crossPostResult{}, err
+	}
+	return crossPostResult{ID: response.ID, URL: response.URL}, nil
+}
+
+// handleCrossPosts lists the external copies of an event
+func handleCrossPosts(c *gin.Context) {
+	rows, err := relay.db.Query(
+		"SELECT target, external_id, external_url, status, error, created_at FROM crossposts WHERE event_id = ?",
+		c.Param("id"),
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	posts := []gin.H{}
+	for rows.Next() {
+		var target, status string
+		var externalID, externalURL, errText *string
+		var createdAt int64
+		if rows.Scan(&target, &externalID, &externalURL, &status, &errText, &createdAt) != nil {
+			continue
+		}
+		posts = append(posts, gin.H{
+			"target":       target,
+			"external_id":  externalID,
+			"external_url": externalURL,
+			"status":       status,
+			"error":        errText,
+			"created_at":   createdAt,
+		})
+	}
+
+	c.JSON(200, gin.H{"event_id": c.Param("id"), "crossposts": posts})
+}
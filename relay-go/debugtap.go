@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// maxTapDuration bounds how long a frame tap may run before it stops itself
+const maxTapDuration = time.Hour
+
+// tapRedactions are the event fields a tap can blank out
+var tapRedactions = map[string]bool{"content": true, "sig": true, "tags": true, "pubkey": true}
+
+// frameTap mirrors one client connection's frames to a log file or a debug
+// websocket. Its sink is set before the tap is registered and never changes.
+type frameTap struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client"`
+	Admin     string    `json:"admin"`
+	Redact    []string  `json:"redact"`
+	File      string    `json:"file,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	frames  atomic.Int64
+	dropped atomic.Int64
+	// mu guards writes to file against its close
+	mu     sync.Mutex
+	redact map[string]bool
+	file   *os.File
+	stream chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+// tapStatus is a frameTap as listed to admins
+type tapStatus struct {
+	*frameTap
+	Frames  int64 `json:"frames"`
+	Dropped int64 `json:"dropped"`
+}
+
+// status returns the tap with its counters read atomically
+func (t *frameTap) status() tapStatus {
+	return tapStatus{frameTap: t, Frames: t.frames.Load(), Dropped: t.dropped.Load()}
+}
+
+// tappedFrame is one mirrored frame
+type tappedFrame struct {
+	Time      time.Time       `json:"time"`
+	Client    string          `json:"client"`
+	Direction string          `json:"direction"` // "in" from the client, "out" to it
+	Frame     json.RawMessage `json:"frame"`
+}
+
+// parseRedactions validates a list of fields to redact
+func parseRedactions(fields []string) (map[string]bool, error) {
+	redact := make(map[string]bool)
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !tapRedactions[field] {
+			return nil, fmt.Errorf("cannot redact %q (content, sig, tags or pubkey)", field)
+		}
+		redact[field] = true
+	}
+	return redact, nil
+}
+
+// redactFrame blanks the chosen fields of every event inside a frame
+func redactFrame(frame []byte, redact map[string]bool) []byte {
+	if len(redact) == 0 {
+		return frame
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(frame))
+	dec.UseNumber()
+	var msg []interface{}
+	if err := dec.Decode(&msg); err != nil {
+		return frame
+	}
+
+	for _, element := range msg {
+		event, ok := element.(map[string]interface{})
+		if !ok || event["sig"] == nil {
+			continue
+		}
+		for field := range redact {
+			if _, present := event[field]; present {
+				event[field] = "[redacted]"
+			}
+		}
+	}
+
+	redacted, err := json.Marshal(msg)
+	if err != nil {
+		return frame
+	}
+	return redacted
+}
+
+// startTap registers a tap on a connected client, mirroring to file or, when
+// file is nil, to stream
+func (r *Relay) startTap(clientID, admin string, redact map[string]bool, duration time.Duration, file *os.File, stream chan []byte) (*frameTap, error) {
+	r.clientsMutex.RLock()
+	_, connected := r.clients[clientID]
+	r.clientsMutex.RUnlock()
+	if !connected {
+		return nil, fmt.Errorf("client %s is not connected", clientID)
+	}
+
+	if duration <= 0 || duration > maxTapDuration {
+		duration = maxTapDuration
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	tap := &frameTap{
+		ID:        hex.EncodeToString(id),
+		ClientID:  clientID,
+		Admin:     admin,
+		Redact:    []string{},
+		StartedAt: time.Now(),
+		ExpiresAt: time.Now().Add(duration),
+		redact:    redact,
+		file:      file,
+		stream:    stream,
+		done:      make(chan struct{}),
+	}
+	if file != nil {
+		tap.File = file.Name()
+	}
+	for field := range redact {
+		tap.Redact = append(tap.Redact, field)
+	}
+	sort.Strings(tap.Redact)
+
+	r.tapsMutex.Lock()
+	r.taps[tap.ID] = tap
+	r.tapsMutex.Unlock()
+
+	time.AfterFunc(duration, func() { r.stopTap(tap) })
+	log.Printf("🔍 %s started tap %s on client %s", admin, tap.ID, clientID)
+	return tap, nil
+}
+
+// stopTap unregisters a tap and closes its sink
+func (r *Relay) stopTap(tap *frameTap) {
+	tap.once.Do(func() {
+		r.tapsMutex.Lock()
+		delete(r.taps, tap.ID)
+		r.tapsMutex.Unlock()
+
+		tap.mu.Lock()
+		if tap.file != nil {
+			tap.file.Close()
+		}
+		tap.mu.Unlock()
+		close(tap.done)
+
+		log.Printf("🔍 Tap %s on client %s stopped after %d frames", tap.ID, tap.ClientID, tap.frames.Load())
+	})
+}
+
+// stopTapsFor stops every tap on a client, called when it disconnects
+func (r *Relay) stopTapsFor(clientID string) {
+	for _, tap := range r.tapsOn(clientID) {
+		r.stopTap(tap)
+	}
+}
+
+// tapsOn returns the taps registered on a client
+func (r *Relay) tapsOn(clientID string) []*frameTap {
+	r.tapsMutex.RLock()
+	defer r.tapsMutex.RUnlock()
+
+	if len(r.taps) == 0 {
+		return nil
+	}
+	var taps []*frameTap
+	for _, tap := range r.taps {
+		if tap.ClientID == clientID {
+			taps = append(taps, tap)
+		}
+	}
+	return taps
+}
+
+// tapFrame mirrors a JSON frame to the client's taps, if any
+func (r *Relay) tapFrame(c *Client, direction string, frame []byte) {
+	for _, tap := range r.tapsOn(c.ID) {
+		record := tappedFrame{Time: time.Now().UTC(), Client: c.ID, Direction: direction}
+		record.Frame = redactFrame(frame, tap.redact)
+		if !json.Valid(record.Frame) {
+			record.Frame, _ = json.Marshal(string(frame))
+		}
+		line, _ := json.Marshal(record)
+
+		tap.frames.Add(1)
+		if tap.file != nil {
+			tap.mu.Lock()
+			tap.file.Write(append(line, '\n'))
+			tap.mu.Unlock()
+			continue
+		}
+		select {
+		case tap.stream <- line:
+		default:
+			tap.dropped.Add(1)
+		}
+	}
+}
+
+// handleListClients lists connected clients so an admin can pick one to tap
+func handleListClients(c *gin.Context) {
+	relay.clientsMutex.RLock()
+	clients := []gin.H{}
+	for _, client := range relay.clients {
+		client.mu.RLock()
+		clients = append(clients, gin.H{
+			"id":            client.ID,
+			"remote_addr":   client.remoteAddr,
+			"user_agent":    client.userAgent,
+			"binary":        client.binary,
+			"subscriptions": len(client.Subscriptions),
+			"last_seen":     client.lastSeen.Unix(),
+		})
+		client.mu.RUnlock()
+	}
+	relay.clientsMutex.RUnlock()
+
+	c.JSON(200, gin.H{"clients": clients})
+}
+
+// handleListTaps lists running taps
+func handleListTaps(c *gin.Context) {
+	relay.tapsMutex.RLock()
+	taps := make([]tapStatus, 0, len(relay.taps))
+	for _, tap := range relay.taps {
+		taps = append(taps, tap.status())
+	}
+	relay.tapsMutex.RUnlock()
+
+	c.JSON(200, gin.H{"taps": taps})
+}
+
+// handleStartFileTap starts mirroring a client's frames to $DATA_DIR/taps
+func handleStartFileTap(c *gin.Context) {
+	var req struct {
+		Client   string   `json:"client"`
+		Redact   []string `json:"redact"`
+		Duration string   `json:"duration"`
+		File     string   `json:"file"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Client == "" {
+		c.JSON(400, gin.H{"error": "client is required"})
+		return
+	}
+	redact, err := parseRedactions(req.Redact)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	duration, _ := time.ParseDuration(req.Duration)
+
+	name := filepath.Base(req.File)
+	if req.File == "" {
+		name = fmt.Sprintf("%s-%d.jsonl", req.Client, time.Now().Unix())
+	}
+	dir := filepath.Join(relay.dataDir, "taps")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	admin := currentAdmin(c)
+	tap, err := relay.startTap(req.Client, admin.Name, redact, duration, file, nil)
+	if err != nil {
+		file.Close()
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	relay.audit(admin, "tap_start", nil, nil, fmt.Sprintf("client %s to %s", req.Client, tap.File))
+	c.JSON(200, tap.status())
+}
+
+// handleStopTap stops a running tap
+func handleStopTap(c *gin.Context) {
+	relay.tapsMutex.RLock()
+	tap, ok := relay.taps[c.Param("id")]
+	relay.tapsMutex.RUnlock()
+	if !ok {
+		c.JSON(404, gin.H{"error": "tap not found"})
+		return
+	}
+
+	relay.stopTap(tap)
+	relay.audit(currentAdmin(c), "tap_stop", nil, nil, "client "+tap.ClientID)
+	c.JSON(200, gin.H{"id": tap.ID, "frames": tap.frames.Load(), "dropped": tap.dropped.Load()})
+}
+
+// tapUpgrader upgrades admin debug websockets, which carry no Nostr subprotocol
+var tapUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// handleTapStream streams a client's frames over a debug websocket until either side closes
+func handleTapStream(c *gin.Context) {
+	var fields []string
+	if c.Query("redact") != "" {
+		fields = strings.Split(c.Query("redact"), ",")
+	}
+	redact, err := parseRedactions(fields)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	duration, _ := time.ParseDuration(c.Query("duration"))
+
+	admin := currentAdmin(c)
+	tap, err := relay.startTap(c.Query("client"), admin.Name, redact, duration, nil, make(chan []byte, 256))
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(admin, "tap_start", nil, nil, fmt.Sprintf("client %s to websocket", tap.ClientID))
+
+	conn, err := tapUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		relay.stopTap(tap)
+		return
+	}
+	defer conn.Close()
+
+	// The admin side only reads; a read error means it went away
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				relay.stopTap(tap)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-tap.stream:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+				relay.stopTap(tap)
+				return
+			}
+		case <-tap.done:
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "tap stopped"))
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+)
+
+// NIP-26 delegation. An event with a valid "delegation" tag is accepted
+// from the delegatee and served as the delegator's too: an authors filter
+// naming the delegator matches it, in queries, COUNT and live
+// subscriptions. Delegations are checked when events arrive; an invalid one
+// rejects the event.
+
+// delegationSchema maps delegated events to their delegators; it is one of
+// the eventIndexes
+const delegationSchema = `
+	CREATE TABLE IF NOT EXISTS event_delegations (
+		delegator TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		PRIMARY KEY (delegator, event_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_delegations_event ON event_delegations(event_id);
+`
+
+// indexDelegation records the delegator of an event with a valid delegation
+func indexDelegation(db sqlExecer, event *Event) error {
+	delegator := validDelegator(event)
+	if delegator == "" {
+		return nil
+	}
+	_, err := db.Exec("INSERT OR IGNORE INTO event_delegations (delegator, event_id) VALUES (?, ?)", delegator, event.ID)
+	return err
+}
+
+// validDelegator returns the delegator of an event whose delegation
+// verifies, or ""
+func validDelegator(event *Event) string {
+	d, ok := event.Delegation()
+	if !ok || event.VerifyDelegation() != nil {
+		return ""
+	}
+	return strings.ToLower(d.Delegator)
+}
+
+// delegatorOf returns the pubkey in an event's delegation tag without
+// checking it, for events that were verified when they arrived; it
+// allocates nothing
+func delegatorOf(event *Event) string {
+	for _, tag := range event.Tags {
+		if len(tag) >= 4 && tag[0] == "delegation" {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// authorsCondition builds the WHERE clause for an authors filter: events
+// signed by one of the authors or delegated by one
+func authorsCondition(authors []string) (string, []interface{}) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(authors)), ",")
+	args := make([]interface{}, 0, 2*len(authors))
+	for _, author := range authors {
+		args = append(args, author)
+	}
+	args = append(args, args...)
+	return "(pubkey IN (" + placeholders + ") OR id IN (SELECT event_id FROM event_delegations WHERE delegator IN (" + placeholders + ")))", args
+}
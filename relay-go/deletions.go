@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// NIP-09: a kind 5 event asks the relay to delete the author's own events,
+// referenced by id in `e` tags or by address in `a` tags. Deleted events are
+// removed and tombstoned, so a copy republished later, by anyone, is rejected.
+// A tombstone only binds the pubkey that made the request, so a deletion
+// cannot suppress someone else's event, even one the relay has not seen yet.
+
+const deletionSchema = `
+	CREATE TABLE IF NOT EXISTS deleted_events (
+		event_id TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		deletion_id TEXT NOT NULL,
+		deleted_at INTEGER NOT NULL,
+		PRIMARY KEY (event_id, pubkey)
+	);
+
+	CREATE TABLE IF NOT EXISTS deleted_addresses (
+		kind INTEGER NOT NULL,
+		pubkey TEXT NOT NULL,
+		d TEXT NOT NULL,
+		deletion_id TEXT NOT NULL,
+		until INTEGER NOT NULL,
+		PRIMARY KEY (kind, pubkey, d)
+	);
+`
+
+// kindDeletion is the NIP-09 deletion request kind
+const kindDeletion = 5
+
+// applyDeletion tombstones and removes the events a kind 5 event deletes,
+// returning the number of stored events removed. It runs inside storeEvent,
+// so the caller holds r.writes.
+func (r *Relay) applyDeletion(deletion *Event) int64 {
+	var removed int64
+	now := time.Now().Unix()
+
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 || tag[0] != "e" {
+			continue
+		}
+		id := tag[1]
+		stored := r.eventsByID([]string{id})
+		if target, ok := stored[id]; ok {
+			// Deleting a deletion has no effect, and nobody deletes others' events
+			if target.PubKey != deletion.PubKey || target.Kind == kindDeletion {
+				continue
+			}
+		}
+		if _, err := r.db.Exec("INSERT OR IGNORE INTO deleted_events (event_id, pubkey, deletion_id, deleted_at) VALUES (?, ?, ?, ?)",
+			id, deletion.PubKey, deletion.ID, now); err != nil {
+			log.Printf("❌ Failed to tombstone %s: %v", id, err)
+			continue
+		}
+		n, err := r.removeEvents("id = ? AND pubkey = ?", id, deletion.PubKey)
+		if err != nil {
+			log.Printf("❌ Failed to delete %s: %v", id, err)
+		}
+		removed += n
+		r.forgetVersions("id = ? AND pubkey = ?", id, deletion.PubKey)
+	}
+
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 || tag[0] != "a" {
+			continue
+		}
+		addr, ok := parseAddress(tag[1])
+		if !ok || addr.Pubkey != deletion.PubKey {
+			continue
+		}
+		// Versions up to the deletion's created_at are deleted; newer ones stand
+		if _, err := r.db.Exec(`INSERT INTO deleted_addresses (kind, pubkey, d, deletion_id, until) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(kind, pubkey, d) DO UPDATE SET deletion_id = excluded.deletion_id, until = excluded.until
+			WHERE excluded.until > deleted_addresses.until`,
+			addr.Kind, addr.Pubkey, addr.D, deletion.ID, deletion.CreatedAt); err != nil {
+			log.Printf("❌ Failed to tombstone %s: %v", tag[1], err)
+			continue
+		}
+		r.forgetVersions("pubkey = ? AND kind = ? AND d = ? AND created_at <= ?", addr.Pubkey, addr.Kind, addr.D, deletion.CreatedAt)
+		versions, err := r.storedVersions(addr)
+		if err != nil {
+			log.Printf("❌ Failed to look up %s: %v", tag[1], err)
+		}
+		for _, v := range versions {
+			if v.createdAt > deletion.CreatedAt {
+				continue
+			}
+			n, err := r.removeEvents("id = ?", v.id)
+			if err != nil {
+				log.Printf("❌ Failed to delete %s: %v", v.id, err)
+			}
+			removed += n
+		}
+	}
+
+	if removed > 0 {
+		log.Printf("🗑️  Deletion %s from %s removed %d events", deletion.ID[:8], deletion.PubKey[:8], removed)
+	}
+	return removed
+}
+
+// isDeleted reports whether an event was deleted by its author
+func (r *Relay) isDeleted(event *Event) bool {
+	var one int
+	err := r.db.QueryRow("SELECT 1 FROM deleted_events WHERE event_id = ? AND pubkey = ?", event.ID, event.PubKey).Scan(&one)
+	if err == nil {
+		return true
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("❌ Failed to check tombstones: %v", err)
+	}
+
+	class, _ := r.kinds.classify(event.Kind)
+	if class != kindAddressable && class != kindReplaceable {
+		return false
+	}
+	var until int64
+	err = r.db.QueryRow("SELECT until FROM deleted_addresses WHERE kind = ? AND pubkey = ? AND d = ?",
+		event.Kind, event.PubKey, event.TagValue("d")).Scan(&until)
+	return err == nil && event.CreatedAt <= until
+}
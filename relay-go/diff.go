@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/articles/:d/diff shows the owner what changed between two
+// revisions of one of their articles as a unified diff of the content. Revisions come from the version
+// history (see versions.go): the current article and the superseded
+// versions kept of it.
+
+// diffContext is the number of unchanged lines around each change
+const diffContext = 3
+
+// diffMaxWork bounds the work of one diff; past it the changed region is
+// reported as replaced wholesale
+const diffMaxWork = 1 << 20
+
+// diffMaxLines is the longest revision, in lines, that is diffed
+const diffMaxLines = 10000
+
+// diffOp is one line of an edit script: ' ' kept, '-' removed or '+' added
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns an edit script turning a into b, using Myers' algorithm
+// on what lies between their common prefix and suffix
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// myers finds a shortest edit script, or falls back to removing all of a
+// and adding all of b when that would take more than diffMaxWork
+func myers(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		if (d+1)*len(v) > diffMaxWork {
+			return replaceAll(a, b)
+		}
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, offset)
+			}
+		}
+	}
+	return replaceAll(a, b)
+}
+
+// backtrack walks the saved frontiers back from the end to recover the
+// edit script
+func backtrack(a, b []string, trace [][]int, offset int) []diffOp {
+	var reversed []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, diffOp{'+', b[y-1]})
+			} else {
+				reversed = append(reversed, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(reversed)-1-i] = op
+	}
+	return ops
+}
+
+// replaceAll is the edit script that removes every line of a and adds b
+func replaceAll(a, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a {
+		ops = append(ops, diffOp{'-', line})
+	}
+	for _, line := range b {
+		ops = append(ops, diffOp{'+', line})
+	}
+	return ops
+}
+
+// unifiedDiff formats the changes from a to b as a unified diff with
+// diffContext lines of context, or "" when they are the same
+func unifiedDiff(fromName, toName string, a, b []string) string {
+	ops := diffLines(a, b)
+
+	// before[i] is how many lines of a and b precede ops[i]
+	type position struct{ a, b int }
+	before := make([]position, len(ops)+1)
+	var changes []int
+	for i, op := range ops {
+		before[i+1] = before[i]
+		if op.kind != '+' {
+			before[i+1].a++
+		}
+		if op.kind != '-' {
+			before[i+1].b++
+		}
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for i := 0; i < len(changes); {
+		// A hunk takes in every change within twice the context of the last
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*diffContext {
+			j++
+		}
+		start := changes[i] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[j] + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		aCount, bCount := before[end].a-before[start].a, before[end].b-before[start].b
+		aStart, bStart := before[start].a+1, before[start].b+1
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+		i = j + 1
+	}
+	return out.String()
+}
+
+// splitLines splits content into lines; empty content has none
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// articleRevision describes one revision of an article
+type articleRevision struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	CreatedAt    int64  `json:"created_at"`
+	SupersededAt *int64 `json:"superseded_at"`
+}
+
+// findRevision picks a revision by event ID, or the one that was current at
+// a Unix time; revisions are newest first
+func findRevision(revisions []versionEntry, ref string) (int, bool) {
+	if isHex64(ref) {
+		for i, v := range revisions {
+			if v.Event.ID == strings.ToLower(ref) {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	at, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	for i, v := range revisions {
+		if v.Event.CreatedAt <= at {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// handleArticleDiff diffs two revisions of the owner's article with d tag :d.
+// from and to are event IDs or Unix times; to defaults to the current
+// revision and from to the one before to, or to nothing for the first.
+// ?format=text returns the bare diff.
+func handleArticleDiff(c *gin.Context) {
+	versions, err := relay.ownerVersions(30023, c.Param("d"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	var revisions []versionEntry
+	for _, v := range versions {
+		if _, ok := relay.publicEvent(v.Event); ok {
+			revisions = append(revisions, v)
+		}
+	}
+	if len(revisions) == 0 || revisions[0].SupersededAt != nil {
+		c.JSON(404, gin.H{"error": "article not found"})
+		return
+	}
+
+	to := 0
+	if ref := c.Query("to"); ref != "" {
+		var ok bool
+		if to, ok = findRevision(revisions, ref); !ok {
+			c.JSON(404, gin.H{"error": "no such revision: " + ref})
+			return
+		}
+	}
+	from := to + 1
+	if ref := c.Query("from"); ref != "" {
+		var ok bool
+		if from, ok = findRevision(revisions, ref); !ok {
+			c.JSON(404, gin.H{"error": "no such revision: " + ref})
+			return
+		}
+	}
+
+	var fromLines []string
+	fromName := "/dev/null"
+	var fromRevision *articleRevision
+	if from < len(revisions) {
+		fromLines = splitLines(revisions[from].Event.Content)
+		fromName = revisionName(revisions[from].Event)
+		r := newArticleRevision(revisions[from])
+		fromRevision = &r
+	}
+	toLines := splitLines(revisions[to].Event.Content)
+	if len(fromLines) > diffMaxLines || len(toLines) > diffMaxLines {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("revisions longer than %d lines are not diffed", diffMaxLines)})
+		return
+	}
+	diff := unifiedDiff(fromName, revisionName(revisions[to].Event), fromLines, toLines)
+
+	if c.Query("format") == "text" {
+		c.Data(200, "text/x-diff; charset=utf-8", []byte(diff))
+		return
+	}
+	list := make([]articleRevision, len(revisions))
+	for i, v := range revisions {
+		list[i] = newArticleRevision(v)
+	}
+	c.JSON(200, gin.H{
+		"d":         c.Param("d"),
+		"from":      fromRevision,
+		"to":        newArticleRevision(revisions[to]),
+		"diff":      diff,
+		"revisions": list,
+	})
+}
+
+// newArticleRevision summarizes a revision
+func newArticleRevision(v versionEntry) articleRevision {
+	return articleRevision{ID: v.Event.ID, Title: v.Event.TagValue("title"), CreatedAt: v.Event.CreatedAt, SupersededAt: v.SupersededAt}
+}
+
+// revisionName labels a revision in the diff header
+func revisionName(event Event) string {
+	return fmt.Sprintf("%s\t%s", event.ID[:12], time.Unix(event.CreatedAt, 0).UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// draftSchema holds the owner's unsigned drafts, so they sync between the
+// owner's devices through the relay
+const draftSchema = `
+	CREATE TABLE IF NOT EXISTS drafts (
+		id TEXT PRIMARY KEY,
+		kind INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		tags TEXT NOT NULL,
+		publish_at INTEGER,
+		version INTEGER NOT NULL DEFAULT 1,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		published_id TEXT,
+		error TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_drafts_due ON drafts(publish_at) WHERE published_id IS NULL;
+`
+
+// draftCheckInterval is how often scheduled drafts are checked
+const draftCheckInterval = 30 * time.Second
+
+// draft is an unsigned event the owner is working on
+type draft struct {
+	ID          string     `json:"id"`
+	Kind        int        `json:"kind"`
+	Content     string     `json:"content"`
+	Tags        [][]string `json:"tags"`
+	PublishAt   *int64     `json:"publish_at"`
+	Version     int        `json:"version"`
+	CreatedAt   int64      `json:"created_at"`
+	UpdatedAt   int64      `json:"updated_at"`
+	PublishedID string     `json:"published_id,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Status      string     `json:"status"`
+}
+
+// draftStatus derives a draft's status: draft, scheduled, published or failed
+func draftStatus(d *draft) string {
+	switch {
+	case d.PublishedID != "":
+		return "published"
+	case d.Error != "":
+		return "failed"
+	case d.PublishAt != nil:
+		return "scheduled"
+	default:
+		return "draft"
+	}
+}
+
+// errDraftPublished is returned when publishing a draft a second time
+var errDraftPublished = errors.New("draft was already published")
+
+// publishingDrafts serializes publishing, so a draft the scheduler and the
+// owner publish at the same moment goes out once
+var publishingDrafts sync.Mutex
+
+// scanDrafts reads drafts from a query selecting draftColumns
+func scanDrafts(rows *sql.Rows) []*draft {
+	drafts := []*draft{}
+	for rows.Next() {
+		var d draft
+		var tags string
+		var publishedID sql.NullString
+		if rows.Scan(&d.ID, &d.Kind, &d.Content, &tags, &d.PublishAt, &d.Version,
+			&d.CreatedAt, &d.UpdatedAt, &publishedID, &d.Error) != nil {
+			continue
+		}
+		json.Unmarshal([]byte(tags), &d.Tags)
+		if d.Tags == nil {
+			d.Tags = [][]string{}
+		}
+		d.PublishedID = publishedID.String
+		d.Status = draftStatus(&d)
+		drafts = append(drafts, &d)
+	}
+	return drafts
+}
+
+const draftColumns = "id, kind, content, tags, publish_at, version, created_at, updated_at, published_id, error"
+
+// loadDraft returns a draft, or nil when there is none with that ID
+func (r *Relay) loadDraft(id string) (*draft, error) {
+	rows, err := r.db.Query("SELECT "+draftColumns+" FROM drafts WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if drafts := scanDrafts(rows); len(drafts) > 0 {
+		return drafts[0], nil
+	}
+	return nil, nil
+}
+
+// publishDraft publishes a draft as a new event, signed with the owner key
+// unless the owner's client sent the signed event itself
+func (r *Relay) publishDraft(d *draft, signed *Event) (*Event, error) {
+	publishingDrafts.Lock()
+	defer publishingDrafts.Unlock()
+
+	var published sql.NullString
+	r.db.QueryRow("SELECT published_id FROM drafts WHERE id = ?", d.ID).Scan(&published)
+	if published.Valid {
+		return nil, errDraftPublished
+	}
+
+	event := signed
+	if event == nil {
+		if r.owner == nil {
+			return nil, fmt.Errorf("cannot sign: OWNER_SIGNING_KEY is not set")
+		}
+		event = &Event{CreatedAt: time.Now().Unix(), Kind: d.Kind, Tags: d.Tags, Content: d.Content}
+		if err := r.owner.sign(event); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := event.Verify(); err != nil {
+			return nil, err
+		}
+		if event.PubKey != r.cfg.OwnerPubkey || event.Kind != d.Kind || event.Content != d.Content {
+			return nil, fmt.Errorf("signed event does not match the draft")
+		}
+	}
+
+	if err := r.publishLocal(event); err != nil {
+		r.db.Exec("UPDATE drafts SET error = ? WHERE id = ?", err.Error(), d.ID)
+		return nil, err
+	}
+	r.db.Exec("UPDATE drafts SET published_id = ?, error = '', updated_at = ? WHERE id = ?", event.ID, time.Now().Unix(), d.ID)
+	return event, nil
+}
+
+// runDraftScheduler publishes scheduled drafts once they are due. Scheduling
+// needs the owner key, so nothing runs without one.
+func (r *Relay) runDraftScheduler() {
+	if r.owner == nil {
+		return
+	}
+	for {
+		rows, err := r.db.Query("SELECT "+draftColumns+" FROM drafts WHERE publish_at <= ? AND published_id IS NULL AND error = ''",
+			time.Now().Unix())
+		if err == nil {
+			due := scanDrafts(rows)
+			rows.Close()
+			for _, d := range due {
+				if event, err := r.publishDraft(d, nil); err != nil {
+					log.Printf("❌ Scheduled draft %s failed: %v", d.ID, err)
+				} else {
+					log.Printf("🗓️  Published scheduled draft %s as %s", d.ID, event.ID[:8])
+				}
+			}
+		}
+		time.Sleep(draftCheckInterval)
+	}
+}
+
+// draftRequest is the editable part of a draft
+type draftRequest struct {
+	Kind      *int       `json:"kind"`
+	Content   string     `json:"content"`
+	Tags      [][]string `json:"tags"`
+	PublishAt *int64     `json:"publish_at"`
+	Version   int        `json:"version"` // when set, the edit fails if the draft changed since
+}
+
+// bindDraft parses and checks a draft request, answering 400 itself on failure
+func bindDraft(c *gin.Context) (*draftRequest, bool) {
+	var req draftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid draft: " + err.Error()})
+		return nil, false
+	}
+	if req.Kind == nil {
+		kind := 1
+		req.Kind = &kind
+	}
+	if req.Tags == nil {
+		req.Tags = [][]string{}
+	}
+	if !relay.kinds.accepts(*req.Kind) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("kind %d is not accepted by this relay", *req.Kind)})
+		return nil, false
+	}
+	if len(req.Content) > relay.cfg.MaxEventBytes {
+		c.JSON(400, gin.H{"error": "content is too large"})
+		return nil, false
+	}
+	if req.PublishAt != nil && relay.owner == nil {
+		c.JSON(400, gin.H{"error": "scheduling needs OWNER_SIGNING_KEY to sign the event"})
+		return nil, false
+	}
+	return &req, true
+}
+
+// handleListDrafts lists drafts, most recently edited first; ?status= narrows
+// the list to draft, scheduled, published or failed
+func handleListDrafts(c *gin.Context) {
+	rows, err := relay.db.Query("SELECT " + draftColumns + " FROM drafts ORDER BY updated_at DESC")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	drafts := []*draft{}
+	for _, d := range scanDrafts(rows) {
+		if status := c.Query("status"); status == "" || d.Status == status {
+			drafts = append(drafts, d)
+		}
+	}
+	c.JSON(200, gin.H{"drafts": drafts})
+}
+
+// handleCreateDraft saves a new draft
+func handleCreateDraft(c *gin.Context) {
+	req, ok := bindDraft(c)
+	if !ok {
+		return
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	tags, _ := json.Marshal(req.Tags)
+	now := time.Now().Unix()
+	if _, err := relay.db.Exec(`INSERT INTO drafts (id, kind, content, tags, publish_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, id, *req.Kind, req.Content, string(tags), req.PublishAt, now, now); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	d, _ := relay.loadDraft(id)
+	c.JSON(201, d)
+}
+
+// handleGetDraft returns one draft
+func handleGetDraft(c *gin.Context) {
+	d, err := relay.loadDraft(c.Param("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if d == nil {
+		c.JSON(404, gin.H{"error": "draft not found"})
+		return
+	}
+	c.JSON(200, d)
+}
+
+// handleUpdateDraft replaces a draft's kind, content, tags and schedule. With
+// a version, an edit made on another device in the meantime is not
+// overwritten: the request fails with 409 and the current draft.
+func handleUpdateDraft(c *gin.Context) {
+	req, ok := bindDraft(c)
+	if !ok {
+		return
+	}
+	d, err := relay.loadDraft(c.Param("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if d == nil {
+		c.JSON(404, gin.H{"error": "draft not found"})
+		return
+	}
+	if d.PublishedID != "" {
+		c.JSON(409, gin.H{"error": errDraftPublished.Error(), "draft": d})
+		return
+	}
+
+	tags, _ := json.Marshal(req.Tags)
+	query := `UPDATE drafts SET kind = ?, content = ?, tags = ?, publish_at = ?, version = version + 1,
+		updated_at = ?, error = '' WHERE id = ? AND published_id IS NULL`
+	args := []interface{}{*req.Kind, req.Content, string(tags), req.PublishAt, time.Now().Unix(), d.ID}
+	if req.Version > 0 {
+		query += " AND version = ?"
+		args = append(args, req.Version)
+	}
+	result, err := relay.db.Exec(query, args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	d, _ = relay.loadDraft(d.ID)
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(409, gin.H{"error": fmt.Sprintf("draft changed since version %d", req.Version), "draft": d})
+		return
+	}
+	c.JSON(200, d)
+}
+
+// handleDeleteDraft deletes a draft
+func handleDeleteDraft(c *gin.Context) {
+	result, err := relay.db.Exec("DELETE FROM drafts WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	n, _ := result.RowsAffected()
+	c.JSON(200, gin.H{"deleted": n > 0})
+}
+
+// handlePublishDraft publishes a draft now. The body may carry the event as
+// signed by the owner's client ({"event": {...}}); otherwise the relay signs
+// it with OWNER_SIGNING_KEY.
+func handlePublishDraft(c *gin.Context) {
+	d, err := relay.loadDraft(c.Param("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if d == nil {
+		c.JSON(404, gin.H{"error": "draft not found"})
+		return
+	}
+
+	var req struct {
+		Event *Event `json:"event"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "body must be empty or {\"event\": {...}}"})
+			return
+		}
+	}
+	if req.Event == nil && relay.owner == nil {
+		c.JSON(400, gin.H{"error": "no OWNER_SIGNING_KEY: sign the event on the client and send it as {\"event\": {...}}"})
+		return
+	}
+
+	event, err := relay.publishDraft(d, req.Event)
+	if err == errDraftPublished {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(currentAdmin(c), "draft_publish", []string{event.ID}, nil, d.ID)
+	c.JSON(200, gin.H{"published": true, "event": event})
+}
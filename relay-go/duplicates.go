@@ -0,0 +1,180 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math/bits"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const simhashSchema = `
+	CREATE TABLE IF NOT EXISTS note_simhashes (
+		event_id TEXT PRIMARY KEY,
+		kind INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		simhash INTEGER NOT NULL
+	);
+`
+
+// simhashKinds are the owner's note kinds checked for near-duplicates
+var simhashKinds = map[int]bool{1: true, 30023: true}
+
+// simhashFeatures splits content into lowercase words and word bigrams
+func simhashFeatures(content string) []string {
+	words := strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	features := make([]string, 0, len(words)*2)
+	features = append(features, words...)
+	for i := 0; i+1 < len(words); i++ {
+		features = append(features, words[i]+" "+words[i+1])
+	}
+	return features
+}
+
+// simhash computes a 64-bit similarity hash: near-identical texts differ in few bits
+func simhash(content string) uint64 {
+	var weights [64]int
+	for _, feature := range simhashFeatures(content) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		for i := 0; i < 64; i++ {
+			if sum&(1<<uint(i)) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+
+	var result uint64
+	for i := 0; i < 64; i++ {
+		if weights[i] > 0 {
+			result |= 1 << uint(i)
+		}
+	}
+	return result
+}
+
+// indexSimhash records the simhash of an owner note
+func (r *Relay) indexSimhash(db sqlExecer, event *Event) error {
+	if event.PubKey != r.cfg.OwnerPubkey || !simhashKinds[event.Kind] {
+		return nil
+	}
+
+	_, err := db.Exec(
+		"INSERT OR REPLACE INTO note_simhashes (event_id, kind, created_at, simhash) VALUES (?, ?, ?, ?)",
+		event.ID, event.Kind, event.CreatedAt, int64(simhash(event.Content)),
+	)
+	return err
+}
+
+// backfillSimhashes hashes owner notes stored before the index existed
+func (r *Relay) backfillSimhashes() {
+	if r.cfg.OwnerPubkey == "" {
+		return
+	}
+
+	var indexed int
+	r.db.QueryRow("SELECT COUNT(*) FROM note_simhashes").Scan(&indexed)
+	if indexed > 0 {
+		return
+	}
+
+	count := 0
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query(
+			"SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE pubkey = ? AND kind IN (1, 30023)",
+			r.cfg.OwnerPubkey,
+		)
+		if err != nil {
+			continue
+		}
+		events := scanEvents(rows)
+		rows.Close()
+
+		for i := range events {
+			if err := r.indexSimhash(r.db, &events[i]); err != nil {
+				log.Printf("❌ Failed to index simhash for %s: %v", events[i].ID[:8], err)
+				continue
+			}
+			count++
+		}
+	}
+
+	if count > 0 {
+		log.Printf("🔎 Indexed simhashes for %d owner notes", count)
+	}
+}
+
+// similarNote is an earlier owner note close to checked content
+type similarNote struct {
+	EventID    string  `json:"event_id"`
+	Kind       int     `json:"kind"`
+	CreatedAt  int64   `json:"created_at"`
+	Distance   int     `json:"distance"`
+	Similarity float64 `json:"similarity"`
+}
+
+// findNearDuplicates returns owner notes within the Hamming distance threshold
+func (r *Relay) findNearDuplicates(content string) ([]similarNote, error) {
+	target := simhash(content)
+
+	rows, err := r.db.Query("SELECT event_id, kind, created_at, simhash FROM note_simhashes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []similarNote{}
+	for rows.Next() {
+		var note similarNote
+		var hash int64
+		if err := rows.Scan(&note.EventID, &note.Kind, &note.CreatedAt, &hash); err != nil {
+			continue
+		}
+
+		note.Distance = bits.OnesCount64(target ^ uint64(hash))
+		if note.Distance <= r.cfg.DuplicateThreshold {
+			note.Similarity = 1 - float64(note.Distance)/64
+			matches = append(matches, note)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].CreatedAt > matches[j].CreatedAt
+	})
+	return matches, nil
+}
+
+// handleDuplicateCheck warns publishing tools about near-identical earlier notes
+func handleDuplicateCheck(c *gin.Context) {
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+		c.JSON(400, gin.H{"error": "content is required"})
+		return
+	}
+
+	matches, err := relay.findNearDuplicates(req.Content)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"duplicate": len(matches) > 0,
+		"threshold": relay.cfg.DuplicateThreshold,
+		"matches":   matches,
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The relay serves the same store on two WebSocket endpoints, so it can be a
+// public showcase and a private inbox at once. The public endpoints (/ and
+// /ws) can be narrowed to RELAY_PUBLIC_KINDS and made read-only with
+// RELAY_PUBLIC_READ_ONLY; /ws-private needs NIP-42 authentication before
+// anything else and has full access.
+
+// endpointPolicy restricts connections to the public endpoints
+type endpointPolicy struct {
+	// kinds are the only kinds served publicly; empty serves every kind
+	kinds    map[int]bool
+	readOnly bool
+}
+
+// newEndpointPolicy builds the public endpoint policy from RELAY_PUBLIC_KINDS
+// and RELAY_PUBLIC_READ_ONLY
+func newEndpointPolicy(cfg *Config) (*endpointPolicy, error) {
+	policy := &endpointPolicy{kinds: map[int]bool{}, readOnly: cfg.PublicReadOnly}
+	for _, spec := range cfg.PublicKinds {
+		kind, err := strconv.Atoi(strings.TrimSpace(spec))
+		if err != nil || kind < 0 {
+			return nil, fmt.Errorf("invalid kind %q in RELAY_PUBLIC_KINDS", spec)
+		}
+		policy.kinds[kind] = true
+	}
+	return policy, nil
+}
+
+// restricted reports whether the public endpoints differ from /ws-private
+func (p *endpointPolicy) restricted() bool {
+	return p.readOnly || len(p.kinds) > 0
+}
+
+// handlePrivateWebSocket serves /ws-private
+func handlePrivateWebSocket(c *gin.Context) {
+	serveWebSocket(c, true)
+}
+
+// endpointRejection returns why an event cannot be published on the
+// connection's endpoint, or ""
+func (c *Client) endpointRejection(event *Event) string {
+	if c.private {
+		if c.authedPubkey() == "" {
+			return "auth-required: /ws-private only accepts events from authenticated users"
+		}
+		return ""
+	}
+	p := c.Relay.endpoints
+	if p.readOnly {
+		return "blocked: this endpoint is read-only; publish through /ws-private"
+	}
+	if len(p.kinds) > 0 && !p.kinds[event.Kind] {
+		return fmt.Sprintf("blocked: kind %d is not accepted on this endpoint; publish through /ws-private", event.Kind)
+	}
+	return ""
+}
+
+// endpointFilters narrows REQ and COUNT filters to what the connection's
+// endpoint serves, and returns why none are left to serve, if so. Filters
+// without kinds ask for the public kinds; filters for other kinds are dropped.
+func (c *Client) endpointFilters(filters []Filter) ([]Filter, string) {
+	if c.private {
+		if c.authedPubkey() == "" {
+			return nil, "auth-required: /ws-private only serves authenticated users"
+		}
+		return filters, ""
+	}
+	p := c.Relay.endpoints
+	if len(p.kinds) == 0 || len(filters) == 0 {
+		return filters, ""
+	}
+
+	public := make([]int, 0, len(p.kinds))
+	for kind := range p.kinds {
+		public = append(public, kind)
+	}
+	sort.Ints(public)
+
+	narrowed := make([]Filter, 0, len(filters))
+	for _, filter := range filters {
+		if len(filter.Kinds) == 0 {
+			filter.Kinds = public
+			narrowed = append(narrowed, filter)
+			continue
+		}
+		var kinds []int
+		for _, kind := range filter.Kinds {
+			if p.kinds[kind] {
+				kinds = append(kinds, kind)
+			}
+		}
+		if len(kinds) > 0 {
+			filter.Kinds = kinds
+			narrowed = append(narrowed, filter)
+		}
+	}
+	if len(narrowed) == 0 {
+		return nil, "restricted: these kinds are not served on this endpoint"
+	}
+	return narrowed, ""
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// NIP-40: an event with an "expiration" tag stops being served once that
+// time has passed, and a sweeper deletes it later. Until it is swept, queries
+// skip it through the expiration index, which only holds events that carry
+// the tag. Events that have already expired are refused.
+
+// expirationSchema indexes the expiration time of events that have one; it is
+// one of the eventIndexes
+const expirationSchema = `
+	CREATE TABLE IF NOT EXISTS event_expirations (
+		event_id TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_expirations_at ON event_expirations(expires_at);
+`
+
+// expiresAt returns an event's expiration time, if it has a valid one
+func expiresAt(event *Event) (int64, bool) {
+	value := event.TagValue("expiration")
+	if value == "" {
+		return 0, false
+	}
+	at, err := strconv.ParseInt(value, 10, 64)
+	return at, err == nil
+}
+
+// isExpired reports whether an event's expiration time has passed
+func isExpired(event *Event) bool {
+	at, ok := expiresAt(event)
+	return ok && at <= time.Now().Unix()
+}
+
+// indexExpiration records when an event expires
+func indexExpiration(db sqlExecer, event *Event) error {
+	at, ok := expiresAt(event)
+	if !ok {
+		return nil
+	}
+	_, err := db.Exec("INSERT OR REPLACE INTO event_expirations (event_id, expires_at) VALUES (?, ?)", event.ID, at)
+	return err
+}
+
+// unexpiredCondition is the WHERE clause that hides expired events from queries
+func unexpiredCondition() (string, []interface{}) {
+	return "id NOT IN (SELECT event_id FROM event_expirations WHERE expires_at <= ?)", []interface{}{time.Now().Unix()}
+}
+
+// sweepExpired deletes the events whose expiration time has passed
+func (r *Relay) sweepExpired() (int64, error) {
+	return r.deleteEvents("id IN (SELECT event_id FROM event_expirations WHERE expires_at <= ?)", time.Now().Unix())
+}
+
+// runExpirationSweeper deletes expired events, and expired cached copies,
+// every RELAY_EXPIRATION_SWEEP
+func (r *Relay) runExpirationSweeper() {
+	if r.cfg.ExpirationSweep <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(r.cfg.ExpirationSweep)
+		r.sweepCache()
+
+		removed, err := r.sweepExpired()
+		if err != nil {
+			log.Printf("❌ Expiration sweep failed: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("⌛ Deleted %d expired events", removed)
+		}
+	}
+}
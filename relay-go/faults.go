@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Fault injection exercises the relay's resilience paths (notification
+// retries, send backpressure, session resumption) in integration tests. It is
+// only armed with RELAY_FAULTS=true and must never be enabled in production.
+// Every fault draws from its own generator seeded with RELAY_FAULT_SEED, so a
+// test replaying the same traffic sees the same faults.
+
+// errInjectedDrop is returned for a webhook delivery dropped on purpose
+var errInjectedDrop = errors.New("dropped by fault injection")
+
+// faultDice is a seeded random source for one kind of fault
+type faultDice struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newFaultDice(seed int64) *faultDice {
+	return &faultDice{rng: rand.New(rand.NewSource(seed))}
+}
+
+// roll reports whether a fault with the given percent chance fires
+func (d *faultDice) roll(percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rng.Intn(100) < percent
+}
+
+// duration returns a random duration in [0, max)
+func (d *faultDice) duration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Duration(d.rng.Int63n(int64(max)))
+}
+
+// faultInjector holds the configured faults and counts those injected
+type faultInjector struct {
+	seed              int64
+	dbLatency         time.Duration
+	dbJitter          time.Duration
+	webhookDropPct    int
+	disconnectPct     int
+	latencyDice       *faultDice
+	webhookDice       *faultDice
+	disconnectDice    *faultDice
+	delayed           int64
+	droppedWebhooks   int64
+	disconnectedConns int64
+}
+
+// newFaultInjector returns the injector, or nil unless RELAY_FAULTS is set
+func newFaultInjector(cfg *Config) *faultInjector {
+	if !cfg.Faults {
+		return nil
+	}
+	f := &faultInjector{
+		seed:           cfg.FaultSeed,
+		dbLatency:      cfg.FaultDBLatency,
+		dbJitter:       cfg.FaultDBJitter,
+		webhookDropPct: cfg.FaultWebhookDrop,
+		disconnectPct:  cfg.FaultDisconnect,
+		latencyDice:    newFaultDice(cfg.FaultSeed),
+		webhookDice:    newFaultDice(cfg.FaultSeed + 1),
+		disconnectDice: newFaultDice(cfg.FaultSeed + 2),
+	}
+	log.Printf("⚠️  FAULT INJECTION IS ON (seed %d): db latency %v+%v, %d%% webhooks dropped, %d%% messages disconnect",
+		f.seed, f.dbLatency, f.dbJitter, f.webhookDropPct, f.disconnectPct)
+	return f
+}
+
+// dbDelay stalls a database read or write
+func (f *faultInjector) dbDelay() {
+	if f == nil || (f.dbLatency <= 0 && f.dbJitter <= 0) {
+		return
+	}
+	atomic.AddInt64(&f.delayed, 1)
+	time.Sleep(f.dbLatency + f.latencyDice.duration(f.dbJitter))
+}
+
+// dropWebhook reports whether an outgoing webhook delivery should fail
+func (f *faultInjector) dropWebhook() bool {
+	if f == nil || !f.webhookDice.roll(f.webhookDropPct) {
+		return false
+	}
+	atomic.AddInt64(&f.droppedWebhooks, 1)
+	return true
+}
+
+// dropConnection reports whether a client should lose its connection before
+// its next message is handled
+func (f *faultInjector) dropConnection() bool {
+	if f == nil || !f.disconnectDice.roll(f.disconnectPct) {
+		return false
+	}
+	atomic.AddInt64(&f.disconnectedConns, 1)
+	return true
+}
+
+// stats reports the configured faults and how many were injected
+func (f *faultInjector) stats() gin.H {
+	if f == nil {
+		return gin.H{"enabled": false}
+	}
+	return gin.H{
+		"enabled":              true,
+		"seed":                 f.seed,
+		"db_latency_ms":        f.dbLatency.Milliseconds(),
+		"db_jitter_ms":         f.dbJitter.Milliseconds(),
+		"webhook_drop_percent": f.webhookDropPct,
+		"disconnect_percent":   f.disconnectPct,
+		"delayed_queries":      atomic.LoadInt64(&f.delayed),
+		"dropped_webhooks":     atomic.LoadInt64(&f.droppedWebhooks),
+		"disconnected_clients": atomic.LoadInt64(&f.disconnectedConns),
+	}
+}
+
+// handleFaultStats reports injected faults, so a test can assert on them
+func handleFaultStats(c *gin.Context) {
+	c.JSON(200, relay.faults.stats())
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Feature flags gate experimental subsystems at runtime, so they can be
+// rolled out and rolled back without a redeploy. A flag's state comes from,
+// in order: an admin toggle stored in the database, RELAY_FEATURES, and the
+// flag's default.
+
+const featureFlagSchema = `
+	CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT PRIMARY KEY,
+		enabled INTEGER NOT NULL,
+		updated_by TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+`
+
+// featureFlag is one gated subsystem
+type featureFlag struct {
+	Name        string
+	Description string
+	// NIPs are advertised in the NIP-11 document while the flag is on
+	NIPs []int
+	// Available is false for subsystems this build does not include yet;
+	// their flags are reserved and cannot be turned on
+	Available bool
+}
+
+// featureRegistry lists every flag the relay knows
+var featureRegistry = []featureFlag{
+	{Name: "binary_protocol", Description: "CBOR WebSocket subprotocol (nostr.cbor)", Available: true},
+	{Name: "negentropy", Description: "NIP-77 negentropy set reconciliation", NIPs: []int{77}},
+	{Name: "groups", Description: "NIP-29 relay-based groups", NIPs: []int{29}, Available: true},
+	{Name: "federation", Description: "Event federation with peer relays"},
+	{Name: "paid_access", Description: "Paid write access"},
+}
+
+// featureFlags holds the state of every flag
+type featureFlags struct {
+	db         *sql.DB
+	configured map[string]bool // from RELAY_FEATURES and the flags' defaults
+	mu         sync.RWMutex
+	overrides  map[string]bool // admin toggles
+}
+
+// findFeature returns a registered flag by name
+func findFeature(name string) (featureFlag, bool) {
+	for _, f := range featureRegistry {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return featureFlag{}, false
+}
+
+// parseFeatures reads RELAY_FEATURES entries such as "negentropy=on" or
+// "binary_protocol=off" on top of the flags' defaults. binary_protocol
+// defaults to RELAY_BINARY_PROTOCOL.
+func parseFeatures(cfg *Config) (map[string]bool, error) {
+	configured := map[string]bool{"binary_protocol": cfg.BinaryProtocol}
+	for _, entry := range cfg.Features {
+		name, value, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		flag, known := findFeature(name)
+		if !known {
+			return nil, fmt.Errorf("RELAY_FEATURES: unknown feature %q", name)
+		}
+		on := true
+		if found {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case "on", "true", "1":
+			case "off", "false", "0":
+				on = false
+			default:
+				return nil, fmt.Errorf("RELAY_FEATURES: %s must be on or off", name)
+			}
+		}
+		if on && !flag.Available {
+			return nil, fmt.Errorf("RELAY_FEATURES: %s is not available in this build", name)
+		}
+		configured[name] = on
+	}
+	return configured, nil
+}
+
+// loadFeatureFlags reads the configured flags and the stored admin toggles
+func loadFeatureFlags(cfg *Config, db *sql.DB) (*featureFlags, error) {
+	configured, err := parseFeatures(cfg)
+	if err != nil {
+		return nil, err
+	}
+	flags := &featureFlags{db: db, configured: configured, overrides: map[string]bool{}}
+
+	rows, err := db.Query("SELECT name, enabled FROM feature_flags")
+	if missingTable(err) {
+		return flags, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var enabled bool
+		if rows.Scan(&name, &enabled) != nil {
+			continue
+		}
+		// Toggles for flags this build no longer has, or cannot enable, are ignored
+		if flag, known := findFeature(name); known && (flag.Available || !enabled) {
+			flags.overrides[name] = enabled
+		}
+	}
+	return flags, rows.Err()
+}
+
+// enabled reports whether a feature is on
+func (f *featureFlags) enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if on, set := f.overrides[name]; set {
+		return on
+	}
+	return f.configured[name]
+}
+
+// set stores an admin toggle for a feature
+func (f *featureFlags) set(name string, enabled bool, by string) error {
+	if _, err := f.db.Exec("INSERT OR REPLACE INTO feature_flags (name, enabled, updated_by, updated_at) VALUES (?, ?, ?, ?)",
+		name, enabled, by, time.Now().Unix()); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.overrides[name] = enabled
+	f.mu.Unlock()
+	return nil
+}
+
+// reset drops the admin toggle of a feature, returning it to its configured state
+func (f *featureFlags) reset(name string) error {
+	if _, err := f.db.Exec("DELETE FROM feature_flags WHERE name = ?", name); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	delete(f.overrides, name)
+	f.mu.Unlock()
+	return nil
+}
+
+// nips returns the NIPs of the enabled features
+func (f *featureFlags) nips() []int {
+	var nips []int
+	for _, flag := range featureRegistry {
+		if f.enabled(flag.Name) {
+			nips = append(nips, flag.NIPs...)
+		}
+	}
+	return nips
+}
+
+// list describes every flag and where its state comes from
+func (f *featureFlags) list() []gin.H {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	list := []gin.H{}
+	for _, flag := range featureRegistry {
+		enabled, source := f.configured[flag.Name], "config"
+		if on, set := f.overrides[flag.Name]; set {
+			enabled, source = on, "admin"
+		}
+		nips := flag.NIPs
+		if nips == nil {
+			nips = []int{}
+		}
+		list = append(list, gin.H{
+			"name":        flag.Name,
+			"description": flag.Description,
+			"enabled":     enabled,
+			"source":      source,
+			"available":   flag.Available,
+			"nips":        nips,
+		})
+	}
+	return list
+}
+
+// handleListFeatures lists the feature flags
+func handleListFeatures(c *gin.Context) {
+	c.JSON(200, gin.H{"features": relay.features.list()})
+}
+
+// handleSetFeature turns a feature on or off at runtime: {"enabled": true}
+func handleSetFeature(c *gin.Context) {
+	name := c.Param("name")
+	flag, known := findFeature(name)
+	if !known {
+		c.JSON(404, gin.H{"error": "unknown feature"})
+		return
+	}
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		c.JSON(400, gin.H{"error": "body must be {\"enabled\": true|false}"})
+		return
+	}
+	if *req.Enabled && !flag.Available {
+		c.JSON(409, gin.H{"error": name + " is not available in this build"})
+		return
+	}
+
+	admin := currentAdmin(c)
+	if err := relay.features.set(name, *req.Enabled, admin.Name); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(admin, "feature_set", nil, nil, fmt.Sprintf("%s=%v", name, *req.Enabled))
+	c.JSON(200, gin.H{"name": name, "enabled": *req.Enabled})
+}
+
+// handleResetFeature drops the admin toggle of a feature
+func handleResetFeature(c *gin.Context) {
+	name := c.Param("name")
+	if _, known := findFeature(name); !known {
+		c.JSON(404, gin.H{"error": "unknown feature"})
+		return
+	}
+	if err := relay.features.reset(name); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(currentAdmin(c), "feature_reset", nil, nil, name)
+	c.JSON(200, gin.H{"name": name, "enabled": relay.features.enabled(name)})
+}
+
+// supportedNIPs returns the NIPs the relay always supports plus those of
+// enabled features, sorted
+func (r *Relay) supportedNIPs(base []int) []int {
+	nips := append([]int{}, base...)
+	seen := map[int]bool{}
+	for _, n := range nips {
+		seen[n] = true
+	}
+	for _, n := range r.features.nips() {
+		if !seen[n] {
+			seen[n] = true
+			nips = append(nips, n)
+		}
+	}
+	sort.Ints(nips)
+	return nips
+}
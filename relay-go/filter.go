@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// filterFields mirrors Filter without its JSON methods
+type filterFields Filter
+
+// UnmarshalJSON decodes a NIP-01 filter, collecting "#<letter>" keys into Tags
+func (f *Filter) UnmarshalJSON(data []byte) error {
+	var fields filterFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key, value := range raw {
+		if len(key) != 2 || key[0] != '#' {
+			continue
+		}
+		var values []string
+		if err := json.Unmarshal(value, &values); err != nil {
+			return fmt.Errorf("%s must be an array of strings", key)
+		}
+		if fields.Tags == nil {
+			fields.Tags = map[string][]string{}
+		}
+		fields.Tags[key[1:]] = values
+	}
+
+	*f = Filter(fields)
+	return nil
+}
+
+// MarshalJSON encodes a filter with its tag constraints as "#<letter>" keys,
+// so persisted sessions and subscription stats keep them
+func (f Filter) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(filterFields(f))
+	if err != nil || len(f.Tags) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, values := range f.Tags {
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		fields["#"+name] = encoded
+	}
+	return json.Marshal(fields)
+}
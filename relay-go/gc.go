@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gcBatch is how many derived rows are checked against the event tables at once
+const gcBatch = 500
+
+// derivedStore is a table in the main database whose rows describe a stored
+// event; rows outlive their event when it is deleted, replaced or pruned
+type derivedStore struct {
+	table  string
+	column string // column holding the event ID
+}
+
+// derivedStores lists every table keyed by event ID
+var derivedStores = []derivedStore{
+	{"note_simhashes", "event_id"},
+	{"crossposts", "event_id"},
+	{"mirror_deliveries", "event_id"},
+	{"event_labels", "event_id"},
+	{"event_notes", "event_id"},
+}
+
+// forgetEvent removes the derived rows of a deleted event
+func (r *Relay) forgetEvent(eventID string) {
+	for _, store := range derivedStores {
+		if _, err := r.db.Exec("DELETE FROM "+store.table+" WHERE "+store.column+" = ?", eventID); err != nil {
+			log.Printf("❌ Failed to clean %s for %s: %v", store.table, eventID, err)
+		}
+	}
+}
+
+// storedEventIDs returns which of the given IDs exist in any event database
+func (r *Relay) storedEventIDs(ids []string) (map[string]bool, error) {
+	found := make(map[string]bool, len(ids))
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query("SELECT id FROM relay_events WHERE id IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if rows.Scan(&id) == nil {
+				found[id] = true
+			}
+		}
+		rows.Close()
+	}
+	return found, nil
+}
+
+// collectStore deletes the rows of a derived store whose event no longer exists
+func (r *Relay) collectStore(store derivedStore) (int64, error) {
+	var removed int64
+	after := ""
+	for {
+		rows, err := r.db.Query("SELECT DISTINCT "+store.column+" FROM "+store.table+
+			" WHERE "+store.column+" > ? ORDER BY "+store.column+" LIMIT ?", after, gcBatch)
+		if err != nil {
+			return removed, err
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return removed, nil
+		}
+		after = ids[len(ids)-1]
+
+		stored, err := r.storedEventIDs(ids)
+		if err != nil {
+			return removed, err
+		}
+		for _, id := range ids {
+			if stored[id] {
+				continue
+			}
+			result, err := r.db.Exec("DELETE FROM "+store.table+" WHERE "+store.column+" = ?", id)
+			if err != nil {
+				return removed, err
+			}
+			n, _ := result.RowsAffected()
+			removed += n
+		}
+	}
+}
+
+// collectSketches drops COUNT sketches for days before the oldest stored
+// event, left behind when partitions are pruned by retention. Daily aggregates
+// are kept on purpose: they are the analytics that outlive raw events.
+func (r *Relay) collectSketches() (int64, error) {
+	oldest := int64(-1)
+	for _, db := range r.eventDBs(nil, nil) {
+		var createdAt *int64
+		db.QueryRow("SELECT MIN(created_at) FROM relay_events").Scan(&createdAt)
+		if createdAt != nil && (oldest < 0 || *createdAt < oldest) {
+			oldest = *createdAt
+		}
+	}
+	if oldest < 0 {
+		return 0, nil
+	}
+
+	result, err := r.db.Exec("DELETE FROM count_sketches WHERE day < ?", eventDay(oldest))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// collectGarbage removes derived rows that no longer belong to a stored event
+// and returns how many rows each store lost
+func (r *Relay) collectGarbage() (map[string]int64, error) {
+	removed := map[string]int64{}
+	for _, store := range derivedStores {
+		n, err := r.collectStore(store)
+		removed[store.table] = n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	n, err := r.collectSketches()
+	removed["count_sketches"] = n
+	return removed, err
+}
+
+// runGarbageCollection collects orphaned derived rows every RELAY_GC_INTERVAL
+func (r *Relay) runGarbageCollection() {
+	if r.cfg.GCInterval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(r.cfg.GCInterval)
+
+		start := time.Now()
+		removed, err := r.collectGarbage()
+		if err != nil {
+			log.Printf("❌ Garbage collection failed: %v", err)
+			continue
+		}
+
+		var total int64
+		for _, n := range removed {
+			total += n
+		}
+		if total > 0 {
+			log.Printf("🧹 Removed %d orphaned derived rows in %v: %v", total, time.Since(start).Round(time.Millisecond), removed)
+		}
+	}
+}
+
+// handleGarbageCollection runs the garbage collector now
+func handleGarbageCollection(c *gin.Context) {
+	removed, err := relay.collectGarbage()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error(), "removed": removed})
+		return
+	}
+
+	var details []string
+	for table, n := range removed {
+		if n > 0 {
+			details = append(details, fmt.Sprintf("%s: %d", table, n))
+		}
+	}
+	sort.Strings(details)
+	relay.audit(currentAdmin(c), "gc", nil, nil, strings.Join(details, ", "))
+	c.JSON(200, gin.H{"removed": removed})
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NIP-34 git collaboration: repository announcements (30617), repository
+// state (30618), patches (1617) and their status events (1630-1633) are
+// indexed into typed tables, so the home page can showcase the owner's
+// repositories and the patches sent to them. Each table is one of the
+// eventIndexes; lists of values are stored as JSON arrays.
+
+const repoSchema = `
+	CREATE TABLE IF NOT EXISTS event_repos (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		d TEXT NOT NULL,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL,
+		web TEXT NOT NULL,
+		clone TEXT NOT NULL,
+		relays TEXT NOT NULL,
+		maintainers TEXT NOT NULL,
+		hashtags TEXT NOT NULL,
+		earliest_commit TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_repos_address ON event_repos(pubkey, d, created_at);
+`
+
+const repoStateSchema = `
+	CREATE TABLE IF NOT EXISTS event_repo_states (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		d TEXT NOT NULL,
+		head TEXT NOT NULL,
+		refs TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_repo_states_address ON event_repo_states(pubkey, d, created_at);
+`
+
+// patchSchema has a row per repository a patch is addressed to
+const patchSchema = `
+	CREATE TABLE IF NOT EXISTS event_patches (
+		event_id TEXT NOT NULL,
+		repo TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		subject TEXT NOT NULL,
+		commit_id TEXT NOT NULL,
+		root INTEGER NOT NULL,
+		reply_to TEXT NOT NULL,
+		PRIMARY KEY (event_id, repo)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_patches_repo ON event_patches(repo, created_at);
+`
+
+const gitStatusSchema = `
+	CREATE TABLE IF NOT EXISTS event_git_statuses (
+		event_id TEXT PRIMARY KEY,
+		target_id TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		kind INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_git_statuses_target ON event_git_statuses(target_id);
+`
+
+// gitStatuses names the NIP-34 status kinds
+var gitStatuses = map[int]string{1630: "open", 1631: "applied", 1632: "closed", 1633: "draft"}
+
+// repoInfo is a repository announcement with its latest state
+type repoInfo struct {
+	EventID        string            `json:"event_id"`
+	PubKey         string            `json:"pubkey"`
+	CreatedAt      int64             `json:"created_at"`
+	D              string            `json:"d"`
+	Address        string            `json:"address"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description"`
+	Web            []string          `json:"web"`
+	Clone          []string          `json:"clone"`
+	Relays         []string          `json:"relays"`
+	Maintainers    []string          `json:"maintainers"`
+	Hashtags       []string          `json:"hashtags"`
+	EarliestCommit string            `json:"earliest_commit"`
+	Head           string            `json:"head,omitempty"`
+	Refs           map[string]string `json:"refs,omitempty"`
+}
+
+// patchInfo is a patch with its current status
+type patchInfo struct {
+	EventID   string `json:"event_id"`
+	PubKey    string `json:"pubkey"`
+	CreatedAt int64  `json:"created_at"`
+	Repo      string `json:"repo"`
+	Subject   string `json:"subject"`
+	Commit    string `json:"commit"`
+	Root      bool   `json:"root"`
+	ReplyTo   string `json:"reply_to,omitempty"`
+	Status    string `json:"status"`
+}
+
+// tagList returns the values of every tag with the given name; tags such as
+// clone and web may also carry several values in one tag
+func tagList(event *Event, name string) []string {
+	values := []string{}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			values = append(values, tag[1:]...)
+		}
+	}
+	return values
+}
+
+func jsonList(values []string) string {
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// indexRepo records a repository announcement
+func indexRepo(db sqlExecer, event *Event) error {
+	if event.Kind != 30617 {
+		return nil
+	}
+	var earliest string
+	for _, tag := range event.Tags {
+		if len(tag) >= 3 && tag[0] == "r" && tag[2] == "euc" {
+			earliest = tag[1]
+		}
+	}
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_repos
+		(event_id, pubkey, created_at, d, name, description, web, clone, relays, maintainers, hashtags, earliest_commit)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, event.PubKey, event.CreatedAt, event.TagValue("d"), event.TagValue("name"), event.TagValue("description"),
+		jsonList(tagList(event, "web")), jsonList(tagList(event, "clone")), jsonList(tagList(event, "relays")),
+		jsonList(tagList(event, "maintainers")), jsonList(tagList(event, "t")), earliest)
+	return err
+}
+
+// indexRepoState records the branch and tag heads a repository state announces
+func indexRepoState(db sqlExecer, event *Event) error {
+	if event.Kind != 30618 {
+		return nil
+	}
+	refs := map[string]string{}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && strings.HasPrefix(tag[0], "refs/") {
+			refs[tag[0]] = tag[1]
+		}
+	}
+	data, _ := json.Marshal(refs)
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_repo_states (event_id, pubkey, created_at, d, head, refs)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		event.ID, event.PubKey, event.CreatedAt, event.TagValue("d"),
+		strings.TrimPrefix(event.TagValue("HEAD"), "ref: "), string(data))
+	return err
+}
+
+// patchSubject takes the subject line of a git format-patch email
+func patchSubject(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if subject, ok := strings.CutPrefix(line, "Subject: "); ok {
+			return strings.TrimSpace(subject)
+		}
+	}
+	return ""
+}
+
+// indexPatch records a patch under every repository it is addressed to
+func indexPatch(db sqlExecer, event *Event) error {
+	if event.Kind != 1617 {
+		return nil
+	}
+	// A patch that replies to nothing starts a series even without t root
+	replyTo := strings.ToLower(event.TagValue("e"))
+	root := replyTo == ""
+	for _, tag := range event.Tags {
+		root = root || (len(tag) >= 2 && tag[0] == "t" && tag[1] == "root")
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "a" {
+			continue
+		}
+		addr, ok := parseAddress(tag[1])
+		if !ok || addr.Kind != 30617 {
+			continue
+		}
+		if _, err := db.Exec(`INSERT OR IGNORE INTO event_patches
+			(event_id, repo, pubkey, created_at, subject, commit_id, root, reply_to) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			event.ID, addr.String(), event.PubKey, event.CreatedAt, patchSubject(event.Content),
+			event.TagValue("commit"), root, replyTo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexGitStatus records a status event against the patch it marks, the e
+// tag marked "root"
+func indexGitStatus(db sqlExecer, event *Event) error {
+	if gitStatuses[event.Kind] == "" {
+		return nil
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 4 && tag[0] == "e" && tag[3] == "root" && isHex64(tag[1]) {
+			_, err := db.Exec(`INSERT OR IGNORE INTO event_git_statuses (event_id, target_id, pubkey, created_at, kind)
+				VALUES (?, ?, ?, ?, ?)`, event.ID, strings.ToLower(tag[1]), event.PubKey, event.CreatedAt, event.Kind)
+			return err
+		}
+	}
+	return nil
+}
+
+// queryRepos returns the latest announcement of each matching repository,
+// with the latest state its author published
+func queryRepos(where string, args []interface{}) ([]repoInfo, error) {
+	latest := map[string]repoInfo{}
+	err := queryPayloads(`SELECT event_id, pubkey, created_at, d, name, description, web, clone, relays,
+		maintainers, hashtags, earliest_commit FROM event_repos WHERE `+where, args, func(rows *sql.Rows) {
+		var r repoInfo
+		var web, clone, relays, maintainers, hashtags string
+		if rows.Scan(&r.EventID, &r.PubKey, &r.CreatedAt, &r.D, &r.Name, &r.Description,
+			&web, &clone, &relays, &maintainers, &hashtags, &r.EarliestCommit) != nil {
+			return
+		}
+		json.Unmarshal([]byte(web), &r.Web)
+		json.Unmarshal([]byte(clone), &r.Clone)
+		json.Unmarshal([]byte(relays), &r.Relays)
+		json.Unmarshal([]byte(maintainers), &r.Maintainers)
+		json.Unmarshal([]byte(hashtags), &r.Hashtags)
+		r.Address = address{Kind: 30617, Pubkey: r.PubKey, D: r.D}.String()
+		if r.CreatedAt >= latest[r.Address].CreatedAt {
+			latest[r.Address] = r
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]repoInfo, 0, len(latest))
+	for _, r := range latest {
+		var stateAt int64
+		queryPayloads("SELECT created_at, head, refs FROM event_repo_states WHERE pubkey = ? AND d = ?",
+			[]interface{}{r.PubKey, r.D}, func(rows *sql.Rows) {
+				var createdAt int64
+				var head, refs string
+				if rows.Scan(&createdAt, &head, &refs) == nil && createdAt > stateAt {
+					stateAt, r.Head, r.Refs = createdAt, head, nil
+					json.Unmarshal([]byte(refs), &r.Refs)
+				}
+			})
+		repos = append(repos, r)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].CreatedAt > repos[j].CreatedAt })
+	return repos, nil
+}
+
+// patchStatus returns the latest status of a patch set by its author or the
+// repository's owner and maintainers; a patch without one is open
+func patchStatus(patchID string, authorized map[string]bool) string {
+	status, statusAt := "open", int64(0)
+	queryPayloads("SELECT pubkey, created_at, kind FROM event_git_statuses WHERE target_id = ?",
+		[]interface{}{patchID}, func(rows *sql.Rows) {
+			var pubkey string
+			var createdAt int64
+			var kind int
+			if rows.Scan(&pubkey, &createdAt, &kind) == nil && authorized[pubkey] && createdAt >= statusAt {
+				status, statusAt = gitStatuses[kind], createdAt
+			}
+		})
+	return status
+}
+
+// queryPatches returns the patches addressed to a repository, newest first
+func queryPatches(repo repoInfo, where string, args []interface{}) ([]patchInfo, error) {
+	patches := []patchInfo{}
+	err := queryPayloads(`SELECT event_id, pubkey, created_at, repo, subject, commit_id, root, reply_to
+		FROM event_patches WHERE `+where, args, func(rows *sql.Rows) {
+		var p patchInfo
+		if rows.Scan(&p.EventID, &p.PubKey, &p.CreatedAt, &p.Repo, &p.Subject, &p.Commit, &p.Root, &p.ReplyTo) == nil {
+			patches = append(patches, p)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range patches {
+		authorized := map[string]bool{repo.PubKey: true, patches[i].PubKey: true}
+		for _, maintainer := range repo.Maintainers {
+			authorized[strings.ToLower(maintainer)] = true
+		}
+		patches[i].Status = patchStatus(patches[i].EventID, authorized)
+	}
+	sort.Slice(patches, func(i, j int) bool { return patches[i].CreatedAt > patches[j].CreatedAt })
+	return patches, nil
+}
+
+// repoFromPath finds the repository named by :pubkey (hex or npub) and :d
+func repoFromPath(c *gin.Context) (repoInfo, bool) {
+	pubkey, err := nostr.DecodePublicKey(c.Param("pubkey"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid pubkey"})
+		return repoInfo{}, false
+	}
+	repos, err := queryRepos("pubkey = ? AND d = ?", []interface{}{pubkey, c.Param("d")})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return repoInfo{}, false
+	}
+	if len(repos) == 0 {
+		c.JSON(404, gin.H{"error": "repository not found"})
+		return repoInfo{}, false
+	}
+	return repos[0], true
+}
+
+// handleRepos lists the latest announcement of each repository, newest
+// first; ?author= narrows it to one pubkey, e.g. the owner's
+func handleRepos(c *gin.Context) {
+	where, args := authorCondition(c, "1=1", []interface{}{})
+	repos, err := queryRepos(where, args)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"repos": repos})
+}
+
+// handleRepo returns one repository with its latest state and how many of
+// its root patches are in each status
+func handleRepo(c *gin.Context) {
+	repo, ok := repoFromPath(c)
+	if !ok {
+		return
+	}
+	patches, err := queryPatches(repo, "repo = ? AND root = 1", []interface{}{repo.Address})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	counts := map[string]int{}
+	for _, p := range patches {
+		counts[p.Status]++
+	}
+	c.JSON(200, gin.H{"repo": repo, "patches": counts})
+}
+
+// handleRepoPatches lists the patches sent to a repository, newest first.
+// ?status= narrows the list; ?all=true includes the follow-up patches of a
+// series, not only each series' root.
+func handleRepoPatches(c *gin.Context) {
+	repo, ok := repoFromPath(c)
+	if !ok {
+		return
+	}
+	where := "repo = ?"
+	if c.Query("all") != "true" {
+		where += " AND root = 1"
+	}
+	patches, err := queryPatches(repo, where, []interface{}{repo.Address})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := c.Query("status")
+	filtered := []patchInfo{}
+	for _, p := range patches {
+		if status == "" || p.Status == status {
+			filtered = append(filtered, p)
+		}
+	}
+	if limit := payloadLimit(c); len(filtered) > limit {
+		filtered = filtered[:limit]
+	}
+	c.JSON(200, gin.H{"repo": repo.Address, "patches": filtered})
+}
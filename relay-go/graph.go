@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/graph/export builds the owner's social graph from stored events
+// for tools like Gephi: who the owner follows, and who the owner mentions,
+// replies to, reacts to, reposts and zaps, and who does so to the owner.
+// Edges are directed and typed, weighted by how many events back them.
+
+// Edge types of the social graph
+const (
+	edgeFollow   = "follow"   // the owner's current contact list
+	edgeMention  = "mention"  // p tag on a note that is not a reply
+	edgeReply    = "reply"    // p tag on a reply
+	edgeReaction = "reaction" // kind 7
+	edgeRepost   = "repost"   // kind 6 or 16
+	edgeZap      = "zap"      // kind 9735 receipt, from the payer
+)
+
+// graphChunk bounds the pubkeys looked up per profile query
+const graphChunk = 500
+
+// graphEdge is a typed, weighted edge between two pubkeys
+type graphEdge struct {
+	Source string
+	Target string
+	Type   string
+	Weight int
+}
+
+// socialGraph is the owner's social graph; labels name the nodes that have
+// a stored profile
+type socialGraph struct {
+	Owner  string
+	Nodes  []string
+	Labels map[string]string
+	Edges  []graphEdge
+}
+
+// interactionType classifies an event between two pubkeys, or "" when it is
+// not an interaction
+func interactionType(event *Event) string {
+	switch event.Kind {
+	case 1:
+		if isReply(event) {
+			return edgeReply
+		}
+		return edgeMention
+	case 6, 16:
+		return edgeRepost
+	case 7:
+		return edgeReaction
+	case 9735:
+		return edgeZap
+	}
+	return ""
+}
+
+// buildSocialGraph gathers the owner's follows and the interactions between
+// the owner and others created in [since, until]
+func (r *Relay) buildSocialGraph(since, until int64) socialGraph {
+	owner := r.cfg.OwnerPubkey
+	weights := map[graphEdge]int{}
+	add := func(source, target, typ string) {
+		source, target = strings.ToLower(source), strings.ToLower(target)
+		if source == target || !isHex64(source) || !isHex64(target) {
+			return
+		}
+		weights[graphEdge{Source: source, Target: target, Type: typ}]++
+	}
+
+	limit := 1
+	if contacts := r.getMatchingEvents([]Filter{{Authors: []string{owner}, Kinds: []int{3}, Limit: &limit}}); len(contacts) > 0 {
+		for _, tag := range contacts[0].Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				add(owner, tag[1], edgeFollow)
+			}
+		}
+	}
+
+	// The owner's interactions with others
+	for _, event := range r.scanRange(since, until, "pubkey = ? AND kind IN (1, 6, 7, 16)", owner) {
+		typ := interactionType(&event)
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				add(owner, tag[1], typ)
+			}
+		}
+	}
+	for _, event := range r.scanRange(since, until, "kind = 9735 AND instr(tags, ?) > 0", tagNeedle("P", owner)) {
+		add(owner, event.TagValue("p"), edgeZap)
+	}
+
+	// Others' interactions with the owner
+	for _, event := range r.scanRange(since, until, "kind IN (1, 6, 7, 16, 9735) AND instr(tags, ?) > 0 AND pubkey != ?", tagNeedle("p", owner), owner) {
+		if event.Kind == 9735 {
+			if event.TagValue("p") == owner {
+				add(zapSender(&event), owner, edgeZap)
+			}
+			continue
+		}
+		add(event.PubKey, owner, interactionType(&event))
+	}
+
+	graph := socialGraph{Owner: owner}
+	nodes := map[string]bool{owner: true}
+	for edge, weight := range weights {
+		edge.Weight = weight
+		graph.Edges = append(graph.Edges, edge)
+		nodes[edge.Source], nodes[edge.Target] = true, true
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Type < b.Type
+	})
+	for pubkey := range nodes {
+		graph.Nodes = append(graph.Nodes, pubkey)
+	}
+	sort.Strings(graph.Nodes)
+	graph.Labels = r.profileNames(graph.Nodes)
+	return graph
+}
+
+// profileNames returns the display name, or else the name, from the stored
+// profiles of the pubkeys that have one
+func (r *Relay) profileNames(pubkeys []string) map[string]string {
+	names := map[string]string{}
+	for start := 0; start < len(pubkeys); start += graphChunk {
+		end := start + graphChunk
+		if end > len(pubkeys) {
+			end = len(pubkeys)
+		}
+		limit := end - start
+		for _, profile := range r.getMatchingEvents([]Filter{{Authors: pubkeys[start:end], Kinds: []int{0}, Limit: &limit}}) {
+			var metadata struct {
+				Name        string `json:"name"`
+				DisplayName string `json:"display_name"`
+			}
+			json.Unmarshal([]byte(profile.Content), &metadata)
+			if metadata.DisplayName != "" {
+				names[profile.PubKey] = metadata.DisplayName
+			} else if metadata.Name != "" {
+				names[profile.PubKey] = metadata.Name
+			}
+		}
+	}
+	return names
+}
+
+// label names a node by its profile, or by its npub
+func (g socialGraph) label(pubkey string) string {
+	if label := g.Labels[pubkey]; label != "" {
+		return label
+	}
+	if npub, err := nostr.EncodePublicKey(pubkey); err == nil {
+		return npub
+	}
+	return pubkey
+}
+
+// writeGraphML writes the graph as GraphML
+func (g socialGraph) writeGraphML(w io.Writer) {
+	escape := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="label" for="node" attr.name="label" attr.type="string"/>
+  <key id="owner" for="node" attr.name="owner" attr.type="boolean"/>
+  <key id="type" for="edge" attr.name="type" attr.type="string"/>
+  <key id="weight" for="edge" attr.name="weight" attr.type="int"/>
+  <graph id="social" edgedefault="directed">
+`)
+	for _, pubkey := range g.Nodes {
+		fmt.Fprintf(w, "    <node id=\"%s\"><data key=\"label\">%s</data><data key=\"owner\">%t</data></node>\n",
+			pubkey, escape(g.label(pubkey)), pubkey == g.Owner)
+	}
+	for i, e := range g.Edges {
+		fmt.Fprintf(w, "    <edge id=\"e%d\" source=\"%s\" target=\"%s\"><data key=\"type\">%s</data><data key=\"weight\">%d</data></edge>\n",
+			i, e.Source, e.Target, e.Type, e.Weight)
+	}
+	fmt.Fprint(w, "  </graph>\n</graphml>\n")
+}
+
+// dotQuote escapes text for a quoted DOT ID
+var dotQuote = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", "")
+
+// writeDOT writes the graph in Graphviz DOT
+func (g socialGraph) writeDOT(w io.Writer) {
+	fmt.Fprint(w, "digraph social {\n")
+	for _, pubkey := range g.Nodes {
+		fmt.Fprintf(w, "  %q [label=\"%s\"", pubkey, dotQuote.Replace(g.label(pubkey)))
+		if pubkey == g.Owner {
+			fmt.Fprint(w, ", owner=true")
+		}
+		fmt.Fprint(w, "];\n")
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(w, "  %q -> %q [type=%s, label=%s, weight=%d];\n", e.Source, e.Target, e.Type, e.Type, e.Weight)
+	}
+	fmt.Fprint(w, "}\n")
+}
+
+// writeCSV writes the edges as a Gephi edge table
+func (g socialGraph) writeCSV(w io.Writer) {
+	out := csv.NewWriter(w)
+	out.Write([]string{"Source", "Target", "Type", "Label", "Weight", "Source Label", "Target Label"})
+	for _, e := range g.Edges {
+		out.Write([]string{e.Source, e.Target, "Directed", e.Type, strconv.Itoa(e.Weight), g.label(e.Source), g.label(e.Target)})
+	}
+	out.Flush()
+}
+
+// handleGraphExport exports the owner's social graph as GraphML (the
+// default), DOT or CSV; ?since= and ?until= limit the interactions counted
+func handleGraphExport(c *gin.Context) {
+	if relay.cfg.OwnerPubkey == "" {
+		c.JSON(404, gin.H{"error": "no owner configured"})
+		return
+	}
+	since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+	until := time.Now().Unix()
+	if value := c.Query("until"); value != "" {
+		until, _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	format := c.DefaultQuery("format", "graphml")
+	var contentType string
+	var write func(socialGraph, io.Writer)
+	switch format {
+	case "graphml":
+		contentType, write = "application/graphml+xml", socialGraph.writeGraphML
+	case "dot":
+		contentType, write = "text/vnd.graphviz", socialGraph.writeDOT
+	case "csv":
+		contentType, write = "text/csv", socialGraph.writeCSV
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("unknown format %q (graphml, dot or csv)", format)})
+		return
+	}
+
+	graph := relay.buildSocialGraph(since, until)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="social-graph.%s"`, format))
+	write(graph, c.Writer)
+}
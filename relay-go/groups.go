@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+)
+
+// NIP-29 relay-based groups let the relay host small communities behind the
+// "groups" feature flag. Events for a group carry an h tag with its id. The
+// owner creates groups (kind 9007), and group admins moderate them with the
+// 9000-series events; the relay keeps the resulting state in relay_groups and
+// group_members and publishes it as kinds 39000-39002, signed with the relay
+// key. Only members may write to a group, and the events of a private group
+// are only sent to members who authenticated with NIP-42.
+
+// groupSchema holds the groups, their members and open invite codes
+const groupSchema = `
+	CREATE TABLE IF NOT EXISTS relay_groups (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		about TEXT NOT NULL,
+		picture TEXT NOT NULL,
+		private INTEGER NOT NULL,
+		closed INTEGER NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS group_members (
+		group_id TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		role TEXT NOT NULL,
+		added_at INTEGER NOT NULL,
+		PRIMARY KEY (group_id, pubkey)
+	);
+
+	CREATE TABLE IF NOT EXISTS group_invites (
+		group_id TEXT NOT NULL,
+		code TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (group_id, code)
+	);
+`
+
+// NIP-29 event kinds
+const (
+	kindGroupPutUser      = 9000
+	kindGroupRemoveUser   = 9001
+	kindGroupEditMetadata = 9002
+	kindGroupDeleteEvent  = 9005
+	kindGroupCreate       = 9007
+	kindGroupDelete       = 9008
+	kindGroupCreateInvite = 9009
+	kindGroupJoinRequest  = 9021
+	kindGroupLeaveRequest = 9022
+	kindGroupMetadata     = 39000
+	kindGroupAdmins       = 39001
+	kindGroupMembers      = 39002
+)
+
+// groupIDPattern is the id alphabet NIP-29 allows
+var groupIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// group is one group and its members by pubkey, mapped to their role
+type group struct {
+	ID      string
+	Name    string
+	About   string
+	Picture string
+	Private bool
+	Closed  bool
+	members map[string]string
+}
+
+// groupAdminRole may moderate a group; every other role is a plain member
+const groupAdminRole = "admin"
+
+// groupStore holds every group in memory for the EVENT and broadcast paths
+type groupStore struct {
+	db     *sql.DB
+	mu     sync.RWMutex
+	groups map[string]*group
+}
+
+// loadGroups reads the groups and their members
+func loadGroups(db *sql.DB) (*groupStore, error) {
+	s := &groupStore{db: db, groups: map[string]*group{}}
+	rows, err := db.Query("SELECT id, name, about, picture, private, closed FROM relay_groups")
+	if missingTable(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		g := &group{members: map[string]string{}}
+		if rows.Scan(&g.ID, &g.Name, &g.About, &g.Picture, &g.Private, &g.Closed) == nil {
+			s.groups[g.ID] = g
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT group_id, pubkey, role FROM group_members")
+	if missingTable(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var groupID, pubkey, role string
+		if rows.Scan(&groupID, &pubkey, &role) == nil && s.groups[groupID] != nil {
+			s.groups[groupID].members[pubkey] = role
+		}
+	}
+	return s, rows.Err()
+}
+
+// eventGroup returns the group an event belongs to: its h tag, or the d tag
+// of the relay's member and admin lists
+func eventGroup(event *Event) string {
+	if event.Kind == kindGroupAdmins || event.Kind == kindGroupMembers {
+		return event.TagValue("d")
+	}
+	return event.TagValue("h")
+}
+
+// lookup returns a copy of a group, without its members, and the role of
+// pubkey in it ("" for non-members)
+func (s *groupStore) lookup(id, pubkey string) (*group, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g := s.groups[id]
+	if g == nil {
+		return nil, ""
+	}
+	copied := *g
+	copied.members = nil
+	return &copied, g.members[pubkey]
+}
+
+// carriesInviteCode reports whether an event holds a group invite code: an
+// invite (9009), or a join request (9021) that used one
+func carriesInviteCode(event *Event) bool {
+	return event.Kind == kindGroupCreateInvite || (event.Kind == kindGroupJoinRequest && event.TagValue("code") != "")
+}
+
+// canReadGroup reports whether an event may be sent to a connection
+// authenticated as authed: events of a private group only go to its members
+// and the owner, and events holding an invite code only to the group's
+// admins, the owner and their author
+func (r *Relay) canReadGroup(event *Event, authed string) bool {
+	id := eventGroup(event)
+	if id == "" {
+		return true
+	}
+	g, role := r.groups.lookup(id, authed)
+	isOwner := authed != "" && authed == r.cfg.OwnerPubkey
+	if carriesInviteCode(event) {
+		return isOwner || role == groupAdminRole || (authed != "" && authed == event.PubKey)
+	}
+	return g == nil || !g.Private || role != "" || isOwner
+}
+
+// privateGroupCondition is an SQL condition leaving out the events of private
+// groups, for public endpoints that read derived tables; column names the
+// event ID. It is "" when there are no private groups.
+func (r *Relay) privateGroupCondition(column string) (string, []interface{}) {
+	var ids []interface{}
+	r.groups.mu.RLock()
+	for id, g := range r.groups.groups {
+		if g.Private {
+			ids = append(ids, id)
+		}
+	}
+	r.groups.mu.RUnlock()
+	if len(ids) == 0 {
+		return "", nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	return column + " NOT IN (SELECT event_id FROM event_tags WHERE name = 'h' AND value IN (" + placeholders + "))", ids
+}
+
+// checkGroupEvent returns why an event is refused under the group rules, or ""
+func (r *Relay) checkGroupEvent(event *Event) string {
+	if !r.features.enabled("groups") {
+		return ""
+	}
+	if event.Kind >= kindGroupMetadata && event.Kind <= 39003 {
+		return "blocked: group metadata is published by the relay"
+	}
+	id := event.TagValue("h")
+	if id == "" {
+		if event.Kind >= 9000 && event.Kind <= 9022 {
+			return "invalid: group events need an h tag"
+		}
+		return ""
+	}
+
+	g, role := r.groups.lookup(id, event.PubKey)
+	isOwner := event.PubKey == r.cfg.OwnerPubkey
+	switch {
+	case event.Kind == kindGroupCreate:
+		if !isOwner {
+			return "restricted: only the relay owner can create groups"
+		}
+		if !groupIDPattern.MatchString(id) {
+			return "invalid: group ids are 1-64 characters of a-z, 0-9, - and _"
+		}
+		if g != nil {
+			return "duplicate: group already exists"
+		}
+		return ""
+	case g == nil:
+		return "invalid: unknown group"
+	case event.Kind == kindGroupJoinRequest:
+		if role != "" {
+			return "duplicate: already a member"
+		}
+		return ""
+	case event.Kind == kindGroupLeaveRequest:
+		if role == "" {
+			return "invalid: not a member"
+		}
+		return ""
+	case event.Kind >= 9000 && event.Kind <= 9020:
+		if role != groupAdminRole && !isOwner {
+			return "restricted: only group admins can moderate the group"
+		}
+		if !isOwner && r.touchesAdmin(id, event) {
+			return "restricted: only the relay owner can remove or demote a group admin"
+		}
+		return ""
+	case role == "" && !isOwner:
+		return "restricted: not a member of this group"
+	}
+	return ""
+}
+
+// touchesAdmin reports whether a put-user event demotes a group admin or a
+// remove-user event removes one
+func (r *Relay) touchesAdmin(id string, event *Event) bool {
+	if event.Kind != kindGroupPutUser && event.Kind != kindGroupRemoveUser {
+		return false
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		if _, role := r.groups.lookup(id, tag[1]); role != groupAdminRole {
+			continue
+		}
+		if event.Kind == kindGroupRemoveUser || len(tag) < 3 || tag[2] != groupAdminRole {
+			return true
+		}
+	}
+	return false
+}
+
+// applyGroupEvent updates the groups after a stored group event and
+// republishes what changed
+func (r *Relay) applyGroupEvent(event *Event) {
+	if !r.features.enabled("groups") || event.Kind < 9000 || event.Kind > 9022 {
+		return
+	}
+	id := event.TagValue("h")
+	var err error
+	switch event.Kind {
+	case kindGroupCreate:
+		err = r.groups.create(id, event.PubKey)
+	case kindGroupPutUser:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && isHex64(tag[1]) {
+				role := "member"
+				if len(tag) >= 3 && tag[2] != "" {
+					role = tag[2]
+				}
+				if err = r.groups.putMember(id, tag[1], role); err != nil {
+					break
+				}
+			}
+		}
+	case kindGroupRemoveUser:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				if err = r.groups.removeMember(id, tag[1]); err != nil {
+					break
+				}
+			}
+		}
+	case kindGroupEditMetadata:
+		err = r.groups.editMetadata(id, event)
+	case kindGroupDeleteEvent:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "e" {
+				if _, err = r.deleteEvents("id = ? AND id IN (SELECT event_id FROM event_tags WHERE name = 'h' AND value = ?)", tag[1], id); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("❌ Failed to delete an event of group %s: %v", id, err)
+		}
+		return
+	case kindGroupDelete:
+		if err = r.groups.remove(id); err == nil {
+			_, err = r.deleteEvents("pubkey = ? AND kind IN (?, ?, ?) AND id IN (SELECT event_id FROM event_tags WHERE name = 'd' AND value = ?)",
+				r.identity.pubkey, kindGroupMetadata, kindGroupAdmins, kindGroupMembers, id)
+		}
+		if err != nil {
+			log.Printf("❌ Failed to delete group %s: %v", id, err)
+		}
+		return
+	case kindGroupCreateInvite:
+		if code := event.TagValue("code"); code != "" {
+			_, err = r.db.Exec("INSERT OR IGNORE INTO group_invites (group_id, code, created_by, created_at) VALUES (?, ?, ?, ?)",
+				id, code, event.PubKey, time.Now().Unix())
+		}
+		if err != nil {
+			log.Printf("❌ Failed to store invite for group %s: %v", id, err)
+		}
+		return
+	case kindGroupJoinRequest:
+		if !r.groups.admits(id, event.TagValue("code")) {
+			return // left for an admin to approve with a put-user event
+		}
+		err = r.groups.putMember(id, event.PubKey, "member")
+	case kindGroupLeaveRequest:
+		err = r.groups.removeMember(id, event.PubKey)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to apply group event %s: %v", event.ID[:8], err)
+		return
+	}
+	r.publishGroupState(id)
+}
+
+// create stores a new private, closed group with its creator as admin
+func (s *groupStore) create(id, creator string) error {
+	now := time.Now().Unix()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO relay_groups (id, name, about, picture, private, closed, created_by, created_at) VALUES (?, ?, '', '', 1, 1, ?, ?)",
+		id, id, creator, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO group_members (group_id, pubkey, role, added_at) VALUES (?, ?, ?, ?)",
+		id, creator, groupAdminRole, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.groups[id] = &group{ID: id, Name: id, Private: true, Closed: true, members: map[string]string{creator: groupAdminRole}}
+	s.mu.Unlock()
+	return nil
+}
+
+// remove deletes a group, its members and its invites
+func (s *groupStore) remove(id string) error {
+	for _, table := range []string{"group_members", "group_invites"} {
+		if _, err := s.db.Exec("DELETE FROM "+table+" WHERE group_id = ?", id); err != nil {
+			return err
+		}
+	}
+	if _, err := s.db.Exec("DELETE FROM relay_groups WHERE id = ?", id); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.groups, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// putMember adds a member or changes their role
+func (s *groupStore) putMember(id, pubkey, role string) error {
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO group_members (group_id, pubkey, role, added_at) VALUES (?, ?, ?, ?)",
+		id, pubkey, role, time.Now().Unix()); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if g := s.groups[id]; g != nil {
+		g.members[pubkey] = role
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// removeMember drops a member
+func (s *groupStore) removeMember(id, pubkey string) error {
+	if _, err := s.db.Exec("DELETE FROM group_members WHERE group_id = ? AND pubkey = ?", id, pubkey); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if g := s.groups[id]; g != nil {
+		delete(g.members, pubkey)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// editMetadata applies the name, about, picture and public/private and
+// open/closed tags of an edit-metadata event
+func (s *groupStore) editMetadata(id string, event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.groups[id]
+	if g == nil {
+		return fmt.Errorf("unknown group %s", id)
+	}
+	edited := *g
+	for _, tag := range event.Tags {
+		switch {
+		case len(tag) >= 2 && tag[0] == "name":
+			edited.Name = tag[1]
+		case len(tag) >= 2 && tag[0] == "about":
+			edited.About = tag[1]
+		case len(tag) >= 2 && tag[0] == "picture":
+			edited.Picture = tag[1]
+		case len(tag) >= 1 && tag[0] == "private":
+			edited.Private = true
+		case len(tag) >= 1 && tag[0] == "public":
+			edited.Private = false
+		case len(tag) >= 1 && tag[0] == "closed":
+			edited.Closed = true
+		case len(tag) >= 1 && tag[0] == "open":
+			edited.Closed = false
+		}
+	}
+	if _, err := s.db.Exec("UPDATE relay_groups SET name = ?, about = ?, picture = ?, private = ?, closed = ? WHERE id = ?",
+		edited.Name, edited.About, edited.Picture, edited.Private, edited.Closed, id); err != nil {
+		return err
+	}
+	*g = edited
+	return nil
+}
+
+// admits reports whether a join request is accepted without an admin: the
+// group is open, or the request carries an invite code of the group
+func (s *groupStore) admits(id, code string) bool {
+	g, _ := s.lookup(id, "")
+	if g == nil {
+		return false
+	}
+	if !g.Closed {
+		return true
+	}
+	if code == "" {
+		return false
+	}
+	var n int
+	s.db.QueryRow("SELECT COUNT(*) FROM group_invites WHERE group_id = ? AND code = ?", id, code).Scan(&n)
+	return n > 0
+}
+
+// publishGroupState publishes a group's metadata (39000), admins (39001) and
+// members (39002), signed with the relay key; unchanged ones are kept
+func (r *Relay) publishGroupState(id string) {
+	r.groups.mu.RLock()
+	g := r.groups.groups[id]
+	if g == nil {
+		r.groups.mu.RUnlock()
+		return
+	}
+	metadata := nostr.NewEvent(kindGroupMetadata, "", []string{"d", id}, []string{"name", g.Name})
+	if g.About != "" {
+		metadata.AddTag("about", g.About)
+	}
+	if g.Picture != "" {
+		metadata.AddTag("picture", g.Picture)
+	}
+	if g.Private {
+		metadata.AddTag("private")
+	} else {
+		metadata.AddTag("public")
+	}
+	if g.Closed {
+		metadata.AddTag("closed")
+	} else {
+		metadata.AddTag("open")
+	}
+
+	pubkeys := make([]string, 0, len(g.members))
+	for pubkey := range g.members {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+	admins := nostr.NewEvent(kindGroupAdmins, "", []string{"d", id})
+	members := nostr.NewEvent(kindGroupMembers, "", []string{"d", id})
+	for _, pubkey := range pubkeys {
+		if role := g.members[pubkey]; role == groupAdminRole {
+			admins.AddTag("p", pubkey, role)
+		}
+		members.AddTag("p", pubkey)
+	}
+	r.groups.mu.RUnlock()
+
+	for _, event := range []*Event{metadata, admins, members} {
+		if _, err := r.publishIfChanged(event); err != nil {
+			log.Printf("❌ Failed to publish kind %d of group %s: %v", event.Kind, id, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NIP-84 highlights (kind 9802) are indexed with the source they quote, so
+// the home site can show what the owner highlighted, grouped by article,
+// note or web page.
+
+const highlightSchema = `
+	CREATE TABLE IF NOT EXISTS event_highlights (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		source_type TEXT NOT NULL,
+		source TEXT NOT NULL,
+		text TEXT NOT NULL,
+		context TEXT NOT NULL,
+		comment TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_highlights_source ON event_highlights(source_type, source);
+`
+
+// highlightInfo is one highlighted passage
+type highlightInfo struct {
+	EventID   string `json:"event_id"`
+	PubKey    string `json:"pubkey"`
+	CreatedAt int64  `json:"created_at"`
+	Text      string `json:"text"`
+	Context   string `json:"context,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+// highlightSource is a source with the passages highlighted from it
+type highlightSource struct {
+	Type       string          `json:"type"` // a (address), e (event) or r (URL)
+	Source     string          `json:"source"`
+	Latest     int64           `json:"latest"`
+	Highlights []highlightInfo `json:"highlights"`
+}
+
+// highlightSourceOf returns what a highlight quotes: a nostr address or event
+// before a URL, skipping tags marked as mentions in the comment
+func highlightSourceOf(event *Event) (string, string, bool) {
+	for _, name := range []string{"a", "e", "r"} {
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != name || tag[1] == "" {
+				continue
+			}
+			if len(tag) >= 3 && tag[len(tag)-1] == "mention" {
+				continue
+			}
+			switch name {
+			case "a":
+				if addr, ok := parseAddress(tag[1]); ok {
+					return "a", addr.String(), true
+				}
+			case "e":
+				if isHex64(tag[1]) {
+					return "e", strings.ToLower(tag[1]), true
+				}
+			case "r":
+				return "r", tag[1], true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// indexHighlight records a highlight against its source; highlights without
+// one are left out
+func indexHighlight(db sqlExecer, event *Event) error {
+	if event.Kind != 9802 {
+		return nil
+	}
+	sourceType, source, ok := highlightSourceOf(event)
+	if !ok {
+		return nil
+	}
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_highlights (event_id, pubkey, created_at, source_type, source, text, context, comment)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, event.ID, event.PubKey, event.CreatedAt, sourceType, source,
+		event.Content, event.TagValue("context"), event.TagValue("comment"))
+	return err
+}
+
+// handleHighlights lists highlights grouped by source, the most recently
+// highlighted source first. It shows the owner's highlights unless ?author=
+// names someone else; ?source= keeps one URL, event ID or address.
+func handleHighlights(c *gin.Context) {
+	where, args := "1=1", []interface{}{}
+	if c.Query("author") == "" && relay.cfg.OwnerPubkey != "" {
+		where += " AND pubkey = ?"
+		args = append(args, relay.cfg.OwnerPubkey)
+	}
+	where, args = authorCondition(c, where, args)
+	if source := c.Query("source"); source != "" {
+		where += " AND source = ?"
+		args = append(args, source)
+	}
+
+	groups := map[[2]string]*highlightSource{}
+	err := queryPayloads("SELECT event_id, pubkey, created_at, source_type, source, text, context, comment FROM event_highlights WHERE "+where,
+		args, func(rows *sql.Rows) {
+			var h highlightInfo
+			var key [2]string
+			if rows.Scan(&h.EventID, &h.PubKey, &h.CreatedAt, &key[0], &key[1], &h.Text, &h.Context, &h.Comment) != nil {
+				return
+			}
+			group := groups[key]
+			if group == nil {
+				group = &highlightSource{Type: key[0], Source: key[1]}
+				groups[key] = group
+			}
+			group.Highlights = append(group.Highlights, h)
+			if h.CreatedAt > group.Latest {
+				group.Latest = h.CreatedAt
+			}
+		})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	sources := make([]highlightSource, 0, len(groups))
+	for _, group := range groups {
+		// Passages read best in the order they were highlighted
+		sort.Slice(group.Highlights, func(i, j int) bool { return group.Highlights[i].CreatedAt < group.Highlights[j].CreatedAt })
+		sources = append(sources, *group)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Latest > sources[j].Latest })
+	if limit := payloadLimit(c); len(sources) > limit {
+		sources = sources[:limit]
+	}
+	c.JSON(200, gin.H{"sources": sources})
+}
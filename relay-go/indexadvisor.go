@@ -0,0 +1,459 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The index advisor watches which filter shapes REQs use and how long they
+// take, and recommends composite indexes on relay_events for the slow,
+// frequent ones. With RELAY_ADAPTIVE_INDEXES it also creates them, and drops
+// the ones it created once their shape has gone unused for a while. Indexes
+// it manages are named idx_auto_*; the schema's own indexes are never touched.
+
+// autoIndexPrefix names the indexes the advisor creates
+const autoIndexPrefix = "idx_auto_"
+
+// indexAdvisorInterval is how often adaptive indexing runs
+const indexAdvisorInterval = 10 * time.Minute
+
+// queryShape is which columns a filter constrains
+type queryShape struct {
+	Authors bool
+	Kinds   bool
+	Time    bool
+	Address bool
+	Tags    bool
+}
+
+// shapeOf returns a filter's shape
+func shapeOf(filter Filter) queryShape {
+	_, address := filter.Tags["a"]
+	tags := len(filter.Tags) > 1 || (len(filter.Tags) == 1 && !address)
+	return queryShape{
+		Authors: len(filter.Authors) > 0,
+		Kinds:   len(filter.Kinds) > 0,
+		Time:    filter.Since != nil || filter.Until != nil,
+		Address: address,
+		Tags:    tags,
+	}
+}
+
+// String names a shape, e.g. "authors+kinds+time"
+func (s queryShape) String() string {
+	var parts []string
+	if s.Authors {
+		parts = append(parts, "authors")
+	}
+	if s.Kinds {
+		parts = append(parts, "kinds")
+	}
+	if s.Time {
+		parts = append(parts, "time")
+	}
+	if s.Address {
+		parts = append(parts, "#a")
+	}
+	if s.Tags {
+		parts = append(parts, "tags")
+	}
+	if len(parts) == 0 {
+		return "all"
+	}
+	return strings.Join(parts, "+")
+}
+
+// indexColumns returns the relay_events index that serves a shape best, or
+// nil when the schema's indexes already do. Equality columns come first and
+// created_at last, since every query orders by it.
+func (s queryShape) indexColumns() []string {
+	if s.Address || s.Tags {
+		// Tag filters are answered from event_atags and event_tags
+		return nil
+	}
+	switch {
+	case s.Authors && s.Kinds:
+		return []string{"pubkey", "kind", "created_at"}
+	case s.Authors:
+		return []string{"pubkey", "created_at"}
+	case s.Kinds:
+		return []string{"kind", "created_at"}
+	}
+	return nil
+}
+
+// shapeStats accumulates the queries of one shape
+type shapeStats struct {
+	queries  int64
+	total    time.Duration
+	max      time.Duration
+	rows     int64
+	lastSeen time.Time
+}
+
+// indexAdvisor records query shapes and manages idx_auto_* indexes
+type indexAdvisor struct {
+	minQueries int64
+	slow       time.Duration
+	idle       time.Duration
+	adaptive   bool
+	started    time.Time
+
+	mu     sync.Mutex
+	shapes map[queryShape]*shapeStats
+}
+
+// newIndexAdvisor creates the advisor from the configuration
+func newIndexAdvisor(cfg *Config) *indexAdvisor {
+	return &indexAdvisor{
+		minQueries: int64(cfg.IndexAdvisorMinQueries),
+		slow:       cfg.IndexAdvisorSlow,
+		idle:       cfg.AdaptiveIndexIdle,
+		adaptive:   cfg.AdaptiveIndexes,
+		started:    time.Now(),
+		shapes:     make(map[queryShape]*shapeStats),
+	}
+}
+
+// record adds one filter's query time and result size
+func (a *indexAdvisor) record(filter Filter, elapsed time.Duration, rows int) {
+	shape := shapeOf(filter)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.shapes[shape]
+	if s == nil {
+		s = &shapeStats{}
+		a.shapes[shape] = s
+	}
+	s.queries++
+	s.total += elapsed
+	s.rows += int64(rows)
+	s.lastSeen = time.Now()
+	if elapsed > s.max {
+		s.max = elapsed
+	}
+}
+
+// indexInfo is an index on relay_events
+type indexInfo struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Auto    bool     `json:"auto"`
+}
+
+// relayEventIndexes lists the indexes on relay_events in a database
+func relayEventIndexes(db *sql.DB) ([]indexInfo, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'relay_events' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+
+	var indexes []indexInfo
+	for _, name := range names {
+		cols, err := db.Query("SELECT name FROM pragma_index_info(?) ORDER BY seqno", name)
+		if err != nil {
+			return nil, err
+		}
+		info := indexInfo{Name: name, Auto: strings.HasPrefix(name, autoIndexPrefix)}
+		for cols.Next() {
+			var col string
+			if cols.Scan(&col) == nil {
+				info.Columns = append(info.Columns, col)
+			}
+		}
+		cols.Close()
+		indexes = append(indexes, info)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+	return indexes, nil
+}
+
+// coveredBy returns the index whose leading columns are columns, if any
+func coveredBy(indexes []indexInfo, columns []string) string {
+	for _, idx := range indexes {
+		if len(idx.Columns) < len(columns) {
+			continue
+		}
+		match := true
+		for i, col := range columns {
+			if idx.Columns[i] != col {
+				match = false
+				break
+			}
+		}
+		if match {
+			return idx.Name
+		}
+	}
+	return ""
+}
+
+// autoIndexName names the advisor's index on columns
+func autoIndexName(columns []string) string {
+	return autoIndexPrefix + strings.Join(columns, "_")
+}
+
+// indexRecommendation is an index the advisor suggests creating
+type indexRecommendation struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	SQL     string   `json:"sql"`
+	Shape   string   `json:"shape"`
+	Reason  string   `json:"reason"`
+}
+
+// createIndexSQL is the statement creating an advisor index
+func createIndexSQL(columns []string) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON relay_events(%s)", autoIndexName(columns), strings.Join(columns, ", "))
+}
+
+// shapeReport describes the queries of one shape
+type shapeReport struct {
+	Shape     string   `json:"shape"`
+	Queries   int64    `json:"queries"`
+	AvgMs     float64  `json:"avg_ms"`
+	MaxMs     float64  `json:"max_ms"`
+	AvgRows   float64  `json:"avg_rows"`
+	LastSeen  int64    `json:"last_seen"`
+	Index     []string `json:"index,omitempty"`
+	CoveredBy string   `json:"covered_by,omitempty"`
+}
+
+// advice holds the shapes seen, the recommendations derived from them, and
+// the advisor indexes whose shapes have gone idle
+type advice struct {
+	Shapes          []shapeReport         `json:"shapes"`
+	Recommendations []indexRecommendation `json:"recommendations"`
+	Idle            []string              `json:"idle"`
+}
+
+// advise compares the recorded shapes with the existing indexes
+func (a *indexAdvisor) advise(indexes []indexInfo) advice {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := advice{Shapes: []shapeReport{}, Recommendations: []indexRecommendation{}, Idle: []string{}}
+	wanted := map[string]bool{}
+	for shape, s := range a.shapes {
+		avg := s.total / time.Duration(s.queries)
+		report := shapeReport{
+			Shape:    shape.String(),
+			Queries:  s.queries,
+			AvgMs:    float64(avg.Microseconds()) / 1000,
+			MaxMs:    float64(s.max.Microseconds()) / 1000,
+			AvgRows:  float64(s.rows) / float64(s.queries),
+			LastSeen: s.lastSeen.Unix(),
+		}
+		columns := shape.indexColumns()
+		if columns != nil {
+			report.Index = columns
+			report.CoveredBy = coveredBy(indexes, columns)
+			if time.Since(s.lastSeen) < a.idle {
+				wanted[autoIndexName(columns)] = true
+			}
+			if report.CoveredBy == "" && s.queries >= a.minQueries && avg >= a.slow {
+				result.Recommendations = append(result.Recommendations, indexRecommendation{
+					Name:    autoIndexName(columns),
+					Columns: columns,
+					SQL:     createIndexSQL(columns),
+					Shape:   report.Shape,
+					Reason:  fmt.Sprintf("%d queries averaging %.1fms", s.queries, report.AvgMs),
+				})
+			}
+		}
+		result.Shapes = append(result.Shapes, report)
+	}
+	sort.Slice(result.Shapes, func(i, j int) bool { return result.Shapes[i].Queries > result.Shapes[j].Queries })
+	sort.Slice(result.Recommendations, func(i, j int) bool { return result.Recommendations[i].Name < result.Recommendations[j].Name })
+
+	// An index created in an earlier run counts as used until the advisor has
+	// watched for a full idle period
+	if time.Since(a.started) >= a.idle {
+		for _, idx := range indexes {
+			if idx.Auto && !wanted[idx.Name] {
+				result.Idle = append(result.Idle, idx.Name)
+			}
+		}
+	}
+	return result
+}
+
+// autoIndexes returns the advisor indexes present in any event database
+func (r *Relay) autoIndexes() (map[string][]string, error) {
+	auto := map[string][]string{}
+	for _, db := range r.eventDBs(nil, nil) {
+		indexes, err := relayEventIndexes(db)
+		if err != nil {
+			return nil, err
+		}
+		for _, idx := range indexes {
+			if idx.Auto {
+				auto[idx.Name] = idx.Columns
+			}
+		}
+	}
+	return auto, nil
+}
+
+// createAutoIndex creates an advisor index in every event database
+func (r *Relay) createAutoIndex(columns []string) error {
+	for _, db := range r.eventDBs(nil, nil) {
+		if _, err := db.Exec(createIndexSQL(columns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropAutoIndex drops an advisor index from every event database
+func (r *Relay) dropAutoIndex(name string) error {
+	for _, db := range r.eventDBs(nil, nil) {
+		if _, err := db.Exec("DROP INDEX IF EXISTS " + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentAdvice reports on the newest event database, which partitioned
+// relays query the most
+func (r *Relay) currentAdvice() ([]indexInfo, advice, error) {
+	dbs := r.eventDBs(nil, nil)
+	if len(dbs) == 0 {
+		return []indexInfo{}, r.indexes.advise(nil), nil
+	}
+	indexes, err := relayEventIndexes(dbs[0])
+	if err != nil {
+		return nil, advice{}, err
+	}
+	return indexes, r.indexes.advise(indexes), nil
+}
+
+// runAdaptiveIndexing creates recommended indexes, drops idle ones, and
+// extends advisor indexes to partitions created since the last run
+func (r *Relay) runAdaptiveIndexing() {
+	if !r.indexes.adaptive {
+		return
+	}
+
+	for {
+		time.Sleep(indexAdvisorInterval)
+
+		_, advice, err := r.currentAdvice()
+		if err != nil {
+			log.Printf("❌ Index advisor failed: %v", err)
+			continue
+		}
+		for _, rec := range advice.Recommendations {
+			start := time.Now()
+			if err := r.createAutoIndex(rec.Columns); err != nil {
+				log.Printf("❌ Failed to create index %s: %v", rec.Name, err)
+				continue
+			}
+			log.Printf("📇 Created index %s for %s in %v", rec.Name, rec.Reason, time.Since(start).Round(time.Millisecond))
+		}
+		for _, name := range advice.Idle {
+			if err := r.dropAutoIndex(name); err != nil {
+				log.Printf("❌ Failed to drop index %s: %v", name, err)
+				continue
+			}
+			log.Printf("📇 Dropped idle index %s", name)
+		}
+
+		auto, err := r.autoIndexes()
+		if err != nil {
+			log.Printf("❌ Index advisor failed: %v", err)
+			continue
+		}
+		for _, columns := range auto {
+			if err := r.createAutoIndex(columns); err != nil {
+				log.Printf("❌ Failed to extend index to new partitions: %v", err)
+			}
+		}
+	}
+}
+
+// handleIndexAdvice shows query shapes, the indexes on relay_events and the
+// recommended indexes
+func handleIndexAdvice(c *gin.Context) {
+	indexes, advice, err := relay.currentAdvice()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{
+		"adaptive":        relay.indexes.adaptive,
+		"indexes":         indexes,
+		"shapes":          advice.Shapes,
+		"recommendations": advice.Recommendations,
+		"idle":            advice.Idle,
+	})
+}
+
+// handleCreateIndex creates a recommended index by name, e.g.
+// idx_auto_pubkey_kind_created_at
+func handleCreateIndex(c *gin.Context) {
+	name := c.Param("name")
+	var columns []string
+	for _, shape := range allQueryShapes() {
+		if cols := shape.indexColumns(); cols != nil && autoIndexName(cols) == name {
+			columns = cols
+		}
+	}
+	if columns == nil {
+		c.JSON(404, gin.H{"error": "not an index the advisor can create"})
+		return
+	}
+
+	start := time.Now()
+	if err := relay.createAutoIndex(columns); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(currentAdmin(c), "index_create", nil, nil, name)
+	c.JSON(200, gin.H{"name": name, "columns": columns, "took_ms": time.Since(start).Milliseconds()})
+}
+
+// handleDropIndex drops an advisor index; the schema's indexes cannot be dropped
+func handleDropIndex(c *gin.Context) {
+	name := c.Param("name")
+	auto, err := relay.autoIndexes()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := auto[name]; !ok {
+		c.JSON(404, gin.H{"error": "no such advisor index"})
+		return
+	}
+	if err := relay.dropAutoIndex(name); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	relay.audit(currentAdmin(c), "index_drop", nil, nil, name)
+	c.JSON(200, gin.H{"name": name, "dropped": true})
+}
+
+// allQueryShapes lists every shape, for resolving index names
+func allQueryShapes() []queryShape {
+	var shapes []queryShape
+	for i := 0; i < 32; i++ {
+		shapes = append(shapes, queryShape{Authors: i&1 != 0, Kinds: i&2 != 0, Time: i&4 != 0, Address: i&8 != 0, Tags: i&16 != 0})
+	}
+	return shapes
+}
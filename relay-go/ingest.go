@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ingestSource turns webhook payloads from one sender into Nostr events
+type ingestSource struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	eventTemplate
+
+	composer *eventComposer
+}
+
+// ingestConfig is the webhook ingest configuration file
+type ingestConfig struct {
+	BotKey  string         `json:"bot_key"`
+	Sources []ingestSource `json:"sources"`
+}
+
+// webhookIngest signs events built from incoming webhook payloads with the bot key
+type webhookIngest struct {
+	botKey    string
+	botPubkey string
+	sources   map[string]*ingestSource
+}
+
+// loadWebhookIngest reads the ingest config; the bot key may be given in the
+// file or overridden with INGEST_BOT_KEY, and defaults to the relay key
+func loadWebhookIngest(path, botKey, relayKey string) (*webhookIngest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg ingestConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid ingest config: %v", err)
+	}
+	if botKey == "" {
+		botKey = cfg.BotKey
+	}
+	if botKey == "" {
+		botKey = relayKey
+	}
+
+	key, err := nostr.DecodePrivateKey(botKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ingest bot key: %v", err)
+	}
+	pubkey, _ := nostr.PublicKey(key)
+
+	ingest := &webhookIngest{
+		botKey:    key,
+		botPubkey: pubkey,
+		sources:   make(map[string]*ingestSource),
+	}
+	for i := range cfg.Sources {
+		source := &cfg.Sources[i]
+		if source.Name == "" || source.Token == "" {
+			return nil, fmt.Errorf("ingest sources need a name and a token")
+		}
+		if source.composer, err = compileEventTemplate(source.Name, source.eventTemplate); err != nil {
+			return nil, err
+		}
+		ingest.sources[source.Name] = source
+	}
+
+	log.Printf("📥 Webhook ingest enabled for %d sources (bot %s)", len(ingest.sources), pubkey[:8])
+	return ingest, nil
+}
+
+// buildEvent renders a source's templates against a payload into a signed event
+func (w *webhookIngest) buildEvent(source *ingestSource, payload interface{}) (*Event, error) {
+	event, err := source.composer.compose(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := event.Sign(w.botKey); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// handleWebhookIngest accepts a JSON payload for a source and publishes the resulting event
+func handleWebhookIngest(c *gin.Context) {
+	if relay.ingest == nil {
+		c.JSON(404, gin.H{"error": "webhook ingest is not configured"})
+		return
+	}
+
+	source, ok := relay.ingest.sources[c.Param("source")]
+	if !ok {
+		c.JSON(404, gin.H{"error": "unknown source"})
+		return
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		token = c.Query("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(source.Token)) != 1 {
+		c.JSON(401, gin.H{"error": "invalid token"})
+		return
+	}
+
+	var payload interface{}
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(400, gin.H{"error": "payload must be JSON"})
+		return
+	}
+
+	event, err := relay.ingest.buildEvent(source, payload)
+	if err != nil {
+		c.JSON(422, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := relay.publishLocal(event); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("📥 Ingested webhook from %s as event %s", source.Name, event.ID[:8])
+	c.JSON(200, gin.H{"id": event.ID, "kind": event.Kind, "pubkey": event.PubKey})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WAL header magic numbers (little- and big-endian checksum variants)
+const (
+	walMagicLE = 0x377f0682
+	walMagicBE = 0x377f0683
+)
+
+// checkDatabaseFile runs a quick integrity check against a SQLite file and
+// its write-ahead log. A missing file is considered healthy.
+func checkDatabaseFile(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := checkWALHeader(path + "-wal"); err != nil {
+		return err
+	}
+
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA quick_check")
+	if err != nil {
+		return fmt.Errorf("quick_check failed: %v", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("quick_check failed: %v", err)
+	}
+
+	if len(problems) > 0 {
+		if len(problems) > 5 {
+			problems = append(problems[:5], fmt.Sprintf("... %d more", len(problems)-5))
+		}
+		return fmt.Errorf("integrity problems: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkWALHeader verifies that a non-empty WAL file starts with a valid header
+func checkWALHeader(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, 32)
+	n, err := io.ReadFull(f, header)
+	if n == 0 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("truncated WAL header in %s", filepath.Base(path))
+	}
+
+	magic := binary.BigEndian.Uint32(header[:4])
+	if magic != walMagicLE && magic != walMagicBE {
+		return fmt.Errorf("corrupt WAL header in %s", filepath.Base(path))
+	}
+	return nil
+}
+
+// latestBackup returns the newest backup in dir for the given database file.
+// Backups are matched by the database name, e.g. relay.db → relay*.db.
+func latestBackup(dir, path string) (string, bool) {
+	prefix := strings.TrimSuffix(filepath.Base(path), ".db")
+	matches, _ := filepath.Glob(filepath.Join(dir, prefix+"*.db"))
+
+	var newest string
+	var newestTime time.Time
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest = match
+			newestTime = info.ModTime()
+		}
+	}
+	return newest, newest != ""
+}
+
+// restoreFromBackup moves a damaged database aside and copies a backup in its place
+func restoreFromBackup(path, backup string) error {
+	suffix := ".corrupt-" + time.Now().UTC().Format("20060102T150405")
+	for _, ext := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(path+ext, path+ext+suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	src, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// verifyDatabase checks a database file before it is opened, restoring it
+// from the configured backup directory when damaged. Databases that remain
+// damaged put the relay into read-only mode.
+func (r *Relay) verifyDatabase(path string) {
+	err := checkDatabaseFile(path)
+	if err == nil {
+		return
+	}
+	log.Printf("🚨 Integrity check failed for %s: %v", path, err)
+
+	if r.cfg.BackupDir != "" {
+		if backup, ok := latestBackup(r.cfg.BackupDir, path); ok {
+			log.Printf("♻️  Restoring %s from backup %s", filepath.Base(path), backup)
+			if rerr := restoreFromBackup(path, backup); rerr != nil {
+				log.Printf("❌ Restore failed: %v", rerr)
+			} else if err = checkDatabaseFile(path); err == nil {
+				log.Printf("✅ Restored %s from backup", filepath.Base(path))
+				return
+			} else {
+				log.Printf("🚨 Restored backup is also damaged: %v", err)
+			}
+		} else {
+			log.Printf("⚠️  No backup found for %s in %s", filepath.Base(path), r.cfg.BackupDir)
+		}
+	}
+
+	r.setReadOnly(fmt.Sprintf("%s failed integrity check: %v", filepath.Base(path), err))
+}
+
+// setReadOnly disables writes, keeping the first reason recorded
+func (r *Relay) setReadOnly(reason string) {
+	r.integrityMutex.Lock()
+	defer r.integrityMutex.Unlock()
+
+	if r.readOnlyReason == "" {
+		r.readOnlyReason = reason
+		log.Printf("🔒 Writes disabled: %s", reason)
+	}
+}
+
+// openMainDatabase opens relay.db, query-only when a database failed its
+// integrity check. Every write path (sessions, sketches, aggregates, audit
+// rows, ...) then fails in SQLite instead of needing its own check, and
+// nothing, the schema included, is written to the damaged files. Readers must
+// tolerate tables missing from a schema older than this build (missingTable).
+func (r *Relay) openMainDatabase(dbPath string) (*sql.DB, error) {
+	if r.readOnly() == "" {
+		return openSQLite(dbPath)
+	}
+	log.Printf("🔒 Opening databases query-only; the schema is left as it is")
+	return sql.Open(sqliteDriver, sqliteQueryOnlyDSN(dbPath))
+}
+
+// missingTable reports whether a query failed on a table that a read-only
+// relay's database predates; callers treat the table as empty
+func missingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table")
+}
+
+// readOnly returns the reason writes are disabled, or "" when writable
+func (r *Relay) readOnly() string {
+	r.integrityMutex.RLock()
+	defer r.integrityMutex.RUnlock()
+
+	return r.readOnlyReason
+}
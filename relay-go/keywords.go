@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The owner can watch keywords and hashtags, a personal "Google Alerts" run
+// on their own relay. Stored notes, comments and articles by others that
+// mention one are recorded in keyword_matches and raise a "keyword" owner
+// alert through the push channels. Like every owner alert it names only the
+// event; the owner's app lists the matches, with the keywords, from the
+// relay. Adding a keyword can backfill matches from the archive, which are
+// recorded without alerting.
+
+// keywordSchema holds the watched keywords and the events that matched them
+const keywordSchema = `
+	CREATE TABLE IF NOT EXISTS watch_keywords (
+		keyword TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS keyword_matches (
+		event_id TEXT NOT NULL,
+		keyword TEXT NOT NULL,
+		matched_at INTEGER NOT NULL,
+		alerted INTEGER NOT NULL,
+		PRIMARY KEY (event_id, keyword)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_keyword_matches_time ON keyword_matches(matched_at);
+`
+
+const (
+	// maxWatchKeywords and maxKeywordLength bound what the owner can watch
+	maxWatchKeywords = 100
+	maxKeywordLength = 100
+	// maxKeywordBackfill bounds how far back a new keyword is searched
+	maxKeywordBackfill = 365
+	// keywordMatchRetention is how long matches are listed
+	keywordMatchRetention = 90 * 24 * time.Hour
+)
+
+// watchedKinds are the kinds whose content is matched against keywords
+var watchedKinds = map[int]bool{1: true, 1111: true, 30023: true}
+
+// keywordWatch holds the watched keywords in memory for the EVENT path and
+// limits how many keyword alerts are pushed per hour
+type keywordWatch struct {
+	mu       sync.Mutex
+	keywords []string
+	perHour  int
+	alerts   []time.Time // alerts pushed in the last hour
+}
+
+// loadKeywordWatch reads the watched keywords
+func loadKeywordWatch(db *sql.DB, cfg *Config) (*keywordWatch, error) {
+	w := &keywordWatch{perHour: cfg.KeywordAlertsPerHour}
+	rows, err := db.Query("SELECT keyword FROM watch_keywords ORDER BY keyword")
+	if missingTable(err) {
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var keyword string
+		if rows.Scan(&keyword) == nil {
+			w.keywords = append(w.keywords, keyword)
+		}
+	}
+	return w, rows.Err()
+}
+
+// list returns a copy of the watched keywords
+func (w *keywordWatch) list() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.keywords...)
+}
+
+// set replaces the watched keywords
+func (w *keywordWatch) set(keywords []string) {
+	w.mu.Lock()
+	w.keywords = keywords
+	w.mu.Unlock()
+}
+
+// allowAlert records a pushed alert, reporting whether it is within the
+// hourly limit (0 is unlimited)
+func (w *keywordWatch) allowAlert() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.perHour <= 0 {
+		return true
+	}
+	cutoff := time.Now().Add(-time.Hour)
+	recent := w.alerts[:0]
+	for _, t := range w.alerts {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	w.alerts = recent
+	if len(w.alerts) >= w.perHour {
+		return false
+	}
+	w.alerts = append(w.alerts, time.Now())
+	return true
+}
+
+// normalizeKeyword lowercases and trims a keyword; hashtags keep one "#"
+func normalizeKeyword(keyword string) string {
+	keyword = strings.ToLower(strings.Join(strings.Fields(keyword), " "))
+	if strings.HasPrefix(keyword, "#") {
+		keyword = "#" + strings.TrimLeft(keyword, "#")
+	}
+	if keyword == "#" {
+		return ""
+	}
+	return keyword
+}
+
+// isWordRune reports whether a rune continues a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// containsWord reports whether text contains phrase as whole words
+func containsWord(text, phrase string) bool {
+	for i := 0; i <= len(text)-len(phrase); {
+		j := strings.Index(text[i:], phrase)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(phrase)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		i = start + 1
+	}
+	return false
+}
+
+// keywordMatches returns the keywords an event mentions: hashtags match t
+// tags or the hashtag in the content, other keywords match whole words
+func keywordMatches(event *Event, keywords []string) []string {
+	content := strings.ToLower(event.Content)
+	var matched []string
+	for _, keyword := range keywords {
+		found := containsWord(content, keyword)
+		if hashtag, ok := strings.CutPrefix(keyword, "#"); ok && !found {
+			for _, tag := range event.Tags {
+				if len(tag) >= 2 && tag[0] == "t" && strings.ToLower(strings.TrimPrefix(tag[1], "#")) == hashtag {
+					found = true
+					break
+				}
+			}
+		}
+		if found {
+			matched = append(matched, keyword)
+		}
+	}
+	return matched
+}
+
+// watchKeywords records the keywords a stored event matches. It reports
+// whether the owner should be alerted: alerting is false when the event
+// already raised another alert, and alerts past the hourly limit are only
+// recorded.
+func (r *Relay) watchKeywords(event *Event, alerting bool) bool {
+	if r.watch == nil || !watchedKinds[event.Kind] || event.PubKey == r.cfg.OwnerPubkey {
+		return false
+	}
+	matched := keywordMatches(event, r.watch.list())
+	if len(matched) == 0 {
+		return false
+	}
+	alert := alerting && r.watch.allowAlert()
+	if err := r.recordKeywordMatches(event.ID, matched, alert); err != nil {
+		log.Printf("❌ Failed to record keyword matches: %v", err)
+	}
+	return alert
+}
+
+// recordKeywordMatches stores matches and drops those past the retention
+func (r *Relay) recordKeywordMatches(eventID string, keywords []string, alerted bool) error {
+	now := time.Now()
+	for _, keyword := range keywords {
+		if _, err := r.db.Exec("INSERT OR IGNORE INTO keyword_matches (event_id, keyword, matched_at, alerted) VALUES (?, ?, ?, ?)",
+			eventID, keyword, now.Unix(), alerted); err != nil {
+			return err
+		}
+	}
+	_, err := r.db.Exec("DELETE FROM keyword_matches WHERE matched_at < ?", now.Add(-keywordMatchRetention).Unix())
+	return err
+}
+
+// backfillKeyword records the stored events of the last days that match a
+// new keyword, without alerting, and returns how many it found
+func (r *Relay) backfillKeyword(keyword string, days int) int {
+	until := time.Now().Unix()
+	since := until - int64(days)*24*60*60
+	condition := "kind IN (1, 1111, 30023) AND pubkey != ?"
+	args := []interface{}{r.cfg.OwnerPubkey}
+	// SQLite's lower() only folds ASCII, so only ASCII keywords narrow the scan
+	if isASCII(keyword) {
+		condition += " AND (instr(lower(content), ?) > 0"
+		args = append(args, keyword)
+		if hashtag, ok := strings.CutPrefix(keyword, "#"); ok {
+			condition += " OR instr(lower(tags), ?) > 0"
+			args = append(args, tagNeedle("t", hashtag))
+		}
+		condition += ")"
+	}
+
+	found := 0
+	for _, event := range r.scanRange(since, until, condition, args...) {
+		if len(keywordMatches(&event, []string{keyword})) == 0 {
+			continue
+		}
+		if err := r.recordKeywordMatches(event.ID, []string{keyword}, false); err != nil {
+			log.Printf("❌ Failed to record keyword matches: %v", err)
+			break
+		}
+		found++
+	}
+	return found
+}
+
+// isASCII reports whether s has only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadKeywords refreshes the in-memory keywords from the database
+func (r *Relay) reloadKeywords() error {
+	watch, err := loadKeywordWatch(r.db, r.cfg)
+	if err != nil {
+		return err
+	}
+	r.watch.set(watch.keywords)
+	return nil
+}
+
+// handleListKeywords lists the watched keywords with their match counts
+func handleListKeywords(c *gin.Context) {
+	rows, err := relay.db.Query(`SELECT w.keyword, w.created_at, COUNT(m.event_id) FROM watch_keywords w
+		LEFT JOIN keyword_matches m ON m.keyword = w.keyword GROUP BY w.keyword ORDER BY w.keyword`)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	keywords := []gin.H{}
+	for rows.Next() {
+		var keyword string
+		var createdAt int64
+		var matches int
+		if rows.Scan(&keyword, &createdAt, &matches) == nil {
+			keywords = append(keywords, gin.H{"keyword": keyword, "created_at": createdAt, "matches": matches})
+		}
+	}
+	c.JSON(200, gin.H{"keywords": keywords, "alerts_per_hour": relay.cfg.KeywordAlertsPerHour})
+}
+
+// handleAddKeyword watches a keyword or #hashtag, optionally recording the
+// matches of the last backfill_days
+func handleAddKeyword(c *gin.Context) {
+	var req struct {
+		Keyword      string `json:"keyword"`
+		BackfillDays int    `json:"backfill_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid JSON body"})
+		return
+	}
+	keyword := normalizeKeyword(req.Keyword)
+	if keyword == "" || len(keyword) > maxKeywordLength {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("keyword must be 1 to %d bytes", maxKeywordLength)})
+		return
+	}
+	if req.BackfillDays < 0 || req.BackfillDays > maxKeywordBackfill {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("backfill_days must be 0 to %d", maxKeywordBackfill)})
+		return
+	}
+	if keywords := relay.watch.list(); len(keywords) >= maxWatchKeywords {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("at most %d keywords can be watched", maxWatchKeywords)})
+		return
+	}
+
+	if _, err := relay.db.Exec("INSERT OR IGNORE INTO watch_keywords (keyword, created_at) VALUES (?, ?)",
+		keyword, time.Now().Unix()); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := relay.reloadKeywords(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	backfilled := 0
+	if req.BackfillDays > 0 {
+		backfilled = relay.backfillKeyword(keyword, req.BackfillDays)
+	}
+	c.JSON(200, gin.H{"keyword": keyword, "backfilled": backfilled})
+}
+
+// handleRemoveKeyword stops watching a keyword and forgets its matches
+func handleRemoveKeyword(c *gin.Context) {
+	keyword := normalizeKeyword(c.Param("keyword"))
+	result, err := relay.db.Exec("DELETE FROM watch_keywords WHERE keyword = ?", keyword)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(404, gin.H{"error": "keyword is not watched"})
+		return
+	}
+	relay.db.Exec("DELETE FROM keyword_matches WHERE keyword = ?", keyword)
+	if err := relay.reloadKeywords(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"removed": keyword})
+}
+
+// handleKeywordMatches lists matched events, newest match first, optionally
+// for one ?keyword= and since a Unix time
+func handleKeywordMatches(c *gin.Context) {
+	since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 && n <= 500 {
+			limit = n
+		}
+	}
+	query := "SELECT event_id, keyword, matched_at, alerted FROM keyword_matches WHERE matched_at >= ?"
+	args := []interface{}{since}
+	if keyword := c.Query("keyword"); keyword != "" {
+		query += " AND keyword = ?"
+		args = append(args, normalizeKeyword(keyword))
+	}
+	query += " ORDER BY matched_at DESC, event_id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := relay.db.Query(query, args...)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	type match struct {
+		EventID   string `json:"event_id"`
+		Keyword   string `json:"keyword"`
+		MatchedAt int64  `json:"matched_at"`
+		Alerted   bool   `json:"alerted"`
+		Event     *Event `json:"event"`
+	}
+	var matches []match
+	var ids []string
+	for rows.Next() {
+		var m match
+		if rows.Scan(&m.EventID, &m.Keyword, &m.MatchedAt, &m.Alerted) == nil {
+			matches = append(matches, m)
+			ids = append(ids, m.EventID)
+		}
+	}
+	rows.Close()
+
+	events := map[string]Event{}
+	for _, event := range relay.eventsByID(ids) {
+		events[event.ID] = event
+	}
+	// Matches of events deleted since are left out
+	listed := []match{}
+	for _, m := range matches {
+		if event, ok := events[m.EventID]; ok {
+			m.Event = &event
+			listed = append(listed, m)
+		}
+	}
+	c.JSON(200, gin.H{"matches": listed})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// kindClass is how the relay treats the events of a kind
+type kindClass string
+
+const (
+	kindRegular     kindClass = "regular"     // stored as is
+	kindReplaceable kindClass = "replaceable" // newest per pubkey and kind
+	kindEphemeral   kindClass = "ephemeral"   // relayed to subscribers, never stored
+	kindAddressable kindClass = "addressable" // newest per pubkey, kind and d tag
+)
+
+// kindRange assigns a class to the kinds from From to To inclusive
+type kindRange struct {
+	From, To int
+	Class    kindClass
+}
+
+// nip01Kinds are the ranges NIP-01 defines; other kinds are unknown
+var nip01Kinds = []kindRange{
+	{0, 0, kindReplaceable},
+	{1, 2, kindRegular},
+	{3, 3, kindReplaceable},
+	{4, 44, kindRegular},
+	{1000, 9999, kindRegular},
+	{10000, 19999, kindReplaceable},
+	{20000, 29999, kindEphemeral},
+	{30000, 39999, kindAddressable},
+}
+
+// kindPolicy classifies kinds: the operator's RELAY_KIND_CLASSES first, then
+// NIP-01, then RELAY_UNKNOWN_KINDS for anything left
+type kindPolicy struct {
+	ranges        []kindRange
+	rejectUnknown bool
+}
+
+// parseKindClasses parses "class:kind" and "class:from-to" entries
+func parseKindClasses(specs []string) ([]kindRange, error) {
+	var ranges []kindRange
+	for _, spec := range specs {
+		class, span, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not class:kind or class:from-to", spec)
+		}
+		switch kindClass(class) {
+		case kindRegular, kindReplaceable, kindEphemeral, kindAddressable:
+		default:
+			return nil, fmt.Errorf("unknown kind class %q in %q", class, spec)
+		}
+
+		from, to, isRange := strings.Cut(span, "-")
+		if !isRange {
+			to = from
+		}
+		lo, err1 := strconv.Atoi(strings.TrimSpace(from))
+		hi, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || lo < 0 || hi < lo {
+			return nil, fmt.Errorf("invalid kind range in %q", spec)
+		}
+		ranges = append(ranges, kindRange{lo, hi, kindClass(class)})
+	}
+	return ranges, nil
+}
+
+// newKindPolicy builds the kind policy from RELAY_KIND_CLASSES and RELAY_UNKNOWN_KINDS
+func newKindPolicy(cfg *Config) (*kindPolicy, error) {
+	overrides, err := parseKindClasses(cfg.KindClasses)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RELAY_KIND_CLASSES: %v", err)
+	}
+
+	policy := &kindPolicy{ranges: append(overrides, nip01Kinds...)}
+	switch cfg.UnknownKinds {
+	case "", "regular":
+	case "reject":
+		policy.rejectUnknown = true
+	default:
+		return nil, fmt.Errorf("RELAY_UNKNOWN_KINDS must be regular or reject, not %q", cfg.UnknownKinds)
+	}
+	return policy, nil
+}
+
+// classify returns a kind's class and whether a range covers it; unknown
+// kinds pass through as regular events
+func (p *kindPolicy) classify(kind int) (kindClass, bool) {
+	for _, r := range p.ranges {
+		if kind >= r.From && kind <= r.To {
+			return r.Class, true
+		}
+	}
+	return kindRegular, false
+}
+
+// accepts reports whether events of a kind are accepted at all
+func (p *kindPolicy) accepts(kind int) bool {
+	_, known := p.classify(kind)
+	return known || !p.rejectUnknown
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latency stages measured by the relay
+const (
+	stageEvent     = "event"     // EVENT validation and storage, up to the OK
+	stageReq       = "req"       // REQ replay of stored events, up to EOSE
+	stageBroadcast = "broadcast" // fan-out of a new event to live subscriptions
+)
+
+// latencySamples is how many recent samples each stage keeps for percentiles
+const latencySamples = 2048
+
+// slowRequests is how many recent SLO breaches each stage keeps request IDs for
+const slowRequests = 10
+
+// slowRequest is a request that breached its stage's SLO
+type slowRequest struct {
+	RequestID string  `json:"request_id"`
+	Ms        float64 `json:"ms"`
+	At        int64   `json:"at"`
+}
+
+// latencyWindow is a ring buffer of recent samples for one stage
+type latencyWindow struct {
+	samples  []time.Duration
+	next     int
+	count    int64
+	breaches int64
+	slow     []slowRequest // most recent last
+}
+
+// latencyTracker keeps per-stage handling latencies and their SLO thresholds
+type latencyTracker struct {
+	mu     sync.Mutex
+	stages map[string]*latencyWindow
+	slos   map[string]time.Duration
+}
+
+func newLatencyTracker(cfg *Config) *latencyTracker {
+	lt := &latencyTracker{
+		stages: make(map[string]*latencyWindow),
+		slos: map[string]time.Duration{
+			stageEvent:     cfg.SLOEvent,
+			stageReq:       cfg.SLOReq,
+			stageBroadcast: cfg.SLOBroadcast,
+		},
+	}
+	for stage := range lt.slos {
+		lt.stages[stage] = &latencyWindow{samples: make([]time.Duration, 0, latencySamples)}
+	}
+	return lt
+}
+
+// observe records one sample for a stage, remembering the request ID of
+// samples that breach the SLO
+func (lt *latencyTracker) observe(stage, requestID string, d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	w := lt.stages[stage]
+	if len(w.samples) < latencySamples {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+	}
+	w.next = (w.next + 1) % latencySamples
+	w.count++
+	if slo := lt.slos[stage]; slo > 0 && d > slo {
+		w.breaches++
+		if requestID != "" {
+			w.slow = append(w.slow, slowRequest{requestID, float64(d.Microseconds()) / 1000, time.Now().Unix()})
+			if len(w.slow) > slowRequests {
+				w.slow = w.slow[1:]
+			}
+		}
+	}
+}
+
+// since returns a function recording the time elapsed from now for a stage
+func (lt *latencyTracker) since(stage string) func() {
+	return lt.track(stage, "")
+}
+
+// track is since for the handling of one incoming message. The returned
+// function records only its first call, so handlers can defer it to count
+// rejections and errors and still call it early where the stage ends.
+func (lt *latencyTracker) track(stage, requestID string) func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() { lt.observe(stage, requestID, time.Since(start)) })
+	}
+}
+
+// percentiles returns the p50, p95 and p99 of a stage's recent samples
+func (lt *latencyTracker) percentiles(stage string) (p50, p95, p99 time.Duration) {
+	lt.mu.Lock()
+	sorted := append([]time.Duration(nil), lt.stages[stage].samples...)
+	lt.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return at(0.50), at(0.95), at(0.99)
+}
+
+// snapshot reports every stage's percentiles in milliseconds for /stats
+func (lt *latencyTracker) snapshot() map[string]interface{} {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+	report := make(map[string]interface{})
+	for stage, slo := range lt.slos {
+		p50, p95, p99 := lt.percentiles(stage)
+		lt.mu.Lock()
+		w := lt.stages[stage]
+		report[stage] = map[string]interface{}{
+			"p50_ms":          ms(p50),
+			"p95_ms":          ms(p95),
+			"p99_ms":          ms(p99),
+			"count":           w.count,
+			"slo_ms":          ms(slo),
+			"breaches":        w.breaches,
+			"recent_breaches": append([]slowRequest{}, w.slow...),
+		}
+		lt.mu.Unlock()
+	}
+	return report
+}
+
+// watchSLOs periodically warns when a stage's p95 exceeds its SLO
+func (lt *latencyTracker) watchSLOs(interval time.Duration) {
+	for range time.Tick(interval) {
+		for stage, slo := range lt.slos {
+			if slo <= 0 {
+				continue
+			}
+			_, p95, p99 := lt.percentiles(stage)
+			if p95 > slo {
+				log.Printf("⚠️  %s latency p95 %s exceeds the %s SLO (p99 %s)", stage, p95, slo, p99)
+			}
+		}
+	}
+}
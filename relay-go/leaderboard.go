@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/leaderboard ranks the people who interact most with the owner
+// over a window, for a "top fans" widget on the home page: most replies, most
+// reactions, most zaps sent to the owner and most zaps received from the
+// owner. Zap boards rank by amount, then by count. Boards are cached briefly
+// since every page view asks for them.
+
+const (
+	// leaderboardCacheTTL is how long a computed leaderboard is served
+	leaderboardCacheTTL = time.Minute
+	// defaultLeaderboardSize and maxLeaderboardSize bound ?limit=
+	defaultLeaderboardSize = 10
+	maxLeaderboardSize     = 100
+)
+
+// fanScore is one person's interactions with the owner over a window
+type fanScore struct {
+	Pubkey           string `json:"pubkey"`
+	Name             string `json:"name,omitempty"`
+	Replies          int    `json:"replies"`
+	Reactions        int    `json:"reactions"`
+	ZapsSent         int    `json:"zaps_sent"`
+	ZapMsatsSent     int64  `json:"zap_msats_sent"`
+	ZapsReceived     int    `json:"zaps_received"`
+	ZapMsatsReceived int64  `json:"zap_msats_received"`
+	Total            int    `json:"total"`
+}
+
+// leaderboard is the ranked boards for one window
+type leaderboard struct {
+	Window       string     `json:"window"`
+	Since        int64      `json:"since"`
+	Until        int64      `json:"until"`
+	Replies      []fanScore `json:"replies"`
+	Reactions    []fanScore `json:"reactions"`
+	ZapsSent     []fanScore `json:"zaps_sent"`
+	ZapsReceived []fanScore `json:"zaps_received"`
+	Overall      []fanScore `json:"overall"`
+}
+
+// leaderboards caches computed boards by window and size
+var leaderboards = struct {
+	mu      sync.Mutex
+	entries map[string]leaderboardEntry
+}{entries: map[string]leaderboardEntry{}}
+
+// leaderboardEntry is a cached leaderboard and when it was computed
+type leaderboardEntry struct {
+	board      leaderboard
+	computedAt time.Time
+}
+
+// fanScores tallies everyone's interactions with the owner in [since, until]
+func (r *Relay) fanScores(since, until int64) map[string]*fanScore {
+	owner := r.cfg.OwnerPubkey
+	scores := map[string]*fanScore{}
+	fan := func(pubkey string) *fanScore {
+		if scores[pubkey] == nil {
+			scores[pubkey] = &fanScore{Pubkey: pubkey}
+		}
+		return scores[pubkey]
+	}
+
+	for _, event := range r.scanRange(since, until, "kind IN (1, 7, 9735) AND instr(tags, ?) > 0 AND pubkey != ?", tagNeedle("p", owner), owner) {
+		switch event.Kind {
+		case 1:
+			if isReply(&event) {
+				fan(event.PubKey).Replies++
+			}
+		case 7:
+			fan(event.PubKey).Reactions++
+		case 9735:
+			if event.TagValue("p") != owner {
+				continue
+			}
+			if sender := zapSender(&event); isHex64(sender) && sender != owner {
+				f := fan(sender)
+				f.ZapsSent++
+				f.ZapMsatsSent += zapAmountMsat(&event)
+			}
+		}
+	}
+
+	for _, event := range r.scanRange(since, until, "kind = 9735 AND instr(tags, ?) > 0", tagNeedle("P", owner)) {
+		if recipient := event.TagValue("p"); isHex64(recipient) && recipient != owner {
+			f := fan(recipient)
+			f.ZapsReceived++
+			f.ZapMsatsReceived += zapAmountMsat(&event)
+		}
+	}
+
+	for _, f := range scores {
+		f.Total = f.Replies + f.Reactions + f.ZapsSent + f.ZapsReceived
+	}
+	return scores
+}
+
+// topFans ranks the fans by a key, compared element by element, then by
+// total, keeping the first n; fans whose key is all zero are left out
+func topFans(scores map[string]*fanScore, n int, key func(*fanScore) [2]int64) []fanScore {
+	top := []fanScore{}
+	for _, f := range scores {
+		if key(f) != [2]int64{} {
+			top = append(top, *f)
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		a, b := key(&top[i]), key(&top[j])
+		if a[0] != b[0] {
+			return a[0] > b[0]
+		}
+		if a[1] != b[1] {
+			return a[1] > b[1]
+		}
+		if top[i].Total != top[j].Total {
+			return top[i].Total > top[j].Total
+		}
+		return top[i].Pubkey < top[j].Pubkey
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// computeLeaderboard builds the boards for a window; a zero window covers
+// the whole archive
+func (r *Relay) computeLeaderboard(name string, window time.Duration, n int) leaderboard {
+	until := time.Now().Unix()
+	var since int64
+	if window > 0 {
+		since = until - int64(window/time.Second)
+	}
+	scores := r.fanScores(since, until)
+
+	board := leaderboard{
+		Window:       name,
+		Since:        since,
+		Until:        until,
+		Replies:      topFans(scores, n, func(f *fanScore) [2]int64 { return [2]int64{int64(f.Replies)} }),
+		Reactions:    topFans(scores, n, func(f *fanScore) [2]int64 { return [2]int64{int64(f.Reactions)} }),
+		ZapsSent:     topFans(scores, n, func(f *fanScore) [2]int64 { return [2]int64{f.ZapMsatsSent, int64(f.ZapsSent)} }),
+		ZapsReceived: topFans(scores, n, func(f *fanScore) [2]int64 { return [2]int64{f.ZapMsatsReceived, int64(f.ZapsReceived)} }),
+		Overall:      topFans(scores, n, func(f *fanScore) [2]int64 { return [2]int64{int64(f.Total)} }),
+	}
+
+	var pubkeys []string
+	for _, list := range [][]fanScore{board.Replies, board.Reactions, board.ZapsSent, board.ZapsReceived, board.Overall} {
+		for _, f := range list {
+			pubkeys = append(pubkeys, f.Pubkey)
+		}
+	}
+	names := r.profileNames(pubkeys)
+	for _, list := range [][]fanScore{board.Replies, board.Reactions, board.ZapsSent, board.ZapsReceived, board.Overall} {
+		for i := range list {
+			list[i].Name = names[list[i].Pubkey]
+		}
+	}
+	return board
+}
+
+// handleLeaderboard returns the top fans over ?window= (a Go duration,
+// whole days as "30d", or "all"; default 30d), ?limit= per board
+func handleLeaderboard(c *gin.Context) {
+	if relay.cfg.OwnerPubkey == "" {
+		c.JSON(404, gin.H{"error": "no owner configured"})
+		return
+	}
+
+	name := c.DefaultQuery("window", "30d")
+	var window time.Duration
+	if name != "all" {
+		var err error
+		if window, err = parseTTL(name); err != nil || window <= 0 {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("invalid window %q (e.g. 7d, 12h or all)", name)})
+			return
+		}
+	}
+	n := defaultLeaderboardSize
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 {
+			c.JSON(400, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		if n > maxLeaderboardSize {
+			n = maxLeaderboardSize
+		}
+	}
+
+	key := name + "/" + strconv.Itoa(n)
+	leaderboards.mu.Lock()
+	entry, ok := leaderboards.entries[key]
+	leaderboards.mu.Unlock()
+	if !ok || time.Since(entry.computedAt) > leaderboardCacheTTL {
+		entry = leaderboardEntry{board: relay.computeLeaderboard(name, window, n), computedAt: time.Now()}
+		leaderboards.mu.Lock()
+		for k, e := range leaderboards.entries {
+			if time.Since(e.computedAt) > leaderboardCacheTTL {
+				delete(leaderboards.entries, k)
+			}
+		}
+		leaderboards.entries[key] = entry
+		leaderboards.mu.Unlock()
+	}
+	c.JSON(200, entry.board)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listingTagSchema holds the t and image tags of classified listings, so
+// listings can be filtered by tag and shown with all their images; it is one
+// of the eventIndexes
+const listingTagSchema = `
+	CREATE TABLE IF NOT EXISTS event_listing_tags (
+		event_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (event_id, name, value)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_listing_tags_value ON event_listing_tags(name, value);
+`
+
+// indexListingTags records the t and image tags of a NIP-99 listing
+func indexListingTags(db sqlExecer, event *Event) error {
+	if event.Kind != 30402 && event.Kind != 30403 {
+		return nil
+	}
+	for i, tag := range event.Tags {
+		if len(tag) < 2 || (tag[0] != "t" && tag[0] != "image") || tag[1] == "" {
+			continue
+		}
+		value := tag[1]
+		if tag[0] == "t" {
+			value = strings.ToLower(strings.TrimPrefix(value, "#"))
+		}
+		if _, err := db.Exec(`INSERT OR IGNORE INTO event_listing_tags (event_id, name, value, position)
+			VALUES (?, ?, ?, ?)`, event.ID, tag[0], value, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadListingTags fills in the images and t tags of listings
+func loadListingTags(listings []listingInfo) error {
+	if len(listings) == 0 {
+		return nil
+	}
+	byID := make(map[string]*listingInfo, len(listings))
+	args := make([]interface{}, len(listings))
+	for i := range listings {
+		listings[i].Images, listings[i].Tags = []string{}, []string{}
+		byID[listings[i].EventID] = &listings[i]
+		args[i] = listings[i].EventID
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(listings)), ",")
+
+	return queryPayloads("SELECT event_id, name, value FROM event_listing_tags WHERE event_id IN ("+placeholders+") ORDER BY position",
+		args, func(rows *sql.Rows) {
+			var id, name, value string
+			if rows.Scan(&id, &name, &value) != nil || byID[id] == nil {
+				return
+			}
+			if name == "image" {
+				byID[id].Images = append(byID[id].Images, value)
+			} else {
+				byID[id].Tags = append(byID[id].Tags, value)
+			}
+		})
+}
+
+// hasAnyTag reports whether a listing carries one of the wanted t tags
+func (l *listingInfo) hasAnyTag(wanted []string) bool {
+	for _, tag := range l.Tags {
+		for _, want := range wanted {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleListings lists the latest version of each classified listing, newest
+// first, for a "for sale" section. ?status= filters on active or sold, each
+// ?tag= adds a t tag a listing may carry, and drafts (kind 30403) are only
+// listed with ?drafts=true.
+func handleListings(c *gin.Context) {
+	where, args := "kind = 30402", []interface{}{}
+	if c.Query("drafts") == "true" {
+		where = "kind IN (30402, 30403)"
+	}
+	where, args = authorCondition(c, where, args)
+
+	listings, err := queryListings(where, args)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := c.Query("status")
+	var tags []string
+	for _, tag := range c.QueryArray("tag") {
+		tags = append(tags, strings.ToLower(strings.TrimPrefix(tag, "#")))
+	}
+	filtered := []listingInfo{}
+	for _, l := range listings {
+		if (status == "" || l.Status == status) && (len(tags) == 0 || l.hasAnyTag(tags)) {
+			filtered = append(filtered, l)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].CreatedAt > filtered[j].CreatedAt })
+	if limit := payloadLimit(c); len(filtered) > limit {
+		filtered = filtered[:limit]
+	}
+	c.JSON(200, gin.H{"listings": filtered})
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Continuous replication of every SQLite database to object storage with
+// Litestream (https://litestream.io), run as a managed child process. The
+// relay writes the Litestream config from its own list of databases and
+// restarts the child when partitions are created or dropped. On a fresh data
+// directory it restores from the replica before opening anything.
+//
+// Each database is replicated on its own, so a restored set may be a few
+// seconds apart between relay.db and the partitions; reconciliation and GC
+// repair that at startup. For a point where all databases agree, the sync
+// endpoint pauses writers until Litestream has shipped everything.
+
+// replicaRestartDelay is how long a crashed Litestream waits before a restart
+const replicaRestartDelay = 10 * time.Second
+
+// replicaCheckInterval is how often the database list is compared with the
+// one Litestream was started with
+const replicaCheckInterval = time.Minute
+
+// litestreamReplica is one replica in the Litestream config
+type litestreamReplica struct {
+	URL              string `yaml:"url"`
+	SyncInterval     string `yaml:"sync-interval,omitempty"`
+	SnapshotInterval string `yaml:"snapshot-interval,omitempty"`
+	Retention        string `yaml:"retention,omitempty"`
+}
+
+// litestreamDB is one database in the Litestream config
+type litestreamDB struct {
+	Path     string              `yaml:"path"`
+	Replicas []litestreamReplica `yaml:"replicas"`
+}
+
+// litestreamConfig is the file passed to `litestream replicate -config`
+type litestreamConfig struct {
+	DBs []litestreamDB `yaml:"dbs"`
+}
+
+// replicator runs Litestream for the relay's databases
+type replicator struct {
+	relay      *Relay
+	bin        string
+	replica    string
+	sync       time.Duration
+	snapshot   time.Duration
+	retention  time.Duration
+	configPath string
+	stop       chan struct{}
+	stopped    chan struct{}
+
+	mu           sync.Mutex
+	launched     bool // run was called; Stop waits for it to finish
+	pid          int
+	running      bool
+	started      time.Time
+	dbs          []string
+	restarts     int
+	lastError    string
+	lastErrorAt  time.Time
+	consistentAt time.Time
+}
+
+// newReplicator returns the replicator, or nil when RELAY_LITESTREAM_REPLICA is unset
+func newReplicator(r *Relay) *replicator {
+	cfg := r.cfg
+	if cfg.LitestreamReplica == "" {
+		return nil
+	}
+	return &replicator{
+		relay:      r,
+		bin:        cfg.LitestreamBin,
+		replica:    strings.TrimSuffix(cfg.LitestreamReplica, "/"),
+		sync:       cfg.LitestreamSync,
+		snapshot:   cfg.LitestreamSnapshot,
+		retention:  cfg.LitestreamRetention,
+		configPath: filepath.Join(cfg.DataDir, "litestream.yml"),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// validateReplicaURL checks a Litestream replica URL
+func validateReplicaURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "s3", "gcs", "abs", "sftp", "file":
+		return nil
+	}
+	return fmt.Errorf("replica URL must be s3://, gcs://, abs://, sftp:// or file://, not %q", raw)
+}
+
+// replicaURL is where a database is replicated, keeping its path under the
+// data directory, e.g. s3://bucket/relay/partitions/events-2024-05.db
+func replicaURL(base, dataDir, path string) string {
+	rel, err := filepath.Rel(dataDir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return base + "/" + filepath.ToSlash(rel)
+}
+
+// databasePaths lists relay.db and every open partition
+func (r *Relay) databasePaths() []string {
+	paths := []string{filepath.Join(r.dataDir, "relay.db")}
+	if r.partitions != nil {
+		r.partitions.mu.RLock()
+		for _, p := range r.partitions.partitions {
+			paths = append(paths, p.path)
+		}
+		r.partitions.mu.RUnlock()
+	}
+	sort.Strings(paths[1:])
+	return paths
+}
+
+// writeConfig writes the Litestream config for dbs
+func (p *replicator) writeConfig(dbs []string) error {
+	var cfg litestreamConfig
+	for _, path := range dbs {
+		cfg.DBs = append(cfg.DBs, litestreamDB{
+			Path: path,
+			Replicas: []litestreamReplica{{
+				URL:              replicaURL(p.replica, p.relay.dataDir, path),
+				SyncInterval:     p.sync.String(),
+				SnapshotInterval: p.snapshot.String(),
+				Retention:        p.retention.String(),
+			}},
+		})
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.configPath, data, 0600)
+}
+
+// fail records a Litestream failure
+func (p *replicator) fail(err error) {
+	p.mu.Lock()
+	p.running = false
+	p.restarts++
+	p.lastError = err.Error()
+	p.lastErrorAt = time.Now()
+	p.mu.Unlock()
+	log.Printf("❌ Litestream: %v", err)
+}
+
+// run keeps `litestream replicate` running until stopped, restarting it when
+// it exits or the set of databases changes
+func (p *replicator) run() {
+	p.mu.Lock()
+	p.launched = true
+	p.mu.Unlock()
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		dbs := p.relay.databasePaths()
+		if err := p.writeConfig(dbs); err != nil {
+			p.fail(fmt.Errorf("failed to write config: %v", err))
+			if p.sleep(replicaRestartDelay) {
+				return
+			}
+			continue
+		}
+
+		cmd := exec.Command(p.bin, "replicate", "-config", p.configPath)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			p.fail(fmt.Errorf("failed to start: %v", err))
+			if p.sleep(replicaRestartDelay) {
+				return
+			}
+			continue
+		}
+		p.mu.Lock()
+		p.pid, p.running, p.started, p.dbs = cmd.Process.Pid, true, time.Now(), dbs
+		p.mu.Unlock()
+		log.Printf("☁️  Litestream replicating %d databases to %s", len(dbs), p.replica)
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		if p.supervise(cmd, done, dbs) {
+			return
+		}
+	}
+}
+
+// supervise waits for Litestream to exit, the database list to change or a
+// stop, and reports whether the replicator should stop
+func (p *replicator) supervise(cmd *exec.Cmd, done chan error, dbs []string) bool {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				err = fmt.Errorf("exited")
+			}
+			p.fail(err)
+			return p.sleep(replicaRestartDelay)
+		case <-ticker.C:
+			if strings.Join(p.relay.databasePaths(), "\n") != strings.Join(dbs, "\n") {
+				log.Printf("☁️  Databases changed, restarting Litestream")
+				terminate(cmd, done)
+				return false
+			}
+		case <-p.stop:
+			terminate(cmd, done)
+			return true
+		}
+	}
+}
+
+// terminate asks Litestream to exit, which ships any pending WAL frames,
+// and kills it if it does not within 10 seconds
+func terminate(cmd *exec.Cmd, done chan error) {
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+// sleep waits d, reporting true if the replicator was stopped meanwhile
+func (p *replicator) sleep(d time.Duration) bool {
+	select {
+	case <-p.stop:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// Stop terminates Litestream after its final sync
+func (p *replicator) Stop() {
+	close(p.stop)
+	p.mu.Lock()
+	launched := p.launched
+	p.mu.Unlock()
+	if launched {
+		<-p.stopped
+	}
+}
+
+// stats reports the state of replication
+func (p *replicator) stats() map[string]interface{} {
+	if p == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := map[string]interface{}{
+		"enabled":       true,
+		"replica":       p.replica,
+		"running":       p.running,
+		"databases":     p.dbs,
+		"restarts":      p.restarts,
+		"sync_interval": p.sync.String(),
+		"consistent_at": unixOrZero(p.consistentAt),
+	}
+	if p.running {
+		stats["pid"] = p.pid
+		stats["started_at"] = p.started.Unix()
+	}
+	if p.lastError != "" {
+		stats["last_error"] = p.lastError
+		stats["last_error_at"] = p.lastErrorAt.Unix()
+	}
+	return stats
+}
+
+// restoreFromReplica fills a fresh data directory from the replica: relay.db
+// first, then the partitions of every month it has aggregates for. Databases
+// already on disk are never overwritten.
+func restoreFromReplica(cfg *Config) error {
+	if cfg.LitestreamReplica == "" || !cfg.LitestreamRestore {
+		return nil
+	}
+	base := strings.TrimSuffix(cfg.LitestreamReplica, "/")
+	mainPath := filepath.Join(cfg.DataDir, "relay.db")
+	if _, err := os.Stat(mainPath); err == nil {
+		return nil
+	}
+
+	if err := litestreamRestore(cfg.LitestreamBin, replicaURL(base, cfg.DataDir, mainPath), mainPath); err != nil {
+		return err
+	}
+	if _, err := os.Stat(mainPath); err != nil {
+		log.Printf("☁️  No replica of relay.db found; starting empty")
+		return nil
+	}
+	log.Printf("☁️  Restored relay.db from %s", base)
+
+	if cfg.Partitioning != "monthly" {
+		return nil
+	}
+	dir := filepath.Join(cfg.DataDir, "partitions")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	first, err := firstAggregateDay(mainPath)
+	if err != nil || first == 0 {
+		return err
+	}
+	now := time.Now().UTC()
+	for month := time.Unix(first*86400, 0).UTC(); !month.After(now); month = month.AddDate(0, 1, 0) {
+		path := filepath.Join(dir, "events-"+month.Format(partitionLayout)+".db")
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := litestreamRestore(cfg.LitestreamBin, replicaURL(base, cfg.DataDir, path), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// litestreamRestore restores one database, doing nothing when it has no replica
+func litestreamRestore(bin, replica, path string) error {
+	out, err := exec.Command(bin, "restore", "-if-replica-exists", "-o", path, replica).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("litestream restore of %s failed: %v: %s", filepath.Base(path), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// firstAggregateDay returns the earliest day with stored events, 0 if none
+func firstAggregateDay(path string) (int64, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var first sql.NullInt64
+	if err := db.QueryRow("SELECT MIN(day) FROM daily_aggregates").Scan(&first); err != nil {
+		return 0, err
+	}
+	month := time.Unix(first.Int64*86400, 0).UTC()
+	// Align to the first of the month so the month loop visits it
+	return time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC).Unix() / 86400, nil
+}
+
+// handleReplicationStatus shows the state of Litestream replication
+func handleReplicationStatus(c *gin.Context) {
+	c.JSON(200, relay.replicator.stats())
+}
+
+// handleReplicationSync pauses event writes until Litestream has shipped them
+// for every database, marking a time at which all replicas agree. Passing it
+// to `litestream restore -timestamp` restores a consistent set.
+func handleReplicationSync(c *gin.Context) {
+	p := relay.replicator
+	if p == nil {
+		c.JSON(404, gin.H{"error": "replication is not configured"})
+		return
+	}
+	p.mu.Lock()
+	running := p.running
+	p.mu.Unlock()
+	if !running {
+		c.JSON(503, gin.H{"error": "litestream is not running", "replication": p.stats()})
+		return
+	}
+
+	// Every store and delete holds relay.writes shared, so holding it here
+	// stops them all; two sync intervals let every database catch up.
+	// Replicas are timestamped when frames are shipped, so the consistent
+	// point is the end of the pause.
+	start := time.Now()
+	relay.writes.Lock()
+	time.Sleep(2*p.sync + time.Second)
+	consistentAt := time.Now()
+	relay.writes.Unlock()
+
+	p.mu.Lock()
+	p.consistentAt = consistentAt
+	p.mu.Unlock()
+	relay.audit(currentAdmin(c), "replication_sync", nil, nil, consistentAt.UTC().Format(time.RFC3339))
+	c.JSON(200, gin.H{
+		"consistent_at": consistentAt.UTC().Format(time.RFC3339),
+		"paused_ms":     time.Since(start).Milliseconds(),
+	})
+}
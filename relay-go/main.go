@@ -1,34 +1,30 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"nostr-relay/pkg/nostr"
+
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // Event represents a Nostr event
-type Event struct {
-	ID        string     `json:"id"`
-	PubKey    string     `json:"pubkey"`
-	CreatedAt int64      `json:"created_at"`
-	Kind      int        `json:"kind"`
-	Tags      [][]string `json:"tags"`
-	Content   string     `json:"content"`
-	Sig       string     `json:"sig"`
-}
+type Event = nostr.Event
 
 // Filter represents subscription filters
 type Filter struct {
@@ -47,6 +43,16 @@ type Subscription struct {
 	ID      string   `json:"id"`
 	Filters []Filter `json:"filters"`
 	Client  *Client  `json:"-"`
+	// matcher is Filters compiled for matching live events
+	matcher subscriptionMatcher
+	// cursor is the received_at time up to which events have been delivered,
+	// used to replay missed events when a session resumes (accessed atomically)
+	cursor int64
+	// Match statistics for the admin API (accessed atomically)
+	createdAt time.Time
+	evaluated int64 // live events tested against the filters
+	matched   int64 // live events that matched
+	delivered int64 // events queued to the client, stored and live
 }
 
 // Client represents a WebSocket client
@@ -54,23 +60,89 @@ type Client struct {
 	ID            string
 	Conn          *websocket.Conn
 	Subscriptions map[string]*Subscription
-	Send          chan []byte
+	Send          *sendQueue
 	Relay         *Relay
 	mu            sync.RWMutex
 	lastSeen      time.Time
+	// binary is set when the client negotiated the CBOR subprotocol
+	binary        bool
+	// sessionToken is set once the client opted into session resumption
+	// (guarded by mu)
+	sessionToken  string
+	// Connection details shown to admins choosing a client to tap
+	remoteAddr    string
+	userAgent     string
+	// requestID identifies the message being handled; only the read pump uses it
+	requestID     string
+	// violations counts malformed messages against the protocol error budget
+	violations    int
+	// challenge is the NIP-42 challenge sent on connect; relayHost is the
+	// host the client connected to, which AUTH events must name
+	challenge     string
+	relayHost     string
+	// release frees the client's slot under the connection cap
+	release       func()
+	// authed is the pubkey the connection authenticated as (guarded by mu)
+	authed        string
+	// private is set on /ws-private connections, which need AUTH first
+	private       bool
 }
 
 // Relay represents the main relay structure
 type Relay struct {
 	db           *sql.DB
+	cfg          *Config
+	partitions   *partitionSet
+	push         *pushGateway
+	selfHostedPush *selfHostedPush
+	watch        *keywordWatch
+	crossPostTargets []crossPostTarget
+	automation   *automation
+	autoReply    *autoReply
+	owner        *ownerSigner
+	reports      *abuseReports
+	identity     *relayIdentity
+	groups       *groupStore
+	ingest       *webhookIngest
+	admins       *adminSet
+	bans         map[string]bool
+	bansMutex    sync.RWMutex
+	taps         map[string]*frameTap
+	tapsMutex    sync.RWMutex
+	latency      *latencyTracker
+	kinds        *kindPolicy
+	auth         *authPolicy
+	endpoints    *endpointPolicy
+	indexes      *indexAdvisor
+	replicator   *replicator
+	verifier     *readVerifier
+	faults       *faultInjector
+	gate         *connectionGate
+	cacheTTLs    []cachedKind
+	pow          *powPolicy
+	// searchEnabled is set when SQLite has FTS5 for NIP-50 search
+	searchEnabled bool
+	features     *featureFlags
+	clock        *clockMonitor
+	protocol     *protocolGuard
+	sends        *sendBudget
+	sketches     sketchStore
+	// writes is held shared by everything that writes or removes stored
+	// events, and exclusively to pause them all
+	writes       sync.RWMutex
 	clients      map[string]*Client
 	clientsMutex sync.RWMutex
+	sessions     *sessionStore
 	upgrader     websocket.Upgrader
 	dataDir      string
-	// Add notification settings
-	notifyURL    string
-	lastNotify   time.Time
-	notifyMutex  sync.Mutex
+	// Cache-update notifications for the Python app
+	notify       *notifier
+	// Set when a database failed its startup integrity check
+	readOnlyReason string
+	integrityMutex sync.RWMutex
+	// Set while an old and a new process serve side by side during an upgrade
+	feed           atomic.Pointer[peerFeed]
+	upgrading      atomic.Bool
 }
 
 var (
@@ -80,23 +152,48 @@ var (
 func main() {
 	gin.SetMode(gin.ReleaseMode)
 
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "/app/data"
+	// Subcommands: "serve" (default), "check", "rebroadcast" and "conformance"
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("RELAY_CONFIG"), "YAML config file keyed by environment variable names")
+	var rebroadcast *rebroadcastOptions
+	if command == "rebroadcast" {
+		rebroadcast = rebroadcastFlags(flags)
+	}
+	var conformance *conformanceOptions
+	if command == "conformance" {
+		conformance = conformanceFlags(flags)
 	}
+	flags.Parse(args)
 
-	// Initialize relay with notification URL
-	notifyURL := os.Getenv("NOTIFY_URL")
-	if notifyURL == "" {
-		notifyURL = "http://nostr-home:3000/api/update-cache" // Default to docker service name
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+	cfg := LoadConfig()
+
+	switch command {
+	case "serve":
+	case "check":
+		os.Exit(runCheck(cfg))
+	case "rebroadcast":
+		os.Exit(runRebroadcast(cfg, rebroadcast))
+	case "conformance":
+		os.Exit(runConformance(cfg, conformance))
+	default:
+		log.Fatalf("Unknown command %q (serve, check, rebroadcast or conformance)", command)
 	}
 
 	var err error
-	relay, err = NewRelay(dataDir, notifyURL)
+	relay, err = NewRelay(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create relay: %v", err)
 	}
-	defer relay.Close()
 
 	router := gin.Default()
 
@@ -116,44 +213,286 @@ func main() {
 
 	// WebSocket endpoint
 	router.GET("/ws", handleWebSocket)
-	router.GET("/", handleWebSocket)
+	router.GET("/ws-private", handlePrivateWebSocket)
+	router.GET("/", handleRoot)
+
+	// Embedded NIP-07 test client for debugging the protocol from a browser
+	router.GET("/client", handleClientPage)
 
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok", "clients": len(relay.clients)})
+		if reason := relay.readOnly(); reason != "" {
+			c.JSON(503, gin.H{"status": "degraded", "read_only": true, "reason": reason, "clients": len(relay.clients)})
+			return
+		}
+		health := gin.H{"status": "ok", "clients": len(relay.clients)}
+		if clock, ok := relay.clockStatus(); clock != nil {
+			health["clock"] = clock
+			if !ok {
+				health["status"] = "degraded"
+			}
+		}
+		c.JSON(200, health)
 	})
 
-	// Stats endpoint
-	router.GET("/stats", func(c *gin.Context) {
+	// Stats endpoint, for auditors unless RELAY_PUBLIC_STATS is set
+	statsAccess := requireRole(roleAuditor)
+	if relay.cfg.PublicStats {
+		statsAccess = func(c *gin.Context) {}
+	}
+	router.GET("/stats", statsAccess, func(c *gin.Context) {
 		stats := relay.getStats()
 		c.JSON(200, stats)
 	})
 
-	log.Printf("🚀 Nostr Relay starting on :7447")
-	log.Printf("📡 WebSocket endpoint: ws://localhost:7447/ws")
-	log.Printf("📊 Stats endpoint: http://localhost:7447/stats")
-	log.Printf("📮 Notifications: %s", notifyURL)
+	// Build and feature information for operators and bug reports
+	router.GET("/version", handleVersion)
+
+	// Storage quota for the NIP-98 authenticated pubkey
+	router.GET("/api/quota", requireNIP98(), handleQuota)
+
+	// Owner's yearly activity report
+	router.GET("/api/report/:year", handleYearReport)
+
+	// Top fans of the owner for the home page
+	router.GET("/api/leaderboard", handleLeaderboard)
+
+	// The owner's follow and interaction graph for Gephi and similar tools
+	router.GET("/api/graph/export", requireOwner(), handleGraphExport)
+
+	// Near-duplicate detection for the owner's publishing tools
+	router.POST("/api/publish/duplicates", requireOwner(), handleDuplicateCheck)
+
+	// Webhook ingest: JSON payloads become events signed by the bot key
+	router.POST("/api/ingest/webhook/:source", handleWebhookIngest)
+
+	// External copies of cross-posted events
+	router.GET("/api/crossposts/:id", handleCrossPosts)
+
+	// Events referencing an addressable event, e.g. comments on an article
+	router.GET("/api/addresses/referenced-by", handleAddressReferences)
+
+	// Quote, mention and reply graph between stored events
+	router.GET("/api/events/:id/references", handleEventReferences)
+	router.GET("/api/events/:id/referenced-by", handleEventReferencedBy)
+
+	// Typed payloads of file metadata, listings and calendar events
+	router.GET("/api/events/:id/payload", handleEventPayload)
+	router.GET("/api/files", handleFiles)
+	router.GET("/api/listings", handleListings)
+	router.GET("/api/calendar", handleCalendar)
+
+	// NIP-34 repositories and the patches sent to them
+	router.GET("/api/git/repos", handleRepos)
+	router.GET("/api/git/repos/:pubkey/:d", handleRepo)
+	router.GET("/api/git/repos/:pubkey/:d/patches", handleRepoPatches)
+
+	// NIP-88 polls with results tallied here
+	router.GET("/api/polls", handlePolls)
+	router.GET("/api/polls/:id", handlePoll)
+
+	// NIP-54 wiki articles and NIP-32 labels for the owner's knowledge base
+	router.GET("/api/wiki", handleWiki)
+	router.GET("/api/wiki/:d", handleWikiArticle)
+	router.GET("/api/labels", handleNIP32Labels)
+
+	// The owner's NIP-38 statuses for the home page's "now" widget
+	router.GET("/api/status", handleStatus)
+
+	// Everything the home page needs at startup, in one ETagged response
+	router.GET("/api/bootstrap", handleBootstrap)
+
+	// The owner's NIP-84 highlights, grouped by source
+	router.GET("/api/highlights", handleHighlights)
+
+	// NIP-35 torrent search, with magnet links
+	router.GET("/api/torrents", handleTorrents)
+
+	// Abuse reports from web visitors, signed with the service key
+	router.POST("/api/report", handleSubmitReport)
+
+	// The owner's calendar events for regular calendar apps
+	router.GET("/calendar.ics", handleCalendarICS)
+
+	// Edit history of the owner's articles as unified diffs
+	router.GET("/api/articles/:d/diff", requireOwner(), handleArticleDiff)
+
+	// The owner's replaceable and addressable events as of a past time
+	router.GET("/api/versions/:kind", requireOwner(), handleVersionAsOf)
+	router.GET("/api/versions/:kind/history", requireOwner(), handleVersionHistory)
+
+	// Per-relay answers for events copied to the mirror relays
+	router.GET("/api/mirror/status/:event_id", requireOwner(), handleMirrorStatus)
+
+	// Availability of the mirrors and the owner's NIP-65 relays
+	router.GET("/api/relays/health", handleUpstreamHealth)
+	router.POST("/api/relays/probe", requireOwner(), handleProbeUpstreams)
+
+	// Anyone's read and write relays from their NIP-65 list
+	router.GET("/api/relaylist/:pubkey", handleRelayList)
+
+	// Suggested NIP-65 relay list based on probes and mirror deliveries
+	router.GET("/api/relays/suggestion", requireOwner(), handleRelaySuggestion)
+	router.POST("/api/relays/suggestion", requireOwner(), handlePublishRelayList)
+
+	// Admin API, gated by role (see ADMIN_CONFIG)
+	admin := router.Group("/api/admin")
+	admin.GET("/whoami", requireRole(roleAuditor), handleWhoAmI)
+	admin.GET("/admins", requireRole(roleOwner), handleListAdmins)
+	admin.GET("/bans", requireRole(roleAuditor), handleListBans)
+	admin.POST("/bans", requireRole(roleModerator), handleBanPubkey)
+	admin.DELETE("/bans/:pubkey", requireRole(roleModerator), handleUnbanPubkey)
+	admin.DELETE("/events/:id", requireRole(roleModerator), handleAdminDeleteEvent)
+	admin.GET("/reports", requireRole(roleAuditor), handleListReports)
+	admin.POST("/reports/:id/dismiss", requireRole(roleModerator), handleDismissReports)
+	admin.POST("/reports/:id/action", requireRole(roleModerator), handleReportAction)
+	admin.GET("/audit", requireRole(roleAuditor), handleAuditExport)
+	admin.GET("/clients", requireRole(roleAuditor), handleListClients)
+	admin.GET("/subscriptions", requireRole(roleAuditor), handleSubscriptionStats)
+	admin.GET("/analytics/daily", requireRole(roleAuditor), handleDailyAnalytics)
+	admin.POST("/aggregates/reconcile", requireRole(roleOwner), handleReconcileAggregates)
+	admin.POST("/gc", requireRole(roleOwner), handleGarbageCollection)
+	admin.GET("/taps", requireRole(roleOwner), handleListTaps)
+	admin.POST("/taps", requireRole(roleOwner), handleStartFileTap)
+	admin.GET("/taps/stream", requireRole(roleOwner), handleTapStream)
+	admin.DELETE("/taps/:id", requireRole(roleOwner), handleStopTap)
+	admin.GET("/pins", requireRole(roleOwner), handleListPins)
+	admin.POST("/pins", requireRole(roleOwner), handlePin)
+	admin.DELETE("/pins", requireRole(roleOwner), handleUnpin)
+	admin.GET("/automation", requireRole(roleAuditor), handleAutomationLog)
+	admin.GET("/notify", requireRole(roleAuditor), handleNotifyStatus)
+	admin.GET("/features", requireRole(roleAuditor), handleListFeatures)
+	admin.PUT("/features/:name", requireRole(roleOwner), handleSetFeature)
+	admin.DELETE("/features/:name", requireRole(roleOwner), handleResetFeature)
+	admin.POST("/notify/flush", requireRole(roleModerator), handleNotifyFlush)
+	admin.GET("/replication", requireRole(roleAuditor), handleReplicationStatus)
+	admin.POST("/replication/sync", requireRole(roleOwner), handleReplicationSync)
+	admin.GET("/verify", requireRole(roleAuditor), handleVerifyStatus)
+	admin.DELETE("/verify", requireRole(roleOwner), handleVerifyReset)
+	admin.GET("/faults", requireRole(roleAuditor), handleFaultStats)
+	admin.GET("/cache", requireRole(roleAuditor), handleCacheStatus)
+	admin.DELETE("/cache", requireRole(roleOwner), handlePurgeCache)
+	admin.GET("/indexes", requireRole(roleAuditor), handleIndexAdvice)
+	admin.POST("/indexes/:name", requireRole(roleOwner), handleCreateIndex)
+	admin.DELETE("/indexes/:name", requireRole(roleOwner), handleDropIndex)
+
+	// Owner's private labels and notes on stored events
+	annotations := router.Group("/api/annotations", requireOwner())
+	annotations.GET("", handleListAnnotations)
+	annotations.GET("/labels", handleListLabels)
+	annotations.GET("/:id", handleGetAnnotation)
+	annotations.PUT("/:id", handleSetAnnotation)
+	annotations.DELETE("/:id", handleDeleteAnnotation)
+
+	// Owner's unsigned drafts, synced between devices and optionally scheduled
+	drafts := router.Group("/api/drafts", requireOwner())
+	drafts.GET("", handleListDrafts)
+	drafts.POST("", handleCreateDraft)
+	drafts.GET("/:id", handleGetDraft)
+	drafts.PUT("/:id", handleUpdateDraft)
+	drafts.DELETE("/:id", handleDeleteDraft)
+	drafts.POST("/:id/publish", handlePublishDraft)
+
+	// Featured notes and articles for the home page
+	router.GET("/api/pinned", handlePinned)
+
+	// Push device registration for the owner's mobile client
+	push := router.Group("/api/push", requireOwner())
+	push.GET("/devices", handleListDevices)
+	push.POST("/devices", handleRegisterDevice)
+	push.DELETE("/devices/:id", handleRemoveDevice)
+
+	// NIP-96 file storage for the owner's media
+	router.GET("/.well-known/nostr/nip96.json", handleNIP96Info)
+	router.POST("/upload", requireOwner(), handleUpload)
+	router.DELETE("/upload/:name", requireOwner(), handleDeleteUpload)
+	router.GET("/media/:name", handleMedia)
+
+	// Keyword and hashtag alerts for the owner
+	alerts := router.Group("/api/alerts", requireOwner())
+	alerts.GET("/keywords", handleListKeywords)
+	alerts.POST("/keywords", handleAddKeyword)
+	alerts.DELETE("/keywords/:keyword", handleRemoveKeyword)
+	alerts.GET("/matches", handleKeywordMatches)
+
+	listener, err := listen(cfg.ListenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	log.Printf("🚀 Nostr Relay starting on %s", listener.Addr())
+	log.Printf("📡 WebSocket endpoint: ws://%s/ws", listener.Addr())
+	log.Printf("🔒 Private WebSocket endpoint: ws://%s/ws-private", listener.Addr())
+	log.Printf("📊 Stats endpoint: http://%s/stats", listener.Addr())
+	log.Printf("📮 Notifications: %s", cfg.NotifyURL)
 	
-	log.Fatal(router.Run(":7447"))
+	server := &http.Server{Handler: router}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	relay.announceUpgradeReady()
+	
+	// Tell systemd (Type=notify) we are serving, and keep its watchdog fed
+	sdNotify("READY=1\nSTATUS=Serving on " + listener.Addr().String())
+	if interval := watchdogInterval(); interval > 0 {
+		go relay.runWatchdog(interval)
+	}
+
+	// Shut down cleanly on SIGINT/SIGTERM so state is flushed before exit;
+	// SIGHUP restarts gracefully into the binary now on disk: the listening
+	// socket carries over, open connections are drained and closed
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for waiting := true; waiting; {
+		select {
+		case <-stop:
+			waiting = false
+		case <-reload:
+			log.Printf("🔄 Upgrading relay binary...")
+			handover, err := relay.upgrade(listener)
+			if err != nil {
+				log.Printf("❌ Upgrade failed, still serving: %v", err)
+				continue
+			}
+			relay.drainAfterUpgrade(server, handover)
+			return
+		}
+	}
+
+	log.Printf("🛑 Shutting down...")
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	relay.Close()
 }
 
 // NewRelay creates a new relay instance
-func NewRelay(dataDir string, notifyURL string) (*Relay, error) {
+func NewRelay(cfg *Config) (*Relay, error) {
+	dataDir := cfg.DataDir
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %v", err)
 	}
 
-	dbPath := dataDir + "/relay.db"
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
-	}
-
 	relay := &Relay{
-		db:        db,
+		cfg:       cfg,
 		clients:   make(map[string]*Client),
+		taps:      make(map[string]*frameTap),
+		latency:   newLatencyTracker(cfg),
+		clock:     &clockMonitor{},
+		protocol:  newProtocolGuard(cfg),
+		sends:     newSendBudget(cfg),
+		indexes:   newIndexAdvisor(cfg),
+		sessions:  newSessionStore(cfg.SessionWindow),
 		dataDir:   dataDir,
-		notifyURL: notifyURL,
+		notify:    newNotifier(cfg.NotifyURL),
+		faults:    newFaultInjector(cfg),
+		searchEnabled: enableSearch(),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
@@ -161,69 +500,313 @@ func NewRelay(dataDir string, notifyURL string) (*Relay, error) {
 		},
 	}
 
-	if err := relay.initDatabase(); err != nil {
-		return nil, fmt.Errorf("failed to initialize database: %v", err)
+	kinds, err := newKindPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	relay.kinds = kinds
+	if relay.notify != nil {
+		relay.notify.faults = relay.faults
+	}
+
+	relay.auth, err = newAuthPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	relay.endpoints, err = newEndpointPolicy(cfg)
+	if err != nil {
+		return nil, err
 	}
 
+	relay.gate, err = newConnectionGate(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	relay.cacheTTLs, err = parseCacheTTLs(cfg.CacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RELAY_CACHE_TTL: %v", err)
+	}
+
+	relay.pow, err = newPowPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := restoreFromReplica(cfg); err != nil {
+		return nil, err
+	}
+
+	// Every database is verified before any is opened, so a damaged one is
+	// never migrated or written to
+	dbPath := dataDir + "/relay.db"
+	relay.verifyDatabase(dbPath)
+
+	if cfg.Partitioning == "monthly" {
+		relay.partitions, err = newPartitionSet(dataDir+"/partitions", relay.verifyDatabase,
+			func() bool { return relay.readOnly() != "" })
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := relay.openMainDatabase(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	relay.db = db
+
+	if relay.readOnly() == "" {
+		if relay.partitions != nil {
+			if err := relay.migrateToPartitions(); err != nil {
+				return nil, fmt.Errorf("failed to migrate events into partitions: %v", err)
+			}
+		}
+		if err := relay.initDatabase(); err != nil {
+			return nil, fmt.Errorf("failed to initialize database: %v", err)
+		}
+	}
+	if relay.partitions != nil {
+		go relay.partitionMaintenance()
+	}
+
+	relay.replicator = newReplicator(relay)
+
+	relay.verifier, err = newReadVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	relay.features, err = loadFeatureFlags(cfg, db)
+	if err != nil {
+		return nil, err
+	}
+
+	relay.push, err = newPushGateway(cfg)
+	if err != nil {
+		return nil, err
+	}
+	relay.selfHostedPush = newSelfHostedPush(cfg)
+	relay.watch, err = loadKeywordWatch(db, cfg)
+	if err != nil {
+		return nil, err
+	}
+	relay.groups, err = loadGroups(db)
+	if err != nil {
+		return nil, err
+	}
+
+	relay.admins, err = loadAdmins(cfg.AdminConfig, cfg.OwnerPubkey)
+	if err != nil {
+		return nil, err
+	}
+	if err := relay.loadBans(); err != nil {
+		return nil, err
+	}
+
+	relay.identity, err = loadRelayIdentity(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("🔑 Relay key %s", relay.identity.pubkey[:8])
+
+	if cfg.IngestConfig != "" {
+		relay.ingest, err = loadWebhookIngest(cfg.IngestConfig, cfg.IngestBotKey, relay.identity.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.OwnerSigningKey != "" {
+		relay.owner, err = loadOwnerSigner(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.CrossPostConfig != "" {
+		relay.crossPostTargets, err = loadCrossPostTargets(cfg.CrossPostConfig)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("🔀 Cross-posting to %d targets", len(relay.crossPostTargets))
+	}
+
+	if cfg.AutomationConfig != "" {
+		relay.automation, err = loadAutomation(cfg)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("🤖 Running %d automation rules", len(relay.automation.rules))
+	}
+
+	if cfg.AutoReplyMessage != "" {
+		relay.autoReply, err = loadAutoReply(cfg)
+		if err != nil {
+			return nil, err
+		}
+		go relay.runAutoReplies()
+		log.Printf("💬 Auto-replying to DMs left unanswered for %s", cfg.AutoReplyDelay)
+	}
+
+	if cfg.ReportsPerHour > 0 {
+		relay.reports = newAbuseReports(cfg, relay.identity)
+		log.Printf("🚩 Accepting visitor reports, signed by %s", relay.reports.pubkey[:8])
+	}
+
+	if cfg.PersistSessions {
+		if err := relay.loadSessions(); err != nil {
+			log.Printf("⚠️  Failed to restore sessions: %v", err)
+		}
+		go relay.persistSessionsPeriodically()
+	}
+
+	go relay.backfillSimhashes()
+	go relay.pruneSuperseded()
+	go func() {
+		relay.backfillSketches()
+		relay.reconcileAggregates()
+	}()
+
 	// Start cleanup routine
 	go relay.cleanupClients()
+	go relay.runAnnouncements()
+	if relay.notify != nil {
+		go relay.notify.run()
+	}
+	go relay.sessions.expire()
+	go relay.latency.watchSLOs(time.Minute)
+	go relay.runProbes()
+	go relay.runClockChecks()
+	go relay.runGarbageCollection()
+	go relay.runExpirationSweeper()
+	go relay.runDraftScheduler()
+	go relay.runAdaptiveIndexing()
+	if relay.replicator != nil {
+		go relay.replicator.run()
+	}
 
 	return relay, nil
 }
 
 // initDatabase creates the necessary tables
 func (r *Relay) initDatabase() error {
-	query := `
-		CREATE TABLE IF NOT EXISTS relay_events (
-			id TEXT PRIMARY KEY,
-			pubkey TEXT NOT NULL,
-			created_at INTEGER NOT NULL,
-			kind INTEGER NOT NULL,
-			tags TEXT NOT NULL,
-			content TEXT NOT NULL,
-			sig TEXT NOT NULL,
-			received_at INTEGER NOT NULL
-		);
-		
-		CREATE INDEX IF NOT EXISTS idx_pubkey ON relay_events(pubkey);
-		CREATE INDEX IF NOT EXISTS idx_kind ON relay_events(kind);
-		CREATE INDEX IF NOT EXISTS idx_created_at ON relay_events(created_at);
-		CREATE INDEX IF NOT EXISTS idx_received_at ON relay_events(received_at);
-	`
+	version := databaseVersion(r.db)
+
+	// Events live in monthly partitions when partitioning is enabled
+	if r.partitions == nil {
+		if err := initEventDB(r.db); err != nil {
+			return err
+		}
+	}
 	
-	_, err := r.db.Exec(query)
+	for _, schema := range []string{pushSchema, sessionSchema, simhashSchema, crosspostSchema, banSchema, auditSchema, sketchSchema, aggregateSchema, mirrorSchema, probeSchema, annotationSchema, pinSchema, draftSchema, automationSchema, reportDismissalSchema, featureFlagSchema, deletionSchema, versionHistorySchema, keywordSchema, mediaSchema, groupSchema, autoReplySchema} {
+		if _, err := r.db.Exec(schema); err != nil {
+			return err
+		}
+	}
+	// Sketches hashed the old way are dropped; backfillSketches rebuilds them
+	if version < eventKeyVersion {
+		if _, err := r.db.Exec("DELETE FROM count_sketches"); err != nil {
+			return err
+		}
+		if _, err := r.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", eventKeyVersion)); err != nil {
+			return err
+		}
+	}
+	// Sessions are bound to the pubkey and endpoint that opened them
+	if err := ensureColumn(r.db, "relay_sessions", "pubkey", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return ensureColumn(r.db, "relay_sessions", "private", "INTEGER NOT NULL DEFAULT 0")
+}
+
+// ensureColumn adds a column to a table created before the column existed
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
 	return err
 }
 
 // Close closes the relay
 func (r *Relay) Close() error {
+	if r.cfg.PersistSessions {
+		if err := r.persistSessions(); err != nil {
+			log.Printf("❌ Failed to persist sessions: %v", err)
+		}
+	}
+	
 	r.clientsMutex.Lock()
 	for _, client := range r.clients {
 		client.Conn.Close()
 	}
 	r.clientsMutex.Unlock()
 	
-	return r.db.Close()
+	if r.partitions != nil {
+		r.partitions.Close()
+	}
+	
+	err := r.db.Close()
+	// Litestream ships the last writes once the databases are closed
+	if r.replicator != nil {
+		r.replicator.Stop()
+	}
+	return err
 }
 
 // getStats returns relay statistics
 func (r *Relay) getStats() map[string]interface{} {
 	var eventCount int
-	r.db.QueryRow("SELECT COUNT(*) FROM relay_events").Scan(&eventCount)
+	for _, db := range r.eventDBs(nil, nil) {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM relay_events").Scan(&n)
+		eventCount += n
+	}
 	
 	r.clientsMutex.RLock()
 	clientCount := len(r.clients)
 	r.clientsMutex.RUnlock()
 	
 	return map[string]interface{}{
-		"events":  eventCount,
-		"clients": clientCount,
+		"events":    eventCount,
+		"clients":   clientCount,
+		"latency":   r.latency.snapshot(),
+		"upstreams": r.upstreamSummary(),
+		"protocol":  r.protocol.stats(),
+		"notify":    r.notify.stats(),
+		"send_buffers": r.sends.stats(),
+		"connections": r.gate.stats(),
 	}
 }
 
 func handleWebSocket(c *gin.Context) {
-	conn, err := relay.upgrader.Upgrade(c.Writer, c.Request, nil)
+	serveWebSocket(c, false)
+}
+
+// serveWebSocket upgrades a connection to one of the WebSocket endpoints
+func serveWebSocket(c *gin.Context, private bool) {
+	if relay.protocol.rejectBlocked(c) {
+		return
+	}
+	release, ok := relay.gate.admit(c)
+	if !ok {
+		return
+	}
+
+	// Only offer the CBOR subprotocol while its feature flag is on
+	upgrader := relay.upgrader
+	if relay.features.enabled("binary_protocol") {
+		upgrader.Subprotocols = []string{cborSubprotocol}
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
+		release()
 		log.Printf("WebSocket upgrade failed: %v", err)
 		return
 	}
@@ -232,9 +815,19 @@ func handleWebSocket(c *gin.Context) {
 		ID:            generateClientID(),
 		Conn:          conn,
 		Subscriptions: make(map[string]*Subscription),
-		Send:          make(chan []byte, 256),
+		Send:          relay.sends.newQueue(),
 		Relay:         relay,
 		lastSeen:      time.Now(),
+		binary:        conn.Subprotocol() == cborSubprotocol,
+		remoteAddr:    c.ClientIP(),
+		userAgent:     c.Request.UserAgent(),
+		challenge:     newChallenge(),
+		relayHost:     c.Request.Host,
+		release:       release,
+		private:       private,
+	}
+	if host := c.GetHeader("X-Forwarded-Host"); host != "" {
+		client.relayHost = host
 	}
 
 	relay.clientsMutex.Lock()
@@ -245,6 +838,7 @@ func handleWebSocket(c *gin.Context) {
 
 	go client.writePump()
 	go client.readPump()
+	client.sendChallenge()
 }
 
 func generateClientID() string {
@@ -257,11 +851,17 @@ func (c *Client) readPump() {
 		c.Relay.clientsMutex.Lock()
 		delete(c.Relay.clients, c.ID)
 		c.Relay.clientsMutex.Unlock()
+		if c.session() != "" {
+			c.Relay.sessions.suspend(c)
+		}
+		c.Relay.stopTapsFor(c.ID)
+		c.Send.close("")
 		c.Conn.Close()
+		c.release()
 		log.Printf("Client %s disconnected", c.ID)
 	}()
 
-	c.Conn.SetReadLimit(1024 * 1024) // 1MB
+	c.Conn.SetReadLimit(int64(c.Relay.cfg.MaxMessageBytes))
 	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -269,7 +869,7 @@ func (c *Client) readPump() {
 	})
 
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		messageType, message, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Client %s read error: %v", c.ID, err)
@@ -277,8 +877,33 @@ func (c *Client) readPump() {
 			break
 		}
 
+		if messageType == websocket.BinaryMessage {
+			message, err = cborToJSON(message)
+			if err != nil {
+				c.protocolError("Invalid CBOR: %v", err)
+				if c.overBudget() {
+					c.disconnectForViolations()
+					break
+				}
+				continue
+			}
+		}
+
+		// An injected fault drops the connection as a network failure would,
+		// without a close frame and before the message is handled
+		if c.Relay.faults.dropConnection() {
+			log.Printf("⚠️  Fault injection dropped client %s", c.ID)
+			break
+		}
+		
 		c.lastSeen = time.Now()
+		c.Relay.tapFrame(c, "in", message)
 		c.handleMessage(message)
+
+		if c.overBudget() {
+			c.disconnectForViolations()
+			break
+		}
 	}
 }
 
@@ -292,15 +917,39 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.Send.ready:
+			for {
+				message, ok := c.Send.pop()
+				if !ok {
+					break
+				}
+				c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				c.Relay.tapFrame(c, "out", message)
+
+				frameType := websocket.TextMessage
+				if c.binary {
+					encoded, err := jsonToCBOR(message)
+					if err != nil {
+						log.Printf("Client %s CBOR encode error: %v", c.ID, err)
+						continue
+					}
+					message, frameType = encoded, websocket.BinaryMessage
+				}
+
+				if err := c.Conn.WriteMessage(frameType, message); err != nil {
+					log.Printf("Client %s write error: %v", c.ID, err)
+					return
+				}
 			}
 
-			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("Client %s write error: %v", c.ID, err)
+			if closed, reason := c.Send.isClosed(); closed {
+				c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if reason == "" {
+					c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				} else {
+					log.Printf("Client %s disconnected: %s", c.ID, reason)
+					c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason))
+				}
 				return
 			}
 		case <-ticker.C:
@@ -314,19 +963,22 @@ func (c *Client) writePump() {
 
 // handleMessage processes incoming messages
 func (c *Client) handleMessage(message []byte) {
+	c.requestID = newRequestID()
+	
 	var raw []json.RawMessage
 	if err := json.Unmarshal(message, &raw); err != nil {
-		log.Printf("Invalid JSON from client %s: %v", c.ID, err)
+		c.protocolError("Invalid JSON: %v", err)
 		return
 	}
 
 	if len(raw) == 0 {
+		c.protocolError("Empty message")
 		return
 	}
 
 	var messageType string
 	if err := json.Unmarshal(raw[0], &messageType); err != nil {
-		log.Printf("Invalid message type from client %s: %v", c.ID, err)
+		c.protocolError("Invalid message type: %v", err)
 		return
 	}
 
@@ -337,20 +989,30 @@ func (c *Client) handleMessage(message []byte) {
 		c.handleSubscription(raw)
 	case "CLOSE":
 		c.handleClose(raw)
+	case "COUNT":
+		c.handleCount(raw)
+	case "SESSION":
+		c.handleSession(raw)
+	case "AUTH":
+		c.handleAuth(raw)
 	default:
-		log.Printf("Unknown message type from client %s: %s", c.ID, messageType)
+		c.protocolError("Unknown message type: %s", messageType)
 	}
 }
 
 // handleEvent processes EVENT messages
 func (c *Client) handleEvent(raw []json.RawMessage) {
 	if len(raw) < 2 {
+		c.protocolError("EVENT without an event")
 		return
 	}
 
+	done := c.Relay.latency.track(stageEvent, c.requestID)
+	defer done()
+
 	var event Event
 	if err := json.Unmarshal(raw[1], &event); err != nil {
-		log.Printf("Invalid event from client %s: %v", c.ID, err)
+		c.protocolError("Invalid event: %v", err)
 		return
 	}
 
@@ -360,17 +1022,108 @@ func (c *Client) handleEvent(raw []json.RawMessage) {
 		return
 	}
 
+	if err := event.VerifyDelegation(); err != nil {
+		c.sendOK(event.ID, false, "invalid: "+err.Error())
+		return
+	}
+
+	if c.Relay.isBanned(event.PubKey) || c.Relay.isBanned(delegatorOf(&event)) {
+		c.sendOK(event.ID, false, "blocked: pubkey is banned from this relay")
+		return
+	}
+
+	if c.Relay.isDeleted(&event) {
+		c.sendOK(event.ID, false, "blocked: this event was deleted by its author")
+		return
+	}
+	
+	if isExpired(&event) {
+		c.sendOK(event.ID, false, "invalid: this event has expired")
+		return
+	}
+
+	if reason := c.Relay.checkCreatedAt(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := c.Relay.checkEventSize(&event, len(raw[1])); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := c.Relay.pow.check(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := c.endpointRejection(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := c.authRequiredToWrite(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := c.protectedEventRejection(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := checkReportTags(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := c.Relay.checkFileMetadata(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	if reason := c.Relay.checkGroupEvent(&event); reason != "" {
+		c.sendOK(event.ID, false, reason)
+		return
+	}
+
+	class, _ := c.Relay.kinds.classify(event.Kind)
+	if !c.Relay.kinds.accepts(event.Kind) {
+		c.sendOK(event.ID, false, fmt.Sprintf("blocked: kind %d is not accepted by this relay", event.Kind))
+		return
+	}
+
+	// Ephemeral events only reach current subscribers
+	if class == kindEphemeral {
+		done()
+		c.sendOK(event.ID, true, "")
+		c.Relay.broadcastEvent(&event)
+		return
+	}
+
 	// Handle metadata events
 	if event.Kind == 0 {
 		c.handleMetadata(&event)
 	}
 
 	// Store event
-	if err := c.Relay.storeEvent(&event); err != nil {
+	if err := c.Relay.storeEvent(&event); err == errDuplicate {
+		done()
+		c.sendOK(event.ID, true, "duplicate: "+err.Error())
+		return
+	} else if err == errSuperseded {
+		c.sendOK(event.ID, false, "duplicate: "+err.Error())
+		return
+	} else if errors.Is(err, errPartitionRange) {
+		c.sendOK(event.ID, false, "invalid: "+err.Error())
+		return
+	} else if err != nil {
 		c.sendOK(event.ID, false, fmt.Sprintf("ERROR: Failed to store event: %v", err))
 		return
 	}
+	c.Relay.applyGroupEvent(&event)
 
+	done()
 	c.sendOK(event.ID, true, "")
 
 	// Broadcast to subscribers
@@ -384,57 +1137,58 @@ func (c *Client) validateEvent(event *Event) bool {
 		return false
 	}
 
-	// Verify event ID
-	expectedID := c.calculateEventID(event)
-	if event.ID != expectedID {
-		log.Printf("Event ID mismatch: expected %s, got %s", expectedID, event.ID)
+	// Verify the event ID and signature
+	if err := event.Verify(); err != nil {
+		c.logf("Invalid event %s: %v", event.ID, err)
 		return false
 	}
 
 	return true
 }
 
-// calculateEventID calculates the event ID
-func (c *Client) calculateEventID(event *Event) string {
-	tagsJSON, _ := json.Marshal(event.Tags)
-	
-	serialized := fmt.Sprintf(`[0,"%s",%d,%d,%s,"%s"]`,
-		event.PubKey,
-		event.CreatedAt,
-		event.Kind,
-		string(tagsJSON),
-		event.Content,
-	)
-	
-	hash := sha256.Sum256([]byte(serialized))
-	return hex.EncodeToString(hash[:])
-}
-
 // handleMetadata processes metadata events (kind 0)
 func (c *Client) handleMetadata(event *Event) {
 	log.Printf("📝 Metadata event from %s", event.PubKey[:8])
 }
 
-// sendOK sends an OK message to the client
+// sendOK sends an OK message to the client; rejections are logged with the
+// request ID
 func (c *Client) sendOK(eventID string, success bool, message string) {
-	response := []interface{}{"OK", eventID, success, message}
-	data, _ := json.Marshal(response)
-	
-	select {
-	case c.Send <- data:
-	default:
-		close(c.Send)
+	if !success {
+		c.logf("⛔ Rejected event %s: %s", eventID, message)
 	}
+	response := []interface{}{"OK", eventID, success, c.withRequestID(message)}
+	data, _ := json.Marshal(response)
+	c.Send.push(data, false)
 }
 
 // handleSubscription processes REQ messages
 func (c *Client) handleSubscription(raw []json.RawMessage) {
 	if len(raw) < 3 {
+		c.protocolError("REQ without filters")
 		return
 	}
+	done := c.Relay.latency.track(stageReq, c.requestID)
+	defer done()
 
 	var subID string
 	if err := json.Unmarshal(raw[1], &subID); err != nil {
+		c.protocolError("Invalid subscription id: %v", err)
+		return
+	}
+	if subID == "" || len(subID) > maxSubIDLength {
+		c.protocolError("Subscription id must be 1-%d characters", maxSubIDLength)
+		c.sendJSON([]interface{}{"CLOSED", subID, fmt.Sprintf("invalid: subscription id must be 1-%d characters", maxSubIDLength)})
+		return
+	}
+
+	// Replacing a subscription does not count against the limit
+	c.mu.RLock()
+	_, replacing := c.Subscriptions[subID]
+	open := len(c.Subscriptions)
+	c.mu.RUnlock()
+	if max := c.Relay.cfg.MaxSubscriptions; max > 0 && !replacing && open >= max && !c.isOwner() {
+		c.sendJSON([]interface{}{"CLOSED", subID, fmt.Sprintf("error: too many subscriptions (max %d)", max)})
 		return
 	}
 
@@ -442,15 +1196,36 @@ func (c *Client) handleSubscription(raw []json.RawMessage) {
 	for i := 2; i < len(raw); i++ {
 		var filter Filter
 		if err := json.Unmarshal(raw[i], &filter); err != nil {
+			c.protocolError("Invalid filter: %v", err)
 			continue
 		}
 		filters = append(filters, filter)
 	}
 
+	filters, reason := c.endpointFilters(filters)
+	if reason == "" {
+		reason = c.authRequiredToRead(filters)
+	}
+	if reason != "" {
+		c.sendJSON([]interface{}{"CLOSED", subID, reason})
+		return
+	}
+	if !c.Relay.searchEnabled {
+		for _, filter := range filters {
+			if filter.Search != "" {
+				c.sendJSON([]interface{}{"CLOSED", subID, "unsupported: search is not available on this relay"})
+				return
+			}
+		}
+	}
+
 	subscription := &Subscription{
-		ID:      subID,
-		Filters: filters,
-		Client:  c,
+		ID:        subID,
+		Filters:   filters,
+		matcher:   compileFilters(filters),
+		Client:    c,
+		cursor:    time.Now().Unix(),
+		createdAt: time.Now(),
 	}
 
 	c.mu.Lock()
@@ -459,38 +1234,40 @@ func (c *Client) handleSubscription(raw []json.RawMessage) {
 
 	// Send matching events
 	events := c.Relay.getMatchingEvents(filters)
+	c.Relay.verifier.verify(c.Relay, filters, events)
+	authed := c.authedPubkey()
 	for _, event := range events {
+		if !c.Relay.auth.canRead(&event, authed) || !c.Relay.canReadGroup(&event, authed) {
+			continue
+		}
 		eventData := []interface{}{"EVENT", subID, event}
 		data, _ := json.Marshal(eventData)
 		
-		select {
-		case c.Send <- data:
-		default:
-			close(c.Send)
+		if !c.Send.push(data, true) {
 			return
 		}
+		atomic.AddInt64(&subscription.delivered, 1)
 	}
 
 	// Send EOSE
 	eoseData := []interface{}{"EOSE", subID}
 	data, _ := json.Marshal(eoseData)
-	select {
-	case c.Send <- data:
-	default:
-		close(c.Send)
-	}
+	c.Send.push(data, false)
+	done()
 
-	log.Printf("Sent %d events for subscription %s", len(events), subID)
+	c.logf("Sent %d events for subscription %s", len(events), subID)
 }
 
 // handleClose processes CLOSE messages
 func (c *Client) handleClose(raw []json.RawMessage) {
 	if len(raw) < 2 {
+		c.protocolError("CLOSE without a subscription id")
 		return
 	}
 
 	var subID string
 	if err := json.Unmarshal(raw[1], &subID); err != nil {
+		c.protocolError("Invalid subscription id: %v", err)
 		return
 	}
 
@@ -498,7 +1275,7 @@ func (c *Client) handleClose(raw []json.RawMessage) {
 	delete(c.Subscriptions, subID)
 	c.mu.Unlock()
 
-	log.Printf("Closed subscription %s for client %s", subID, c.ID)
+	c.logf("Closed subscription %s", subID)
 }
 
 // getMatchingEvents retrieves events matching the filters
@@ -506,158 +1283,229 @@ func (r *Relay) getMatchingEvents(filters []Filter) []Event {
 	var events []Event
 	
 	for _, filter := range filters {
-		query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE 1=1"
-		var args []interface{}
-		
-		if len(filter.Authors) > 0 {
-			placeholders := make([]string, len(filter.Authors))
-			for i, author := range filter.Authors {
-				placeholders[i] = "?"
-				args = append(args, author)
+		// Search results are ranked by relevance rather than time
+		if filter.Search != "" && r.searchEnabled {
+			start := time.Now()
+			found, err := r.searchEvents(filter, r.effectiveLimit(filter))
+			if err != nil {
+				log.Printf("Search error: %v", err)
 			}
-			query += " AND pubkey IN (" + strings.Join(placeholders, ",") + ")"
+			events = append(events, found...)
+			r.indexes.record(filter, time.Since(start), len(found))
+			continue
 		}
 		
-		if len(filter.Kinds) > 0 {
-			placeholders := make([]string, len(filter.Kinds))
-			for i, kind := range filter.Kinds {
-				placeholders[i] = "?"
-				args = append(args, kind)
+		where, args := r.filterConditions(filter)
+		query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE " + where +
+			" ORDER BY created_at DESC LIMIT ?"
+		
+		// Partitions are visited newest first, so the limit can be spent in order
+		start := time.Now()
+		limit := r.effectiveLimit(filter)
+		remaining := limit
+		for _, db := range r.eventDBs(filter.Since, filter.Until) {
+			if remaining <= 0 {
+				break
 			}
-			query += " AND kind IN (" + strings.Join(placeholders, ",") + ")"
+			r.faults.dbDelay()
+			
+			rows, err := db.Query(query, append(args, remaining)...)
+			if err != nil {
+				log.Printf("Query error: %v", err)
+				continue
+			}
+			
+			found := scanEvents(rows)
+			rows.Close()
+			
+			events = append(events, found...)
+			remaining -= len(found)
 		}
-		
-		if filter.Since != nil {
-			query += " AND created_at >= ?"
-			args = append(args, *filter.Since)
+		r.indexes.record(filter, time.Since(start), limit-remaining)
+	}
+	
+	return events
+}
+
+// filterConditions builds the SQL WHERE clause and arguments for a filter
+func (r *Relay) filterConditions(filter Filter) (string, []interface{}) {
+	// Expired events are never served, even before the sweeper deletes them
+	where, args := unexpiredCondition()
+	
+	if len(filter.IDs) > 0 {
+		placeholders := make([]string, len(filter.IDs))
+		for i, id := range filter.IDs {
+			placeholders[i] = "?"
+			args = append(args, id)
 		}
-		
-		if filter.Until != nil {
-			query += " AND created_at <= ?"
-			args = append(args, *filter.Until)
+		where += " AND id IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	
+	if len(filter.Authors) > 0 {
+		condition, authorArgs := authorsCondition(filter.Authors)
+		where += " AND " + condition
+		args = append(args, authorArgs...)
+	}
+	
+	if len(filter.Kinds) > 0 {
+		placeholders := make([]string, len(filter.Kinds))
+		for i, kind := range filter.Kinds {
+			placeholders[i] = "?"
+			args = append(args, kind)
 		}
-		
-		query += " ORDER BY created_at DESC"
-		
-		if filter.Limit != nil {
-			query += " LIMIT ?"
-			args = append(args, *filter.Limit)
+		where += " AND kind IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	
+	if filter.Since != nil {
+		where += " AND created_at >= ?"
+		args = append(args, *filter.Since)
+	}
+	
+	if filter.Until != nil {
+		where += " AND created_at <= ?"
+		args = append(args, *filter.Until)
+	}
+	
+	if values, ok := filter.Tags["a"]; ok {
+		condition, addressArgs := addressConditions(values)
+		where += " AND " + condition
+		args = append(args, addressArgs...)
+	}
+	
+	// Other tags go through the generic tag index
+	for _, name := range sortedTagNames(filter.Tags) {
+		if name == "a" {
+			continue
 		}
+		condition, tagArgs := tagConditions(name, filter.Tags[name])
+		where += " AND " + condition
+		args = append(args, tagArgs...)
+	}
+	
+	if filter.Search != "" {
+		condition, searchArgs := r.searchConditions(parseSearch(filter.Search), false)
+		where += " AND " + condition
+		args = append(args, searchArgs...)
+	}
+	
+	return where, args
+}
+
+// scanEvents reads event rows selected as (id, pubkey, created_at, kind, tags, content, sig)
+func scanEvents(rows *sql.Rows) []Event {
+	var events []Event
+	
+	for rows.Next() {
+		var event Event
+		var tagsJSON string
+		
+		err := rows.Scan(
+			&event.ID,
+			&event.PubKey,
+			&event.CreatedAt,
+			&event.Kind,
+			&tagsJSON,
+			&event.Content,
+			&event.Sig,
+		)
 		
-		rows, err := r.db.Query(query, args...)
 		if err != nil {
-			log.Printf("Query error: %v", err)
+			log.Printf("Scan error: %v", err)
 			continue
 		}
 		
-		for rows.Next() {
-			var event Event
-			var tagsJSON string
-			
-			err := rows.Scan(
-				&event.ID,
-				&event.PubKey,
-				&event.CreatedAt,
-				&event.Kind,
-				&tagsJSON,
-				&event.Content,
-				&event.Sig,
-			)
-			
-			if err != nil {
-				log.Printf("Scan error: %v", err)
-				continue
-			}
-			
-			json.Unmarshal([]byte(tagsJSON), &event.Tags)
-			events = append(events, event)
-		}
-		
-		rows.Close()
+		json.Unmarshal([]byte(tagsJSON), &event.Tags)
+		events = append(events, event)
 	}
 	
 	return events
 }
 
+// effectiveLimit returns the filter limit, defaulted and clamped to the configured bounds
+func (r *Relay) effectiveLimit(filter Filter) int {
+	if filter.Limit == nil || *filter.Limit < 0 {
+		return r.cfg.DefaultLimit
+	}
+	if *filter.Limit > r.cfg.MaxLimit {
+		return r.cfg.MaxLimit
+	}
+	return *filter.Limit
+}
+
 // broadcastEvent broadcasts an event to all matching subscriptions
 func (r *Relay) broadcastEvent(event *Event) {
+	defer r.latency.since(stageBroadcast)()
+
 	r.clientsMutex.RLock()
 	defer r.clientsMutex.RUnlock()
 	
-	for _, client := range r.clients {
-		client.mu.RLock()
-		for subID, sub := range client.Subscriptions {
-			if r.eventMatchesFilters(event, sub.Filters) {
-				eventData := []interface{}{"EVENT", subID, event}
-				data, _ := json.Marshal(eventData)
+	if feed := r.feed.Load(); feed != nil {
+		feed.mark(event.ID)
+	}
+	
+	// The owner's connections are served first, so their queues are filled
+	// before a burst to everyone else uses up the send memory
+	owner := r.cfg.OwnerPubkey
+	for _, ownerPass := range []bool{true, false} {
+		for _, client := range r.clients {
+			client.mu.RLock()
+			if isOwner := owner != "" && client.authed == owner; isOwner != ownerPass {
+				client.mu.RUnlock()
+				continue
+			}
+			for subID, sub := range client.Subscriptions {
+				atomic.AddInt64(&sub.evaluated, 1)
+				if sub.matcher.matches(event) && r.auth.canRead(event, client.authed) && r.canReadGroup(event, client.authed) {
+					atomic.AddInt64(&sub.matched, 1)
+					eventData := []interface{}{"EVENT", subID, event}
+					data, _ := json.Marshal(eventData)
 				
-				select {
-				case client.Send <- data:
-				default:
-					close(client.Send)
+					if client.Send.push(data, true) {
+						atomic.StoreInt64(&sub.cursor, time.Now().Unix())
+						atomic.AddInt64(&sub.delivered, 1)
+					}
 				}
 			}
+			client.mu.RUnlock()
 		}
-		client.mu.RUnlock()
 	}
 }
 
-// eventMatchesFilters checks if an event matches any of the filters
-func (r *Relay) eventMatchesFilters(event *Event, filters []Filter) bool {
-	for _, filter := range filters {
-		if r.eventMatchesFilter(event, filter) {
-			return true
-		}
-	}
-	return false
+func formatTags(tags [][]string) string {
+	result, _ := json.Marshal(tags)
+	return string(result)
 }
 
-// eventMatchesFilter checks if an event matches a filter
-func (r *Relay) eventMatchesFilter(event *Event, filter Filter) bool {
-	if len(filter.Authors) > 0 {
-		found := false
-		for _, author := range filter.Authors {
-			if event.PubKey == author {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
-		}
+// errDuplicate is returned by storeEvent for an event already stored
+var errDuplicate = errors.New("already have this event")
+
+// isStored reports whether an event ID is stored, looking in the event's own
+// database through its write transaction, then in every other partition
+func (r *Relay) isStored(eventTx *sql.Tx, db *sql.DB, id string) (bool, error) {
+	var n int
+	if err := eventTx.QueryRow("SELECT COUNT(*) FROM relay_events WHERE id = ?", id).Scan(&n); err != nil || n > 0 {
+		return n > 0, err
 	}
-	
-	if len(filter.Kinds) > 0 {
-		found := false
-		for _, kind := range filter.Kinds {
-			if event.Kind == kind {
-				found = true
-				break
-			}
+	for _, other := range r.eventDBs(nil, nil) {
+		if other == db {
+			continue
 		}
-		if !found {
-			return false
+		if err := other.QueryRow("SELECT COUNT(*) FROM relay_events WHERE id = ?", id).Scan(&n); err != nil || n > 0 {
+			return n > 0, err
 		}
 	}
-	
-	if filter.Since != nil && event.CreatedAt < *filter.Since {
-		return false
-	}
-	
-	if filter.Until != nil && event.CreatedAt > *filter.Until {
-		return false
-	}
-	
-	return true
-}
-
-func formatTags(tags [][]string) string {
-	result, _ := json.Marshal(tags)
-	return string(result)
+	return false, nil
 }
 
 // storeEvent stores an event in the database and notifies the Python app
 func (r *Relay) storeEvent(event *Event) error {
+	if reason := r.readOnly(); reason != "" {
+		return fmt.Errorf("relay is read-only (%s)", reason)
+	}
+	if r.isDeleted(event) {
+		return fmt.Errorf("event was deleted by its author")
+	}
+	
 	tagsJSON, _ := json.Marshal(event.Tags)
 	
 	query := `
@@ -666,7 +1514,52 @@ func (r *Relay) storeEvent(event *Event) error {
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	
-	_, err := r.db.Exec(query,
+	// The event and its derived rows are written in one transaction, so a
+	// crash cannot leave aggregates, simhashes or sketches disagreeing with it.
+	// Holding the sketch lock throughout orders this writer with sketch rebuilds.
+	r.writes.RLock()
+	defer r.writes.RUnlock()
+	r.sketches.mu.Lock()
+	defer r.sketches.mu.Unlock()
+	r.faults.dbDelay()
+	
+	// Older versions of a replaceable event go in the same write, and a
+	// version older than the stored one is refused
+	superseded, err := r.supersededBy(event)
+	if err != nil {
+		return err
+	}
+	
+	db, err := r.eventDB(event.CreatedAt)
+	if err != nil {
+		return err
+	}
+	
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	
+	// A partitioned event lives in another file. Its derived rows commit first:
+	// if the event commit is then lost, reconciliation and GC remove them.
+	eventTx := tx
+	if db != r.db {
+		if eventTx, err = db.Begin(); err != nil {
+			return err
+		}
+		defer eventTx.Rollback()
+	}
+	
+	// A re-sent event changes nothing, so its aggregates, alerts and
+	// automations must not run a second time
+	if stored, err := r.isStored(eventTx, db, event.ID); err != nil {
+		return err
+	} else if stored {
+		return errDuplicate
+	}
+	
+	_, err = eventTx.Exec(query,
 		event.ID,
 		event.PubKey,
 		event.CreatedAt,
@@ -680,45 +1573,112 @@ func (r *Relay) storeEvent(event *Event) error {
 	if err != nil {
 		return err
 	}
+	if err := indexEvent(eventTx, event); err != nil {
+		return err
+	}
 	
-	log.Printf("📝 Stored event %s (kind %d) from %s", event.ID[:8], event.Kind, event.PubKey[:8])
+	// Versions in other partitions commit right after the event; a crash in
+	// between leaves them for pruneSuperseded at the next start
+	var versionTxs []*sql.Tx
+	for _, v := range superseded {
+		vtx := eventTx
+		if v.db != db {
+			if vtx, err = v.db.Begin(); err != nil {
+				return err
+			}
+			defer vtx.Rollback()
+			versionTxs = append(versionTxs, vtx)
+		}
+		if r.keepsHistory(event) {
+			key, _ := r.versionKey(event)
+			if err := r.archiveVersion(tx, vtx, key, v.id, time.Now().Unix()); err != nil {
+				return fmt.Errorf("failed to keep superseded version: %v", err)
+			}
+		}
+		if err := removeVersion(vtx, v.id); err != nil {
+			return fmt.Errorf("failed to remove superseded event: %v", err)
+		}
+	}
 	
-	// Trigger notification to Python app (throttled to avoid spam)
-	go r.notifyPythonApp()
+	// Aggregates go first: their upsert takes the write lock before any read
+	if err := r.aggregate(tx, event); err != nil {
+		return fmt.Errorf("failed to update daily aggregates: %v", err)
+	}
+	if err := r.indexSimhash(tx, event); err != nil {
+		return fmt.Errorf("failed to index simhash: %v", err)
+	}
+	if err := r.addToSketches(tx, event); err != nil {
+		return fmt.Errorf("failed to update count sketches: %v", err)
+	}
 	
-	return nil
-}
-
-// notifyPythonApp sends a notification to the Python application
-func (r *Relay) notifyPythonApp() {
-	r.notifyMutex.Lock()
-	defer r.notifyMutex.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if eventTx != tx {
+		if err := eventTx.Commit(); err != nil {
+			return err
+		}
+	}
+	for _, vtx := range versionTxs {
+		if err := vtx.Commit(); err != nil {
+			log.Printf("❌ Failed to remove superseded versions: %v", err)
+		}
+	}
+	for _, v := range superseded {
+		r.forgetEvent(v.id)
+	}
 	
-	// Throttle notifications - only send one every 30 seconds
-	if time.Since(r.lastNotify) < 30*time.Second {
-		return
+	log.Printf("📝 Stored event %s (kind %d) from %s", event.ID[:8], event.Kind, event.PubKey[:8])
+	
+	// Deletions take effect before the OK, so the author never sees the
+	// deleted events served again
+	if event.Kind == kindDeletion {
+		r.applyDeletion(event)
+	}
+	
+	// Queue a notification to the Python app (throttled to avoid spam)
+	if r.notify != nil {
+		replaced := make([]string, len(superseded))
+		for i, v := range superseded {
+			replaced[i] = v.id
+		}
+		r.notify.enqueue(r.cacheChanges(event, replaced))
 	}
 	
-	r.lastNotify = time.Now()
+	// Alert the owner about mentions, DMs, zaps and watched keywords
+	go r.dispatchOwnerAlerts(event)
 	
-	log.Printf("🔔 Notifying Python app for cache update...")
+	// An edited article or other new version is not cross-posted again
+	if len(r.crossPostTargets) > 0 && len(superseded) == 0 {
+		go r.crossPost(event)
+	}
 	
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+	if r.automation != nil {
+		go r.runAutomation(event)
 	}
 	
-	resp, err := client.Post(r.notifyURL, "application/json", bytes.NewBuffer([]byte("{}")))
-	if err != nil {
-		log.Printf("❌ Failed to notify Python app: %v", err)
-		return
+	if r.autoReply != nil {
+		go r.observeDM(event)
 	}
-	defer resp.Body.Close()
 	
-	if resp.StatusCode == 200 {
-		log.Printf("✅ Python app notified successfully")
-	} else {
-		log.Printf("⚠️  Python app notification returned status: %d", resp.StatusCode)
+	if len(r.cfg.MirrorRelays) > 0 && event.PubKey == r.cfg.OwnerPubkey && !isProtected(event) {
+		go r.mirrorEvent(event)
 	}
+	
+	return nil
+}
+
+// publishLocal stores a relay-originated event and delivers it to subscribers.
+// An event already stored was delivered when it arrived, so it is not an error.
+func (r *Relay) publishLocal(event *Event) error {
+	if err := r.storeEvent(event); err == errDuplicate {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	
+	r.broadcastEvent(event)
+	return nil
 }
 
 // cleanupClients removes inactive clients
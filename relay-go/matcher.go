@@ -0,0 +1,197 @@
+package main
+
+// Every live event is tested against every open subscription, so filters are
+// compiled once at REQ time into sets and bitmaps. Matching an event is then a
+// handful of lookups that allocate nothing, however long the filter's lists.
+
+// maxKindBitmap bounds the kind bitmap; larger kinds go to a map
+const maxKindBitmap = 1 << 16
+
+// kindSet is a set of kinds: a bitmap for common kinds, a map for the rest
+type kindSet struct {
+	bits  []uint64
+	large map[int]bool
+}
+
+// add puts a kind in the set
+func (s *kindSet) add(kind int) {
+	if kind < 0 || kind >= maxKindBitmap {
+		if s.large == nil {
+			s.large = map[int]bool{}
+		}
+		s.large[kind] = true
+		return
+	}
+	word := kind / 64
+	if word >= len(s.bits) {
+		bits := make([]uint64, word+1)
+		copy(bits, s.bits)
+		s.bits = bits
+	}
+	s.bits[word] |= 1 << (uint(kind) % 64)
+}
+
+// has reports whether a kind is in the set
+func (s *kindSet) has(kind int) bool {
+	if kind < 0 || kind >= maxKindBitmap {
+		return s.large[kind]
+	}
+	word := kind / 64
+	return word < len(s.bits) && s.bits[word]&(1<<(uint(kind)%64)) != 0
+}
+
+// filterMatcher is a filter compiled for matching live events. A nil set
+// means the filter does not constrain that field.
+type filterMatcher struct {
+	ids      map[string]bool
+	authors  map[string]bool
+	kinds    *kindSet
+	since    int64
+	hasSince bool
+	until    int64
+	hasUntil bool
+	// addresses are the #a values, parsed so that equivalent spellings match
+	addresses map[address]bool
+	// tags are the other tag constraints, all of which must be met
+	tags []tagConstraint
+	// words are the search words, which must all occur in the content
+	words []string
+}
+
+// tagConstraint is a "#x" filter entry: the event needs an x tag with one of
+// the values
+type tagConstraint struct {
+	name   string
+	values map[string]bool
+}
+
+// compileFilter builds the matcher for a filter
+func compileFilter(filter Filter) filterMatcher {
+	var m filterMatcher
+	if len(filter.IDs) > 0 {
+		m.ids = make(map[string]bool, len(filter.IDs))
+		for _, id := range filter.IDs {
+			m.ids[id] = true
+		}
+	}
+	if len(filter.Authors) > 0 {
+		m.authors = make(map[string]bool, len(filter.Authors))
+		for _, author := range filter.Authors {
+			m.authors[author] = true
+		}
+	}
+	if len(filter.Kinds) > 0 {
+		m.kinds = &kindSet{}
+		for _, kind := range filter.Kinds {
+			m.kinds.add(kind)
+		}
+	}
+	if filter.Since != nil {
+		m.since, m.hasSince = *filter.Since, true
+	}
+	if filter.Until != nil {
+		m.until, m.hasUntil = *filter.Until, true
+	}
+	if values, ok := filter.Tags["a"]; ok {
+		m.addresses = make(map[address]bool, len(values))
+		for _, value := range values {
+			if addr, ok := parseAddress(value); ok {
+				m.addresses[addr] = true
+			}
+		}
+	}
+	for _, name := range sortedTagNames(filter.Tags) {
+		if name == "a" {
+			continue
+		}
+		constraint := tagConstraint{name: name, values: make(map[string]bool, len(filter.Tags[name]))}
+		for _, value := range filter.Tags[name] {
+			constraint.values[value] = true
+		}
+		m.tags = append(m.tags, constraint)
+	}
+	if filter.Search != "" {
+		// Spam reports come after the event, so only the words apply live
+		if q := parseSearch(filter.Search); len(q.words) > 0 {
+			m.words = q.words
+		}
+	}
+	return m
+}
+
+// matches reports whether an event passes the filter
+func (m *filterMatcher) matches(event *Event) bool {
+	if m.ids != nil && !m.ids[event.ID] {
+		return false
+	}
+	if m.authors != nil && !m.authors[event.PubKey] && !m.authors[delegatorOf(event)] {
+		return false
+	}
+	if m.kinds != nil && !m.kinds.has(event.Kind) {
+		return false
+	}
+	if m.hasSince && event.CreatedAt < m.since {
+		return false
+	}
+	if m.hasUntil && event.CreatedAt > m.until {
+		return false
+	}
+	if m.addresses != nil && !m.referencesAddress(event) {
+		return false
+	}
+	if m.words != nil && (unsearchableKinds[event.Kind] || !matchesWords(event.Content, m.words)) {
+		return false
+	}
+	for i := range m.tags {
+		if !m.tags[i].matches(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// referencesAddress reports whether an event has an `a` tag for one of the
+// filter's addresses
+func (m *filterMatcher) referencesAddress(event *Event) bool {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "a" {
+			continue
+		}
+		if addr, ok := parseAddress(tag[1]); ok && m.addresses[addr] {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether an event has a tag meeting the constraint
+func (t *tagConstraint) matches(event *Event) bool {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == t.name && t.values[tag[1]] {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionMatcher matches events against any of a subscription's filters
+type subscriptionMatcher []filterMatcher
+
+// compileFilters builds the matcher for a subscription's filters
+func compileFilters(filters []Filter) subscriptionMatcher {
+	matchers := make(subscriptionMatcher, len(filters))
+	for i, filter := range filters {
+		matchers[i] = compileFilter(filter)
+	}
+	return matchers
+}
+
+// matches reports whether an event passes any of the filters
+func (s subscriptionMatcher) matches(event *Event) bool {
+	for i := range s {
+		if s[i].matches(event) {
+			return true
+		}
+	}
+	return false
+}
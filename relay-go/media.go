@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NIP-96 file storage, so the owner can attach images and other media to
+// their notes without a third-party host. Uploads need NIP-98 auth from the
+// owner, are stored under DATA_DIR/media by SHA-256 and served back from
+// /media. Files are never transformed, so the original and the served hash
+// are the same.
+
+// mediaSchema records the uploaded files
+const mediaSchema = `
+	CREATE TABLE IF NOT EXISTS media_files (
+		sha256 TEXT PRIMARY KEY,
+		mime TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		dim TEXT NOT NULL,
+		caption TEXT NOT NULL,
+		alt TEXT NOT NULL,
+		uploaded_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+`
+
+// defaultMediaTypes are accepted when RELAY_MEDIA_TYPES is unset
+var defaultMediaTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp",
+	"video/mp4", "video/webm", "audio/mpeg",
+}
+
+// mediaExtensions name stored files by type in their URLs
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/webp": ".webp",
+	"video/mp4": ".mp4", "video/webm": ".webm", "audio/mpeg": ".mp3",
+}
+
+// mediaTypes returns the accepted MIME types
+func (r *Relay) mediaTypes() []string {
+	if len(r.cfg.MediaTypes) > 0 {
+		return r.cfg.MediaTypes
+	}
+	return defaultMediaTypes
+}
+
+// mediaPath is where a file is stored, fanned out by the first byte of its hash
+func (r *Relay) mediaPath(hash string) string {
+	return filepath.Join(r.dataDir, "media", hash[:2], hash)
+}
+
+// mediaURL is the public URL of a stored file
+func (r *Relay) mediaURL(c *gin.Context, hash, mime string) string {
+	base := strings.TrimSuffix(r.cfg.MediaURL, "/")
+	if base == "" {
+		base = requestOrigin(c) + "/media"
+	}
+	return base + "/" + hash + mediaExtensions[mime]
+}
+
+// mediaFile is one stored upload
+type mediaFile struct {
+	Hash       string
+	Mime       string
+	Size       int64
+	Dim        string
+	Caption    string
+	Alt        string
+	UploadedBy string
+	CreatedAt  int64
+}
+
+// lookupMedia finds a stored file by hash
+func (r *Relay) lookupMedia(hash string) (*mediaFile, error) {
+	var f mediaFile
+	err := r.db.QueryRow("SELECT sha256, mime, size, dim, caption, alt, uploaded_by, created_at FROM media_files WHERE sha256 = ?", hash).Scan(
+		&f.Hash, &f.Mime, &f.Size, &f.Dim, &f.Caption, &f.Alt, &f.UploadedBy, &f.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// nip94Event is the unsigned NIP-94 file metadata returned for an upload
+func (r *Relay) nip94Event(c *gin.Context, f *mediaFile) gin.H {
+	tags := [][]string{
+		{"url", r.mediaURL(c, f.Hash, f.Mime)},
+		{"ox", f.Hash},
+		{"x", f.Hash},
+		{"m", f.Mime},
+		{"size", strconv.FormatInt(f.Size, 10)},
+	}
+	if f.Dim != "" {
+		tags = append(tags, []string{"dim", f.Dim})
+	}
+	if f.Alt != "" {
+		tags = append(tags, []string{"alt", f.Alt})
+	}
+	return gin.H{"tags": tags, "content": f.Caption}
+}
+
+// mediaError answers in the NIP-96 error format
+func mediaError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"status": "error", "message": message})
+}
+
+// parseMediaName reads a "<sha256>[.ext]" path segment
+func parseMediaName(name string) (string, bool) {
+	hash := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+	return hash, isHex64(hash)
+}
+
+// handleNIP96Info serves the NIP-96 discovery document
+func handleNIP96Info(c *gin.Context) {
+	origin := requestOrigin(c)
+	download := strings.TrimSuffix(relay.cfg.MediaURL, "/")
+	if download == "" {
+		download = origin + "/media"
+	}
+	c.JSON(200, gin.H{
+		"api_url":        origin + "/upload",
+		"download_url":   download,
+		"supported_nips": []int{94, 96, 98},
+		"content_types":  relay.mediaTypes(),
+		"plans": gin.H{
+			"free": gin.H{
+				"name":                  "Owner",
+				"is_nip98_required":     true,
+				"max_byte_size":         relay.cfg.MediaMaxBytes,
+				"file_expiration":       []int{0, 0},
+				"media_transformations": gin.H{},
+			},
+		},
+	})
+}
+
+// handleUpload stores a multipart "file" upload from the owner. The type is
+// sniffed from the content, not taken from the client, and must be one of
+// RELAY_MEDIA_TYPES; files over RELAY_MEDIA_MAX_BYTES are refused.
+func handleUpload(c *gin.Context) {
+	limit := int64(relay.cfg.MediaMaxBytes)
+	if limit <= 0 {
+		mediaError(c, 403, "uploads are disabled")
+		return
+	}
+	if reason := relay.readOnly(); reason != "" {
+		mediaError(c, 503, "relay is read-only ("+reason+")")
+		return
+	}
+	// Leave room for the multipart envelope and the other form fields
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+64*1024)
+	header, err := c.FormFile("file")
+	if err != nil {
+		if strings.Contains(err.Error(), "too large") {
+			mediaError(c, 413, fmt.Sprintf("file exceeds %d bytes", limit))
+			return
+		}
+		mediaError(c, 400, "expected a multipart form with a file field")
+		return
+	}
+	if header.Size > limit {
+		mediaError(c, 413, fmt.Sprintf("file exceeds %d bytes", limit))
+		return
+	}
+	src, err := header.Open()
+	if err != nil {
+		mediaError(c, 400, err.Error())
+		return
+	}
+	defer src.Close()
+
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(src, sniff)
+	mime := strings.SplitN(http.DetectContentType(sniff[:n]), ";", 2)[0]
+	allowed := false
+	for _, t := range relay.mediaTypes() {
+		allowed = allowed || strings.EqualFold(t, mime)
+	}
+	if !allowed {
+		mediaError(c, 415, fmt.Sprintf("%s files are not accepted", mime))
+		return
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+
+	// Write to a temporary file while hashing, then move it into place
+	dir := filepath.Join(relay.dataDir, "media")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	tmp, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), src)
+	tmp.Close()
+	if err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	existing, err := relay.lookupMedia(hash)
+	if err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	if existing != nil {
+		c.JSON(200, gin.H{"status": "success", "message": "File already stored", "nip94_event": relay.nip94Event(c, existing)})
+		return
+	}
+
+	path := relay.mediaPath(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+
+	file := &mediaFile{
+		Hash:       hash,
+		Mime:       mime,
+		Size:       size,
+		Dim:        imageDim(path),
+		Caption:    c.PostForm("caption"),
+		Alt:        c.PostForm("alt"),
+		UploadedBy: c.GetString("pubkey"),
+		CreatedAt:  time.Now().Unix(),
+	}
+	if _, err := relay.db.Exec(`INSERT OR IGNORE INTO media_files (sha256, mime, size, dim, caption, alt, uploaded_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, file.Hash, file.Mime, file.Size, file.Dim, file.Caption, file.Alt, file.UploadedBy, file.CreatedAt); err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	c.JSON(201, gin.H{"status": "success", "message": "Upload successful", "nip94_event": relay.nip94Event(c, file)})
+}
+
+// imageDim returns "<width>x<height>" for images the standard library can
+// decode, or ""
+func imageDim(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", config.Width, config.Height)
+}
+
+// handleDeleteUpload removes a stored file
+func handleDeleteUpload(c *gin.Context) {
+	hash, ok := parseMediaName(c.Param("name"))
+	if !ok {
+		mediaError(c, 400, "expected a SHA-256 hash")
+		return
+	}
+	result, err := relay.db.Exec("DELETE FROM media_files WHERE sha256 = ?", hash)
+	if err != nil {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		mediaError(c, 404, "file not found")
+		return
+	}
+	if err := os.Remove(relay.mediaPath(hash)); err != nil && !os.IsNotExist(err) {
+		mediaError(c, 500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{"status": "success", "message": "File deleted"})
+}
+
+// handleMedia serves a stored file; its name is its hash, so it never
+// changes and may be cached forever
+func handleMedia(c *gin.Context) {
+	hash, ok := parseMediaName(c.Param("name"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return
+	}
+	file, err := relay.lookupMedia(hash)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if file == nil {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return
+	}
+	f, err := os.Open(relay.mediaPath(hash))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "file not found"})
+		return
+	}
+	defer f.Close()
+
+	c.Header("Content-Type", file.Mime)
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("ETag", `"`+hash+`"`)
+	http.ServeContent(c.Writer, c.Request, "", time.Unix(file.CreatedAt, 0), f)
+}
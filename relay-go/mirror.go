@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostrclient"
+
+	"github.com/gin-gonic/gin"
+)
+
+const mirrorSchema = `
+	CREATE TABLE IF NOT EXISTS mirror_deliveries (
+		event_id TEXT NOT NULL,
+		relay TEXT NOT NULL,
+		status TEXT NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 1,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (event_id, relay)
+	);
+`
+
+const (
+	// mirrorWindow bounds the events awaiting an OK on one upstream connection
+	mirrorWindow = 64
+	// mirrorAckTimeout is how long an upstream may go without answering
+	mirrorAckTimeout = 15 * time.Second
+)
+
+// mirrorAck is an upstream relay's answer to one published event
+type mirrorAck struct {
+	EventID  string
+	Answered bool // false when the relay never sent an OK
+	Accepted bool
+	Message  string
+}
+
+// status is the delivery status recorded for the ack: accepted, rejected or failed
+func (a mirrorAck) status() string {
+	switch {
+	case !a.Answered:
+		return "failed"
+	case a.Accepted:
+		return "accepted"
+	default:
+		return "rejected"
+	}
+}
+
+// publishToRelay sends events to an upstream relay over one connection and
+// returns the OK answer for each, in order. Events the relay did not answer
+// before the timeout are reported as not accepted.
+func publishToRelay(target string, events []Event) ([]mirrorAck, error) {
+	ctx := context.Background()
+	client, err := nostrclient.Connect(ctx, target, nostrclient.Options{OKTimeout: mirrorAckTimeout})
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	acks := make([]mirrorAck, len(events))
+	for i, result := range client.PublishAll(ctx, events, mirrorWindow) {
+		acks[i] = mirrorAck{EventID: events[i].ID, Answered: result.Err == nil, Accepted: result.Accepted, Message: result.Message}
+		if result.Err == nostrclient.ErrNoResponse {
+			acks[i].Message = "no response"
+		} else if result.Err != nil {
+			acks[i].Message = result.Err.Error()
+		}
+	}
+	return acks, nil
+}
+
+// mirrorEvent copies a newly stored owner event to every mirror relay
+func (r *Relay) mirrorEvent(event *Event) {
+	for _, target := range r.cfg.MirrorRelays {
+		acks, err := r.mirrorEvents(target, []Event{*event})
+		switch {
+		case err != nil:
+			log.Printf("❌ Mirroring %s to %s failed: %v", event.ID[:8], target, err)
+		case !acks[0].Accepted:
+			log.Printf("⚠️  %s rejected mirrored event %s: %s", target, event.ID[:8], acks[0].Message)
+		}
+	}
+}
+
+// mirrorEvents publishes events to one mirror and records each delivery
+func (r *Relay) mirrorEvents(target string, events []Event) ([]mirrorAck, error) {
+	acks, err := publishToRelay(target, events)
+	if err != nil {
+		acks = make([]mirrorAck, len(events))
+		for i, event := range events {
+			acks[i] = mirrorAck{EventID: event.ID, Message: err.Error()}
+		}
+	}
+
+	if recordErr := r.recordDeliveries(target, acks); recordErr != nil {
+		log.Printf("❌ Failed to record deliveries to %s: %v", target, recordErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return acks, nil
+}
+
+// recordDeliveries stores the latest outcome of publishing each event to a
+// mirror. A failed retry keeps an earlier acceptance: the relay still has it.
+func (r *Relay) recordDeliveries(target string, acks []mirrorAck) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO mirror_deliveries (event_id, relay, status, message, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(event_id, relay) DO UPDATE SET
+			status = CASE WHEN status = 'accepted' AND excluded.status = 'failed' THEN status ELSE excluded.status END,
+			message = CASE WHEN status = 'accepted' AND excluded.status = 'failed' THEN message ELSE excluded.message END,
+			attempts = attempts + 1, updated_at = excluded.updated_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, ack := range acks {
+		if _, err := stmt.Exec(ack.EventID, target, ack.status(), ack.Message, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleMirrorStatus reports how each mirror relay answered an event, so the
+// owner can confirm a post reached their public relays. Configured mirrors
+// the event was never sent to are listed as "not_sent".
+func handleMirrorStatus(c *gin.Context) {
+	eventID := c.Param("event_id")
+	rows, err := relay.db.Query(
+		"SELECT relay, status, message, attempts, updated_at FROM mirror_deliveries WHERE event_id = ? ORDER BY relay",
+		eventID,
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []gin.H{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var target, status, message string
+		var attempts int
+		var updatedAt int64
+		if rows.Scan(&target, &status, &message, &attempts, &updatedAt) != nil {
+			continue
+		}
+		seen[target] = true
+		deliveries = append(deliveries, gin.H{
+			"relay":      target,
+			"status":     status,
+			"message":    message,
+			"attempts":   attempts,
+			"updated_at": updatedAt,
+		})
+	}
+
+	for _, target := range relay.cfg.MirrorRelays {
+		if !seen[target] {
+			deliveries = append(deliveries, gin.H{"relay": target, "status": "not_sent"})
+		}
+	}
+
+	c.JSON(200, gin.H{"event_id": eventID, "relays": deliveries})
+}
+
+// rebroadcastOptions are the flags of the `rebroadcast` command
+type rebroadcastOptions struct {
+	filter string
+	target string
+	dryRun bool
+}
+
+// rebroadcastFlags registers the `rebroadcast` flags on a command's flag set
+func rebroadcastFlags(flags *flag.FlagSet) *rebroadcastOptions {
+	opts := &rebroadcastOptions{}
+	flags.StringVar(&opts.filter, "filter", "{}", `NIP-01 filter selecting stored events, e.g. '{"kinds":[1],"since":1700000000}'`)
+	flags.StringVar(&opts.target, "target", "", "republish to this relay only instead of every RELAY_MIRRORS entry")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "only report how many events would be sent")
+	return opts
+}
+
+// openStorage opens the relay's databases without starting any of its
+// background work, for commands that run next to (or instead of) the server
+func openStorage(cfg *Config) (*Relay, error) {
+	r := &Relay{cfg: cfg, dataDir: cfg.DataDir}
+
+	db, err := openSQLite(filepath.Join(cfg.DataDir, "relay.db"))
+	if err != nil {
+		return nil, err
+	}
+	r.db = db
+
+	if cfg.Partitioning == "monthly" {
+		r.partitions, err = newPartitionSet(filepath.Join(cfg.DataDir, "partitions"), func(string) {}, func() bool { return false })
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err := r.initDatabase(); err != nil {
+		r.closeStorage()
+		return nil, err
+	}
+	return r, nil
+}
+
+// closeStorage closes the databases opened by openStorage
+func (r *Relay) closeStorage() {
+	if r.partitions != nil {
+		r.partitions.Close()
+	}
+	r.db.Close()
+}
+
+// selectEvents returns every stored event matching a filter, oldest first so
+// replaceable events reach mirrors in the order they were written
+func (r *Relay) selectEvents(filter Filter) []Event {
+	where, args := r.filterConditions(filter)
+	query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE " + where
+
+	var events []Event
+	for _, db := range r.eventDBs(filter.Since, filter.Until) {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("Query error: %v", err)
+			continue
+		}
+		events = append(events, scanEvents(rows)...)
+		rows.Close()
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt < events[j].CreatedAt })
+	if filter.Limit != nil && *filter.Limit >= 0 && len(events) > *filter.Limit {
+		events = events[len(events)-*filter.Limit:]
+	}
+	return events
+}
+
+// runRebroadcast republishes stored events to the mirror relays, e.g. after
+// adding a mirror or once one recovers from an outage; it returns the exit code
+func runRebroadcast(cfg *Config, opts *rebroadcastOptions) int {
+	var filter Filter
+	if err := json.Unmarshal([]byte(opts.filter), &filter); err != nil {
+		fmt.Printf("Invalid --filter: %v\n", err)
+		return 2
+	}
+	// Without authors only the owner's archive is republished
+	if len(filter.Authors) == 0 && cfg.OwnerPubkey != "" {
+		filter.Authors = []string{cfg.OwnerPubkey}
+	}
+
+	targets := cfg.MirrorRelays
+	if opts.target != "" {
+		targets = []string{opts.target}
+	}
+	if len(targets) == 0 && !opts.dryRun {
+		fmt.Println("No mirror relays: set RELAY_MIRRORS or pass --target")
+		return 2
+	}
+
+	r, err := openStorage(cfg)
+	if err != nil {
+		fmt.Printf("Failed to open storage: %v\n", err)
+		return 1
+	}
+	defer r.closeStorage()
+
+	events := r.selectEvents(filter)
+	fmt.Printf("%d events match %s\n", len(events), opts.filter)
+	// Protected events (NIP-70) are only published by their author
+	unprotected := events[:0]
+	for i := range events {
+		if !isProtected(&events[i]) {
+			unprotected = append(unprotected, events[i])
+		}
+	}
+	if skipped := len(events) - len(unprotected); skipped > 0 {
+		fmt.Printf("%d protected events are skipped\n", skipped)
+	}
+	events = unprotected
+	if opts.dryRun || len(events) == 0 {
+		return 0
+	}
+
+	status := 0
+	var results []string
+	for _, target := range targets {
+		acks, err := r.mirrorEvents(target, events)
+		if err != nil {
+			fmt.Printf("  ❌ %s: %v\n", target, err)
+			results = append(results, fmt.Sprintf("%s: %v", target, err))
+			status = 1
+			continue
+		}
+
+		accepted, reasons := 0, map[string]int{}
+		for _, ack := range acks {
+			if ack.Accepted {
+				accepted++
+			} else {
+				reasons[ack.Message]++
+			}
+		}
+		fmt.Printf("  %s: %d accepted, %d rejected\n", target, accepted, len(acks)-accepted)
+		for reason, n := range reasons {
+			fmt.Printf("      %d × %s\n", n, reason)
+		}
+		results = append(results, fmt.Sprintf("%s: %d/%d accepted", target, accepted, len(acks)))
+		if accepted < len(acks) {
+			status = 1
+		}
+	}
+
+	cli := &adminIdentity{Name: "cli", role: roleOwner}
+	r.audit(cli, "rebroadcast", nil, filter.Authors,
+		fmt.Sprintf("filter %s; %s", opts.filter, strings.Join(results, "; ")))
+	return status
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSubIDLength is the longest subscription ID NIP-01 allows
+const maxSubIDLength = 64
+
+// relaySoftware is advertised as the NIP-11 software URL
+const relaySoftware = "https://github.com/PlebOne/nostr-home"
+
+// RelayLimitation describes the limits advertised in the NIP-11 document.
+// Every value is one the relay enforces.
+type RelayLimitation struct {
+	MaxMessageLength int  `json:"max_message_length"`
+	MaxSubscriptions int  `json:"max_subscriptions,omitempty"`
+	MaxLimit         int  `json:"max_limit"`
+	DefaultLimit     int  `json:"default_limit"`
+	MaxSubIDLength   int  `json:"max_subid_length"`
+	MinPowDifficulty int  `json:"min_pow_difficulty,omitempty"`
+	AuthRequired     bool `json:"auth_required"`
+	PaymentRequired  bool `json:"payment_required"`
+	// CreatedAtLowerLimit and CreatedAtUpperLimit are in seconds before and
+	// after the current time
+	CreatedAtLowerLimit int64 `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64 `json:"created_at_upper_limit,omitempty"`
+}
+
+// RelayInfo is the NIP-11 relay information document
+type RelayInfo struct {
+	Name          string          `json:"name,omitempty"`
+	Description   string          `json:"description,omitempty"`
+	Pubkey        string          `json:"pubkey,omitempty"`
+	Self          string          `json:"self,omitempty"`
+	Contact       string          `json:"contact,omitempty"`
+	SupportedNIPs []int           `json:"supported_nips"`
+	Software      string          `json:"software"`
+	Version       string          `json:"version"`
+	Limitation    RelayLimitation `json:"limitation"`
+}
+
+// baseNIPs are the NIPs the relay always supports, NIP-13 when it requires
+// proof of work, NIP-50 when SQLite has FTS5 and NIP-96 when uploads are on
+func (r *Relay) baseNIPs() []int {
+	nips := []int{1, 9, 11, 26, 33, 40, 42, 45, 70}
+	if r.pow != nil {
+		nips = append(nips, 13)
+	}
+	if r.cfg.CreatedAtMaxFuture > 0 || r.cfg.CreatedAtMaxAge > 0 {
+		nips = append(nips, 22)
+	}
+	if r.searchEnabled {
+		nips = append(nips, 50)
+	}
+	if r.cfg.MediaMaxBytes > 0 {
+		nips = append(nips, 96)
+	}
+	return nips
+}
+
+// relayInfo builds the NIP-11 document from the current configuration
+func (r *Relay) relayInfo() RelayInfo {
+	pubkey := r.cfg.RelayPubkey
+	if pubkey == "" {
+		pubkey = r.cfg.OwnerPubkey
+	}
+	return RelayInfo{
+		Name:          r.cfg.RelayName,
+		Description:   r.cfg.RelayDescription,
+		Pubkey:        pubkey,
+		Self:          r.identity.pubkey,
+		Contact:       r.cfg.RelayContact,
+		SupportedNIPs: r.supportedNIPs(r.baseNIPs()),
+		Software:      relaySoftware,
+		Version:       version,
+		Limitation: RelayLimitation{
+			MaxMessageLength:    r.cfg.MaxMessageBytes,
+			MaxSubscriptions:    r.cfg.MaxSubscriptions,
+			MaxLimit:            r.cfg.MaxLimit,
+			DefaultLimit:        r.cfg.DefaultLimit,
+			MaxSubIDLength:      maxSubIDLength,
+			MinPowDifficulty:    r.pow.minDifficulty(),
+			CreatedAtLowerLimit: int64(r.cfg.CreatedAtMaxAge / time.Second),
+			CreatedAtUpperLimit: int64(r.cfg.CreatedAtMaxFuture / time.Second),
+			// NIP-11 means authentication before any other action
+			AuthRequired: r.auth.writes && r.auth.reads,
+		},
+	}
+}
+
+// handleRoot serves the NIP-11 document to HTTP clients and upgrades everything else
+func handleRoot(c *gin.Context) {
+	if strings.Contains(c.GetHeader("Accept"), "application/nostr+json") {
+		// NIP-11 documents are fetched by web clients on other origins
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Access-Control-Allow-Headers", "*")
+		c.Header("Access-Control-Allow-Methods", "GET")
+		data, _ := json.Marshal(relay.relayInfo())
+		c.Data(200, "application/nostr+json", data)
+		return
+	}
+
+	handleWebSocket(c)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nip42Window is how far an AUTH event's created_at may drift from now
+const nip42Window = 10 * time.Minute
+
+// authPolicy decides which messages need a NIP-42 authenticated connection
+type authPolicy struct {
+	writes bool
+	reads  bool
+	// kinds need authentication to publish, and are only served to
+	// authenticated connections
+	kinds map[int]bool
+	// relayHost is the host AUTH events must name; empty means the host the
+	// client connected to
+	relayHost string
+}
+
+// newAuthPolicy builds the auth policy from RELAY_AUTH_WRITES,
+// RELAY_AUTH_READS, RELAY_AUTH_KINDS and RELAY_URL
+func newAuthPolicy(cfg *Config) (*authPolicy, error) {
+	policy := &authPolicy{writes: cfg.AuthWrites, reads: cfg.AuthReads, kinds: map[int]bool{}}
+	for _, spec := range cfg.AuthKinds {
+		kind, err := strconv.Atoi(strings.TrimSpace(spec))
+		if err != nil || kind < 0 {
+			return nil, fmt.Errorf("invalid kind %q in RELAY_AUTH_KINDS", spec)
+		}
+		policy.kinds[kind] = true
+	}
+	if cfg.RelayURL != "" {
+		u, err := url.Parse(cfg.RelayURL)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return nil, fmt.Errorf("RELAY_URL must be a ws:// or wss:// URL, not %q", cfg.RelayURL)
+		}
+		policy.relayHost = strings.ToLower(u.Host)
+	}
+	return policy, nil
+}
+
+// required reports whether the policy asks anything of clients
+func (p *authPolicy) required() bool {
+	return p.writes || p.reads || len(p.kinds) > 0
+}
+
+// newChallenge returns a random AUTH challenge
+func newChallenge() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sendChallenge offers the client a chance to authenticate
+func (c *Client) sendChallenge() {
+	c.sendJSON([]interface{}{"AUTH", c.challenge})
+}
+
+// authedPubkey returns the pubkey the connection authenticated as, if any
+func (c *Client) authedPubkey() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.authed
+}
+
+// isOwner reports whether the connection authenticated as the relay owner.
+// The owner's connections are never throttled: they skip the subscription cap
+// and the protocol error budget, and get a priority send queue.
+func (c *Client) isOwner() bool {
+	owner := c.Relay.cfg.OwnerPubkey
+	return owner != "" && c.authedPubkey() == owner
+}
+
+// handleAuth processes AUTH messages carrying a signed kind 22242 event
+func (c *Client) handleAuth(raw []json.RawMessage) {
+	if len(raw) < 2 {
+		c.protocolError("AUTH without an event")
+		return
+	}
+
+	var event Event
+	if err := json.Unmarshal(raw[1], &event); err != nil {
+		c.protocolError("Invalid event: %v", err)
+		return
+	}
+
+	if err := c.verifyAuthEvent(&event); err != nil {
+		c.sendOK(event.ID, false, "invalid: "+err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	c.authed = event.PubKey
+	c.mu.Unlock()
+
+	if c.isOwner() {
+		c.Send.prioritize(c.Relay.cfg.OwnerSendBuffer)
+		c.logf("🔑 Authenticated as the owner; using the priority lane")
+	} else {
+		c.logf("🔑 Authenticated as %s", event.PubKey[:8])
+	}
+	c.sendOK(event.ID, true, "")
+}
+
+// verifyAuthEvent checks a kind 22242 event against the connection's
+// challenge and the relay's URL
+func (c *Client) verifyAuthEvent(event *Event) error {
+	if event.Kind != 22242 {
+		return fmt.Errorf("auth event must be kind 22242")
+	}
+
+	window := nip42Window + c.Relay.clockSlack()
+	drift := time.Since(time.Unix(event.CreatedAt, 0))
+	if drift > window || drift < -window {
+		return fmt.Errorf("auth event is too old or too far in the future")
+	}
+
+	if event.TagValue("challenge") != c.challenge {
+		return fmt.Errorf("challenge mismatch")
+	}
+
+	host := c.Relay.auth.relayHost
+	if host == "" {
+		host = c.relayHost
+	}
+	u, err := url.Parse(strings.TrimSpace(event.TagValue("relay")))
+	if err != nil || !strings.EqualFold(u.Host, host) {
+		return fmt.Errorf("relay url mismatch")
+	}
+
+	if event.ComputeID() != event.ID {
+		return fmt.Errorf("event id mismatch")
+	}
+	if err := event.Verify(); err != nil {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// authRequiredToWrite returns the reason an event cannot be published on an
+// unauthenticated connection, or "" when it can
+func (c *Client) authRequiredToWrite(event *Event) string {
+	p := c.Relay.auth
+	if !p.writes && !p.kinds[event.Kind] {
+		return ""
+	}
+	if c.authedPubkey() != "" {
+		return ""
+	}
+	if p.writes {
+		return "auth-required: this relay only accepts events from authenticated users"
+	}
+	return fmt.Sprintf("auth-required: kind %d can only be published by authenticated users", event.Kind)
+}
+
+// authRequiredToRead returns the reason filters cannot be served on an
+// unauthenticated connection, or "" when they can. Filters that ask only for
+// restricted kinds are refused outright; broader filters are served with the
+// restricted kinds left out.
+func (c *Client) authRequiredToRead(filters []Filter) string {
+	p := c.Relay.auth
+	if !p.reads && len(p.kinds) == 0 {
+		return ""
+	}
+	if c.authedPubkey() != "" || len(filters) == 0 {
+		return ""
+	}
+	if p.reads {
+		return "auth-required: this relay only serves authenticated users"
+	}
+	for _, filter := range filters {
+		if len(filter.Kinds) == 0 {
+			return ""
+		}
+		for _, kind := range filter.Kinds {
+			if !p.kinds[kind] {
+				return ""
+			}
+		}
+	}
+	return "auth-required: these kinds are only served to authenticated users"
+}
+
+// privateKinds are direct messages (kind 4) and gift wraps (kind 1059). When
+// they need authentication, only their author and p-tagged recipients may
+// read them.
+var privateKinds = map[int]bool{4: true, 1059: true}
+
+// canRead reports whether an event may be sent to a connection
+// authenticated as authed ("" when it is not)
+func (p *authPolicy) canRead(event *Event, authed string) bool {
+	if !p.kinds[event.Kind] && !(p.reads && privateKinds[event.Kind]) {
+		return true
+	}
+	if authed == "" {
+		return false
+	}
+	if !privateKinds[event.Kind] || event.PubKey == authed {
+		return true
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && tag[1] == authed {
+			return true
+		}
+	}
+	return false
+}
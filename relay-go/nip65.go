@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// suggestionWindow is the history relay suggestions are based on
+	suggestionWindow = 7 * 24 * time.Hour
+	// minProbes and minDeliveries are the evidence needed before judging a relay
+	minProbes     = 4
+	minDeliveries = 10
+	// A listed relay below either rate is suggested for removal
+	dropUptime   = 0.5
+	dropAccepted = 0.5
+	// A mirror above both rates is suggested for addition
+	addUptime   = 0.95
+	addAccepted = 0.9
+	// autoPublishInterval spaces automatic list updates
+	autoPublishInterval = 24 * time.Hour
+)
+
+// relayScore is the evidence about one relay over the suggestion window
+type relayScore struct {
+	Probes     int      `json:"probes"`
+	Uptime     *float64 `json:"uptime"`
+	Deliveries int      `json:"deliveries"`
+	Accepted   *float64 `json:"accepted"`
+}
+
+// relayChange explains what the suggestion does with one relay
+type relayChange struct {
+	Relay  string     `json:"relay"`
+	Action string     `json:"action"` // keep, remove or add
+	Reason string     `json:"reason"`
+	Score  relayScore `json:"score"`
+}
+
+// relaySuggestion is a proposed replacement for the owner's NIP-65 list
+type relaySuggestion struct {
+	Current []string      `json:"current"`
+	Changed bool          `json:"changed"`
+	Changes []relayChange `json:"changes"`
+	Event   Event         `json:"event"` // unsigned kind 10002 for the owner to sign
+}
+
+// scoreRelay gathers probe and mirror delivery rates for a relay since a time
+func (r *Relay) scoreRelay(relayURL string, since int64) relayScore {
+	var score relayScore
+	var ok int
+	r.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(ok), 0) FROM relay_probes WHERE relay = ? AND probed_at >= ?",
+		relayURL, since).Scan(&score.Probes, &ok)
+	if score.Probes > 0 {
+		uptime := float64(ok) / float64(score.Probes)
+		score.Uptime = &uptime
+	}
+
+	// Deliveries are keyed by the configured URL, which may differ in case or
+	// a trailing slash from the normalized one
+	var accepted int
+	r.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(status = 'accepted'), 0) FROM mirror_deliveries
+		WHERE RTRIM(LOWER(relay), '/') = ? AND updated_at >= ?`,
+		relayURL, since).Scan(&score.Deliveries, &accepted)
+	if score.Deliveries > 0 {
+		rate := float64(accepted) / float64(score.Deliveries)
+		score.Accepted = &rate
+	}
+	return score
+}
+
+// suggestRelayList proposes an updated kind 10002 list: listed relays that are
+// mostly down or reject mirrored events are dropped, and reliable mirrors that
+// are missing are added. Markers of kept relays are preserved.
+func (r *Relay) suggestRelayList() relaySuggestion {
+	since := time.Now().Add(-suggestionWindow).Unix()
+	suggestion := relaySuggestion{Current: []string{}, Changes: []relayChange{}}
+
+	listed := map[string]bool{}
+	var tags [][]string
+	var bestTag []string // least bad removed relay
+	bestUptime := -1.0
+	for _, tag := range r.ownerRelayList() {
+		url := normalizeRelayURL(tag[1])
+		if listed[url] {
+			continue
+		}
+		listed[url] = true
+		suggestion.Current = append(suggestion.Current, url)
+
+		change := relayChange{Relay: url, Action: "keep", Score: r.scoreRelay(url, since)}
+		s := change.Score
+		switch {
+		case s.Probes >= minProbes && *s.Uptime < dropUptime:
+			change.Action = "remove"
+			change.Reason = fmt.Sprintf("up in %.0f%% of %d probes over 7 days", *s.Uptime*100, s.Probes)
+		case s.Deliveries >= minDeliveries && *s.Accepted < dropAccepted:
+			change.Action = "remove"
+			change.Reason = fmt.Sprintf("accepted %.0f%% of %d mirrored events over 7 days", *s.Accepted*100, s.Deliveries)
+		case s.Probes < minProbes && s.Deliveries < minDeliveries:
+			change.Reason = "not enough probes or deliveries to judge"
+		default:
+			change.Reason = "healthy"
+		}
+
+		if change.Action == "keep" {
+			tags = append(tags, tag)
+		} else if uptimeOf(s) > bestUptime {
+			bestTag, bestUptime = tag, uptimeOf(s)
+		}
+		suggestion.Changes = append(suggestion.Changes, change)
+	}
+
+	for _, mirror := range r.cfg.MirrorRelays {
+		url := normalizeRelayURL(mirror)
+		if listed[url] {
+			continue
+		}
+		listed[url] = true
+
+		s := r.scoreRelay(url, since)
+		if s.Probes >= minProbes && *s.Uptime >= addUptime && s.Deliveries >= minDeliveries && *s.Accepted >= addAccepted {
+			tags = append(tags, []string{"r", url})
+			suggestion.Changes = append(suggestion.Changes, relayChange{
+				Relay: url, Action: "add", Score: s,
+				Reason: fmt.Sprintf("mirror up in %.0f%% of probes and accepting %.0f%% of events", *s.Uptime*100, *s.Accepted*100),
+			})
+		}
+	}
+
+	// Never suggest an empty list: keep the least bad relay
+	if len(tags) == 0 && bestTag != nil {
+		tags = append(tags, bestTag)
+		for i := range suggestion.Changes {
+			if suggestion.Changes[i].Relay == normalizeRelayURL(bestTag[1]) {
+				suggestion.Changes[i].Action = "keep"
+				suggestion.Changes[i].Reason += "; kept as every listed relay is unhealthy"
+			}
+		}
+	}
+
+	for _, change := range suggestion.Changes {
+		if change.Action != "keep" {
+			suggestion.Changed = true
+		}
+	}
+	if tags == nil {
+		tags = [][]string{}
+	}
+	suggestion.Event = Event{
+		PubKey:    r.cfg.OwnerPubkey,
+		CreatedAt: time.Now().Unix(),
+		Kind:      10002,
+		Tags:      tags,
+	}
+	return suggestion
+}
+
+// uptimeOf returns a score's uptime, treating unprobed relays as fully up
+func uptimeOf(s relayScore) float64 {
+	if s.Uptime == nil {
+		return 1
+	}
+	return *s.Uptime
+}
+
+// publishRelayList stores a signed kind 10002 list and sends it to the mirrors
+// and to every relay in the old and new lists, so readers of either find it
+func (r *Relay) publishRelayList(event *Event) error {
+	targets := map[string]bool{}
+	for _, tag := range r.ownerRelayList() {
+		targets[normalizeRelayURL(tag[1])] = true
+	}
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "r" {
+			targets[normalizeRelayURL(tag[1])] = true
+		}
+	}
+	// Mirrors receive owner events from storeEvent already
+	for _, mirror := range r.cfg.MirrorRelays {
+		delete(targets, normalizeRelayURL(mirror))
+	}
+
+	if err := r.publishLocal(event); err != nil {
+		return err
+	}
+
+	for target := range targets {
+		go func(target string) {
+			if _, err := r.mirrorEvents(target, []Event{*event}); err != nil {
+				log.Printf("❌ Publishing relay list to %s failed: %v", target, err)
+			}
+		}(target)
+	}
+	return nil
+}
+
+// autoPublishRelayList signs and publishes the suggested list when the owner
+// opted in with NIP65_AUTO_PUBLISH and the suggestion changes the list. Lists
+// are updated at most once a day so a flapping relay does not churn them.
+func (r *Relay) autoPublishRelayList() {
+	if !r.cfg.NIP65AutoPublish || r.owner == nil {
+		return
+	}
+
+	suggestion := r.suggestRelayList()
+	if !suggestion.Changed || len(suggestion.Current) == 0 {
+		return
+	}
+
+	var lastUpdate int64
+	for _, db := range r.eventDBs(nil, nil) {
+		var createdAt int64
+		db.QueryRow("SELECT COALESCE(MAX(created_at), 0) FROM relay_events WHERE pubkey = ? AND kind = 10002",
+			r.cfg.OwnerPubkey).Scan(&createdAt)
+		if createdAt > lastUpdate {
+			lastUpdate = createdAt
+		}
+	}
+	if time.Since(time.Unix(lastUpdate, 0)) < autoPublishInterval {
+		return
+	}
+
+	event := suggestion.Event
+	if err := r.owner.sign(&event); err != nil {
+		log.Printf("❌ Failed to sign relay list: %v", err)
+		return
+	}
+	if err := r.publishRelayList(&event); err != nil {
+		log.Printf("❌ Failed to publish relay list: %v", err)
+		return
+	}
+
+	var summary []string
+	for _, change := range suggestion.Changes {
+		if change.Action != "keep" {
+			summary = append(summary, change.Action+" "+change.Relay)
+		}
+	}
+	sort.Strings(summary)
+	log.Printf("📋 Published updated relay list: %s", strings.Join(summary, ", "))
+}
+
+// handleRelaySuggestion returns the suggested NIP-65 list as an unsigned event
+// for the owner's client to review and sign
+func handleRelaySuggestion(c *gin.Context) {
+	c.JSON(200, relay.suggestRelayList())
+}
+
+// handlePublishRelayList accepts the owner's signed kind 10002 event, usually
+// the reviewed suggestion, and publishes it
+func handlePublishRelayList(c *gin.Context) {
+	var event Event
+	if err := c.ShouldBindJSON(&event); err != nil {
+		c.JSON(400, gin.H{"error": "invalid event"})
+		return
+	}
+	if event.Kind != 10002 || event.PubKey != relay.cfg.OwnerPubkey {
+		c.JSON(400, gin.H{"error": "expected a kind 10002 event signed by the owner"})
+		return
+	}
+	if err := event.Verify(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := relay.publishRelayList(&event); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"published": event.ID})
+}
@@ -0,0 +1,33 @@
+package main
+
+// NIP-70 protected events. An event with a "-" tag may only be published by
+// its author: the connection must have authenticated (NIP-42) as the event's
+// pubkey. The relay does not republish protected events to its mirrors,
+// which would refuse them from anyone but the author, and does not cross-post
+// them to Mastodon, Bluesky or webhooks either.
+
+// isProtected reports whether an event carries the "-" tag
+func isProtected(event *Event) bool {
+	for _, tag := range event.Tags {
+		if len(tag) >= 1 && tag[0] == "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// protectedEventRejection returns the reason a protected event cannot be
+// published on this connection, or "" when it can
+func (c *Client) protectedEventRejection(event *Event) string {
+	if !isProtected(event) {
+		return ""
+	}
+	switch c.authedPubkey() {
+	case "":
+		return "auth-required: this event may only be published by its author"
+	case event.PubKey:
+		return ""
+	default:
+		return "restricted: this event may only be published by its author"
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// NIP-94 file metadata (kind 1063) is checked before it is stored: it must
+// name the file's URL, SHA-256 and MIME type. When the file is one the owner
+// uploaded here, the tags must also agree with what is stored, so clients
+// de-duplicating media by hash can trust the relay's x tags.
+
+// localMediaHash returns the hash named by a URL under this relay's /media,
+// or under RELAY_MEDIA_URL when it is served elsewhere
+func (r *Relay) localMediaHash(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	var prefix string
+	if r.cfg.MediaURL != "" {
+		base, err := url.Parse(strings.TrimSuffix(r.cfg.MediaURL, "/"))
+		if err != nil || !strings.EqualFold(u.Host, base.Host) {
+			return "", false
+		}
+		prefix = base.Path + "/"
+	} else {
+		relayURL, err := url.Parse(r.cfg.RelayURL)
+		if r.cfg.RelayURL == "" || err != nil || !strings.EqualFold(u.Host, relayURL.Host) {
+			return "", false
+		}
+		prefix = "/media/"
+	}
+	name := strings.TrimPrefix(u.Path, prefix)
+	if name == u.Path || strings.Contains(name, "/") {
+		return "", false
+	}
+	return parseMediaName(name)
+}
+
+// checkFileMetadata returns why a kind 1063 event is rejected, or ""
+func (r *Relay) checkFileMetadata(event *Event) string {
+	if event.Kind != 1063 {
+		return ""
+	}
+
+	fileURL := event.TagValue("url")
+	u, err := url.Parse(fileURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "invalid: file metadata needs a url tag with an http(s) URL"
+	}
+	hash := strings.ToLower(event.TagValue("x"))
+	if !isHex64(hash) {
+		return "invalid: file metadata needs an x tag with the file's SHA-256"
+	}
+	if ox := event.TagValue("ox"); ox != "" && !isHex64(ox) {
+		return "invalid: ox tag must be a SHA-256"
+	}
+	m := event.TagValue("m")
+	if mediaType, _, err := mime.ParseMediaType(m); err != nil || !strings.Contains(mediaType, "/") {
+		return "invalid: file metadata needs an m tag with a MIME type"
+	}
+	size := int64(-1)
+	if s := event.TagValue("size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return "invalid: size tag must be a number of bytes"
+		}
+		size = n
+	}
+
+	local, isLocal := r.localMediaHash(fileURL)
+	if isLocal && local != hash {
+		return "invalid: x tag does not match the file at url"
+	}
+	file, err := r.lookupMedia(hash)
+	if err != nil {
+		return fmt.Sprintf("error: checking stored files: %v", err)
+	}
+	if file == nil {
+		if isLocal {
+			return "invalid: url names a file that is not stored on this relay"
+		}
+		return ""
+	}
+	if !strings.EqualFold(file.Mime, m) {
+		return fmt.Sprintf("invalid: m tag is %s but the stored file is %s", m, file.Mime)
+	}
+	if size >= 0 && size != file.Size {
+		return fmt.Sprintf("invalid: size tag is %d but the stored file is %d bytes", size, file.Size)
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// nip98Window is how far an HTTP auth event's created_at may drift from now
+const nip98Window = 60 * time.Second
+
+// requestURL reconstructs the absolute URL a client used, honoring reverse proxy headers
+func requestURL(c *gin.Context) string {
+	return requestOrigin(c) + c.Request.URL.RequestURI()
+}
+
+// requestOrigin is the scheme and host a client used
+func requestOrigin(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	host := c.Request.Host
+	if fwdHost := c.GetHeader("X-Forwarded-Host"); fwdHost != "" {
+		host = fwdHost
+	}
+
+	return scheme + "://" + host
+}
+
+// verifyHTTPAuth validates a NIP-98 Authorization header and returns the signer's pubkey
+func verifyHTTPAuth(c *gin.Context) (string, error) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Nostr ") {
+		return "", fmt.Errorf("missing Nostr authorization")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Nostr "))
+	if err != nil {
+		return "", fmt.Errorf("authorization is not valid base64")
+	}
+
+	var event Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return "", fmt.Errorf("authorization is not a valid event")
+	}
+
+	if event.Kind != 27235 {
+		return "", fmt.Errorf("authorization event must be kind 27235")
+	}
+
+	// A skewed server clock would otherwise reject every client
+	window := nip98Window + relay.clockSlack()
+	drift := time.Since(time.Unix(event.CreatedAt, 0))
+	if drift > window || drift < -window {
+		return "", fmt.Errorf("authorization event is expired")
+	}
+
+	if u := event.TagValue("u"); u != requestURL(c) {
+		return "", fmt.Errorf("authorization url mismatch")
+	}
+
+	if method := event.TagValue("method"); !strings.EqualFold(method, c.Request.Method) {
+		return "", fmt.Errorf("authorization method mismatch")
+	}
+
+	// The body is only read for a signed request
+	if err := event.Verify(); err != nil {
+		return "", fmt.Errorf("authorization event invalid: %v", err)
+	}
+
+	if err := checkPayload(c, event.TagValue("payload")); err != nil {
+		return "", err
+	}
+
+	return event.PubKey, nil
+}
+
+// nip98BodyLimit is the largest body checkPayload reads: a media upload, or
+// 1 MiB for every other request
+func nip98BodyLimit() int64 {
+	limit := int64(relay.cfg.MediaMaxBytes) + 64*1024
+	if limit < 1<<20 {
+		limit = 1 << 20
+	}
+	return limit
+}
+
+// checkPayload compares a NIP-98 payload tag with the SHA-256 of the request
+// body, which is put back for the handler. A body without the tag passes
+// unless RELAY_NIP98_REQUIRE_PAYLOAD is set.
+func checkPayload(c *gin.Context, payload string) error {
+	if payload == "" && (!relay.cfg.NIP98RequirePayload || c.Request.ContentLength == 0) {
+		return nil
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		var err error
+		reader := http.MaxBytesReader(c.Writer, c.Request.Body, nip98BodyLimit())
+		if body, err = io.ReadAll(reader); err != nil {
+			return fmt.Errorf("failed to read request body: %v", err)
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if payload == "" {
+		if len(body) > 0 {
+			return fmt.Errorf("authorization payload tag required")
+		}
+		return nil
+	}
+	sum := sha256.Sum256(body)
+	if !strings.EqualFold(payload, hex.EncodeToString(sum[:])) {
+		return fmt.Errorf("authorization payload mismatch")
+	}
+	return nil
+}
+
+// requireNIP98 rejects requests without a valid NIP-98 Authorization header and
+// stores the authenticated pubkey in the context under "pubkey"
+func requireNIP98() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pubkey, err := verifyHTTPAuth(c)
+		if err != nil {
+			c.Header("WWW-Authenticate", "Nostr")
+			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set("pubkey", pubkey)
+	}
+}
+
+// requireOwner rejects requests that are not from an admin with the owner role
+func requireOwner() gin.HandlerFunc {
+	return requireRole(roleOwner)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notifyInterval is the least time between two cache-update notifications,
+// and how often a failed one is retried
+const notifyInterval = 30 * time.Second
+
+// notifyMaxIDs caps the event IDs a notification lists per domain; past it
+// the whole domain is marked changed
+const notifyMaxIDs = 500
+
+// Cache domains, the parts of the Python app's cache a stored event changes
+const (
+	domainProfile    = "profile"    // the owner's kind 0, 3 and 10002
+	domainNotes      = "notes"      // the owner's notes and reposts
+	domainArticles   = "articles"   // the owner's long-form articles
+	domainEngagement = "engagement" // replies, reactions, reposts and zaps of the owner's events
+)
+
+// cacheChange is one domain an event changes and the IDs affected; all is
+// set when they are not known, so the domain is refreshed as a whole
+type cacheChange struct {
+	domain string
+	ids    []string
+	all    bool
+}
+
+// notifyBatch is the set of changes one notification covers
+type notifyBatch struct {
+	events  int
+	from    time.Time
+	domains map[string]map[string]bool
+	all     map[string]bool
+}
+
+// newNotifyBatch returns an empty batch
+func newNotifyBatch() *notifyBatch {
+	return &notifyBatch{domains: map[string]map[string]bool{}, all: map[string]bool{}}
+}
+
+// add records an event's changes
+func (b *notifyBatch) add(changes []cacheChange) {
+	if b.events == 0 {
+		b.from = time.Now()
+	}
+	b.events++
+	for _, change := range changes {
+		ids := b.domains[change.domain]
+		if ids == nil {
+			ids = map[string]bool{}
+			b.domains[change.domain] = ids
+		}
+		for _, id := range change.ids {
+			ids[id] = true
+		}
+		if change.all || len(ids) > notifyMaxIDs {
+			b.all[change.domain] = true
+		}
+	}
+}
+
+// merge folds an older batch, one that failed to deliver, into this one
+func (b *notifyBatch) merge(older *notifyBatch) {
+	if older.events == 0 {
+		return
+	}
+	if b.events == 0 || older.from.Before(b.from) {
+		b.from = older.from
+	}
+	b.events += older.events
+	for domain, ids := range older.domains {
+		if b.domains[domain] == nil {
+			b.domains[domain] = map[string]bool{}
+		}
+		for id := range ids {
+			b.domains[domain][id] = true
+		}
+		if older.all[domain] || len(b.domains[domain]) > notifyMaxIDs {
+			b.all[domain] = true
+		}
+	}
+}
+
+// payload is the notification body. With nothing queued, as on a manual
+// flush, it asks for a full refresh.
+func (b *notifyBatch) payload() map[string]interface{} {
+	domains := map[string]interface{}{}
+	for domain, ids := range b.domains {
+		if b.all[domain] {
+			domains[domain] = map[string]interface{}{"all": true}
+			continue
+		}
+		list := make([]string, 0, len(ids))
+		for id := range ids {
+			list = append(list, id)
+		}
+		sort.Strings(list)
+		domains[domain] = map[string]interface{}{"ids": list}
+	}
+	return map[string]interface{}{"events": b.events, "domains": domains, "full": b.events == 0}
+}
+
+// notifier tells the Python app (NOTIFY_URL) to refresh its cache after
+// events are stored, naming the cache domains and event IDs that changed.
+// Stored events queue up until a notification succeeds, so one sent in a
+// throttled or failing window is delivered later rather than lost.
+type notifier struct {
+	url    string
+	client *http.Client
+	wake   chan struct{}
+	faults *faultInjector
+
+	mu          sync.Mutex
+	pending     *notifyBatch
+	lastAttempt time.Time
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+	delivered   int64
+	failed      int64
+}
+
+// newNotifier returns a notifier for url, or nil when notifications are off
+func newNotifier(url string) *notifier {
+	if url == "" {
+		return nil
+	}
+	return &notifier{
+		url:     url,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		wake:    make(chan struct{}, 1),
+		pending: newNotifyBatch(),
+	}
+}
+
+// enqueue records the cache changes of a stored event awaiting notification
+func (n *notifier) enqueue(changes []cacheChange) {
+	if len(changes) == 0 {
+		return
+	}
+	n.mu.Lock()
+	n.pending.add(changes)
+	n.mu.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued notifications, at most one per notifyInterval. A
+// queue left after a throttled window or a failure is retried when the
+// interval is up.
+func (n *notifier) run() {
+	retry := time.NewTimer(notifyInterval)
+	retry.Stop()
+	for {
+		select {
+		case <-n.wake:
+		case <-retry.C:
+		}
+		n.mu.Lock()
+		pending := n.pending.events > 0
+		wait := notifyInterval - time.Since(n.lastAttempt)
+		n.mu.Unlock()
+		if !pending {
+			continue
+		}
+		if wait <= 0 {
+			n.deliver()
+			wait = notifyInterval
+		}
+		// Whatever is still queued goes out with the next attempt
+		retry.Stop()
+		select {
+		case <-retry.C:
+		default:
+		}
+		retry.Reset(wait)
+	}
+}
+
+// deliver posts the queued changes; when that fails they go back into the
+// queue, ahead of anything stored meanwhile
+func (n *notifier) deliver() error {
+	n.mu.Lock()
+	n.lastAttempt = time.Now()
+	batch := n.pending
+	n.pending = newNotifyBatch()
+	n.mu.Unlock()
+
+	log.Printf("🔔 Notifying Python app for cache update (%d events)...", batch.events)
+	err := n.post(batch)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.pending.merge(batch)
+		n.failed++
+		n.lastError = err.Error()
+		n.lastErrorAt = time.Now()
+		log.Printf("❌ Failed to notify Python app: %v", err)
+		return err
+	}
+	n.delivered++
+	n.lastSuccess = time.Now()
+	log.Printf("✅ Python app notified successfully")
+	return nil
+}
+
+// post sends one notification
+func (n *notifier) post(batch *notifyBatch) error {
+	if n.faults.dropWebhook() {
+		return errInjectedDrop
+	}
+	body, err := json.Marshal(batch.payload())
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// cacheChanges returns the cache domains a stored event changes, with the
+// IDs affected: the event itself and the versions it replaced for the
+// owner's events, the events it reacts to for engagement, and the deleted
+// events for the owner's deletions. Other events change nothing cached.
+func (r *Relay) cacheChanges(event *Event, superseded []string) []cacheChange {
+	owner := r.cfg.OwnerPubkey
+	if owner == "" {
+		return nil
+	}
+	ids := append([]string{event.ID}, superseded...)
+
+	if event.PubKey == owner {
+		switch event.Kind {
+		case 0, 3, 10002:
+			return []cacheChange{{domain: domainProfile, ids: ids}}
+		case 1, 6:
+			return []cacheChange{{domain: domainNotes, ids: ids}}
+		case 30023:
+			return []cacheChange{{domain: domainArticles, ids: ids}}
+		case kindDeletion:
+			return deletionChanges(event)
+		}
+		return nil
+	}
+
+	tagged := false
+	for _, tag := range event.Tags {
+		tagged = tagged || (len(tag) >= 2 && tag[0] == "p" && tag[1] == owner)
+	}
+	if !tagged {
+		return nil
+	}
+	switch event.Kind {
+	case 1, 6, 7, 16, 1111, 9735:
+	default:
+		return nil
+	}
+	var targets []string
+	for _, ref := range eventReferences(event) {
+		targets = append(targets, ref.Target)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	return []cacheChange{{domain: domainEngagement, ids: targets}}
+}
+
+// deletionChanges maps the owner's deletion to the domains of what it
+// deletes, going by its k tags, or to notes and articles without them. An
+// article deleted by address changes the article domain as a whole.
+func deletionChanges(deletion *Event) []cacheChange {
+	var ids []string
+	kinds := map[string]bool{}
+	addressed := false
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			if isHex64(tag[1]) {
+				ids = append(ids, strings.ToLower(tag[1]))
+			}
+		case "k":
+			kinds[tag[1]] = true
+		case "a":
+			if addr, ok := parseAddress(tag[1]); ok && addr.Kind == 30023 {
+				addressed = true
+			}
+		}
+	}
+
+	var changes []cacheChange
+	if len(ids) > 0 && (kinds["0"] || kinds["3"] || kinds["10002"]) {
+		changes = append(changes, cacheChange{domain: domainProfile, ids: ids})
+	}
+	if len(ids) > 0 && (len(kinds) == 0 || kinds["1"] || kinds["6"]) {
+		changes = append(changes, cacheChange{domain: domainNotes, ids: ids})
+	}
+	if addressed || (len(ids) > 0 && (len(kinds) == 0 || kinds["30023"])) {
+		changes = append(changes, cacheChange{domain: domainArticles, ids: ids, all: addressed})
+	}
+	return changes
+}
+
+// stats reports delivery counters, the queue and the last error
+func (n *notifier) stats() map[string]interface{} {
+	if n == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	queuedDomains := map[string]interface{}{}
+	for domain, ids := range n.pending.domains {
+		if n.pending.all[domain] {
+			queuedDomains[domain] = "all"
+		} else {
+			queuedDomains[domain] = len(ids)
+		}
+	}
+	stats := map[string]interface{}{
+		"enabled":        true,
+		"url":            n.url,
+		"queued_events":  n.pending.events,
+		"queued_domains": queuedDomains,
+		"delivered":      n.delivered,
+		"failed":         n.failed,
+		"last_attempt":   unixOrZero(n.lastAttempt),
+		"last_success":   unixOrZero(n.lastSuccess),
+	}
+	if n.pending.events > 0 {
+		stats["oldest_queued"] = n.pending.from.Unix()
+	}
+	if n.lastError != "" {
+		stats["last_error"] = n.lastError
+		stats["last_error_at"] = n.lastErrorAt.Unix()
+	}
+	return stats
+}
+
+// unixOrZero returns t as a Unix time, or 0 when it was never set
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// handleNotifyStatus shows the state of the NOTIFY_URL outbox
+func handleNotifyStatus(c *gin.Context) {
+	c.JSON(200, relay.notify.stats())
+}
+
+// handleNotifyFlush notifies the Python app right away, ignoring the throttle
+// and whether anything is queued
+func handleNotifyFlush(c *gin.Context) {
+	if relay.notify == nil {
+		c.JSON(404, gin.H{"error": "notifications are not configured"})
+		return
+	}
+	err := relay.notify.deliver()
+	relay.audit(currentAdmin(c), "notify_flush", nil, nil, "")
+	if err != nil {
+		c.JSON(502, gin.H{"error": err.Error(), "notify": relay.notify.stats()})
+		return
+	}
+	c.JSON(200, relay.notify.stats())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"nostr-relay/pkg/nostr"
+)
+
+// Features that publish as the owner (relay list suggestions, scheduled
+// drafts, automation rules and DM auto-replies) all sign through one
+// ownerSigner, loaded from OWNER_SIGNING_KEY. NIP65_SIGNING_KEY, the name the
+// setting had when relay lists were its only use, is still read as a fallback.
+
+// ownerSigner holds the owner's private key; nothing outside it reads the key
+type ownerSigner struct {
+	key    string
+	pubkey string
+}
+
+// loadOwnerSigner decodes OWNER_SIGNING_KEY and checks it belongs to NOSTR_NPUB
+func loadOwnerSigner(cfg *Config) (*ownerSigner, error) {
+	if cfg.OwnerSigningKey == "" {
+		return nil, fmt.Errorf("OWNER_SIGNING_KEY is not set")
+	}
+	key, err := nostr.DecodePrivateKey(cfg.OwnerSigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OWNER_SIGNING_KEY: %v", err)
+	}
+	pubkey, err := nostr.PublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OWNER_SIGNING_KEY: %v", err)
+	}
+	if pubkey != cfg.OwnerPubkey {
+		return nil, fmt.Errorf("OWNER_SIGNING_KEY does not belong to NOSTR_NPUB")
+	}
+	return &ownerSigner{key: key, pubkey: pubkey}, nil
+}
+
+// sign signs an event as the owner
+func (s *ownerSigner) sign(event *Event) error {
+	return event.Sign(s.key)
+}
+
+// encryptNIP04 encrypts a message from the owner to a pubkey (NIP-04)
+func (s *ownerSigner) encryptNIP04(pubkey, message string) (string, error) {
+	return nostr.EncryptNIP04(s.key, pubkey, message)
+}
+
+// conversationKey returns the NIP-44 conversation key between the owner and
+// a pubkey
+func (s *ownerSigner) conversationKey(pubkey string) ([]byte, error) {
+	return nostr.ConversationKey(s.key, pubkey)
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partitionLayout is the time.Format layout used to name monthly partitions
+const partitionLayout = "2006-01"
+
+// partitionEpoch is the earliest month a partition is created for; no Nostr
+// event predates it
+const partitionEpoch = "2020-01"
+
+// partitionLookahead is how many months past the current one a partition may
+// be created for
+const partitionLookahead = 1
+
+// errPartitionRange refuses timestamps that would create a partition outside
+// [partitionEpoch, now + partitionLookahead], so a client cannot make the relay
+// open a database file per month of arbitrary signed timestamps
+var errPartitionRange = errors.New("created_at is outside the range this relay stores")
+
+// eventSchema creates the event tables in a database. It is applied to the
+// main database, or to every monthly partition when partitioning is enabled.
+const eventSchema = `
+	CREATE TABLE IF NOT EXISTS relay_events (
+		id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		kind INTEGER NOT NULL,
+		tags TEXT NOT NULL,
+		content TEXT NOT NULL,
+		sig TEXT NOT NULL,
+		received_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_pubkey ON relay_events(pubkey);
+	CREATE INDEX IF NOT EXISTS idx_kind ON relay_events(kind);
+	CREATE INDEX IF NOT EXISTS idx_created_at ON relay_events(created_at);
+	CREATE INDEX IF NOT EXISTS idx_received_at ON relay_events(received_at);
+`
+
+// eventPartition is a single month of events stored in its own SQLite file
+type eventPartition struct {
+	month string
+	path  string
+	db    *sql.DB
+}
+
+// partitionSet routes events into per-month SQLite databases
+type partitionSet struct {
+	dir        string
+	mu         sync.RWMutex
+	partitions map[string]*eventPartition
+	// queryOnly opens partitions with sqliteQueryOnlyDSN once the relay is read-only
+	queryOnly bool
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx, so derived-row writers
+// can run on their own or inside the ingest transaction
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// openSQLite opens a SQLite database in WAL mode
+func openSQLite(path string) (*sql.DB, error) {
+	return sql.Open(sqliteDriver, sqliteDSN(path))
+}
+
+// eventIndex is a table derived from event tags or content that lives next to
+// relay_events in every event database, so its rows are written, pruned and
+// migrated with their events
+type eventIndex struct {
+	table  string
+	schema string
+	index  func(db sqlExecer, event *Event) error
+	// remove deletes an event's rows, for tables not indexed on event_id
+	remove func(db sqlExecer, eventID string) error
+}
+
+// eventIndexes lists every per-event-database index, keyed by event_id
+var eventIndexes = []eventIndex{
+	{"event_atags", addressSchema, indexAddressTags, nil},
+	{"event_tags", tagSchema, indexTags, nil},
+	{"event_delegations", delegationSchema, indexDelegation, nil},
+	{"event_relay_lists", relayListSchema, indexRelayList, nil},
+	{"event_expirations", expirationSchema, indexExpiration, nil},
+	{"event_refs", referenceSchema, indexReferences, nil},
+	{"event_files", fileSchema, indexFile, nil},
+	{"event_listings", listingSchema, indexListing, nil},
+	{"event_listing_tags", listingTagSchema, indexListingTags, nil},
+	{"event_repos", repoSchema, indexRepo, nil},
+	{"event_repo_states", repoStateSchema, indexRepoState, nil},
+	{"event_patches", patchSchema, indexPatch, nil},
+	{"event_git_statuses", gitStatusSchema, indexGitStatus, nil},
+	{"event_polls", pollSchema, indexPoll, nil},
+	{"event_poll_votes", pollVoteSchema, indexPollVote, nil},
+	{"event_wiki", wikiSchema, indexWiki, nil},
+	{"nip32_labels", nip32LabelSchema, indexNIP32Labels, nil},
+	{"event_highlights", highlightSchema, indexHighlight, nil},
+	{"event_torrents", torrentSchema, indexTorrent, nil},
+	{"event_calendar", calendarSchema, indexCalendar, nil},
+	{"event_reports", reportSchema, indexReport, nil},
+}
+
+// indexEvent writes an event's rows into every event index
+func indexEvent(db sqlExecer, event *Event) error {
+	for _, idx := range eventIndexes {
+		if err := idx.index(db, event); err != nil {
+			return fmt.Errorf("failed to update %s: %v", idx.table, err)
+		}
+	}
+	return nil
+}
+
+// eventKeyVersion is the user_version of databases whose search rowids and
+// count sketch hashes are taken from the last 64 bits of event IDs. Earlier
+// releases took the first 64, so older rows are rebuilt once.
+const eventKeyVersion = 1
+
+// databaseVersion reads a database's user_version
+func databaseVersion(db *sql.DB) int {
+	var version int
+	db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version
+}
+
+// initEventDB applies the event schema to a database. An index created for
+// the first time is filled from the events already stored there, and a
+// search index keyed the old way is rebuilt.
+func initEventDB(db *sql.DB) error {
+	if _, err := db.Exec(eventSchema); err != nil {
+		return err
+	}
+
+	version := databaseVersion(db)
+	for _, idx := range eventIndexes {
+		var exists int
+		db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", idx.table).Scan(&exists)
+		if exists == 1 && idx.table == searchIndex.table && version < eventKeyVersion {
+			if _, err := db.Exec("DROP TABLE " + idx.table); err != nil {
+				return err
+			}
+			exists = 0
+		}
+		if _, err := db.Exec(idx.schema); err != nil {
+			return err
+		}
+		if exists == 0 {
+			if err := backfillIndex(db, idx); err != nil {
+				return fmt.Errorf("failed to backfill %s: %v", idx.table, err)
+			}
+		}
+	}
+	if version < eventKeyVersion {
+		if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", eventKeyVersion)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillIndex indexes the events stored before an index existed
+func backfillIndex(db *sql.DB, idx eventIndex) error {
+	rows, err := db.Query("SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events")
+	if err != nil {
+		return err
+	}
+	events := scanEvents(rows)
+	rows.Close()
+	if len(events) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := range events {
+		if err := idx.index(tx, &events[i]); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("🔗 Built %s for %d existing events", idx.table, len(events))
+	return nil
+}
+
+// newPartitionSet opens every existing partition found in dir. Every file is
+// passed to verify before any is opened, and if queryOnly then reports the
+// relay read-only, they are all opened query-only and left as they are.
+func newPartitionSet(dir string, verify func(path string), queryOnly func() bool) (*partitionSet, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create partition directory: %v", err)
+	}
+
+	ps := &partitionSet{
+		dir:        dir,
+		partitions: make(map[string]*eventPartition),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "events-*.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	var months []string
+	for _, file := range files {
+		month := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "events-"), ".db")
+		if _, err := time.Parse(partitionLayout, month); err != nil {
+			log.Printf("⚠️  Ignoring unexpected partition file %s", file)
+			continue
+		}
+		verify(file)
+		months = append(months, month)
+	}
+
+	ps.queryOnly = queryOnly()
+	for _, month := range months {
+		if _, err := ps.open(month); err != nil {
+			ps.Close()
+			return nil, err
+		}
+	}
+
+	return ps, nil
+}
+
+// open opens (creating if needed) the partition for a month. Callers must
+// not hold ps.mu.
+func (ps *partitionSet) open(month string) (*eventPartition, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if p, ok := ps.partitions[month]; ok {
+		return p, nil
+	}
+
+	path := filepath.Join(ps.dir, "events-"+month+".db")
+	if ps.queryOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("cannot create partition %s: the relay is read-only", month)
+		}
+		db, err := sql.Open(sqliteDriver, sqliteQueryOnlyDSN(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open partition %s: %v", month, err)
+		}
+		p := &eventPartition{month: month, path: path, db: db}
+		ps.partitions[month] = p
+		return p, nil
+	}
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partition %s: %v", month, err)
+	}
+	if err := initEventDB(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize partition %s: %v", month, err)
+	}
+
+	p := &eventPartition{month: month, path: path, db: db}
+	ps.partitions[month] = p
+	return p, nil
+}
+
+// forTime returns the partition holding events created at the given timestamp
+func (ps *partitionSet) forTime(createdAt int64) (*eventPartition, error) {
+	month := time.Unix(createdAt, 0).UTC().Format(partitionLayout)
+
+	ps.mu.RLock()
+	p, ok := ps.partitions[month]
+	ps.mu.RUnlock()
+	if ok {
+		return p, nil
+	}
+
+	latest := time.Now().UTC().AddDate(0, partitionLookahead, 0).Format(partitionLayout)
+	if month < partitionEpoch || month > latest {
+		return nil, errPartitionRange
+	}
+	return ps.open(month)
+}
+
+// inRange returns the partitions overlapping [since, until], newest first
+func (ps *partitionSet) inRange(since, until *int64) []*eventPartition {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var result []*eventPartition
+	for month, p := range ps.partitions {
+		start, _ := time.Parse(partitionLayout, month)
+		end := start.AddDate(0, 1, 0)
+
+		if since != nil && end.Unix() <= *since {
+			continue
+		}
+		if until != nil && start.Unix() > *until {
+			continue
+		}
+		result = append(result, p)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].month > result[j].month
+	})
+	return result
+}
+
+// drop closes and deletes the partition for a month
+func (ps *partitionSet) drop(month string) error {
+	ps.mu.Lock()
+	p, ok := ps.partitions[month]
+	delete(ps.partitions, month)
+	ps.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("partition %s not found", month)
+	}
+
+	p.db.Close()
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(p.path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every open partition
+func (ps *partitionSet) Close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for _, p := range ps.partitions {
+		p.db.Close()
+	}
+}
+
+// eventDB returns the database an event with the given timestamp belongs in
+func (r *Relay) eventDB(createdAt int64) (*sql.DB, error) {
+	if r.partitions == nil {
+		return r.db, nil
+	}
+
+	p, err := r.partitions.forTime(createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return p.db, nil
+}
+
+// eventDBs returns the databases that may hold events in [since, until],
+// ordered newest first so callers can stop once a limit is satisfied
+func (r *Relay) eventDBs(since, until *int64) []*sql.DB {
+	if r.partitions == nil {
+		return []*sql.DB{r.db}
+	}
+
+	var dbs []*sql.DB
+	for _, p := range r.partitions.inRange(since, until) {
+		dbs = append(dbs, p.db)
+	}
+	return dbs
+}
+
+// migrateToPartitions moves events left in the main database into their
+// monthly partitions, so enabling partitioning does not hide existing data
+func (r *Relay) migrateToPartitions() error {
+	var exists int
+	r.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'relay_events'").Scan(&exists)
+	if exists == 0 {
+		return nil
+	}
+
+	rows, err := r.db.Query("SELECT id, pubkey, created_at, kind, tags, content, sig, received_at FROM relay_events")
+	if err != nil {
+		return err
+	}
+
+	moved, skipped := 0, 0
+	for rows.Next() {
+		var id, pubkey, tags, content, sig string
+		var createdAt, receivedAt int64
+		var kind int
+		if err := rows.Scan(&id, &pubkey, &createdAt, &kind, &tags, &content, &sig, &receivedAt); err != nil {
+			rows.Close()
+			return err
+		}
+
+		db, err := r.eventDB(createdAt)
+		if errors.Is(err, errPartitionRange) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		_, err = db.Exec(`INSERT OR IGNORE INTO relay_events
+			(id, pubkey, created_at, kind, tags, content, sig, received_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, pubkey, createdAt, kind, tags, content, sig, receivedAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		event := Event{ID: id, PubKey: pubkey, CreatedAt: createdAt, Kind: kind, Content: content}
+		json.Unmarshal([]byte(tags), &event.Tags)
+		if err := indexEvent(db, &event); err != nil {
+			rows.Close()
+			return err
+		}
+		moved++
+	}
+	rows.Close()
+
+	if moved > 0 {
+		log.Printf("📦 Moved %d events into monthly partitions", moved)
+	}
+	if skipped > 0 {
+		log.Printf("⚠️  Dropped %d events dated outside %s to %d months ahead", skipped, partitionEpoch, partitionLookahead)
+	}
+
+	if _, err := r.db.Exec("DROP TABLE relay_events"); err != nil {
+		return err
+	}
+	for _, idx := range eventIndexes {
+		if _, err := r.db.Exec("DROP TABLE IF EXISTS " + idx.table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prunePartitions drops whole partitions older than the retention window
+func (r *Relay) prunePartitions() {
+	if r.partitions == nil || r.cfg.RetentionMonths <= 0 {
+		return
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, -r.cfg.RetentionMonths, 0).Format(partitionLayout)
+	for _, p := range r.partitions.inRange(nil, nil) {
+		if p.month >= cutoff {
+			continue
+		}
+		r.writes.RLock()
+		err := r.partitions.drop(p.month)
+		r.writes.RUnlock()
+		if err != nil {
+			log.Printf("❌ Failed to drop partition %s: %v", p.month, err)
+			continue
+		}
+		log.Printf("🗑️  Dropped partition %s (retention %d months)", p.month, r.cfg.RetentionMonths)
+	}
+}
+
+// partitionMaintenance periodically applies the partition retention policy
+func (r *Relay) partitionMaintenance() {
+	r.prunePartitions()
+
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.prunePartitions()
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Structured payloads are pulled out of file metadata, classified listings and
+// calendar events into typed tables, so the front-end can render rich cards
+// without parsing tags. Each table is one of the eventIndexes.
+
+// fileSchema holds NIP-94 file metadata (kind 1063)
+const fileSchema = `
+	CREATE TABLE IF NOT EXISTS event_files (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		mime TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		dim TEXT NOT NULL,
+		blurhash TEXT NOT NULL,
+		thumb TEXT NOT NULL,
+		alt TEXT NOT NULL,
+		summary TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_files_mime ON event_files(mime, created_at);
+	CREATE INDEX IF NOT EXISTS idx_files_sha256 ON event_files(sha256);
+`
+
+// listingSchema holds NIP-99 classified listings (kinds 30402 and 30403)
+const listingSchema = `
+	CREATE TABLE IF NOT EXISTS event_listings (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		kind INTEGER NOT NULL,
+		d TEXT NOT NULL,
+		title TEXT NOT NULL,
+		summary TEXT NOT NULL,
+		image TEXT NOT NULL,
+		location TEXT NOT NULL,
+		price TEXT NOT NULL,
+		currency TEXT NOT NULL,
+		frequency TEXT NOT NULL,
+		status TEXT NOT NULL,
+		published_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_listings_address ON event_listings(pubkey, d, created_at);
+`
+
+// calendarSchema holds NIP-52 calendar events (kinds 31922 and 31923). Dates
+// of all-day events are stored as midnight UTC.
+const calendarSchema = `
+	CREATE TABLE IF NOT EXISTS event_calendar (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		d TEXT NOT NULL,
+		title TEXT NOT NULL,
+		summary TEXT NOT NULL,
+		image TEXT NOT NULL,
+		location TEXT NOT NULL,
+		all_day INTEGER NOT NULL,
+		starts_at INTEGER NOT NULL,
+		ends_at INTEGER NOT NULL,
+		start_tzid TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_calendar_start ON event_calendar(starts_at);
+`
+
+// fileInfo is the card data of a kind 1063 event
+type fileInfo struct {
+	EventID   string `json:"event_id"`
+	PubKey    string `json:"pubkey"`
+	CreatedAt int64  `json:"created_at"`
+	URL       string `json:"url"`
+	Mime      string `json:"mime"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	Dim       string `json:"dim"`
+	Blurhash  string `json:"blurhash"`
+	Thumb     string `json:"thumb"`
+	Alt       string `json:"alt"`
+	Summary   string `json:"summary"`
+}
+
+// listingInfo is the card data of a classified listing
+type listingInfo struct {
+	EventID     string `json:"event_id"`
+	PubKey      string `json:"pubkey"`
+	CreatedAt   int64  `json:"created_at"`
+	Kind        int    `json:"kind"`
+	D           string `json:"d"`
+	Title       string `json:"title"`
+	Summary     string `json:"summary"`
+	Image       string `json:"image"`
+	Location    string `json:"location"`
+	Price       string `json:"price"`
+	Currency    string `json:"currency"`
+	Frequency   string `json:"frequency"`
+	Status      string `json:"status"`
+	PublishedAt int64  `json:"published_at"`
+
+	Images []string `json:"images"` // every image tag, from event_listing_tags
+	Tags   []string `json:"tags"`   // t tags, lowercased
+}
+
+// calendarInfo is the card data of a calendar event; End is 0 when open-ended
+type calendarInfo struct {
+	EventID   string `json:"event_id"`
+	PubKey    string `json:"pubkey"`
+	CreatedAt int64  `json:"created_at"`
+	D         string `json:"d"`
+	Title     string `json:"title"`
+	Summary   string `json:"summary"`
+	Image     string `json:"image"`
+	Location  string `json:"location"`
+	AllDay    bool   `json:"all_day"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	StartTZID string `json:"start_tzid"`
+}
+
+// tagValues returns every value of the first tag with the given name
+func tagValues(event *Event, name string) []string {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1:]
+		}
+	}
+	return nil
+}
+
+// indexFile records the metadata of a kind 1063 event with a url
+func indexFile(db sqlExecer, event *Event) error {
+	url := event.TagValue("url")
+	if event.Kind != 1063 || url == "" {
+		return nil
+	}
+	size, _ := strconv.ParseInt(event.TagValue("size"), 10, 64)
+	thumb := event.TagValue("thumb")
+	if thumb == "" {
+		thumb = event.TagValue("image")
+	}
+	summary := event.TagValue("summary")
+	if summary == "" {
+		summary = event.Content
+	}
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_files
+		(event_id, pubkey, created_at, url, mime, sha256, size, dim, blurhash, thumb, alt, summary)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, event.PubKey, event.CreatedAt, url, strings.ToLower(event.TagValue("m")), strings.ToLower(event.TagValue("x")),
+		size, event.TagValue("dim"), event.TagValue("blurhash"), thumb, event.TagValue("alt"), summary)
+	return err
+}
+
+// indexListing records a NIP-99 listing; kind 30403 is a draft or inactive listing
+func indexListing(db sqlExecer, event *Event) error {
+	if event.Kind != 30402 && event.Kind != 30403 {
+		return nil
+	}
+	var price, currency, frequency string
+	if values := tagValues(event, "price"); len(values) > 0 {
+		price = values[0]
+		if len(values) > 1 {
+			currency = values[1]
+		}
+		if len(values) > 2 {
+			frequency = values[2]
+		}
+	}
+	status := event.TagValue("status")
+	if status == "" {
+		status = "active"
+	}
+	publishedAt, _ := strconv.ParseInt(event.TagValue("published_at"), 10, 64)
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_listings
+		(event_id, pubkey, created_at, kind, d, title, summary, image, location, price, currency, frequency, status, published_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, event.PubKey, event.CreatedAt, event.Kind, event.TagValue("d"), event.TagValue("title"),
+		event.TagValue("summary"), event.TagValue("image"), event.TagValue("location"),
+		price, currency, frequency, status, publishedAt)
+	return err
+}
+
+// calendarTime parses a NIP-52 start or end: a date for all-day events, a
+// unix timestamp otherwise
+func calendarTime(value string, allDay bool) (int64, bool) {
+	if allDay {
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return 0, false
+		}
+		return t.Unix(), true
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil && n > 0
+}
+
+// indexCalendar records a NIP-52 date-based (31922) or time-based (31923)
+// calendar event; events without a valid start are skipped
+func indexCalendar(db sqlExecer, event *Event) error {
+	if event.Kind != 31922 && event.Kind != 31923 {
+		return nil
+	}
+	allDay := event.Kind == 31922
+	start, ok := calendarTime(event.TagValue("start"), allDay)
+	if !ok {
+		return nil
+	}
+	end, _ := calendarTime(event.TagValue("end"), allDay)
+	if allDay && end == 0 {
+		end = start + 24*60*60 // the end date is exclusive, so a single day
+	}
+	title := event.TagValue("title")
+	if title == "" {
+		title = event.TagValue("name") // deprecated spelling
+	}
+	summary := event.TagValue("summary")
+	if summary == "" {
+		summary = event.Content
+	}
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_calendar
+		(event_id, pubkey, created_at, d, title, summary, image, location, all_day, starts_at, ends_at, start_tzid)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.ID, event.PubKey, event.CreatedAt, event.TagValue("d"), title, summary, event.TagValue("image"),
+		event.TagValue("location"), allDay, start, end, event.TagValue("start_tzid"))
+	return err
+}
+
+const (
+	fileColumns     = "event_id, pubkey, created_at, url, mime, sha256, size, dim, blurhash, thumb, alt, summary"
+	listingColumns  = "event_id, pubkey, created_at, kind, d, title, summary, image, location, price, currency, frequency, status, published_at"
+	calendarColumns = "event_id, pubkey, created_at, d, title, summary, image, location, all_day, starts_at, ends_at, start_tzid"
+)
+
+func scanFile(rows *sql.Rows) (f fileInfo, err error) {
+	err = rows.Scan(&f.EventID, &f.PubKey, &f.CreatedAt, &f.URL, &f.Mime, &f.SHA256, &f.Size, &f.Dim,
+		&f.Blurhash, &f.Thumb, &f.Alt, &f.Summary)
+	return
+}
+
+func scanListing(rows *sql.Rows) (l listingInfo, err error) {
+	err = rows.Scan(&l.EventID, &l.PubKey, &l.CreatedAt, &l.Kind, &l.D, &l.Title, &l.Summary, &l.Image,
+		&l.Location, &l.Price, &l.Currency, &l.Frequency, &l.Status, &l.PublishedAt)
+	return
+}
+
+func scanCalendar(rows *sql.Rows) (e calendarInfo, err error) {
+	err = rows.Scan(&e.EventID, &e.PubKey, &e.CreatedAt, &e.D, &e.Title, &e.Summary, &e.Image, &e.Location,
+		&e.AllDay, &e.Start, &e.End, &e.StartTZID)
+	return
+}
+
+// queryPayloads runs a query against every event database, handing each row
+// to scan
+func queryPayloads(query string, args []interface{}, scan func(*sql.Rows)) error {
+	for _, db := range relay.eventDBs(nil, nil) {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			scan(rows)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publicPayloads narrows a payload query to events public endpoints may show
+func publicPayloads(where string, args []interface{}) (string, []interface{}) {
+	if condition, groupArgs := relay.privateGroupCondition("event_id"); condition != "" {
+		return "(" + where + ") AND " + condition, append(args, groupArgs...)
+	}
+	return where, args
+}
+
+func queryFiles(where string, args []interface{}) ([]fileInfo, error) {
+	where, args = publicPayloads(where, args)
+	files := []fileInfo{}
+	err := queryPayloads("SELECT "+fileColumns+" FROM event_files WHERE "+where, args, func(rows *sql.Rows) {
+		if f, err := scanFile(rows); err == nil {
+			files = append(files, f)
+		}
+	})
+	return files, err
+}
+
+// latestOnly narrows a query on an addressable payload table to the latest
+// version of each address in one database before where applies, so an older
+// version cannot match a filter its replacement no longer does. kindColumn
+// is the column that tells the address kinds apart. Ties go to the lowest id,
+// as NIP-01 specifies.
+func latestOnly(table, kindColumn, where string) string {
+	return "NOT EXISTS (SELECT 1 FROM " + table + " AS newer WHERE newer." + kindColumn + " = " + table + "." + kindColumn +
+		" AND newer.pubkey = " + table + ".pubkey AND newer.d = " + table + ".d" +
+		" AND (newer.created_at > " + table + ".created_at OR (newer.created_at = " + table + ".created_at AND newer.event_id < " + table + ".event_id)))" +
+		" AND (" + where + ")"
+}
+
+// latestVersions returns the created_at of the latest version of each
+// address by the given authors across every event database, keyed by
+// kind:pubkey:d. Partitions are monthly, so a replacement can live in a later
+// partition than the version a query found.
+func latestVersions(table, kindColumn string, pubkeys map[string]bool) (map[string]int64, error) {
+	latest := map[string]int64{}
+	if len(pubkeys) == 0 {
+		return latest, nil
+	}
+	args := make([]interface{}, 0, len(pubkeys))
+	for pubkey := range pubkeys {
+		args = append(args, pubkey)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+	query := "SELECT " + kindColumn + ", pubkey, d, MAX(created_at) FROM " + table +
+		" WHERE pubkey IN (" + placeholders + ") GROUP BY " + kindColumn + ", pubkey, d"
+	err := queryPayloads(query, args, func(rows *sql.Rows) {
+		var kind int
+		var pubkey, d string
+		var createdAt int64
+		if rows.Scan(&kind, &pubkey, &d, &createdAt) != nil {
+			return
+		}
+		addr := strconv.Itoa(kind) + ":" + pubkey + ":" + d
+		if createdAt > latest[addr] {
+			latest[addr] = createdAt
+		}
+	})
+	return latest, err
+}
+
+// queryListings returns the matching listings that are the latest version of
+// their address
+func queryListings(where string, args []interface{}) ([]listingInfo, error) {
+	where, args = publicPayloads(where, args)
+	found := map[string]listingInfo{}
+	pubkeys := map[string]bool{}
+	err := queryPayloads("SELECT "+listingColumns+" FROM event_listings WHERE "+latestOnly("event_listings", "kind", where), args, func(rows *sql.Rows) {
+		l, err := scanListing(rows)
+		addr := strconv.Itoa(l.Kind) + ":" + l.PubKey + ":" + l.D
+		if err == nil && l.CreatedAt >= found[addr].CreatedAt {
+			found[addr] = l
+			pubkeys[l.PubKey] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	latest, err := latestVersions("event_listings", "kind", pubkeys)
+	if err != nil {
+		return nil, err
+	}
+
+	listings := make([]listingInfo, 0, len(found))
+	for addr, l := range found {
+		if l.CreatedAt >= latest[addr] {
+			listings = append(listings, l)
+		}
+	}
+	return listings, loadListingTags(listings)
+}
+
+// queryCalendar returns the matching calendar events that are the latest
+// version of their address. all_day tells the two calendar kinds apart.
+func queryCalendar(where string, args []interface{}) ([]calendarInfo, error) {
+	where, args = publicPayloads(where, args)
+	found := map[string]calendarInfo{}
+	pubkeys := map[string]bool{}
+	err := queryPayloads("SELECT "+calendarColumns+" FROM event_calendar WHERE "+latestOnly("event_calendar", "all_day", where), args, func(rows *sql.Rows) {
+		e, err := scanCalendar(rows)
+		addr := calendarAddress(e.AllDay, e.PubKey, e.D)
+		if err == nil && e.CreatedAt >= found[addr].CreatedAt {
+			found[addr] = e
+			pubkeys[e.PubKey] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	latest, err := latestVersions("event_calendar", "all_day", pubkeys)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]calendarInfo, 0, len(found))
+	for addr, e := range found {
+		if e.CreatedAt >= latest[addr] {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// calendarAddress keys a calendar event the way latestVersions does
+func calendarAddress(allDay bool, pubkey, d string) string {
+	if allDay {
+		return "1:" + pubkey + ":" + d
+	}
+	return "0:" + pubkey + ":" + d
+}
+
+// payloadLimit reads ?limit= within the relay's limits
+func payloadLimit(c *gin.Context) int {
+	limit := relay.cfg.DefaultLimit
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n >= 0 && n <= relay.cfg.MaxLimit {
+		limit = n
+	}
+	return limit
+}
+
+// authorCondition narrows a payload query to ?author= when given
+func authorCondition(c *gin.Context, where string, args []interface{}) (string, []interface{}) {
+	if author := strings.ToLower(c.Query("author")); author != "" {
+		where += " AND pubkey = ?"
+		args = append(args, author)
+	}
+	return where, args
+}
+
+// handleFiles lists file metadata, newest first. ?mime= matches a prefix such
+// as image/, ?x= one SHA-256, so clients can find every reference to a file,
+// and ?author= one uploader.
+func handleFiles(c *gin.Context) {
+	where, args := "1=1", []interface{}{}
+	if hash := strings.ToLower(c.Query("x")); hash != "" {
+		if !isHex64(hash) {
+			c.JSON(400, gin.H{"error": "x must be a SHA-256"})
+			return
+		}
+		where += " AND sha256 = ?"
+		args = append(args, hash)
+	}
+	if mime := strings.ToLower(c.Query("mime")); mime != "" {
+		where += " AND mime LIKE ? ESCAPE '\\'"
+		args = append(args, strings.NewReplacer("%", "\\%", "_", "\\_").Replace(mime)+"%")
+	}
+	where, args = authorCondition(c, where, args)
+
+	files, err := queryFiles(where, args)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt > files[j].CreatedAt })
+	if limit := payloadLimit(c); len(files) > limit {
+		files = files[:limit]
+	}
+	c.JSON(200, gin.H{"files": files})
+}
+
+// calendarRange returns the latest version of each calendar event that has
+// not ended by from and starts before to (0 for no end), soonest first
+func calendarRange(from, to int64, author string) ([]calendarInfo, error) {
+	where := "(ends_at >= ? OR (ends_at = 0 AND starts_at >= ?))"
+	args := []interface{}{from, from}
+	if to > 0 {
+		where += " AND starts_at < ?"
+		args = append(args, to)
+	}
+	if author != "" {
+		where += " AND pubkey = ?"
+		args = append(args, author)
+	}
+
+	events, err := queryCalendar(where, args)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start < events[j].Start })
+	return events, nil
+}
+
+// handleCalendar lists the latest version of each calendar event that has not
+// ended by ?from= (unix, default now) and starts before ?to=, soonest first
+func handleCalendar(c *gin.Context) {
+	from := time.Now().Unix()
+	if n, err := strconv.ParseInt(c.Query("from"), 10, 64); err == nil {
+		from = n
+	}
+	var to int64
+	if n, err := strconv.ParseInt(c.Query("to"), 10, 64); err == nil {
+		to = n
+	}
+
+	events, err := calendarRange(from, to, strings.ToLower(c.Query("author")))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if limit := payloadLimit(c); len(events) > limit {
+		events = events[:limit]
+	}
+	c.JSON(200, gin.H{"events": events})
+}
+
+// handleEventPayload returns the structured payload of one event, with its
+// type, or 404 when the event has none. Superseded versions of a listing or
+// calendar event are still returned when asked for by id.
+func handleEventPayload(c *gin.Context) {
+	eventID := strings.ToLower(c.Param("id"))
+	args := []interface{}{eventID}
+
+	if files, err := queryFiles("event_id = ?", args); err == nil && len(files) > 0 {
+		c.JSON(200, gin.H{"type": "file", "payload": files[0]})
+		return
+	}
+	where, args := publicPayloads("event_id = ?", args)
+	var listings []listingInfo
+	queryPayloads("SELECT "+listingColumns+" FROM event_listings WHERE "+where, args, func(rows *sql.Rows) {
+		if l, err := scanListing(rows); err == nil {
+			listings = append(listings, l)
+		}
+	})
+	if len(listings) > 0 && loadListingTags(listings) == nil {
+		c.JSON(200, gin.H{"type": "listing", "payload": listings[0]})
+		return
+	}
+	var events []calendarInfo
+	queryPayloads("SELECT "+calendarColumns+" FROM event_calendar WHERE "+where, args, func(rows *sql.Rows) {
+		if e, err := scanCalendar(rows); err == nil {
+			events = append(events, e)
+		}
+	})
+	if len(events) > 0 {
+		c.JSON(200, gin.H{"type": "calendar", "payload": events[0]})
+		return
+	}
+	c.JSON(404, gin.H{"error": "event has no structured payload"})
+}
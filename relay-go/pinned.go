@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pinSchema holds the notes and articles the owner pinned through the admin API
+const pinSchema = `
+	CREATE TABLE IF NOT EXISTS pinned_events (
+		ref TEXT PRIMARY KEY,
+		position INTEGER NOT NULL,
+		pinned_at INTEGER NOT NULL
+	);
+`
+
+// pin is one featured item: an event ID, or a kind:pubkey:d address that
+// resolves to the latest version of an article
+type pin struct {
+	Ref    string
+	Source string // "admin" or "nip51" (the owner's kind 10001 list)
+}
+
+// parsePinRef normalizes a pin to a hex event ID or an address, accepting the
+// NIP-19 note, nevent and naddr forms too
+func parsePinRef(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	switch {
+	case isHex64(s):
+		return strings.ToLower(s), true
+	case strings.HasPrefix(s, "note1"), strings.HasPrefix(s, "nevent1"):
+		ptr, err := nostr.DecodeEventPointer(s)
+		return ptr.ID, err == nil
+	case strings.HasPrefix(s, "naddr1"):
+		ptr, err := nostr.DecodeAddress(s)
+		if err != nil {
+			return "", false
+		}
+		return address{Kind: ptr.Kind, Pubkey: ptr.PubKey, D: ptr.Identifier}.String(), true
+	}
+	if addr, ok := parseAddress(s); ok {
+		return addr.String(), true
+	}
+	return "", false
+}
+
+// ownerPinList returns the e and a tags of the owner's latest kind 10001 pin list
+func (r *Relay) ownerPinList() []string {
+	if r.cfg.OwnerPubkey == "" {
+		return nil
+	}
+
+	// Partitions are visited newest first, so the first hit is the latest list
+	for _, db := range r.eventDBs(nil, nil) {
+		var tagsJSON string
+		err := db.QueryRow(
+			"SELECT tags FROM relay_events WHERE pubkey = ? AND kind = 10001 ORDER BY created_at DESC LIMIT 1",
+			r.cfg.OwnerPubkey,
+		).Scan(&tagsJSON)
+		if err != nil {
+			continue
+		}
+
+		var tags [][]string
+		var refs []string
+		json.Unmarshal([]byte(tagsJSON), &tags)
+		for _, tag := range tags {
+			if len(tag) < 2 || (tag[0] != "e" && tag[0] != "a") {
+				continue
+			}
+			if ref, ok := parsePinRef(tag[1]); ok {
+				refs = append(refs, ref)
+			}
+		}
+		return refs
+	}
+	return nil
+}
+
+// pins lists the admin pins in order, then the owner's kind 10001 pins that
+// are not pinned already
+func (r *Relay) pins() ([]pin, error) {
+	rows, err := r.db.Query("SELECT ref FROM pinned_events ORDER BY position, pinned_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := []pin{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var ref string
+		if rows.Scan(&ref) == nil && !seen[ref] {
+			seen[ref] = true
+			pins = append(pins, pin{Ref: ref, Source: "admin"})
+		}
+	}
+	for _, ref := range r.ownerPinList() {
+		if !seen[ref] {
+			seen[ref] = true
+			pins = append(pins, pin{Ref: ref, Source: "nip51"})
+		}
+	}
+	return pins, nil
+}
+
+// latestAtAddress returns the newest stored event at an address
+func (r *Relay) latestAtAddress(addr address) (Event, bool) {
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query("SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE kind = ? AND pubkey = ? ORDER BY created_at DESC",
+			addr.Kind, addr.Pubkey)
+		if err != nil {
+			continue
+		}
+		events := scanEvents(rows)
+		rows.Close()
+		for _, event := range events {
+			if event.TagValue("d") == addr.D {
+				return event, true
+			}
+		}
+	}
+	return Event{}, false
+}
+
+// resolvePins loads the event each pin refers to; pins whose event is not
+// stored here are left out
+func (r *Relay) resolvePins(pins []pin) []gin.H {
+	var ids []string
+	for _, p := range pins {
+		if isHex64(p.Ref) {
+			ids = append(ids, p.Ref)
+		}
+	}
+	stored := r.eventsByID(ids)
+
+	featured := []gin.H{}
+	for _, p := range pins {
+		var event Event
+		var ok bool
+		if addr, isAddr := parseAddress(p.Ref); isAddr {
+			event, ok = r.latestAtAddress(addr)
+		} else {
+			event, ok = stored[p.Ref]
+		}
+		if ok {
+			featured = append(featured, gin.H{"ref": p.Ref, "source": p.Source, "event": event})
+		}
+	}
+	return featured
+}
+
+// handlePinned lists the owner's pinned notes and articles for the home
+// page's featured section, admin pins first. Pins with a content warning
+// follow RELAY_CONTENT_WARNINGS.
+func handlePinned(c *gin.Context) {
+	pins, err := relay.pins()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	featured := []gin.H{}
+	for _, entry := range relay.resolvePins(pins) {
+		if event, ok := relay.publicEvent(entry["event"].(Event)); ok {
+			entry["event"] = event
+			featured = append(featured, entry)
+		}
+	}
+	c.JSON(200, gin.H{"pinned": featured})
+}
+
+// handleListPins lists every pin, including ones whose event is not stored
+func handleListPins(c *gin.Context) {
+	pins, err := relay.pins()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	resolved := map[string]bool{}
+	for _, entry := range relay.resolvePins(pins) {
+		resolved[entry["ref"].(string)] = true
+	}
+	list := []gin.H{}
+	for _, p := range pins {
+		list = append(list, gin.H{"ref": p.Ref, "source": p.Source, "stored": resolved[p.Ref]})
+	}
+	c.JSON(200, gin.H{"pins": list})
+}
+
+// handlePin pins an event ID, address, note, nevent or naddr. Without a
+// position it goes last; with one, later pins move down.
+func handlePin(c *gin.Context) {
+	var req struct {
+		Ref      string `json:"ref"`
+		Position *int   `json:"position"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "ref is required"})
+		return
+	}
+	ref, ok := parsePinRef(req.Ref)
+	if !ok {
+		c.JSON(400, gin.H{"error": "ref must be an event id, kind:pubkey:d, note, nevent or naddr"})
+		return
+	}
+
+	tx, err := relay.db.Begin()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var position int
+	tx.QueryRow("SELECT COALESCE(MAX(position) + 1, 0) FROM pinned_events WHERE ref != ?", ref).Scan(&position)
+	if req.Position != nil && *req.Position >= 0 && *req.Position < position {
+		position = *req.Position
+		if _, err := tx.Exec("UPDATE pinned_events SET position = position + 1 WHERE position >= ? AND ref != ?", position, ref); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO pinned_events (ref, position, pinned_at) VALUES (?, ?, ?)",
+		ref, position, time.Now().Unix()); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	relay.audit(currentAdmin(c), "pin", nil, nil, ref)
+	c.JSON(200, gin.H{"pinned": ref, "position": position})
+}
+
+// handleUnpin removes an admin pin; ?ref= takes the same forms as pinning.
+// Pins from the kind 10001 list are changed by publishing a new list.
+func handleUnpin(c *gin.Context) {
+	ref, ok := parsePinRef(c.Query("ref"))
+	if !ok {
+		c.JSON(400, gin.H{"error": "ref must be an event id, kind:pubkey:d, note, nevent or naddr"})
+		return
+	}
+	result, err := relay.db.Exec("DELETE FROM pinned_events WHERE ref = ?", ref)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	n, _ := result.RowsAffected()
+	if n > 0 {
+		relay.audit(currentAdmin(c), "unpin", nil, nil, ref)
+	}
+	c.JSON(200, gin.H{"removed": n > 0})
+}
@@ -0,0 +1,148 @@
+// Package nostr holds the Nostr primitives shared by the relay and the
+// companion Go tools of nostr-home: building, serializing, signing and
+// verifying events, keys, NIP-19 bech32 entities and NIP-04 and NIP-44
+// encryption.
+//
+// Import it as nostr-relay/pkg/nostr.
+package nostr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// Event is a NIP-01 event
+type Event struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// NewEvent starts an unsigned event created now
+func NewEvent(kind int, content string, tags ...[]string) *Event {
+	if tags == nil {
+		tags = [][]string{}
+	}
+	return &Event{CreatedAt: time.Now().Unix(), Kind: kind, Tags: tags, Content: content}
+}
+
+// AddTag appends a tag and returns the event, so tags can be chained
+func (e *Event) AddTag(tag ...string) *Event {
+	e.Tags = append(e.Tags, tag)
+	return e
+}
+
+// TagValue returns the first value of the first tag with the given name
+func (e *Event) TagValue(name string) string {
+	for _, tag := range e.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// Serialize returns the canonical NIP-01 serialization the event ID is the
+// hash of: [0,pubkey,created_at,kind,tags,content] without whitespace
+func (e *Event) Serialize() []byte {
+	b := make([]byte, 0, 128+len(e.Content))
+	b = append(b, `[0,`...)
+	b = appendString(b, e.PubKey)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, e.CreatedAt, 10)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, int64(e.Kind), 10)
+	b = append(b, ",["...)
+	for i, tag := range e.Tags {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '[')
+		for j, value := range tag {
+			if j > 0 {
+				b = append(b, ',')
+			}
+			b = appendString(b, value)
+		}
+		b = append(b, ']')
+	}
+	b = append(b, "],"...)
+	b = appendString(b, e.Content)
+	return append(b, ']')
+}
+
+// appendString appends a JSON string escaped as NIP-01 requires: quotes,
+// backslashes and control characters only, everything else verbatim
+func appendString(b []byte, s string) []byte {
+	const hexDigits = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		case '\b':
+			b = append(b, '\\', 'b')
+		case '\f':
+			b = append(b, '\\', 'f')
+		default:
+			if c < 0x20 {
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			} else {
+				b = append(b, c)
+			}
+		}
+	}
+	return append(b, '"')
+}
+
+// ComputeID returns the hex sha256 of the canonical serialization
+func (e *Event) ComputeID() string {
+	hash := sha256.Sum256(e.Serialize())
+	return hex.EncodeToString(hash[:])
+}
+
+// Sign fills in the pubkey, ID and signature using a hex private key
+func (e *Event) Sign(privateKey string) error {
+	priv, err := parseKey(privateKey)
+	if err != nil {
+		return err
+	}
+	if e.Tags == nil {
+		e.Tags = [][]string{}
+	}
+	e.PubKey = hex.EncodeToString(schnorr.SerializePubKey(priv.PubKey()))
+	e.ID = e.ComputeID()
+
+	idBytes, _ := hex.DecodeString(e.ID)
+	sig, err := signHash(priv, idBytes)
+	if err != nil {
+		return err
+	}
+	e.Sig = sig
+	return nil
+}
+
+// Verify checks the event ID and its BIP-340 Schnorr signature
+func (e *Event) Verify() error {
+	if e.ComputeID() != e.ID {
+		return fmt.Errorf("event id does not match its content")
+	}
+
+	idBytes, _ := hex.DecodeString(e.ID)
+	return verifyHash(e.PubKey, idBytes, e.Sig)
+}
@@ -0,0 +1,81 @@
+package nostr
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// GeneratePrivateKey returns a new random hex private key
+func GeneratePrivateKey() (string, error) {
+	priv, err := btcec.NewPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(priv.Serialize()), nil
+}
+
+// PublicKey returns the hex x-only public key for a hex private key
+func PublicKey(privateKey string) (string, error) {
+	priv, err := parseKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(schnorr.SerializePubKey(priv.PubKey())), nil
+}
+
+// parseKey decodes a hex private key
+func parseKey(privateKey string) (*btcec.PrivateKey, error) {
+	keyBytes, err := hex.DecodeString(privateKey)
+	if err != nil || len(keyBytes) != 32 {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	priv, _ := btcec.PrivKeyFromBytes(keyBytes)
+	return priv, nil
+}
+
+// parsePublicKey decodes a hex x-only public key
+func parsePublicKey(pubkey string) (*btcec.PublicKey, error) {
+	keyBytes, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed pubkey")
+	}
+	pub, err := schnorr.ParsePubKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("malformed pubkey: %v", err)
+	}
+	return pub, nil
+}
+
+// signHash returns the hex BIP-340 signature of a 32-byte hash
+func signHash(priv *btcec.PrivateKey, hash []byte) (string, error) {
+	sig, err := schnorr.Sign(priv, hash)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig.Serialize()), nil
+}
+
+// verifyHash checks a hex BIP-340 signature of a 32-byte hash
+func verifyHash(pubkey string, hash []byte, signature string) error {
+	pub, err := parsePublicKey(pubkey)
+	if err != nil {
+		return err
+	}
+
+	sigBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+	sig, err := schnorr.ParseSignature(sigBytes)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %v", err)
+	}
+
+	if !sig.Verify(hash, pub) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
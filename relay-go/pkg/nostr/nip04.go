@@ -0,0 +1,90 @@
+package nostr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// sharedX returns the x coordinate of the ECDH point between a private key
+// and another party's x-only pubkey
+func sharedX(privateKey, pubkey string) ([]byte, error) {
+	priv, err := parseKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.GenerateSharedSecret(priv, pub), nil
+}
+
+// EncryptNIP04 encrypts a kind 4 DM for pubkey as base64(ciphertext)?iv=base64(iv).
+// NIP-04 is deprecated in favour of NIP-44 but is still what most clients send.
+func EncryptNIP04(privateKey, pubkey, plaintext string) (string, error) {
+	key, err := sharedX(privateKey, pubkey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	data := append([]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return base64.StdEncoding.EncodeToString(data) + "?iv=" + base64.StdEncoding.EncodeToString(iv), nil
+}
+
+// DecryptNIP04 decrypts a kind 4 DM from pubkey
+func DecryptNIP04(privateKey, pubkey, content string) (string, error) {
+	encoded, ivPart, ok := strings.Cut(content, "?iv=")
+	if !ok {
+		return "", fmt.Errorf("nip04: missing iv")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("nip04: invalid ciphertext")
+	}
+	iv, err := base64.StdEncoding.DecodeString(ivPart)
+	if err != nil || len(iv) != aes.BlockSize {
+		return "", fmt.Errorf("nip04: invalid iv")
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("nip04: invalid ciphertext length")
+	}
+
+	key, err := sharedX(privateKey, pubkey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	padding := int(data[len(data)-1])
+	if padding < 1 || padding > aes.BlockSize {
+		return "", fmt.Errorf("nip04: invalid padding")
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return "", fmt.Errorf("nip04: invalid padding")
+		}
+	}
+	return string(data[:len(data)-padding]), nil
+}
@@ -0,0 +1,22 @@
+package nostr
+
+import "testing"
+
+func TestNIP04RoundTrip(t *testing.T) {
+	sec1, _ := GeneratePrivateKey()
+	sec2, _ := GeneratePrivateKey()
+	pub1, _ := PublicKey(sec1)
+	pub2, _ := PublicKey(sec2)
+
+	content, err := EncryptNIP04(sec1, pub2, "hello nostr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := DecryptNIP04(sec2, pub1, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "hello nostr" {
+		t.Errorf("got %q", plaintext)
+	}
+}
@@ -0,0 +1,65 @@
+package nostr
+
+import (
+	"math/bits"
+	"strconv"
+)
+
+// Difficulty returns the NIP-13 proof of work of an event ID: the number of
+// leading zero bits of its hex form. A malformed ID counts only up to its
+// first non-hex character.
+func Difficulty(id string) int {
+	count := 0
+	for i := 0; i < len(id); i++ {
+		nibble, ok := hexNibble(id[i])
+		if !ok {
+			break
+		}
+		if nibble != 0 {
+			return count + bits.LeadingZeros8(nibble) - 4
+		}
+		count += 4
+	}
+	return count
+}
+
+// hexNibble decodes one hex digit
+func hexNibble(c byte) (uint8, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// CommittedDifficulty returns the target of the event's nonce tag, the
+// difficulty its author set out to reach, and whether it has one
+func (e *Event) CommittedDifficulty() (int, bool) {
+	for _, tag := range e.Tags {
+		if len(tag) >= 3 && tag[0] == "nonce" {
+			target, err := strconv.Atoi(tag[2])
+			return target, err == nil
+		}
+	}
+	return 0, false
+}
+
+// Mine adds a nonce tag committing to difficulty and counts it up until the
+// ID has at least that many leading zero bits. PubKey must be set; Sign
+// afterwards keeps the mined ID.
+func (e *Event) Mine(difficulty int) {
+	target := strconv.Itoa(difficulty)
+	e.Tags = append(e.Tags, []string{"nonce", "0", target})
+	nonce := e.Tags[len(e.Tags)-1]
+	for n := uint64(0); ; n++ {
+		nonce[1] = strconv.FormatUint(n, 10)
+		if id := e.ComputeID(); Difficulty(id) >= difficulty {
+			e.ID = id
+			return
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package nostr
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+// bech32Polymod computes the bech32 checksum polynomial
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= bech32Generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32HRPExpand expands the human-readable part for checksum computation
+func bech32HRPExpand(hrp string) []byte {
+	result := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		result = append(result, hrp[i]>>5)
+	}
+	result = append(result, 0)
+	for i := 0; i < len(hrp); i++ {
+		result = append(result, hrp[i]&31)
+	}
+	return result
+}
+
+// convertBits regroups a byte slice between bit widths
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	acc := uint32(0)
+	bits := uint(0)
+	maxv := uint32(1<<to) - 1
+	var result []byte
+
+	for _, value := range data {
+		if uint32(value)>>from != 0 {
+			return nil, fmt.Errorf("invalid data range")
+		}
+		acc = acc<<from | uint32(value)
+		bits += from
+		for bits >= to {
+			bits -= to
+			result = append(result, byte(acc>>bits&maxv))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			result = append(result, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return result, nil
+}
+
+// DecodeBech32 decodes a bech32 string into its human-readable part and data
+// bytes. NIP-19 entities may exceed the 90 characters BIP-173 allows.
+func DecodeBech32(s string) (string, []byte, error) {
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, fmt.Errorf("invalid bech32 string")
+	}
+
+	hrp := s[:pos]
+	var values []byte
+	for _, ch := range s[pos+1:] {
+		idx := strings.IndexRune(bech32Charset, ch)
+		if idx < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", ch)
+		}
+		values = append(values, byte(idx))
+	}
+
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, fmt.Errorf("invalid bech32 checksum")
+	}
+
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
+
+// EncodeBech32 encodes data bytes under a human-readable part
+func EncodeBech32(hrp string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	polymod := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+
+	var b strings.Builder
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		b.WriteByte(bech32Charset[polymod>>uint(5*(5-i))&31])
+	}
+	return b.String(), nil
+}
+
+// encodeHex32 bech32-encodes a 32-byte hex value such as a key or event ID
+func encodeHex32(hrp, value string) (string, error) {
+	data, err := hex.DecodeString(value)
+	if err != nil || len(data) != 32 {
+		return "", fmt.Errorf("%s value must be 32 bytes of hex", hrp)
+	}
+	return EncodeBech32(hrp, data)
+}
+
+// EncodePublicKey returns the npub for a hex pubkey
+func EncodePublicKey(pubkey string) (string, error) { return encodeHex32("npub", pubkey) }
+
+// EncodePrivateKey returns the nsec for a hex private key
+func EncodePrivateKey(privateKey string) (string, error) { return encodeHex32("nsec", privateKey) }
+
+// EncodeNote returns the note for a hex event ID
+func EncodeNote(id string) (string, error) { return encodeHex32("note", id) }
+
+// decodeHex32 accepts a 32-byte hex value or its bech32 form with the given
+// prefix, and returns the lowercase hex form
+func decodeHex32(s, hrp, what string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(strings.ToLower(s), hrp+"1") {
+		prefix, data, err := DecodeBech32(s)
+		if err != nil {
+			return "", err
+		}
+		if prefix != hrp || len(data) != 32 {
+			return "", fmt.Errorf("invalid %s", hrp)
+		}
+		return hex.EncodeToString(data), nil
+	}
+
+	if b, err := hex.DecodeString(s); err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid %s %q", what, s)
+	}
+	return strings.ToLower(s), nil
+}
+
+// DecodePublicKey accepts a hex pubkey, an npub or an nprofile and returns
+// the hex pubkey
+func DecodePublicKey(s string) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "nprofile1") {
+		profile, err := DecodeProfile(strings.TrimSpace(s))
+		return profile.PubKey, err
+	}
+	return decodeHex32(s, "npub", "pubkey")
+}
+
+// DecodePrivateKey accepts a hex private key or an nsec and returns the hex form
+func DecodePrivateKey(s string) (string, error) {
+	key, err := decodeHex32(s, "nsec", "private key")
+	if err != nil && !strings.HasPrefix(strings.TrimSpace(s), "nsec1") {
+		// Never echo what may be a secret
+		return "", fmt.Errorf("invalid private key")
+	}
+	return key, err
+}
+
+// ProfilePointer is a decoded nprofile
+type ProfilePointer struct {
+	PubKey string
+	Relays []string
+}
+
+// EventPointer is a decoded note or nevent
+type EventPointer struct {
+	ID     string
+	Relays []string
+	Author string // optional
+	Kind   int    // optional, -1 when absent
+}
+
+// AddressPointer is a decoded naddr
+type AddressPointer struct {
+	Kind       int
+	PubKey     string
+	Identifier string
+	Relays     []string
+}
+
+// NIP-19 TLV types
+const (
+	tlvSpecial = 0
+	tlvRelay   = 1
+	tlvAuthor  = 2
+	tlvKind    = 3
+)
+
+// tlv is one NIP-19 type-length-value entry
+type tlv struct {
+	typ   byte
+	value []byte
+}
+
+// parseTLV splits NIP-19 TLV data; a truncated entry ends the list
+func parseTLV(data []byte) []tlv {
+	var entries []tlv
+	for len(data) >= 2 {
+		typ, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			break
+		}
+		entries = append(entries, tlv{typ, data[2 : 2+length]})
+		data = data[2+length:]
+	}
+	return entries
+}
+
+// appendTLV appends one TLV entry; values longer than 255 bytes cannot be encoded
+func appendTLV(data []byte, typ byte, value []byte) ([]byte, error) {
+	if len(value) > 255 {
+		return nil, fmt.Errorf("TLV value of type %d is too long", typ)
+	}
+	return append(append(data, typ, byte(len(value))), value...), nil
+}
+
+// encodeTLV bech32-encodes a special value followed by relays, an optional
+// author and an optional kind
+func encodeTLV(hrp string, special []byte, relays []string, author string, kind int) (string, error) {
+	data, err := appendTLV(nil, tlvSpecial, special)
+	if err != nil {
+		return "", err
+	}
+	for _, relay := range relays {
+		if data, err = appendTLV(data, tlvRelay, []byte(relay)); err != nil {
+			return "", err
+		}
+	}
+	if author != "" {
+		pub, err := hex.DecodeString(author)
+		if err != nil || len(pub) != 32 {
+			return "", fmt.Errorf("invalid author %q", author)
+		}
+		data, _ = appendTLV(data, tlvAuthor, pub)
+	}
+	if kind >= 0 {
+		data, _ = appendTLV(data, tlvKind, binary.BigEndian.AppendUint32(nil, uint32(kind)))
+	}
+	return EncodeBech32(hrp, data)
+}
+
+// EncodeProfile returns the nprofile for a pubkey and its relays
+func EncodeProfile(p ProfilePointer) (string, error) {
+	pub, err := hex.DecodeString(p.PubKey)
+	if err != nil || len(pub) != 32 {
+		return "", fmt.Errorf("invalid pubkey %q", p.PubKey)
+	}
+	return encodeTLV("nprofile", pub, p.Relays, "", -1)
+}
+
+// EncodeEvent returns the nevent for an event pointer
+func EncodeEvent(p EventPointer) (string, error) {
+	id, err := hex.DecodeString(p.ID)
+	if err != nil || len(id) != 32 {
+		return "", fmt.Errorf("invalid event id %q", p.ID)
+	}
+	return encodeTLV("nevent", id, p.Relays, p.Author, p.Kind)
+}
+
+// EncodeAddress returns the naddr for an addressable event
+func EncodeAddress(p AddressPointer) (string, error) {
+	return encodeTLV("naddr", []byte(p.Identifier), p.Relays, p.PubKey, p.Kind)
+}
+
+// DecodeProfile decodes an nprofile
+func DecodeProfile(s string) (ProfilePointer, error) {
+	hrp, data, err := DecodeBech32(s)
+	if err != nil {
+		return ProfilePointer{}, err
+	}
+	if hrp != "nprofile" {
+		return ProfilePointer{}, fmt.Errorf("not an nprofile: %s", hrp)
+	}
+	var p ProfilePointer
+	for _, entry := range parseTLV(data) {
+		switch {
+		case entry.typ == tlvSpecial && len(entry.value) == 32:
+			p.PubKey = hex.EncodeToString(entry.value)
+		case entry.typ == tlvRelay:
+			p.Relays = append(p.Relays, string(entry.value))
+		}
+	}
+	if p.PubKey == "" {
+		return p, fmt.Errorf("nprofile has no pubkey")
+	}
+	return p, nil
+}
+
+// DecodeEventPointer decodes a note or an nevent
+func DecodeEventPointer(s string) (EventPointer, error) {
+	hrp, data, err := DecodeBech32(s)
+	if err != nil {
+		return EventPointer{}, err
+	}
+
+	p := EventPointer{Kind: -1}
+	switch hrp {
+	case "note":
+		if len(data) != 32 {
+			return p, fmt.Errorf("invalid note")
+		}
+		p.ID = hex.EncodeToString(data)
+		return p, nil
+	case "nevent":
+		for _, entry := range parseTLV(data) {
+			switch {
+			case entry.typ == tlvSpecial && len(entry.value) == 32:
+				p.ID = hex.EncodeToString(entry.value)
+			case entry.typ == tlvRelay:
+				p.Relays = append(p.Relays, string(entry.value))
+			case entry.typ == tlvAuthor && len(entry.value) == 32:
+				p.Author = hex.EncodeToString(entry.value)
+			case entry.typ == tlvKind && len(entry.value) == 4:
+				p.Kind = int(binary.BigEndian.Uint32(entry.value))
+			}
+		}
+		if p.ID == "" {
+			return p, fmt.Errorf("nevent has no event ID")
+		}
+		return p, nil
+	}
+	return p, fmt.Errorf("not an event pointer: %s", hrp)
+}
+
+// DecodeAddress decodes an naddr
+func DecodeAddress(s string) (AddressPointer, error) {
+	hrp, data, err := DecodeBech32(s)
+	if err != nil {
+		return AddressPointer{}, err
+	}
+	if hrp != "naddr" {
+		return AddressPointer{}, fmt.Errorf("not an naddr: %s", hrp)
+	}
+
+	p := AddressPointer{Kind: -1}
+	for _, entry := range parseTLV(data) {
+		switch {
+		case entry.typ == tlvSpecial:
+			p.Identifier = string(entry.value)
+		case entry.typ == tlvRelay:
+			p.Relays = append(p.Relays, string(entry.value))
+		case entry.typ == tlvAuthor && len(entry.value) == 32:
+			p.PubKey = hex.EncodeToString(entry.value)
+		case entry.typ == tlvKind && len(entry.value) == 4:
+			p.Kind = int(binary.BigEndian.Uint32(entry.value))
+		}
+	}
+	if p.PubKey == "" || p.Kind < 0 {
+		return p, fmt.Errorf("naddr needs an author and a kind")
+	}
+	return p, nil
+}
@@ -0,0 +1,144 @@
+package nostr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+// Delegation is a NIP-26 "delegation" tag: the delegator's pubkey, the
+// conditions it signed and its signature (the token)
+type Delegation struct {
+	Delegator  string
+	Conditions string
+	Token      string
+}
+
+// DelegationConditions are the parsed conditions of a delegation. Kinds
+// lists the allowed kinds, any kind when empty; Since and Until bound
+// created_at exclusively and are 0 when absent.
+type DelegationConditions struct {
+	Kinds []int
+	Since int64
+	Until int64
+}
+
+// Delegation returns the event's delegation tag, if it has one
+func (e *Event) Delegation() (Delegation, bool) {
+	for _, tag := range e.Tags {
+		if len(tag) >= 4 && tag[0] == "delegation" {
+			return Delegation{Delegator: tag[1], Conditions: tag[2], Token: tag[3]}, true
+		}
+	}
+	return Delegation{}, false
+}
+
+// delegationHash is what the delegator signs for a delegatee
+func delegationHash(delegatee, conditions string) []byte {
+	h := sha256.Sum256([]byte("nostr:delegation:" + delegatee + ":" + conditions))
+	return h[:]
+}
+
+// CreateDelegation signs conditions for a delegatee and returns the tag the
+// delegatee adds to its events
+func CreateDelegation(privateKey, delegatee, conditions string) ([]string, error) {
+	if _, err := ParseDelegationConditions(conditions); err != nil {
+		return nil, err
+	}
+	priv, err := parseKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := schnorr.Sign(priv, delegationHash(delegatee, conditions))
+	if err != nil {
+		return nil, err
+	}
+	delegator := hex.EncodeToString(schnorr.SerializePubKey(priv.PubKey()))
+	return []string{"delegation", delegator, conditions, hex.EncodeToString(sig.Serialize())}, nil
+}
+
+// ParseDelegationConditions parses a query string of kind=N,
+// created_at>T and created_at<T clauses joined by "&". Several kind
+// clauses allow any of those kinds.
+func ParseDelegationConditions(conditions string) (DelegationConditions, error) {
+	var c DelegationConditions
+	if conditions == "" {
+		return c, fmt.Errorf("empty conditions")
+	}
+	for _, clause := range strings.Split(conditions, "&") {
+		var err error
+		switch {
+		case strings.HasPrefix(clause, "kind="):
+			var kind int
+			kind, err = strconv.Atoi(clause[len("kind="):])
+			c.Kinds = append(c.Kinds, kind)
+		case strings.HasPrefix(clause, "created_at>"):
+			c.Since, err = strconv.ParseInt(clause[len("created_at>"):], 10, 64)
+		case strings.HasPrefix(clause, "created_at<"):
+			c.Until, err = strconv.ParseInt(clause[len("created_at<"):], 10, 64)
+		default:
+			return c, fmt.Errorf("unknown condition %q", clause)
+		}
+		if err != nil {
+			return c, fmt.Errorf("malformed condition %q", clause)
+		}
+	}
+	return c, nil
+}
+
+// Allows reports whether an event of kind created at createdAt meets the
+// conditions
+func (c DelegationConditions) Allows(kind int, createdAt int64) bool {
+	if c.Since != 0 && createdAt <= c.Since {
+		return false
+	}
+	if c.Until != 0 && createdAt >= c.Until {
+		return false
+	}
+	if len(c.Kinds) == 0 {
+		return true
+	}
+	for _, k := range c.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyDelegation checks an event's delegation: the token must be the
+// delegator's signature over the event's pubkey and the conditions, and
+// the event must meet them. Events without a delegation pass.
+func (e *Event) VerifyDelegation() error {
+	d, ok := e.Delegation()
+	if !ok {
+		return nil
+	}
+	conditions, err := ParseDelegationConditions(d.Conditions)
+	if err != nil {
+		return fmt.Errorf("delegation conditions: %v", err)
+	}
+	if !conditions.Allows(e.Kind, e.CreatedAt) {
+		return fmt.Errorf("event does not meet the delegation conditions")
+	}
+	delegator, err := parsePublicKey(d.Delegator)
+	if err != nil {
+		return fmt.Errorf("delegator: %v", err)
+	}
+	tokenBytes, err := hex.DecodeString(d.Token)
+	if err != nil {
+		return fmt.Errorf("malformed delegation token")
+	}
+	sig, err := schnorr.ParseSignature(tokenBytes)
+	if err != nil {
+		return fmt.Errorf("malformed delegation token: %v", err)
+	}
+	if !sig.Verify(delegationHash(e.PubKey, d.Conditions), delegator) {
+		return fmt.Errorf("invalid delegation token")
+	}
+	return nil
+}
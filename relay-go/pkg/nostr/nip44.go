@@ -0,0 +1,145 @@
+package nostr
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NIP-44 v2 limits
+const (
+	nip44Version      = 2
+	nip44MinPlaintext = 1
+	nip44MaxPlaintext = 65535
+)
+
+// ConversationKey derives the NIP-44 v2 key two parties share. It is the same
+// in both directions, so it can be computed once per peer and reused.
+func ConversationKey(privateKey, pubkey string) ([]byte, error) {
+	shared, err := sharedX(privateKey, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2")), nil
+}
+
+// messageKeys derives the ChaCha20 key and nonce and the HMAC key for one nonce
+func messageKeys(conversationKey, nonce []byte) (key, chachaNonce, hmacKey []byte, err error) {
+	if len(conversationKey) != 32 {
+		return nil, nil, nil, fmt.Errorf("nip44: conversation key must be 32 bytes")
+	}
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[:32], keys[32:44], keys[44:], nil
+}
+
+// paddedLen rounds a plaintext length up as NIP-44 specifies: to 32 bytes,
+// then in chunks of an eighth of the next power of two
+func paddedLen(n int) int {
+	if n <= 32 {
+		return 32
+	}
+	nextPower := 1 << bits.Len(uint(n-1))
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((n-1)/chunk + 1)
+}
+
+// mac authenticates the nonce and ciphertext
+func mac(hmacKey, nonce, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(nonce)
+	h.Write(ciphertext)
+	return h.Sum(nil)
+}
+
+// EncryptNIP44 encrypts plaintext with a conversation key as a NIP-44 v2 payload
+func EncryptNIP44(conversationKey []byte, plaintext string) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return encryptNIP44(conversationKey, plaintext, nonce)
+}
+
+// encryptNIP44 encrypts with a given nonce
+func encryptNIP44(conversationKey []byte, plaintext string, nonce []byte) (string, error) {
+	if len(plaintext) < nip44MinPlaintext || len(plaintext) > nip44MaxPlaintext {
+		return "", fmt.Errorf("nip44: plaintext must be %d to %d bytes", nip44MinPlaintext, nip44MaxPlaintext)
+	}
+	key, chachaNonce, hmacKey, err := messageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded := make([]byte, 2+paddedLen(len(plaintext)))
+	binary.BigEndian.PutUint16(padded, uint16(len(plaintext)))
+	copy(padded[2:], plaintext)
+
+	stream, err := chacha20.NewUnauthenticatedCipher(key, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	stream.XORKeyStream(padded, padded)
+
+	payload := make([]byte, 0, 1+32+len(padded)+32)
+	payload = append(payload, nip44Version)
+	payload = append(payload, nonce...)
+	payload = append(payload, padded...)
+	payload = append(payload, mac(hmacKey, nonce, padded)...)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// DecryptNIP44 decrypts a NIP-44 v2 payload with a conversation key
+func DecryptNIP44(conversationKey []byte, payload string) (string, error) {
+	if payload == "" || payload[0] == '#' {
+		return "", fmt.Errorf("nip44: unsupported encryption version")
+	}
+	if len(payload) < 132 || len(payload) > 87472 {
+		return "", fmt.Errorf("nip44: invalid payload length")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("nip44: invalid base64")
+	}
+	if len(data) < 99 || len(data) > 65603 {
+		return "", fmt.Errorf("nip44: invalid payload length")
+	}
+	if data[0] != nip44Version {
+		return "", fmt.Errorf("nip44: unsupported encryption version %d", data[0])
+	}
+
+	nonce, ciphertext, tag := data[1:33], data[33:len(data)-32], data[len(data)-32:]
+	key, chachaNonce, hmacKey, err := messageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(tag, mac(hmacKey, nonce, ciphertext)) {
+		return "", fmt.Errorf("nip44: invalid MAC")
+	}
+
+	stream, err := chacha20.NewUnauthenticatedCipher(key, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, len(ciphertext))
+	stream.XORKeyStream(padded, ciphertext)
+
+	n := int(binary.BigEndian.Uint16(padded))
+	if n < nip44MinPlaintext || len(padded) != 2+paddedLen(n) {
+		return "", fmt.Errorf("nip44: invalid padding")
+	}
+	return string(padded[2 : 2+n]), nil
+}
@@ -0,0 +1,585 @@
+// Package nostrclient is a small client for Nostr relays: a connection that
+// reconnects on its own, subscriptions that resume after a reconnect, and
+// publishing that waits for the relay's OK.
+//
+// The relay uses it to mirror events upstream and to probe relays; the
+// companion Go tools of nostr-home can import it as nostr-relay/pkg/nostrclient.
+package nostrclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event is the event type of nostr-relay/pkg/nostr, which builds and signs them
+type Event = nostr.Event
+
+// Filter is a NIP-01 filter, e.g. Filter{"kinds": []int{1}, "limit": 10}
+type Filter map[string]interface{}
+
+// OK is a relay's answer to a published event
+type OK struct {
+	EventID  string
+	Accepted bool
+	Message  string
+}
+
+// Errors returned when a relay cannot answer
+var (
+	ErrClosed         = errors.New("nostrclient: relay connection closed")
+	ErrConnectionLost = errors.New("nostrclient: connection lost before the relay answered")
+	ErrNoResponse     = errors.New("nostrclient: relay did not answer in time")
+)
+
+// Options configure a relay connection; the zero value connects once without
+// reconnecting
+type Options struct {
+	// Dialer defaults to a dialer with a 10 second handshake timeout
+	Dialer *websocket.Dialer
+	Header http.Header
+
+	// Reconnect redials with exponential backoff between MinBackoff (default
+	// 1s) and MaxBackoff (default 1m) when the connection drops
+	Reconnect  bool
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OKTimeout bounds how long Publish waits for an OK (default 15s)
+	OKTimeout time.Duration
+
+	// OnNotice receives NOTICE messages
+	OnNotice func(message string)
+}
+
+// Relay is a connection to one relay. It is safe for concurrent use.
+type Relay struct {
+	URL  string
+	opts Options
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	up      chan struct{} // closed while a connection is established
+	subs    map[string]*Subscription
+	pending map[string]chan OK
+	closed  bool
+	// lost is set when the connection dropped and is not being redialed
+	lost bool
+	done chan struct{}
+
+	writeMu sync.Mutex
+	nextSub uint64
+}
+
+// Connect dials a relay. The first dial must succeed; later drops are
+// redialed when opts.Reconnect is set.
+func Connect(ctx context.Context, url string, opts Options) (*Relay, error) {
+	if opts.Dialer == nil {
+		opts.Dialer = &websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Minute
+	}
+	if opts.OKTimeout <= 0 {
+		opts.OKTimeout = 15 * time.Second
+	}
+
+	r := &Relay{
+		URL:     url,
+		opts:    opts,
+		up:      make(chan struct{}),
+		subs:    make(map[string]*Subscription),
+		pending: make(map[string]chan OK),
+		done:    make(chan struct{}),
+	}
+	if err := r.dial(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// dial opens a connection and starts reading from it
+func (r *Relay) dial(ctx context.Context) error {
+	conn, _, err := r.opts.Dialer.DialContext(ctx, r.URL, r.opts.Header)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	r.conn = conn
+	close(r.up)
+	r.mu.Unlock()
+
+	go r.readLoop(conn)
+	return nil
+}
+
+// Close closes the connection and stops reconnecting
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	conn := r.conn
+	r.mu.Unlock()
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// Connected reports whether a connection is currently established
+func (r *Relay) Connected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn != nil
+}
+
+// waitConnected blocks until a connection is up. Without Reconnect, a
+// dropped connection never comes back, so it fails at once.
+func (r *Relay) waitConnected(ctx context.Context) error {
+	r.mu.Lock()
+	up, closed, lost := r.up, r.closed, r.lost
+	r.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if lost {
+		return ErrConnectionLost
+	}
+
+	select {
+	case <-up:
+		return nil
+	case <-r.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// write sends one message on the current connection
+func (r *Relay) write(message []interface{}) error {
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+	if conn == nil {
+		return ErrConnectionLost
+	}
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.WriteJSON(message)
+}
+
+// readLoop dispatches messages from one connection until it fails
+func (r *Relay) readLoop(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			r.dropped(conn)
+			return
+		}
+
+		var msg []json.RawMessage
+		var msgType string
+		if json.Unmarshal(data, &msg) != nil || len(msg) < 2 || json.Unmarshal(msg[0], &msgType) != nil {
+			continue
+		}
+		var first string
+		json.Unmarshal(msg[1], &first)
+
+		switch msgType {
+		case "EVENT":
+			var event Event
+			if len(msg) < 3 || json.Unmarshal(msg[2], &event) != nil {
+				continue
+			}
+			if sub := r.subscription(first); sub != nil {
+				sub.deliver(event)
+			}
+		case "EOSE":
+			if sub := r.subscription(first); sub != nil {
+				sub.eoseOnce.Do(func() { close(sub.EOSE) })
+			}
+		case "CLOSED":
+			var reason string
+			if len(msg) > 2 {
+				json.Unmarshal(msg[2], &reason)
+			}
+			if sub := r.subscription(first); sub != nil {
+				r.forget(sub.ID)
+				sub.closeWith(reason)
+			}
+		case "OK":
+			ok := OK{EventID: first}
+			if len(msg) > 2 {
+				json.Unmarshal(msg[2], &ok.Accepted)
+			}
+			if len(msg) > 3 {
+				json.Unmarshal(msg[3], &ok.Message)
+			}
+			r.mu.Lock()
+			if ch, found := r.pending[ok.EventID]; found {
+				delete(r.pending, ok.EventID)
+				ch <- ok
+			}
+			r.mu.Unlock()
+		case "NOTICE":
+			if r.opts.OnNotice != nil {
+				r.opts.OnNotice(first)
+			}
+		}
+	}
+}
+
+// dropped handles a failed connection: pending publishes fail, and the relay
+// is redialed when reconnecting is enabled
+func (r *Relay) dropped(conn *websocket.Conn) {
+	conn.Close()
+
+	r.mu.Lock()
+	if r.conn != conn {
+		r.mu.Unlock()
+		return
+	}
+	r.conn = nil
+	r.up = make(chan struct{})
+	for id, ch := range r.pending {
+		close(ch)
+		delete(r.pending, id)
+	}
+	reconnect := r.opts.Reconnect && !r.closed
+	r.lost = !reconnect
+	r.mu.Unlock()
+
+	if reconnect {
+		go r.reconnect()
+	} else {
+		r.closeSubscriptions("connection lost")
+	}
+}
+
+// reconnect redials with backoff and resubscribes
+func (r *Relay) reconnect() {
+	backoff := r.opts.MinBackoff
+	for {
+		select {
+		case <-r.done:
+			r.closeSubscriptions("relay connection closed")
+			return
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.opts.Dialer.HandshakeTimeout+5*time.Second)
+		err := r.dial(ctx)
+		cancel()
+		if err == nil {
+			r.resubscribe()
+			return
+		}
+		if err == ErrClosed {
+			return
+		}
+
+		if backoff *= 2; backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+}
+
+// Publish sends an event and waits for the relay's OK. An error means the
+// relay never answered; a rejection is an OK with Accepted false.
+func (r *Relay) Publish(ctx context.Context, event Event) (OK, error) {
+	if err := r.waitConnected(ctx); err != nil {
+		return OK{}, err
+	}
+
+	answer := make(chan OK, 1)
+	r.mu.Lock()
+	r.pending[event.ID] = answer
+	r.mu.Unlock()
+	forget := func() {
+		r.mu.Lock()
+		if r.pending[event.ID] == answer {
+			delete(r.pending, event.ID)
+		}
+		r.mu.Unlock()
+	}
+
+	if err := r.write([]interface{}{"EVENT", event}); err != nil {
+		forget()
+		return OK{}, err
+	}
+
+	timer := time.NewTimer(r.opts.OKTimeout)
+	defer timer.Stop()
+	select {
+	case ok, answered := <-answer:
+		if !answered {
+			return OK{}, ErrConnectionLost
+		}
+		return ok, nil
+	case <-timer.C:
+		forget()
+		return OK{}, ErrNoResponse
+	case <-ctx.Done():
+		forget()
+		return OK{}, ctx.Err()
+	}
+}
+
+// PublishResult is the outcome of publishing one event with PublishAll
+type PublishResult struct {
+	OK
+	Err error // set when the relay never answered
+}
+
+// PublishAll publishes events with at most window of them awaiting an OK at
+// once, and returns the outcome of each in order
+func (r *Relay) PublishAll(ctx context.Context, events []Event, window int) []PublishResult {
+	if window < 1 {
+		window = 1
+	}
+	results := make([]PublishResult, len(events))
+	slots := make(chan struct{}, window)
+	var wg sync.WaitGroup
+	for i, event := range events {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, event Event) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ok, err := r.Publish(ctx, event)
+			if ok.EventID == "" {
+				ok.EventID = event.ID
+			}
+			results[i] = PublishResult{OK: ok, Err: err}
+		}(i, event)
+	}
+	wg.Wait()
+	return results
+}
+
+// Subscription is an open REQ. Events arrive on Events; EOSE is closed once
+// stored events have been sent; Done is closed when the subscription ends.
+// Events that arrive while Events is full are dropped and counted by Dropped,
+// so a slow reader never stalls the connection.
+type Subscription struct {
+	ID      string
+	Filters []Filter
+	Events  chan Event
+	EOSE    chan struct{}
+	Done    chan struct{}
+
+	relay    *Relay
+	eoseOnce sync.Once
+	doneOnce sync.Once
+	reason   string
+	latest   int64 // newest created_at delivered, to resume from
+	dropped  int64
+}
+
+// Subscribe opens a subscription. After a reconnect it is sent again with
+// since moved up to the newest event already delivered.
+func (r *Relay) Subscribe(ctx context.Context, filters ...Filter) (*Subscription, error) {
+	if err := r.waitConnected(ctx); err != nil {
+		return nil, err
+	}
+
+	sub := &Subscription{
+		ID:      "sub" + strconv.FormatUint(atomic.AddUint64(&r.nextSub, 1), 10),
+		Filters: filters,
+		Events:  make(chan Event, 256),
+		EOSE:    make(chan struct{}),
+		Done:    make(chan struct{}),
+		relay:   r,
+	}
+	r.mu.Lock()
+	r.subs[sub.ID] = sub
+	r.mu.Unlock()
+
+	if err := r.write(sub.request(filters)); err != nil {
+		r.forget(sub.ID)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// request builds the REQ message for a set of filters
+func (s *Subscription) request(filters []Filter) []interface{} {
+	message := []interface{}{"REQ", s.ID}
+	for _, filter := range filters {
+		message = append(message, filter)
+	}
+	return message
+}
+
+// deliver passes an event to the subscriber without blocking the read loop
+func (s *Subscription) deliver(event Event) {
+	select {
+	case s.Events <- event:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+	if event.CreatedAt > atomic.LoadInt64(&s.latest) {
+		atomic.StoreInt64(&s.latest, event.CreatedAt)
+	}
+}
+
+// Dropped is how many events were dropped because Events was full
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// closeWith ends the subscription with a reason
+func (s *Subscription) closeWith(reason string) {
+	s.doneOnce.Do(func() {
+		s.reason = reason
+		close(s.Done)
+	})
+}
+
+// Reason is why the relay or the connection ended the subscription
+func (s *Subscription) Reason() string {
+	select {
+	case <-s.Done:
+		return s.reason
+	default:
+		return ""
+	}
+}
+
+// Close sends CLOSE and ends the subscription
+func (s *Subscription) Close() {
+	s.relay.forget(s.ID)
+	s.relay.write([]interface{}{"CLOSE", s.ID})
+	s.closeWith("closed by client")
+}
+
+// subscription looks up an open subscription
+func (r *Relay) subscription(id string) *Subscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subs[id]
+}
+
+// forget removes a subscription
+func (r *Relay) forget(id string) {
+	r.mu.Lock()
+	delete(r.subs, id)
+	r.mu.Unlock()
+}
+
+// resubscribe sends every open subscription again after a reconnect
+func (r *Relay) resubscribe() {
+	r.mu.Lock()
+	subs := make([]*Subscription, 0, len(r.subs))
+	for _, sub := range r.subs {
+		subs = append(subs, sub)
+	}
+	r.mu.Unlock()
+
+	for _, sub := range subs {
+		filters := sub.Filters
+		if latest := atomic.LoadInt64(&sub.latest); latest > 0 {
+			filters = make([]Filter, len(sub.Filters))
+			for i, filter := range sub.Filters {
+				resumed := Filter{}
+				for k, v := range filter {
+					resumed[k] = v
+				}
+				if since, ok := timestamp(resumed["since"]); !ok || since < latest {
+					resumed["since"] = latest
+				}
+				filters[i] = resumed
+			}
+		}
+		r.write(sub.request(filters))
+	}
+}
+
+// timestamp reads a filter's since or until, whichever numeric type the
+// caller used
+func timestamp(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return t, true
+	case int:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case float64:
+		return int64(t), true
+	case json.Number:
+		n, err := t.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// closeSubscriptions ends every open subscription
+func (r *Relay) closeSubscriptions(reason string) {
+	r.mu.Lock()
+	subs := r.subs
+	r.subs = make(map[string]*Subscription)
+	r.mu.Unlock()
+	for _, sub := range subs {
+		sub.closeWith(reason)
+	}
+}
+
+// Query returns the stored events matching filters, up to EOSE
+func (r *Relay) Query(ctx context.Context, filters ...Filter) ([]Event, error) {
+	sub, err := r.Subscribe(ctx, filters...)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+
+	var events []Event
+	for {
+		select {
+		case event := <-sub.Events:
+			events = append(events, event)
+		case <-sub.EOSE:
+			// Drain events that arrived before EOSE
+			for {
+				select {
+				case event := <-sub.Events:
+					events = append(events, event)
+				default:
+					return events, nil
+				}
+			}
+		case <-sub.Done:
+			return events, fmt.Errorf("subscription closed: %s", sub.Reason())
+		case <-ctx.Done():
+			return events, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NIP-88 polls (kind 1068) and their responses (kind 1018) are indexed next
+// to the events, so the relay can tally results itself: each pubkey counts
+// once, with its latest response before the poll ends.
+
+const pollSchema = `
+	CREATE TABLE IF NOT EXISTS event_polls (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		question TEXT NOT NULL,
+		poll_type TEXT NOT NULL,
+		ends_at INTEGER NOT NULL,
+		options TEXT NOT NULL
+	);
+`
+
+const pollVoteSchema = `
+	CREATE TABLE IF NOT EXISTS event_poll_votes (
+		event_id TEXT PRIMARY KEY,
+		poll_id TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		options TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_poll_votes_poll ON event_poll_votes(poll_id, pubkey, created_at);
+`
+
+// pollOption is one answer of a poll
+type pollOption struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Votes int    `json:"votes"`
+}
+
+// pollInfo is a poll with its tallied results
+type pollInfo struct {
+	EventID   string       `json:"event_id"`
+	PubKey    string       `json:"pubkey"`
+	CreatedAt int64        `json:"created_at"`
+	Question  string       `json:"question"`
+	PollType  string       `json:"poll_type"`
+	EndsAt    int64        `json:"ends_at,omitempty"`
+	Options   []pollOption `json:"options"`
+	Voters    int          `json:"voters"`
+}
+
+// indexPoll records a poll's question and options
+func indexPoll(db sqlExecer, event *Event) error {
+	if event.Kind != 1068 {
+		return nil
+	}
+	options := []pollOption{}
+	for _, tag := range event.Tags {
+		if len(tag) >= 3 && tag[0] == "option" && tag[1] != "" {
+			options = append(options, pollOption{ID: tag[1], Label: tag[2]})
+		}
+	}
+	pollType := event.TagValue("polltype")
+	if pollType != "multiplechoice" {
+		pollType = "singlechoice"
+	}
+	endsAt, _ := strconv.ParseInt(event.TagValue("endsAt"), 10, 64)
+	data, _ := json.Marshal(options)
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_polls (event_id, pubkey, created_at, question, poll_type, ends_at, options)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, event.ID, event.PubKey, event.CreatedAt, event.Content, pollType, endsAt, string(data))
+	return err
+}
+
+// indexPollVote records the options a response picks
+func indexPollVote(db sqlExecer, event *Event) error {
+	pollID := strings.ToLower(event.TagValue("e"))
+	if event.Kind != 1018 || !isHex64(pollID) {
+		return nil
+	}
+	data, _ := json.Marshal(tagList(event, "response"))
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_poll_votes (event_id, poll_id, pubkey, created_at, options)
+		VALUES (?, ?, ?, ?, ?)`, event.ID, pollID, event.PubKey, event.CreatedAt, string(data))
+	return err
+}
+
+// tallyPoll counts the latest response of each pubkey. Responses after the
+// poll ended and options the poll does not have are ignored; a single-choice
+// response counts for its first option only.
+func tallyPoll(poll *pollInfo) error {
+	type vote struct {
+		createdAt int64
+		options   []string
+	}
+	latest := map[string]vote{}
+	err := queryPayloads("SELECT pubkey, created_at, options FROM event_poll_votes WHERE poll_id = ?",
+		[]interface{}{poll.EventID}, func(rows *sql.Rows) {
+			var pubkey, options string
+			var v vote
+			if rows.Scan(&pubkey, &v.createdAt, &options) != nil {
+				return
+			}
+			if poll.EndsAt > 0 && v.createdAt > poll.EndsAt {
+				return
+			}
+			if prev, seen := latest[pubkey]; !seen || v.createdAt > prev.createdAt {
+				json.Unmarshal([]byte(options), &v.options)
+				latest[pubkey] = v
+			}
+		})
+	if err != nil {
+		return err
+	}
+
+	index := map[string]int{}
+	for i := range poll.Options {
+		index[poll.Options[i].ID] = i
+	}
+	for _, v := range latest {
+		counted := map[string]bool{}
+		for _, id := range v.options {
+			i, known := index[id]
+			if !known || counted[id] {
+				continue
+			}
+			counted[id] = true
+			poll.Options[i].Votes++
+			if poll.PollType == "singlechoice" {
+				break
+			}
+		}
+		if len(counted) > 0 {
+			poll.Voters++
+		}
+	}
+	return nil
+}
+
+// queryPolls returns the matching polls with their results, newest first
+func queryPolls(where string, args []interface{}) ([]pollInfo, error) {
+	polls := []pollInfo{}
+	err := queryPayloads("SELECT event_id, pubkey, created_at, question, poll_type, ends_at, options FROM event_polls WHERE "+where,
+		args, func(rows *sql.Rows) {
+			var p pollInfo
+			var options string
+			if rows.Scan(&p.EventID, &p.PubKey, &p.CreatedAt, &p.Question, &p.PollType, &p.EndsAt, &options) == nil {
+				json.Unmarshal([]byte(options), &p.Options)
+				polls = append(polls, p)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	for i := range polls {
+		if err := tallyPoll(&polls[i]); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(polls, func(i, j int) bool { return polls[i].CreatedAt > polls[j].CreatedAt })
+	return polls, nil
+}
+
+// handlePolls lists polls with their results, newest first; ?author= narrows
+// it to one pubkey, e.g. the owner's
+func handlePolls(c *gin.Context) {
+	where, args := authorCondition(c, "1=1", []interface{}{})
+	polls, err := queryPolls(where, args)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if limit := payloadLimit(c); len(polls) > limit {
+		polls = polls[:limit]
+	}
+	c.JSON(200, gin.H{"polls": polls})
+}
+
+// handlePoll returns one poll with its results
+func handlePoll(c *gin.Context) {
+	polls, err := queryPolls("event_id = ?", []interface{}{strings.ToLower(c.Param("id"))})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if len(polls) == 0 {
+		c.JSON(404, gin.H{"error": "poll not found"})
+		return
+	}
+	c.JSON(200, polls[0])
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"nostr-relay/pkg/nostr"
+)
+
+// NIP-13 proof of work. With RELAY_MIN_POW_DIFFICULTY set, an event is only
+// stored when its ID has at least that many leading zero bits and its nonce
+// tag commits to at least that target, so an ID that happens to be lucky
+// with a lower target does not pass. The owner and the pubkeys in
+// RELAY_POW_EXEMPT publish without mining.
+
+// powPolicy is the proof-of-work requirement
+type powPolicy struct {
+	min    int
+	exempt map[string]bool
+}
+
+// newPowPolicy returns the policy, or nil when no work is required
+func newPowPolicy(cfg *Config) (*powPolicy, error) {
+	if cfg.MinPowDifficulty < 0 || cfg.MinPowDifficulty > 256 {
+		return nil, fmt.Errorf("RELAY_MIN_POW_DIFFICULTY must be from 0 to 256, not %d", cfg.MinPowDifficulty)
+	}
+	if cfg.MinPowDifficulty == 0 {
+		return nil, nil
+	}
+	p := &powPolicy{min: cfg.MinPowDifficulty, exempt: map[string]bool{}}
+	if cfg.OwnerPubkey != "" {
+		p.exempt[cfg.OwnerPubkey] = true
+	}
+	for _, entry := range cfg.PowExempt {
+		pubkey, err := nostr.DecodePublicKey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_POW_EXEMPT entry %q: %v", entry, err)
+		}
+		p.exempt[pubkey] = true
+	}
+	return p, nil
+}
+
+// minDifficulty is the required difficulty, 0 when there is none
+func (p *powPolicy) minDifficulty() int {
+	if p == nil {
+		return 0
+	}
+	return p.min
+}
+
+// check returns an OK rejection message when an event lacks the required
+// work, or "" when it may be stored
+func (p *powPolicy) check(event *Event) string {
+	if p == nil || p.exempt[event.PubKey] {
+		return ""
+	}
+	target, ok := event.CommittedDifficulty()
+	if !ok {
+		return fmt.Sprintf("pow: a nonce tag with a difficulty of at least %d is required", p.min)
+	}
+	if target < p.min {
+		return fmt.Sprintf("pow: committed target %d is below the required %d", target, p.min)
+	}
+	if difficulty := nostr.Difficulty(event.ID); difficulty < p.min {
+		return fmt.Sprintf("pow: difficulty %d is below the required %d", difficulty, p.min)
+	}
+	return ""
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nostr-relay/pkg/nostrclient"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const probeSchema = `
+	CREATE TABLE IF NOT EXISTS relay_probes (
+		relay TEXT NOT NULL,
+		probed_at INTEGER NOT NULL,
+		ok INTEGER NOT NULL,
+		connect_ms INTEGER,
+		req_ms INTEGER,
+		nip11 INTEGER NOT NULL,
+		software TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_relay_probes_relay ON relay_probes(relay, probed_at);
+`
+
+const (
+	// probeTimeout bounds each step of a probe
+	probeTimeout = 10 * time.Second
+	// probeRetention is how long probe history is kept
+	probeRetention = 30 * 24 * time.Hour
+)
+
+// relayProbe is the outcome of probing one upstream relay
+type relayProbe struct {
+	Relay     string
+	ProbedAt  int64
+	OK        bool  // connected and answered a REQ with EOSE
+	ConnectMS int64 // websocket handshake time, -1 when it failed
+	ReqMS     int64 // time from REQ to EOSE, -1 when it failed
+	NIP11     bool  // served a NIP-11 document
+	Software  string
+	Error     string
+}
+
+// upstreamRelay is a relay the owner publishes to, with why it is probed
+type upstreamRelay struct {
+	URL     string
+	Sources []string // "mirror" and/or "nip65"
+	Marker  string   // NIP-65 read/write marker, "" for both
+}
+
+// normalizeRelayURL makes relay URLs from different sources comparable
+func normalizeRelayURL(url string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(url)), "/")
+}
+
+// ownerRelayList returns the "r" tags of the owner's latest NIP-65 (kind 10002) event
+func (r *Relay) ownerRelayList() [][]string {
+	if r.cfg.OwnerPubkey == "" {
+		return nil
+	}
+
+	// Partitions are visited newest first, so the first hit is the latest list
+	for _, db := range r.eventDBs(nil, nil) {
+		var tagsJSON string
+		err := db.QueryRow(
+			"SELECT tags FROM relay_events WHERE pubkey = ? AND kind = 10002 ORDER BY created_at DESC LIMIT 1",
+			r.cfg.OwnerPubkey,
+		).Scan(&tagsJSON)
+		if err != nil {
+			continue
+		}
+
+		var tags, list [][]string
+		json.Unmarshal([]byte(tagsJSON), &tags)
+		for _, tag := range tags {
+			if len(tag) >= 2 && tag[0] == "r" {
+				list = append(list, tag)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// upstreamRelays returns the mirrors and the owner's NIP-65 relays, deduplicated
+func (r *Relay) upstreamRelays() []upstreamRelay {
+	byURL := map[string]*upstreamRelay{}
+	var order []string
+	add := func(url, source, marker string) {
+		key := normalizeRelayURL(url)
+		if key == "" {
+			return
+		}
+		u, ok := byURL[key]
+		if !ok {
+			u = &upstreamRelay{URL: key}
+			byURL[key] = u
+			order = append(order, key)
+		}
+		u.Sources = append(u.Sources, source)
+		if source == "nip65" {
+			u.Marker = marker
+		}
+	}
+
+	for _, mirror := range r.cfg.MirrorRelays {
+		add(mirror, "mirror", "")
+	}
+	for _, tag := range r.ownerRelayList() {
+		marker := ""
+		if len(tag) >= 3 {
+			marker = tag[2]
+		}
+		add(tag[1], "nip65", marker)
+	}
+
+	relays := make([]upstreamRelay, len(order))
+	for i, key := range order {
+		relays[i] = *byURL[key]
+	}
+	return relays
+}
+
+// fetchNIP11 fetches a relay's information document over HTTP
+func fetchNIP11(relayURL string) (map[string]interface{}, error) {
+	httpURL := strings.Replace(strings.Replace(relayURL, "wss://", "https://", 1), "ws://", "http://", 1)
+	req, err := http.NewRequest("GET", httpURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/nostr+json")
+
+	var info map[string]interface{}
+	if err := doJSON(&http.Client{Timeout: probeTimeout}, req, &info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// probeRelay connects to a relay, fetches its NIP-11 document and checks that
+// a one-event REQ is answered with EOSE
+func probeRelay(relayURL string) relayProbe {
+	probe := relayProbe{Relay: relayURL, ProbedAt: time.Now().Unix(), ConnectMS: -1, ReqMS: -1}
+
+	if info, err := fetchNIP11(relayURL); err == nil {
+		probe.NIP11 = true
+		if software, ok := info["software"].(string); ok {
+			probe.Software = software
+		}
+		if version, ok := info["version"].(string); ok && version != "" {
+			probe.Software = strings.TrimSpace(probe.Software + " " + version)
+		}
+	}
+
+	start := time.Now()
+	client, err := nostrclient.Connect(context.Background(), relayURL, nostrclient.Options{
+		Dialer: &websocket.Dialer{HandshakeTimeout: probeTimeout},
+	})
+	if err != nil {
+		probe.Error = "connect: " + err.Error()
+		return probe
+	}
+	defer client.Close()
+	probe.ConnectMS = time.Since(start).Milliseconds()
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	start = time.Now()
+	if _, err := client.Query(ctx, nostrclient.Filter{"limit": 1}); err != nil {
+		probe.Error = "req: " + err.Error()
+		return probe
+	}
+	probe.ReqMS = time.Since(start).Milliseconds()
+	probe.OK = true
+	return probe
+}
+
+// probeUpstreams probes every upstream relay concurrently and stores the results
+func (r *Relay) probeUpstreams() []relayProbe {
+	relays := r.upstreamRelays()
+	probes := make([]relayProbe, len(relays))
+
+	var wg sync.WaitGroup
+	for i, u := range relays {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			probes[i] = probeRelay(url)
+		}(i, u.URL)
+	}
+	wg.Wait()
+
+	for _, p := range probes {
+		// Relays start out presumed up, so one that is down from the first probe is logged
+		wasOK := true
+		r.db.QueryRow("SELECT ok FROM relay_probes WHERE relay = ? ORDER BY probed_at DESC LIMIT 1", p.Relay).Scan(&wasOK)
+		if wasOK != p.OK {
+			if p.OK {
+				log.Printf("✅ Upstream relay %s is back up", p.Relay)
+			} else {
+				log.Printf("⚠️  Upstream relay %s is down: %s", p.Relay, p.Error)
+			}
+		}
+
+		_, err := r.db.Exec(`INSERT INTO relay_probes (relay, probed_at, ok, connect_ms, req_ms, nip11, software, error)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.Relay, p.ProbedAt, p.OK, p.ConnectMS, p.ReqMS, p.NIP11, p.Software, p.Error)
+		if err != nil {
+			log.Printf("❌ Failed to record probe of %s: %v", p.Relay, err)
+		}
+	}
+
+	r.db.Exec("DELETE FROM relay_probes WHERE probed_at < ?", time.Now().Add(-probeRetention).Unix())
+	return probes
+}
+
+// runProbes probes the upstream relays every RELAY_PROBE_INTERVAL
+func (r *Relay) runProbes() {
+	if r.cfg.ProbeInterval <= 0 {
+		return
+	}
+
+	r.publishMonitorAnnouncement()
+	for {
+		r.publishRelayDiscovery(r.probeUpstreams())
+		r.autoPublishRelayList()
+		time.Sleep(r.cfg.ProbeInterval)
+	}
+}
+
+// relayHealth summarizes the probe history of one upstream relay
+type relayHealth struct {
+	URL       string             `json:"url"`
+	Sources   []string           `json:"sources"`
+	Marker    string             `json:"marker,omitempty"`
+	Up        *bool              `json:"up"` // nil until the first probe
+	LastProbe int64              `json:"last_probe,omitempty"`
+	ConnectMS int64              `json:"connect_ms,omitempty"`
+	ReqMS     int64              `json:"req_ms,omitempty"`
+	NIP11     bool               `json:"nip11"`
+	Software  string             `json:"software,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	Uptime24h *float64           `json:"uptime_24h"`
+	Uptime7d  *float64           `json:"uptime_7d"`
+	DownSince int64              `json:"down_since,omitempty"`
+	History   []relayProbeSample `json:"history"`
+}
+
+// relayProbeSample is one point of a relay's availability history
+type relayProbeSample struct {
+	ProbedAt int64 `json:"probed_at"`
+	OK       bool  `json:"ok"`
+}
+
+// uptimeSince returns the share of successful probes of a relay since a time
+func (r *Relay) uptimeSince(relayURL string, since int64) *float64 {
+	var total, ok int
+	r.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(ok), 0) FROM relay_probes WHERE relay = ? AND probed_at >= ?",
+		relayURL, since).Scan(&total, &ok)
+	if total == 0 {
+		return nil
+	}
+	uptime := float64(ok) / float64(total)
+	return &uptime
+}
+
+// upstreamHealth returns the health of every upstream relay with its last
+// historyLen probes, dead relays first
+func (r *Relay) upstreamHealth(historyLen int) []relayHealth {
+	now := time.Now()
+	health := []relayHealth{}
+
+	for _, u := range r.upstreamRelays() {
+		h := relayHealth{URL: u.URL, Sources: u.Sources, Marker: u.Marker, History: []relayProbeSample{}}
+
+		rows, err := r.db.Query(
+			`SELECT probed_at, ok, connect_ms, req_ms, nip11, software, error
+			 FROM relay_probes WHERE relay = ? ORDER BY probed_at DESC LIMIT ?`,
+			u.URL, historyLen)
+		if err == nil {
+			for rows.Next() {
+				var p relayProbe
+				if rows.Scan(&p.ProbedAt, &p.OK, &p.ConnectMS, &p.ReqMS, &p.NIP11, &p.Software, &p.Error) != nil {
+					continue
+				}
+				if h.Up == nil {
+					up := p.OK
+					h.Up, h.LastProbe = &up, p.ProbedAt
+					h.NIP11, h.Software, h.Error = p.NIP11, p.Software, p.Error
+					if p.ConnectMS >= 0 {
+						h.ConnectMS = p.ConnectMS
+					}
+					if p.ReqMS >= 0 {
+						h.ReqMS = p.ReqMS
+					}
+				}
+				h.History = append(h.History, relayProbeSample{ProbedAt: p.ProbedAt, OK: p.OK})
+			}
+			rows.Close()
+		}
+
+		// History is newest first: the relay has been down since the oldest
+		// failure of the current streak
+		if h.Up != nil && !*h.Up {
+			for _, s := range h.History {
+				if s.OK {
+					break
+				}
+				h.DownSince = s.ProbedAt
+			}
+		}
+
+		h.Uptime24h = r.uptimeSince(u.URL, now.Add(-24*time.Hour).Unix())
+		h.Uptime7d = r.uptimeSince(u.URL, now.Add(-7*24*time.Hour).Unix())
+		health = append(health, h)
+	}
+
+	sort.SliceStable(health, func(i, j int) bool {
+		return health[i].Up != nil && !*health[i].Up && (health[j].Up == nil || *health[j].Up)
+	})
+	return health
+}
+
+// handleUpstreamHealth serves the availability of the mirrors and the owner's
+// NIP-65 relays with their recent probe history
+func handleUpstreamHealth(c *gin.Context) {
+	history := 48
+	fmt.Sscanf(c.Query("history"), "%d", &history)
+	if history < 0 || history > 1000 {
+		history = 48
+	}
+
+	c.JSON(200, gin.H{"interval": relay.cfg.ProbeInterval.String(), "relays": relay.upstreamHealth(history)})
+}
+
+// handleProbeUpstreams probes the upstream relays now instead of waiting for
+// the next scheduled round
+func handleProbeUpstreams(c *gin.Context) {
+	relay.probeUpstreams()
+	c.JSON(200, gin.H{"interval": relay.cfg.ProbeInterval.String(), "relays": relay.upstreamHealth(1)})
+}
+
+// upstreamSummary is the compact upstream status included in /stats
+func (r *Relay) upstreamSummary() map[string]interface{} {
+	var down []string
+	health := r.upstreamHealth(1)
+	for _, h := range health {
+		if h.Up != nil && !*h.Up {
+			down = append(down, h.URL)
+		}
+	}
+	if down == nil {
+		down = []string{}
+	}
+	return map[string]interface{}{"relays": len(health), "down": down}
+}
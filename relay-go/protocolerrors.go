@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// protocolGuard disconnects clients that keep sending malformed messages and
+// turns away their IP for a while, so a broken bot cannot reconnect and loop
+type protocolGuard struct {
+	budget   int // violations allowed per connection; 0 disables the guard
+	blockFor time.Duration
+
+	// tarpit holds a blocked IP's upgrade request this long before the 429,
+	// up to tarpitMax requests at once; 0 rejects immediately
+	tarpit    time.Duration
+	tarpitMax int64
+	held      int64 // requests being held right now
+	tarpitted int64
+
+	mu      sync.Mutex
+	blocked map[string]time.Time // IP -> blocked until
+
+	disconnects int64
+	rejected    int64
+}
+
+func newProtocolGuard(cfg *Config) *protocolGuard {
+	return &protocolGuard{
+		budget:    cfg.ProtocolErrorBudget,
+		blockFor:  cfg.ProtocolBlock,
+		tarpit:    cfg.Tarpit,
+		tarpitMax: int64(cfg.TarpitMax),
+		blocked:   make(map[string]time.Time),
+	}
+}
+
+// blockedUntil reports whether an IP is blocked, and until when
+func (g *protocolGuard) blockedUntil(ip string) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, ok := g.blocked[ip]
+	if ok && time.Now().After(until) {
+		delete(g.blocked, ip)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+// block turns away an IP for the block duration, dropping expired blocks
+func (g *protocolGuard) block(ip string) {
+	if g.blockFor <= 0 || ip == "" {
+		return
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for other, until := range g.blocked {
+		if now.After(until) {
+			delete(g.blocked, other)
+		}
+	}
+	g.blocked[ip] = now.Add(g.blockFor)
+}
+
+// stats summarizes the guard for /api/stats
+func (g *protocolGuard) stats() map[string]interface{} {
+	g.mu.Lock()
+	blocked := 0
+	for _, until := range g.blocked {
+		if time.Now().Before(until) {
+			blocked++
+		}
+	}
+	g.mu.Unlock()
+
+	return map[string]interface{}{
+		"error_budget": g.budget,
+		"disconnects":  atomic.LoadInt64(&g.disconnects),
+		"rejected":     atomic.LoadInt64(&g.rejected),
+		"blocked_ips":  blocked,
+		"tarpitted":    atomic.LoadInt64(&g.tarpitted),
+		"tarpit_held":  atomic.LoadInt64(&g.held),
+	}
+}
+
+// rejectBlocked answers a blocked IP's WebSocket upgrade with 429 and
+// reports whether it did. With a tarpit the answer is delayed, so a bot
+// retrying in a loop spends its time waiting; requests beyond the tarpit's
+// capacity are rejected at once so holding them stays cheap.
+func (g *protocolGuard) rejectBlocked(c *gin.Context) bool {
+	until, blocked := g.blockedUntil(c.ClientIP())
+	if !blocked {
+		return false
+	}
+	atomic.AddInt64(&g.rejected, 1)
+
+	if g.tarpit > 0 {
+		if atomic.AddInt64(&g.held, 1) <= g.tarpitMax {
+			atomic.AddInt64(&g.tarpitted, 1)
+			timer := time.NewTimer(g.tarpit)
+			select {
+			case <-timer.C:
+			case <-c.Request.Context().Done():
+				timer.Stop()
+			}
+		}
+		atomic.AddInt64(&g.held, -1)
+	}
+
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	c.JSON(429, gin.H{"error": "too many protocol errors; try again later"})
+	return true
+}
+
+// protocolError logs a malformed message and counts it against the
+// connection's budget; only the read pump calls it
+func (c *Client) protocolError(format string, args ...interface{}) {
+	c.logf(format, args...)
+	c.violations++
+}
+
+// overBudget reports whether the client has used up its protocol error budget
+func (c *Client) overBudget() bool {
+	budget := c.Relay.protocol.budget
+	return budget > 0 && c.violations >= budget && !c.isOwner()
+}
+
+// disconnectForViolations tells the client why with a NOTICE, closes the
+// connection and blocks its IP
+func (c *Client) disconnectForViolations() {
+	guard := c.Relay.protocol
+	atomic.AddInt64(&guard.disconnects, 1)
+	guard.block(c.remoteAddr)
+	log.Printf("🚫 Client %s (%s) sent %d malformed messages; disconnecting and blocking for %v",
+		c.ID, c.remoteAddr, c.violations, guard.blockFor)
+
+	c.sendJSON([]interface{}{"NOTICE", fmt.Sprintf("error: too many protocol errors (%d); disconnecting", c.violations)})
+
+	// Give the write pump a moment to flush the NOTICE before the close frame
+	for i := 0; i < 20 && c.Send.len() > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many protocol errors"),
+		time.Now().Add(time.Second))
+}
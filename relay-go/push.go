@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const pushSchema = `
+	CREATE TABLE IF NOT EXISTS push_devices (
+		token TEXT PRIMARY KEY,
+		platform TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_push_at INTEGER
+	);
+`
+
+// ownerAlert describes an incoming event that concerns the relay owner. It
+// deliberately carries no content or author so pushes leak nothing to the
+// push provider; the app fetches the event from the relay itself.
+type ownerAlert struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Kind    int    `json:"kind"`
+}
+
+// alertTitles are the generic notification texts for each alert type
+var alertTitles = map[string]string{
+	"dm":       "New direct message",
+	"mention":  "New mention",
+	"zap":      "New zap",
+	"reaction": "New reaction",
+	"keyword":  "Watched keyword mentioned",
+}
+
+// classifyOwnerAlert returns the alert an event raises for the owner, or nil
+func (r *Relay) classifyOwnerAlert(event *Event) *ownerAlert {
+	owner := r.cfg.OwnerPubkey
+	if owner == "" || event.PubKey == owner {
+		return nil
+	}
+
+	tagged := false
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && tag[1] == owner {
+			tagged = true
+			break
+		}
+	}
+	if !tagged {
+		return nil
+	}
+
+	var alertType string
+	switch event.Kind {
+	case 4, 14, 1059:
+		alertType = "dm"
+	case 9735:
+		alertType = "zap"
+	case 7:
+		alertType = "reaction"
+	case 1, 42, 1111, 30023:
+		alertType = "mention"
+	default:
+		return nil
+	}
+
+	return &ownerAlert{Type: alertType, EventID: event.ID, Kind: event.Kind}
+}
+
+// dispatchOwnerAlerts forwards owner alerts raised by a stored event to the
+// configured notification channels
+func (r *Relay) dispatchOwnerAlerts(event *Event) {
+	alert := r.classifyOwnerAlert(event)
+	// Keyword matches are recorded even when the event raised another alert
+	if r.watchKeywords(event, alert == nil) {
+		alert = &ownerAlert{Type: "keyword", EventID: event.ID, Kind: event.Kind}
+	}
+	if alert == nil {
+		return
+	}
+
+	if alert.Type != "reaction" && r.push != nil {
+		r.push.send(r, alert)
+	}
+
+	if r.selfHostedPush != nil {
+		r.selfHostedPush.send(alert)
+	}
+}
+
+// pushGateway delivers owner alerts to registered mobile devices
+type pushGateway struct {
+	client *http.Client
+	apns   *apnsSender
+	fcm    *fcmSender
+}
+
+// newPushGateway configures the APNs and FCM senders that have credentials
+func newPushGateway(cfg *Config) (*pushGateway, error) {
+	gw := &pushGateway{client: &http.Client{Timeout: 10 * time.Second}}
+
+	if cfg.APNsKeyFile != "" {
+		apns, err := newAPNsSender(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure APNs: %v", err)
+		}
+		gw.apns = apns
+	}
+
+	if cfg.FCMCredentialsFile != "" {
+		fcm, err := newFCMSender(cfg.FCMCredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure FCM: %v", err)
+		}
+		gw.fcm = fcm
+	}
+
+	if gw.apns == nil && gw.fcm == nil {
+		return nil, nil
+	}
+	return gw, nil
+}
+
+// send pushes an alert to every registered device
+func (gw *pushGateway) send(r *Relay, alert *ownerAlert) {
+	rows, err := r.db.Query("SELECT token, platform FROM push_devices")
+	if err != nil {
+		log.Printf("❌ Failed to load push devices: %v", err)
+		return
+	}
+
+	type device struct{ token, platform string }
+	var devices []device
+	for rows.Next() {
+		var d device
+		if rows.Scan(&d.token, &d.platform) == nil {
+			devices = append(devices, d)
+		}
+	}
+	rows.Close()
+
+	for _, d := range devices {
+		var err error
+		var unregistered bool
+
+		switch {
+		case d.platform == "apns" && gw.apns != nil:
+			unregistered, err = gw.apns.send(gw.client, d.token, alert)
+		case d.platform == "fcm" && gw.fcm != nil:
+			unregistered, err = gw.fcm.send(gw.client, d.token, alert)
+		default:
+			continue
+		}
+
+		if unregistered {
+			log.Printf("📵 Removing unregistered %s device", d.platform)
+			r.db.Exec("DELETE FROM push_devices WHERE token = ?", d.token)
+			continue
+		}
+		if err != nil {
+			log.Printf("❌ %s push failed: %v", d.platform, err)
+			continue
+		}
+		r.db.Exec("UPDATE push_devices SET last_push_at = ? WHERE token = ?", time.Now().Unix(), d.token)
+	}
+}
+
+// base64URL encodes JWT segments
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signJWT builds a compact JWT signed with an ES256 or RS256 key
+func signJWT(header, claims map[string]interface{}, key crypto.Signer) (string, error) {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signingInput := base64URL(h) + "." + base64URL(c)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return signingInput + "." + base64URL(sig), nil
+}
+
+// parsePrivateKeyPEM loads a PKCS#8 private key
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// apnsSender pushes to Apple devices with token-based authentication
+type apnsSender struct {
+	key     crypto.Signer
+	keyID   string
+	teamID  string
+	topic   string
+	baseURL string
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func newAPNsSender(cfg *Config) (*apnsSender, error) {
+	data, err := os.ReadFile(cfg.APNsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("APNs key must be an ES256 (.p8) key")
+	}
+
+	baseURL := "https://api.push.apple.com"
+	if cfg.APNsSandbox {
+		baseURL = "https://api.sandbox.push.apple.com"
+	}
+
+	return &apnsSender{
+		key:     key,
+		keyID:   cfg.APNsKeyID,
+		teamID:  cfg.APNsTeamID,
+		topic:   cfg.APNsTopic,
+		baseURL: baseURL,
+	}, nil
+}
+
+// authToken returns the provider JWT, refreshed every 50 minutes as Apple requires
+func (a *apnsSender) authToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Since(a.issuedAt) < 50*time.Minute {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	token, err := signJWT(
+		map[string]interface{}{"alg": "ES256", "kid": a.keyID},
+		map[string]interface{}{"iss": a.teamID, "iat": now.Unix()},
+		a.key,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	a.token, a.issuedAt = token, now
+	return token, nil
+}
+
+// send delivers one alert; unregistered reports a token Apple no longer accepts
+func (a *apnsSender) send(client *http.Client, deviceToken string, alert *ownerAlert) (bool, error) {
+	token, err := a.authToken()
+	if err != nil {
+		return false, err
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert":           map[string]string{"title": alertTitles[alert.Type]},
+			"mutable-content": 1,
+		},
+		"type":     alert.Type,
+		"event_id": alert.EventID,
+		"kind":     alert.Kind,
+	})
+
+	req, _ := http.NewRequest("POST", a.baseURL+"/3/device/"+deviceToken, bytes.NewReader(payload))
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == 410 || strings.Contains(string(body), "BadDeviceToken") {
+		return true, nil
+	}
+	return false, fmt.Errorf("APNs returned %d: %s", resp.StatusCode, body)
+}
+
+// fcmSender pushes to Android devices through the FCM HTTP v1 API
+type fcmSender struct {
+	key         crypto.Signer
+	clientEmail string
+	tokenURI    string
+	projectID   string
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newFCMSender(path string) (*fcmSender, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var account struct {
+		ProjectID   string `json:"project_id"`
+		PrivateKey  string `json:"private_key"`
+		ClientEmail string `json:"client_email"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid service account file: %v", err)
+	}
+
+	key, err := parsePrivateKeyPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &fcmSender{
+		key:         key,
+		clientEmail: account.ClientEmail,
+		tokenURI:    account.TokenURI,
+		projectID:   account.ProjectID,
+	}, nil
+}
+
+// oauthToken exchanges a signed service account assertion for an access token
+func (f *fcmSender) oauthToken(client *http.Client) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.accessToken != "" && time.Now().Before(f.expiresAt) {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(
+		map[string]interface{}{"alg": "RS256", "typ": "JWT"},
+		map[string]interface{}{
+			"iss":   f.clientEmail,
+			"scope": "https://www.googleapis.com/auth/firebase.messaging",
+			"aud":   f.tokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		f.key,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.PostForm(f.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.AccessToken == "" {
+		return "", fmt.Errorf("token exchange failed with status %d", resp.StatusCode)
+	}
+
+	f.accessToken = result.AccessToken
+	f.expiresAt = now.Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return f.accessToken, nil
+}
+
+// send delivers one alert; unregistered reports a token FCM no longer accepts
+func (f *fcmSender) send(client *http.Client, deviceToken string, alert *ownerAlert) (bool, error) {
+	token, err := f.oauthToken(client)
+	if err != nil {
+		return false, err
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        deviceToken,
+			"notification": map[string]string{"title": alertTitles[alert.Type]},
+			"data": map[string]string{
+				"type":     alert.Type,
+				"event_id": alert.EventID,
+				"kind":     fmt.Sprint(alert.Kind),
+			},
+		},
+	})
+
+	endpoint := "https://fcm.googleapis.com/v1/projects/" + f.projectID + "/messages:send"
+	req, _ := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == 404 || strings.Contains(string(body), "UNREGISTERED") {
+		return true, nil
+	}
+	return false, fmt.Errorf("FCM returned %d: %s", resp.StatusCode, body)
+}
+
+// deviceID is the opaque ID a push token is listed and removed by, so the
+// listing never returns the tokens themselves
+func deviceID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// handleRegisterDevice registers (or refreshes) a push token for the owner
+func handleRegisterDevice(c *gin.Context) {
+	var req struct {
+		Platform string `json:"platform"`
+		Token    string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		c.JSON(400, gin.H{"error": "platform and token are required"})
+		return
+	}
+	if req.Platform != "apns" && req.Platform != "fcm" {
+		c.JSON(400, gin.H{"error": "platform must be apns or fcm"})
+		return
+	}
+
+	_, err := relay.db.Exec(
+		"INSERT OR REPLACE INTO push_devices (token, platform, created_at) VALUES (?, ?, ?)",
+		req.Token, req.Platform, time.Now().Unix(),
+	)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	relay.audit(currentAdmin(c), "push_register", nil, nil, req.Platform)
+	c.JSON(200, gin.H{"registered": true, "id": deviceID(req.Token), "enabled": relay.push != nil})
+}
+
+// handleListDevices lists registered push devices by ID
+func handleListDevices(c *gin.Context) {
+	rows, err := relay.db.Query("SELECT token, platform, created_at, last_push_at FROM push_devices ORDER BY created_at")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	devices := []gin.H{}
+	for rows.Next() {
+		var token, platform string
+		var createdAt int64
+		var lastPush *int64
+		if rows.Scan(&token, &platform, &createdAt, &lastPush) != nil {
+			continue
+		}
+		devices = append(devices, gin.H{
+			"id":           deviceID(token),
+			"platform":     platform,
+			"created_at":   createdAt,
+			"last_push_at": lastPush,
+		})
+	}
+
+	c.JSON(200, gin.H{"devices": devices})
+}
+
+// handleRemoveDevice unregisters a push device by its ID
+func handleRemoveDevice(c *gin.Context) {
+	rows, err := relay.db.Query("SELECT token FROM push_devices")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	var token string
+	for rows.Next() {
+		var candidate string
+		if rows.Scan(&candidate) == nil && deviceID(candidate) == c.Param("id") {
+			token = candidate
+		}
+	}
+	rows.Close()
+	if token == "" {
+		c.JSON(200, gin.H{"removed": false})
+		return
+	}
+
+	result, err := relay.db.Exec("DELETE FROM push_devices WHERE token = ?", token)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	n, _ := result.RowsAffected()
+	if n > 0 {
+		relay.audit(currentAdmin(c), "push_remove", nil, nil, "")
+	}
+	c.JSON(200, gin.H{"removed": n > 0})
+}
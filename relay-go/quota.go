@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storedSize is the number of bytes an event accounts for against a quota
+func storedSize(event *Event) int64 {
+	return int64(len(formatTags(event.Tags)) + len(event.Content))
+}
+
+// pubkeyUsage returns the stored bytes and event count for a pubkey
+func (r *Relay) pubkeyUsage(pubkey string) (int64, int) {
+	var used int64
+	var count int
+
+	for _, db := range r.eventDBs(nil, nil) {
+		var bytes int64
+		var n int
+		db.QueryRow(
+			"SELECT COALESCE(SUM(LENGTH(tags) + LENGTH(content)), 0), COUNT(*) FROM relay_events WHERE pubkey = ?",
+			pubkey,
+		).Scan(&bytes, &n)
+		used += bytes
+		count += n
+	}
+
+	return used, count
+}
+
+// checkEventSize returns an OK rejection message when an event exceeds the
+// size limit or its author's storage quota, or "" when it may be stored
+func (r *Relay) checkEventSize(event *Event, wireSize int) string {
+	if r.cfg.MaxEventBytes > 0 && wireSize > r.cfg.MaxEventBytes {
+		return fmt.Sprintf("invalid: event is %s, the maximum event size is %s",
+			formatBytes(int64(wireSize)), formatBytes(int64(r.cfg.MaxEventBytes)))
+	}
+
+	if r.cfg.PubkeyQuotaBytes > 0 {
+		used, _ := r.pubkeyUsage(event.PubKey)
+		size := storedSize(event)
+		if used+size > r.cfg.PubkeyQuotaBytes {
+			return fmt.Sprintf("blocked: storage quota exceeded (%s of %s used, event needs %s)",
+				formatBytes(used), formatBytes(r.cfg.PubkeyQuotaBytes), formatBytes(size))
+		}
+	}
+
+	return ""
+}
+
+// formatBytes renders a byte count for human-readable messages
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// handleQuota reports the authenticated pubkey's storage usage and limits
+func handleQuota(c *gin.Context) {
+	pubkey := c.GetString("pubkey")
+	used, count := relay.pubkeyUsage(pubkey)
+
+	response := gin.H{
+		"pubkey":          pubkey,
+		"events":          count,
+		"used_bytes":      used,
+		"max_event_bytes": relay.cfg.MaxEventBytes,
+		"quota_bytes":     relay.cfg.PubkeyQuotaBytes,
+	}
+	if relay.cfg.PubkeyQuotaBytes > 0 {
+		remaining := relay.cfg.PubkeyQuotaBytes - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		response["remaining_bytes"] = remaining
+	}
+
+	c.JSON(200, response)
+}
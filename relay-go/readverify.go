@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A/B read verification de-risks moving the archive to another store. REQs
+// are still served from the primary (the relay's own databases), while a
+// sample of them is replayed against a secondary copy in the background and
+// any difference in the results is recorded. The secondary must carry the
+// relay schema (relay_events and its derived tables); it is never written.
+//
+// RELAY_VERIFY_SECONDARY selects it: a SQLite file, or a data directory with
+// relay.db and partitions/.
+
+// verifyWorkers bounds concurrent secondary reads; REQs beyond it are skipped
+const verifyWorkers = 4
+
+// verifyRecent is how many recent divergences are kept for the admin API
+const verifyRecent = 50
+
+// verifySample is how many differing IDs a divergence records per side
+const verifySample = 10
+
+// secondaryStore is the store reads are compared against
+type secondaryStore struct {
+	dbs []*sql.DB
+}
+
+// openSecondary opens the store RELAY_VERIFY_SECONDARY names
+func openSecondary(target string) (*secondaryStore, error) {
+	if strings.Contains(target, "://") {
+		return nil, fmt.Errorf("RELAY_VERIFY_SECONDARY must be a SQLite file or data directory, not %q", target)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{target}
+	if info.IsDir() {
+		paths = []string{filepath.Join(target, "relay.db")}
+		partitions, _ := filepath.Glob(filepath.Join(target, "partitions", "events-*.db"))
+		paths = append(paths, partitions...)
+	}
+	store := &secondaryStore{}
+	for _, path := range paths {
+		db, err := sql.Open(sqliteDriver, sqliteReadOnlyDSN(path))
+		if err != nil {
+			return nil, err
+		}
+		store.dbs = append(store.dbs, db)
+	}
+	return store, nil
+}
+
+// query runs the filters the way getMatchingEvents does, newest first per
+// filter. Partition files are not time-routed here, so every one is asked.
+func (s *secondaryStore) query(r *Relay, filters []Filter) ([]Event, error) {
+	var events []Event
+	for _, filter := range filters {
+		where, args := r.filterConditions(filter)
+		query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE " + where +
+			" ORDER BY created_at DESC LIMIT ?"
+		limit := r.effectiveLimit(filter)
+
+		var found []Event
+		for _, db := range s.dbs {
+			rows, err := db.Query(query, append(args, limit)...)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, scanEvents(rows)...)
+			rows.Close()
+		}
+		sort.SliceStable(found, func(i, j int) bool { return found[i].CreatedAt > found[j].CreatedAt })
+		if len(found) > limit {
+			found = found[:limit]
+		}
+		events = append(events, found...)
+	}
+	return events, nil
+}
+
+// divergence is one REQ whose secondary results differ from the primary's
+type divergence struct {
+	At             int64           `json:"at"`
+	Filters        json.RawMessage `json:"filters"`
+	Primary        int             `json:"primary_count"`
+	Secondary      int             `json:"secondary_count"`
+	MissingIDs     []string        `json:"missing_in_secondary"`
+	ExtraIDs       []string        `json:"extra_in_secondary"`
+	MismatchedIDs  []string        `json:"content_mismatch"`
+	SecondaryError string          `json:"secondary_error,omitempty"`
+}
+
+// readVerifier compares a sample of REQ results with the secondary store
+type readVerifier struct {
+	store   *secondaryStore
+	target  string
+	percent int
+	recheck time.Duration
+	slots   chan struct{}
+
+	compared int64
+	matched  int64
+	diverged int64
+	errors   int64
+	skipped  int64
+
+	mu     sync.Mutex
+	recent []divergence
+}
+
+// newReadVerifier opens the secondary, or returns nil when verification is off
+func newReadVerifier(cfg *Config) (*readVerifier, error) {
+	if cfg.VerifySecondary == "" {
+		return nil, nil
+	}
+	store, err := openSecondary(cfg.VerifySecondary)
+	if err != nil {
+		return nil, fmt.Errorf("RELAY_VERIFY_SECONDARY: %v", err)
+	}
+	return &readVerifier{
+		store:   store,
+		target:  redactDSN(cfg.VerifySecondary),
+		percent: cfg.VerifyPercent,
+		recheck: cfg.VerifyRecheck,
+		slots:   make(chan struct{}, verifyWorkers),
+	}, nil
+}
+
+// redactDSN hides the password in a connection URL
+func redactDSN(target string) string {
+	if i := strings.Index(target, "://"); i >= 0 {
+		if at := strings.LastIndex(target, "@"); at > i {
+			if colon := strings.Index(target[i+3:at], ":"); colon >= 0 {
+				return target[:i+3+colon] + ":***" + target[at:]
+			}
+		}
+	}
+	return target
+}
+
+// verify schedules a comparison of a REQ's primary results, unless it is
+// not sampled or every worker is busy
+func (v *readVerifier) verify(r *Relay, filters []Filter, primary []Event) {
+	if v == nil || rand.Intn(100) >= v.percent {
+		return
+	}
+	select {
+	case v.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&v.skipped, 1)
+		return
+	}
+	go func() {
+		defer func() { <-v.slots }()
+		v.compare(r, filters, primary)
+	}()
+}
+
+// compare runs the filters against the secondary and records a divergence.
+// A difference is re-read after the recheck delay before it is reported, so
+// a secondary fed by replication has a chance to catch up.
+func (v *readVerifier) compare(r *Relay, filters []Filter, primary []Event) {
+	atomic.AddInt64(&v.compared, 1)
+	d, err := v.diff(r, filters, primary)
+	if err == nil && d != nil && v.recheck > 0 {
+		time.Sleep(v.recheck)
+		primary = r.getMatchingEvents(filters)
+		d, err = v.diff(r, filters, primary)
+	}
+	if err != nil {
+		atomic.AddInt64(&v.errors, 1)
+		d = &divergence{Primary: len(primary), SecondaryError: err.Error()}
+	}
+	if d == nil {
+		atomic.AddInt64(&v.matched, 1)
+		return
+	}
+	if err == nil {
+		atomic.AddInt64(&v.diverged, 1)
+	}
+
+	d.At = time.Now().Unix()
+	d.Filters, _ = json.Marshal(filters)
+	v.mu.Lock()
+	v.recent = append(v.recent, *d)
+	if len(v.recent) > verifyRecent {
+		v.recent = v.recent[len(v.recent)-verifyRecent:]
+	}
+	v.mu.Unlock()
+	if err == nil {
+		log.Printf("⚖️  Secondary diverges for %s: %d missing, %d extra, %d mismatched",
+			d.Filters, len(d.MissingIDs), len(d.ExtraIDs), len(d.MismatchedIDs))
+	}
+}
+
+// eventDigest fingerprints everything about an event but its ID
+func eventDigest(e Event) [32]byte {
+	tags, _ := json.Marshal(e.Tags)
+	return sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s|%s", e.PubKey, e.CreatedAt, e.Kind, tags, e.Content, e.Sig)))
+}
+
+// diff compares primary results with the secondary's, returning nil when they
+// agree. Events tied on created_at at the edge of a full limit may be picked
+// differently by each store, so those do not count.
+func (v *readVerifier) diff(r *Relay, filters []Filter, primary []Event) (*divergence, error) {
+	secondary, err := v.store.query(r, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryByID := make(map[string]Event, len(primary))
+	for _, e := range primary {
+		primaryByID[e.ID] = e
+	}
+	secondaryByID := make(map[string]Event, len(secondary))
+	for _, e := range secondary {
+		secondaryByID[e.ID] = e
+	}
+
+	// The oldest created_at either side returned: a limit cut ties there
+	edge := int64(-1)
+	if len(primary) == len(secondary) && len(primary) > 0 {
+		edge = primary[len(primary)-1].CreatedAt
+		if s := secondary[len(secondary)-1].CreatedAt; s < edge {
+			edge = s
+		}
+	}
+
+	d := &divergence{Primary: len(primary), Secondary: len(secondary), MissingIDs: []string{}, ExtraIDs: []string{}, MismatchedIDs: []string{}}
+	for id, e := range primaryByID {
+		other, ok := secondaryByID[id]
+		switch {
+		case !ok && e.CreatedAt != edge:
+			d.MissingIDs = appendSample(d.MissingIDs, id)
+		case ok && eventDigest(e) != eventDigest(other):
+			d.MismatchedIDs = appendSample(d.MismatchedIDs, id)
+		}
+	}
+	for id, e := range secondaryByID {
+		if _, ok := primaryByID[id]; !ok && e.CreatedAt != edge {
+			d.ExtraIDs = appendSample(d.ExtraIDs, id)
+		}
+	}
+	if len(d.MissingIDs)+len(d.ExtraIDs)+len(d.MismatchedIDs) == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// appendSample adds an ID unless the sample is full
+func appendSample(ids []string, id string) []string {
+	if len(ids) >= verifySample {
+		return ids
+	}
+	return append(ids, id)
+}
+
+// stats reports the comparison counters and recent divergences
+func (v *readVerifier) stats() gin.H {
+	if v == nil {
+		return gin.H{"enabled": false}
+	}
+	v.mu.Lock()
+	recent := append([]divergence{}, v.recent...)
+	v.mu.Unlock()
+	// Newest first
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+	return gin.H{
+		"enabled":     true,
+		"secondary":   v.target,
+		"percent":     v.percent,
+		"compared":    atomic.LoadInt64(&v.compared),
+		"matched":     atomic.LoadInt64(&v.matched),
+		"diverged":    atomic.LoadInt64(&v.diverged),
+		"errors":      atomic.LoadInt64(&v.errors),
+		"skipped":     atomic.LoadInt64(&v.skipped),
+		"divergences": recent,
+	}
+}
+
+// reset clears the counters and divergences
+func (v *readVerifier) reset() {
+	for _, n := range []*int64{&v.compared, &v.matched, &v.diverged, &v.errors, &v.skipped} {
+		atomic.StoreInt64(n, 0)
+	}
+	v.mu.Lock()
+	v.recent = nil
+	v.mu.Unlock()
+}
+
+// handleVerifyStatus reports how reads from the secondary compare
+func handleVerifyStatus(c *gin.Context) {
+	c.JSON(200, relay.verifier.stats())
+}
+
+// handleVerifyReset clears the verification counters, e.g. after fixing a
+// divergence in the secondary
+func handleVerifyReset(c *gin.Context) {
+	if relay.verifier == nil {
+		c.JSON(404, gin.H{"error": "read verification is not configured"})
+		return
+	}
+	relay.verifier.reset()
+	relay.audit(currentAdmin(c), "verify_reset", nil, nil, "")
+	c.JSON(200, relay.verifier.stats())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// referenceSchema records which stored events point at which other events;
+// it is one of the eventIndexes, so it lives with the referencing event
+const referenceSchema = `
+	CREATE TABLE IF NOT EXISTS event_refs (
+		target_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		type TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (target_id, event_id, type)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_refs_event ON event_refs(event_id);
+`
+
+// Reference types, from the referencing event's point of view
+const (
+	refReply    = "reply"    // e tag on a note or comment
+	refMention  = "mention"  // e tag marked "mention", or nostr:note/nevent in content
+	refQuote    = "quote"    // q tag (NIP-18 quote repost)
+	refRepost   = "repost"   // kind 6 or 16
+	refReaction = "reaction" // kind 7
+	refZap      = "zap"      // kind 9735 receipt
+)
+
+// contentPointer matches NIP-27 event pointers in content
+var contentPointer = regexp.MustCompile(`nostr:((?:note|nevent)1[02-9ac-hj-np-z]+)`)
+
+// eventReference is one edge of the reference graph
+type eventReference struct {
+	Target string
+	Type   string
+}
+
+// eventReferences lists the events an event quotes, mentions, replies to or
+// reacts to, once per target and type
+func eventReferences(event *Event) []eventReference {
+	var refs []eventReference
+	seen := map[eventReference]bool{}
+	add := func(target, typ string) {
+		target = strings.ToLower(target)
+		ref := eventReference{target, typ}
+		if isHex64(target) && target != event.ID && !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	eTagType := refReply
+	switch event.Kind {
+	case 6, 16:
+		eTagType = refRepost
+	case 7:
+		eTagType = refReaction
+	case 9735:
+		eTagType = refZap
+	}
+
+	quoted := map[string]bool{}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch {
+		case tag[0] == "q":
+			add(tag[1], refQuote)
+			quoted[strings.ToLower(tag[1])] = true
+		case tag[0] == "e" && eTagType == refReply && len(tag) >= 4 && tag[3] == "mention":
+			add(tag[1], refMention)
+		case tag[0] == "e":
+			add(tag[1], eTagType)
+		}
+	}
+
+	// A quote repost also embeds its target in the content; count it once
+	for _, match := range contentPointer.FindAllStringSubmatch(event.Content, -1) {
+		if ptr, err := nostr.DecodeEventPointer(match[1]); err == nil && !quoted[ptr.ID] {
+			add(ptr.ID, refMention)
+		}
+	}
+	return refs
+}
+
+// indexReferences records the events an event references
+func indexReferences(db sqlExecer, event *Event) error {
+	for _, ref := range eventReferences(event) {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO event_refs (target_id, event_id, pubkey, type, created_at)
+			VALUES (?, ?, ?, ?, ?)`, ref.Target, event.ID, event.PubKey, ref.Type, event.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventsByID loads the stored events among the given IDs
+func (r *Relay) eventsByID(ids []string) map[string]Event {
+	found := make(map[string]Event, len(ids))
+	if len(ids) == 0 {
+		return found
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query("SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE id IN ("+placeholders+")", args...)
+		if err != nil {
+			continue
+		}
+		for _, event := range scanEvents(rows) {
+			found[event.ID] = event
+		}
+		rows.Close()
+	}
+	return found
+}
+
+// handleEventReferences lists the events an event references, with each
+// target included when it is stored here
+func handleEventReferences(c *gin.Context) {
+	eventID := strings.ToLower(c.Param("id"))
+	refs := []gin.H{}
+	var ids []string
+	query, args := "SELECT target_id, type FROM event_refs WHERE event_id = ?", []interface{}{eventID}
+	if condition, groupArgs := relay.privateGroupCondition("event_id"); condition != "" {
+		query += " AND " + condition
+		args = append(args, groupArgs...)
+	}
+	for _, db := range relay.eventDBs(nil, nil) {
+		rows, err := db.Query(query+" ORDER BY type, target_id", args...)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var target, typ string
+			if rows.Scan(&target, &typ) == nil {
+				refs = append(refs, gin.H{"id": target, "type": typ})
+				ids = append(ids, target)
+			}
+		}
+		rows.Close()
+	}
+
+	stored := relay.eventsByID(ids)
+	for _, ref := range refs {
+		if event, ok := stored[ref["id"].(string)]; ok {
+			if public, ok := relay.publicEvent(event); ok {
+				ref["event"] = public
+			}
+		}
+	}
+	c.JSON(200, gin.H{"event_id": eventID, "references": refs})
+}
+
+// handleEventReferencedBy lists the events referencing an event, newest first,
+// with per-type totals of events and distinct authors, so the front-end can
+// show "quoted by N people". ?type= narrows the list to one reference type.
+// Referrers with a content warning follow RELAY_CONTENT_WARNINGS, though
+// they still count.
+func handleEventReferencedBy(c *gin.Context) {
+	eventID := strings.ToLower(c.Param("id"))
+	typ := c.Query("type")
+	limit := relay.cfg.DefaultLimit
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil && n >= 0 && n <= relay.cfg.MaxLimit {
+		limit = n
+	}
+
+	type referrer struct {
+		ID, Type  string
+		CreatedAt int64
+	}
+	var referrers []referrer
+	people := map[string]map[string]bool{}
+	events := map[string]int{}
+	// Referrers in private groups are neither listed nor counted
+	query, args := "SELECT event_id, pubkey, type, created_at FROM event_refs WHERE target_id = ?", []interface{}{eventID}
+	if condition, groupArgs := relay.privateGroupCondition("event_id"); condition != "" {
+		query += " AND " + condition
+		args = append(args, groupArgs...)
+	}
+	for _, db := range relay.eventDBs(nil, nil) {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var ref referrer
+			var pubkey string
+			if rows.Scan(&ref.ID, &pubkey, &ref.Type, &ref.CreatedAt) != nil {
+				continue
+			}
+			events[ref.Type]++
+			if people[ref.Type] == nil {
+				people[ref.Type] = map[string]bool{}
+			}
+			people[ref.Type][pubkey] = true
+			if typ == "" || ref.Type == typ {
+				referrers = append(referrers, ref)
+			}
+		}
+		rows.Close()
+	}
+
+	counts := gin.H{}
+	for t, n := range events {
+		counts[t] = gin.H{"events": n, "people": len(people[t])}
+	}
+
+	sort.Slice(referrers, func(i, j int) bool { return referrers[i].CreatedAt > referrers[j].CreatedAt })
+	if len(referrers) > limit {
+		referrers = referrers[:limit]
+	}
+
+	ids := make([]string, len(referrers))
+	for i, ref := range referrers {
+		ids[i] = ref.ID
+	}
+	stored := relay.eventsByID(ids)
+	list := []gin.H{}
+	for _, ref := range referrers {
+		if event, ok := stored[ref.ID]; ok {
+			if public, ok := relay.publicEvent(event); ok {
+				list = append(list, gin.H{"type": ref.Type, "event": public})
+			}
+		}
+	}
+	c.JSON(200, gin.H{"event_id": eventID, "counts": counts, "events": list})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+)
+
+// The relay has its own keypair, separate from the owner's, for the events it
+// originates itself: visitor reports, webhook ingests without a bot key of
+// their own, and NIP-66 monitor announcements of the upstream relays it
+// probes. The key is RELAY_SERVICE_KEY when set; otherwise it is generated on
+// first run and kept in DATA_DIR/relay.key. The relay publishes a kind 0
+// profile for it and advertises it as "self" in the NIP-11 document.
+
+// relayKeyFile is the generated key's file in the data dir
+const relayKeyFile = "relay.key"
+
+// relayIdentity is the relay's own keypair
+type relayIdentity struct {
+	key    string
+	pubkey string
+	source string // "RELAY_SERVICE_KEY", the key file, or "generated"
+}
+
+// loadRelayIdentity returns RELAY_SERVICE_KEY, or the key stored in the data
+// dir. A missing key is generated, and saved when persist is set; check
+// passes false so it never writes to the data dir.
+func loadRelayIdentity(cfg *Config, persist bool) (*relayIdentity, error) {
+	if cfg.ServiceKey != "" {
+		key, err := nostr.DecodePrivateKey(cfg.ServiceKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_SERVICE_KEY: %v", err)
+		}
+		return newRelayIdentity(key, "RELAY_SERVICE_KEY")
+	}
+
+	path := filepath.Join(cfg.DataDir, relayKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := nostr.DecodePrivateKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay key in %s: %v", path, err)
+		}
+		return newRelayIdentity(key, path)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := nostr.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	if persist {
+		if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("saving relay key: %v", err)
+		}
+		log.Printf("🔑 Generated the relay key in %s", path)
+	}
+	return newRelayIdentity(key, "generated")
+}
+
+// newRelayIdentity derives the public key of a hex private key
+func newRelayIdentity(key, source string) (*relayIdentity, error) {
+	pubkey, err := nostr.PublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &relayIdentity{key: key, pubkey: pubkey, source: source}, nil
+}
+
+// signAndPublish signs an event with the relay key and stores it
+func (r *Relay) signAndPublish(event *Event) error {
+	if err := event.Sign(r.identity.key); err != nil {
+		return err
+	}
+	return r.publishLocal(event)
+}
+
+// publishIfChanged signs and stores a replaceable event of the relay's unless
+// the newest stored one of the same kind (and d tag) has the same content and
+// tags, so restarts do not churn the relay's profile and announcements. It
+// returns whichever of the two is current.
+func (r *Relay) publishIfChanged(event *Event) (*Event, error) {
+	filter := Filter{Authors: []string{r.identity.pubkey}, Kinds: []int{event.Kind}}
+	if d := event.TagValue("d"); d != "" {
+		filter.Tags = map[string][]string{"d": {d}}
+	}
+	limit := 1
+	filter.Limit = &limit
+	if stored := r.getMatchingEvents([]Filter{filter}); len(stored) > 0 &&
+		stored[0].Content == event.Content && reflect.DeepEqual(stored[0].Tags, event.Tags) {
+		return &stored[0], nil
+	}
+	if err := r.signAndPublish(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// publishRelayProfile publishes the relay's kind 0 profile from RELAY_NAME,
+// RELAY_DESCRIPTION and RELAY_URL, and returns it (nil when it failed)
+func (r *Relay) publishRelayProfile() *Event {
+	profile := map[string]string{"name": r.cfg.RelayName}
+	if r.cfg.RelayDescription != "" {
+		profile["about"] = r.cfg.RelayDescription
+	}
+	if r.cfg.RelayURL != "" {
+		profile["website"] = strings.Replace(strings.Replace(r.cfg.RelayURL, "wss://", "https://", 1), "ws://", "http://", 1)
+	}
+	content, _ := json.Marshal(profile)
+	event, err := r.publishIfChanged(nostr.NewEvent(0, string(content)))
+	if err != nil {
+		log.Printf("❌ Failed to publish the relay profile: %v", err)
+	}
+	return event
+}
+
+// publishMonitorAnnouncement announces the relay as a NIP-66 monitor
+// (kind 10166) of its upstream relays, with what and how often it checks
+func (r *Relay) publishMonitorAnnouncement() {
+	event := nostr.NewEvent(10166, "",
+		[]string{"frequency", strconv.Itoa(int(r.cfg.ProbeInterval / time.Second))},
+		[]string{"timeout", "open", strconv.Itoa(int(probeTimeout / time.Millisecond))},
+		[]string{"timeout", "read", strconv.Itoa(int(probeTimeout / time.Millisecond))},
+		[]string{"c", "open"},
+		[]string{"c", "read"},
+		[]string{"c", "nip11"})
+	if _, err := r.publishIfChanged(event); err != nil {
+		log.Printf("❌ Failed to publish the monitor announcement: %v", err)
+	}
+}
+
+// publishRelayDiscovery publishes a NIP-66 discovery event (kind 30166) for
+// each upstream relay that answered its probe. The events expire after three
+// probe intervals, so a relay that stays down drops out.
+func (r *Relay) publishRelayDiscovery(probes []relayProbe) {
+	expiration := time.Now().Add(3 * r.cfg.ProbeInterval).Unix()
+	for _, p := range probes {
+		if !p.OK {
+			continue
+		}
+		event := nostr.NewEvent(30166, "",
+			[]string{"d", p.Relay},
+			[]string{"rtt-open", strconv.FormatInt(p.ConnectMS, 10)},
+			[]string{"rtt-read", strconv.FormatInt(p.ReqMS, 10)},
+			[]string{"expiration", strconv.FormatInt(expiration, 10)})
+		if err := r.signAndPublish(event); err != nil {
+			log.Printf("❌ Failed to publish discovery of %s: %v", p.Relay, err)
+		}
+	}
+}
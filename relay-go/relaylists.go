@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NIP-65 relay lists (kind 10002) of every pubkey are indexed so a client can
+// look up where someone reads and writes without parsing their events. Like
+// any replaceable event only the newest list per pubkey is stored; the index
+// rows of a superseded list go with it.
+
+// relayListSchema holds the "r" tags of relay lists; it is one of the
+// eventIndexes
+const relayListSchema = `
+	CREATE TABLE IF NOT EXISTS event_relay_lists (
+		event_id TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		relay TEXT NOT NULL,
+		read INTEGER NOT NULL,
+		write INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (event_id, relay)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_relay_lists_pubkey ON event_relay_lists(pubkey, created_at);
+`
+
+// indexRelayList records the relays of a NIP-65 list. A "read" or "write"
+// marker limits a relay to that use; without one it is used for both.
+func indexRelayList(db sqlExecer, event *Event) error {
+	if event.Kind != 10002 {
+		return nil
+	}
+	for i, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		url := normalizeRelayURL(tag[1])
+		if url == "" {
+			continue
+		}
+		read, write := true, true
+		if len(tag) >= 3 {
+			switch tag[2] {
+			case "read":
+				write = false
+			case "write":
+				read = false
+			}
+		}
+		if _, err := db.Exec(`INSERT OR IGNORE INTO event_relay_lists (event_id, pubkey, created_at, relay, read, write, position)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, event.ID, event.PubKey, event.CreatedAt, url, read, write, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listedRelay is one relay of a NIP-65 list
+type listedRelay struct {
+	URL   string `json:"url"`
+	Read  bool   `json:"read"`
+	Write bool   `json:"write"`
+}
+
+// relayList is a pubkey's newest NIP-65 list
+type relayList struct {
+	Pubkey    string        `json:"pubkey"`
+	EventID   string        `json:"event_id"`
+	CreatedAt int64         `json:"created_at"`
+	Read      []string      `json:"read"`
+	Write     []string      `json:"write"`
+	Relays    []listedRelay `json:"relays"`
+}
+
+// relayListOf returns a pubkey's newest indexed relay list, or nil
+func relayListOf(pubkey string) (*relayList, error) {
+	var list *relayList
+	err := queryPayloads(`SELECT event_id, created_at, relay, read, write FROM event_relay_lists
+		WHERE pubkey = ? AND created_at = (SELECT MAX(created_at) FROM event_relay_lists WHERE pubkey = ?)
+		ORDER BY position`, []interface{}{pubkey, pubkey}, func(rows *sql.Rows) {
+		var id string
+		var createdAt int64
+		var relay listedRelay
+		if rows.Scan(&id, &createdAt, &relay.URL, &relay.Read, &relay.Write) != nil {
+			return
+		}
+		// Partitions may briefly hold an older list too; the newest wins
+		if list == nil || createdAt > list.CreatedAt || (createdAt == list.CreatedAt && id < list.EventID) {
+			list = &relayList{Pubkey: pubkey, EventID: id, CreatedAt: createdAt, Read: []string{}, Write: []string{}, Relays: []listedRelay{}}
+		}
+		if id != list.EventID {
+			return
+		}
+		list.Relays = append(list.Relays, relay)
+		if relay.Read {
+			list.Read = append(list.Read, relay.URL)
+		}
+		if relay.Write {
+			list.Write = append(list.Write, relay.URL)
+		}
+	})
+	return list, err
+}
+
+// handleRelayList returns the read and write relays of :pubkey (hex or npub)
+// from their newest NIP-65 list
+func handleRelayList(c *gin.Context) {
+	pubkey, err := nostr.DecodePublicKey(c.Param("pubkey"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "invalid pubkey"})
+		return
+	}
+	list, err := relayListOf(pubkey)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if list == nil {
+		c.JSON(404, gin.H{"error": "no relay list for this pubkey"})
+		return
+	}
+	c.JSON(200, list)
+}
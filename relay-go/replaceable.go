@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// NIP-01 replaceable events: for kinds 0, 3 and 10000-19999 (or whatever
+// RELAY_KIND_CLASSES makes replaceable) only the newest event per pubkey and
+// kind is kept, and for addressable kinds 30000-39999 the newest per pubkey,
+// kind and d tag. On a created_at tie the lowest ID wins. Superseded versions
+// are removed in the same write as their replacement, so REQs never see them.
+
+// errSuperseded rejects a version older than the one already stored
+var errSuperseded = errors.New("a newer version of this event is already stored")
+
+// storedVersion is a stored event competing with a new version
+type storedVersion struct {
+	db        *sql.DB
+	id        string
+	createdAt int64
+}
+
+// supersedes reports whether a version replaces another under NIP-01
+func supersedes(createdAt int64, id string, otherCreatedAt int64, otherID string) bool {
+	return createdAt > otherCreatedAt || (createdAt == otherCreatedAt && id < otherID)
+}
+
+// versionKey is what versions of an event are grouped by, and whether its
+// kind is replaced at all
+func (r *Relay) versionKey(event *Event) (address, bool) {
+	switch class, _ := r.kinds.classify(event.Kind); class {
+	case kindReplaceable:
+		return address{Kind: event.Kind, Pubkey: event.PubKey}, true
+	case kindAddressable:
+		// An addressable event without a d tag has the empty d
+		return address{Kind: event.Kind, Pubkey: event.PubKey, D: event.TagValue("d")}, true
+	}
+	return address{}, false
+}
+
+// storedVersions returns the stored events at an address, in any database.
+// The d tag is only compared for addressable kinds.
+func (r *Relay) storedVersions(key address) ([]storedVersion, error) {
+	class, _ := r.kinds.classify(key.Kind)
+	var versions []storedVersion
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query("SELECT id, created_at, tags FROM relay_events WHERE pubkey = ? AND kind = ?", key.Pubkey, key.Kind)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			v := storedVersion{db: db}
+			var tagsJSON string
+			if rows.Scan(&v.id, &v.createdAt, &tagsJSON) != nil {
+				continue
+			}
+			if class == kindAddressable {
+				var tags [][]string
+				json.Unmarshal([]byte(tagsJSON), &tags)
+				if (&Event{Tags: tags}).TagValue("d") != key.D {
+					continue
+				}
+			}
+			versions = append(versions, v)
+		}
+		rows.Close()
+	}
+	return versions, nil
+}
+
+// supersededBy returns the stored versions a new event replaces, or
+// errSuperseded when one of them is newer. A stored copy of the event itself
+// is not a competing version.
+func (r *Relay) supersededBy(event *Event) ([]storedVersion, error) {
+	key, ok := r.versionKey(event)
+	if !ok {
+		return nil, nil
+	}
+	versions, err := r.storedVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	var superseded []storedVersion
+	for _, v := range versions {
+		if v.id == event.ID {
+			continue
+		}
+		if !supersedes(event.CreatedAt, event.ID, v.createdAt, v.id) {
+			return nil, errSuperseded
+		}
+		superseded = append(superseded, v)
+	}
+	return superseded, nil
+}
+
+// removeVersion deletes a stored event and its event index rows, whether it
+// was superseded or deleted
+func removeVersion(db sqlExecer, id string) error {
+	if _, err := db.Exec("DELETE FROM relay_events WHERE id = ?", id); err != nil {
+		return err
+	}
+	for _, idx := range eventIndexes {
+		if idx.remove != nil {
+			if err := idx.remove(db, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := db.Exec("DELETE FROM "+idx.table+" WHERE event_id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneBatch is how many superseded versions pruneSuperseded removes per
+// hold of the write locks, so live writes are not stalled behind the scan
+const pruneBatch = 200
+
+// staleVersion is a superseded version found by pruneSuperseded
+type staleVersion struct {
+	storedVersion
+	key address
+}
+
+// pruneSuperseded removes versions left behind by earlier releases, which kept
+// every version, or by a crash between partition commits. The owner's are
+// moved to the version history, as storeEvent does.
+func (r *Relay) pruneSuperseded() {
+	var ranges []string
+	var args []interface{}
+	for _, kr := range r.kinds.ranges {
+		if kr.Class == kindReplaceable || kr.Class == kindAddressable {
+			ranges = append(ranges, "kind BETWEEN ? AND ?")
+			args = append(args, kr.From, kr.To)
+		}
+	}
+	if len(ranges) == 0 {
+		return
+	}
+
+	newest := map[address]storedVersion{}
+	var stale []staleVersion
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query("SELECT id, pubkey, kind, created_at, tags FROM relay_events WHERE "+strings.Join(ranges, " OR "), args...)
+		if err != nil {
+			log.Printf("❌ Failed to scan replaceable events: %v", err)
+			return
+		}
+		for rows.Next() {
+			v := storedVersion{db: db}
+			var event Event
+			var tagsJSON string
+			if rows.Scan(&v.id, &event.PubKey, &event.Kind, &v.createdAt, &tagsJSON) != nil {
+				continue
+			}
+			json.Unmarshal([]byte(tagsJSON), &event.Tags)
+			key, ok := r.versionKey(&event)
+			if !ok {
+				continue
+			}
+			if kept, seen := newest[key]; !seen {
+				newest[key] = v
+			} else if supersedes(v.createdAt, v.id, kept.createdAt, kept.id) {
+				newest[key] = v
+				stale = append(stale, staleVersion{kept, key})
+			} else {
+				stale = append(stale, staleVersion{v, key})
+			}
+		}
+		rows.Close()
+	}
+
+	removed := 0
+	for start := 0; start < len(stale); start += pruneBatch {
+		end := start + pruneBatch
+		if end > len(stale) {
+			end = len(stale)
+		}
+		r.writes.RLock()
+		r.sketches.mu.Lock()
+		for _, v := range stale[start:end] {
+			if err := r.removeSuperseded(v); err != nil {
+				log.Printf("❌ Failed to remove superseded event %s: %v", v.id[:8], err)
+				continue
+			}
+			r.forgetEvent(v.id)
+			removed++
+		}
+		r.sketches.mu.Unlock()
+		r.writes.RUnlock()
+	}
+	if removed > 0 {
+		log.Printf("♻️  Removed %d superseded replaceable and addressable events", removed)
+	}
+}
+
+// removeSuperseded removes one superseded version, moving it to the history
+// first when it is the owner's; the caller must hold r.writes
+func (r *Relay) removeSuperseded(v staleVersion) error {
+	vtx, err := v.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer vtx.Rollback()
+
+	tx := vtx
+	if v.db != r.db {
+		if tx, err = r.db.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+
+	if r.keepsHistory(&Event{PubKey: v.key.Pubkey}) {
+		err := r.archiveVersion(tx, vtx, v.key, v.id, time.Now().Unix())
+		if err == sql.ErrNoRows {
+			return nil // deleted since the scan
+		}
+		if err != nil {
+			return fmt.Errorf("failed to keep superseded version: %v", err)
+		}
+	}
+	if err := removeVersion(vtx, v.id); err != nil {
+		return err
+	}
+
+	if tx != vtx {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return vtx.Commit()
+}
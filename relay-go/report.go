@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scanRange returns every event in [since, until] matching an extra SQL
+// condition, across all partitions that overlap the range
+func (r *Relay) scanRange(since, until int64, condition string, args ...interface{}) []Event {
+	query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE created_at >= ? AND created_at <= ?"
+	if condition != "" {
+		query += " AND " + condition
+	}
+	queryArgs := append([]interface{}{since, until}, args...)
+
+	var events []Event
+	for _, db := range r.eventDBs(&since, &until) {
+		rows, err := db.Query(query, queryArgs...)
+		if err != nil {
+			log.Printf("Range query error: %v", err)
+			continue
+		}
+		events = append(events, scanEvents(rows)...)
+		rows.Close()
+	}
+	return events
+}
+
+// tagNeedle is the substring of the serialized tags of events that carry a
+// tag with the given name and value, for use with instr(tags, ?) > 0. Unlike
+// LIKE, instr is case-sensitive, so "p" and "P" tags stay distinct.
+func tagNeedle(name, value string) string {
+	return `["` + name + `","` + value + `"`
+}
+
+// isReply reports whether an event references another event with an e tag
+func isReply(event *Event) bool {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			return true
+		}
+	}
+	return false
+}
+
+// interactionCount is a ranked counterpart in the yearly report
+type interactionCount struct {
+	Pubkey    string `json:"pubkey"`
+	Replies   int    `json:"replies"`
+	Reactions int    `json:"reactions"`
+	Zaps      int    `json:"zaps"`
+	ZapMsats  int64  `json:"zap_msats"`
+	Total     int    `json:"total"`
+}
+
+// handleYearReport returns the owner's "year in nostr" summary and activity heatmap
+func handleYearReport(c *gin.Context) {
+	owner := relay.cfg.OwnerPubkey
+	if owner == "" {
+		c.JSON(404, gin.H{"error": "no owner configured"})
+		return
+	}
+
+	year, err := strconv.Atoi(c.Param("year"))
+	if err != nil || year < 2000 || year > time.Now().Year() {
+		c.JSON(400, gin.H{"error": "invalid year"})
+		return
+	}
+
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+	since, until := start.Unix(), end.Unix()-1
+
+	// Owner activity
+	perDay := make(map[string]int)
+	kinds := make(map[int]int)
+	notes, replies, articles, reactionsGiven := 0, 0, 0, 0
+	for _, event := range relay.scanRange(since, until, "pubkey = ?", owner) {
+		perDay[time.Unix(event.CreatedAt, 0).UTC().Format("2006-01-02")]++
+		kinds[event.Kind]++
+
+		switch event.Kind {
+		case 1:
+			if isReply(&event) {
+				replies++
+			} else {
+				notes++
+			}
+		case 7:
+			reactionsGiven++
+		case 30023:
+			articles++
+		}
+	}
+
+	// Interactions with the owner
+	counterparts := make(map[string]*interactionCount)
+	counterpart := func(pubkey string) *interactionCount {
+		if counterparts[pubkey] == nil {
+			counterparts[pubkey] = &interactionCount{Pubkey: pubkey}
+		}
+		return counterparts[pubkey]
+	}
+
+	repliesReceived, reactionsReceived, zapsIn := 0, 0, 0
+	var zapMsatsIn int64
+	for _, event := range relay.scanRange(since, until, "instr(tags, ?) > 0 AND pubkey != ?", tagNeedle("p", owner), owner) {
+		switch event.Kind {
+		case 1:
+			if isReply(&event) {
+				repliesReceived++
+				counterpart(event.PubKey).Replies++
+			}
+		case 7:
+			reactionsReceived++
+			counterpart(event.PubKey).Reactions++
+		case 9735:
+			if event.TagValue("p") != owner {
+				continue
+			}
+			amount := zapAmountMsat(&event)
+			zapsIn++
+			zapMsatsIn += amount
+			if sender := zapSender(&event); sender != "" && sender != owner {
+				ic := counterpart(sender)
+				ic.Zaps++
+				ic.ZapMsats += amount
+			}
+		}
+	}
+
+	zapsOut := 0
+	var zapMsatsOut int64
+	for _, event := range relay.scanRange(since, until, "kind = 9735 AND instr(tags, ?) > 0", tagNeedle("P", owner)) {
+		zapsOut++
+		zapMsatsOut += zapAmountMsat(&event)
+	}
+
+	top := make([]*interactionCount, 0, len(counterparts))
+	for _, ic := range counterparts {
+		ic.Total = ic.Replies + ic.Reactions + ic.Zaps
+		top = append(top, ic)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Total != top[j].Total {
+			return top[i].Total > top[j].Total
+		}
+		return top[i].ZapMsats > top[j].ZapMsats
+	})
+	if len(top) > 10 {
+		top = top[:10]
+	}
+
+	// GitHub-style heatmap: one entry per day of the year
+	heatmap := []gin.H{}
+	busiestDay, busiestCount, activeDays := "", 0, 0
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		count := perDay[date]
+		heatmap = append(heatmap, gin.H{"date": date, "count": count})
+		if count > 0 {
+			activeDays++
+		}
+		if count > busiestCount {
+			busiestDay, busiestCount = date, count
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"year":   year,
+		"pubkey": owner,
+		"posts": gin.H{
+			"notes":     notes,
+			"replies":   replies,
+			"articles":  articles,
+			"reactions": reactionsGiven,
+			"by_kind":   kinds,
+		},
+		"received": gin.H{
+			"replies":   repliesReceived,
+			"reactions": reactionsReceived,
+		},
+		"zaps": gin.H{
+			"received":       zapsIn,
+			"received_msats": zapMsatsIn,
+			"sent":           zapsOut,
+			"sent_msats":     zapMsatsOut,
+		},
+		"top_interactions": top,
+		"heatmap":          heatmap,
+		"active_days":      activeDays,
+		"busiest_day":      gin.H{"date": busiestDay, "count": busiestCount},
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+)
+
+// bootID distinguishes request IDs of different relay runs
+var bootID = func() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+var requestSeq uint64
+
+// newRequestID returns a short ID correlating one incoming message across
+// logs, latency samples and (in debug mode) OK messages
+func newRequestID() string {
+	return bootID + "-" + strconv.FormatUint(atomic.AddUint64(&requestSeq, 1), 36)
+}
+
+// logf logs a line about the message being handled, tagged with its request
+// and client IDs so a single message can be followed through the pipeline
+func (c *Client) logf(format string, args ...interface{}) {
+	log.Printf("req=%s client=%s %s", c.requestID, c.ID, fmt.Sprintf(format, args...))
+}
+
+// withRequestID appends the request ID to a human-readable reply when
+// RELAY_DEBUG_REQUEST_IDS is on, so users can quote it when reporting problems
+func (c *Client) withRequestID(message string) string {
+	if !c.Relay.cfg.DebugRequestIDs || c.requestID == "" {
+		return message
+	}
+	if message == "" {
+		return "req " + c.requestID
+	}
+	return message + " (req " + c.requestID + ")"
+}
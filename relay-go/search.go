@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NIP-50 search. Event content is indexed in an FTS5 table in every event
+// database, and "search" filters are answered from it, best match first.
+// FTS5 is compiled into the pure-Go build and into the default build with
+// -tags sqlite_fts5; without it search is not offered and NIP-50 is not
+// advertised.
+//
+// The search string is words, all of which must occur, and key:value
+// extensions. Events reported as spam (NIP-56) by the owner or an admin are
+// left out, as are those of authors reported as spam, unless the search
+// includes include:spam. Other extensions are ignored, as NIP-50 asks.
+
+// searchSchema is the full-text index. Its rowid is derived from the event ID
+// (see searchRowID), so an event's row is found without scanning the table.
+const searchSchema = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS event_search USING fts5(
+		content,
+		event_id UNINDEXED,
+		tokenize = 'unicode61 remove_diacritics 2'
+	);
+`
+
+// unsearchableKinds hold ciphertext, which is not worth indexing
+var unsearchableKinds = map[int]bool{4: true, 1059: true}
+
+// searchIndex is the eventIndexes entry for search, added by enableSearch
+var searchIndex = eventIndex{table: "event_search", schema: searchSchema, index: indexSearch, remove: unindexSearch}
+
+// enableSearch adds the search index to the eventIndexes when the SQLite
+// build has FTS5; it must run before any event database is opened
+func enableSearch() bool {
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE VIRTUAL TABLE probe USING fts5(content)"); err != nil {
+		log.Printf("⚠️  SQLite was built without FTS5; NIP-50 search is disabled")
+		return false
+	}
+	eventIndexes = append(eventIndexes, searchIndex)
+	return true
+}
+
+// searchRowID maps an event ID to the index's rowid: the ID's last 64 bits,
+// as proof of work (NIP-13) leaves the first ones mostly zero
+func searchRowID(eventID string) int64 {
+	if len(eventID) < 16 {
+		return 0
+	}
+	n, _ := strconv.ParseUint(eventID[len(eventID)-16:], 16, 64)
+	return int64(n)
+}
+
+// indexSearch indexes an event's content, replacing any earlier row of it
+func indexSearch(db sqlExecer, event *Event) error {
+	if unsearchableKinds[event.Kind] || strings.TrimSpace(event.Content) == "" {
+		return nil
+	}
+	if err := unindexSearch(db, event.ID); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO event_search (rowid, content, event_id) VALUES (?, ?, ?)",
+		searchRowID(event.ID), event.Content, event.ID)
+	return err
+}
+
+// unindexSearch removes an event's row
+func unindexSearch(db sqlExecer, eventID string) error {
+	_, err := db.Exec("DELETE FROM event_search WHERE rowid = ?", searchRowID(eventID))
+	return err
+}
+
+// searchQuery is a parsed NIP-50 search string
+type searchQuery struct {
+	// words are the tokens that must all occur
+	words []string
+	// includeSpam is set by include:spam
+	includeSpam bool
+}
+
+// parseSearch splits a search string into words and extensions
+func parseSearch(search string) searchQuery {
+	var q searchQuery
+	for _, field := range strings.Fields(search) {
+		if key, value, ok := strings.Cut(field, ":"); ok && key != "" && value != "" && isExtensionKey(key) {
+			if key == "include" && value == "spam" {
+				q.includeSpam = true
+			}
+			continue
+		}
+		q.words = append(q.words, searchTokens(field)...)
+	}
+	return q
+}
+
+// isExtensionKey reports whether a word before a colon names an extension,
+// such as include or language, rather than being part of the text
+func isExtensionKey(key string) bool {
+	for _, r := range key {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// searchTokens splits text into words of letters and digits, the way the
+// index's tokenizer does, up to diacritics
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+// match returns the FTS5 expression for the words; each is quoted so that
+// nothing a client sends is read as query syntax
+func (q searchQuery) match() string {
+	quoted := make([]string, len(q.words))
+	for i, word := range q.words {
+		quoted[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// searchConditions builds the WHERE clause for a filter's search: the match
+// (unless ranked is set, when the caller joins event_search itself) and the
+// spam exclusions
+func (r *Relay) searchConditions(q searchQuery, ranked bool) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if !r.searchEnabled {
+		return "0", nil
+	}
+	if len(q.words) > 0 && !ranked {
+		conditions = append(conditions, "id IN (SELECT event_id FROM event_search WHERE event_search MATCH ?)")
+		args = append(args, q.match())
+	}
+	if !q.includeSpam {
+		events, authors := r.spamTargets()
+		if len(events) > 0 {
+			conditions = append(conditions, "id NOT IN ("+strings.TrimSuffix(strings.Repeat("?,", len(events)), ",")+")")
+			for id := range events {
+				args = append(args, id)
+			}
+		}
+		if len(authors) > 0 {
+			conditions = append(conditions, "pubkey NOT IN ("+strings.TrimSuffix(strings.Repeat("?,", len(authors)), ",")+")")
+			for pubkey := range authors {
+				args = append(args, pubkey)
+			}
+		}
+	}
+	if len(conditions) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// spamTargets returns the events and authors reported as spam by the owner or
+// an admin. Reports the service key signs on behalf of visitors do not count,
+// and neither does a report of an event a moderator dismissed afterwards.
+func (r *Relay) spamTargets() (map[string]bool, map[string]bool) {
+	var reporters []string
+	if r.cfg.OwnerPubkey != "" {
+		reporters = append(reporters, r.cfg.OwnerPubkey)
+	}
+	if r.admins != nil {
+		for pubkey := range r.admins.byPubkey {
+			reporters = append(reporters, pubkey)
+		}
+	}
+	events, authors := map[string]bool{}, map[string]bool{}
+	if len(reporters) == 0 {
+		return events, authors
+	}
+
+	dismissed := map[string]int64{}
+	if rows, err := r.db.Query("SELECT event_id, dismissed_at FROM report_dismissals"); err == nil {
+		for rows.Next() {
+			var id string
+			var at int64
+			if rows.Scan(&id, &at) == nil {
+				dismissed[id] = at
+			}
+		}
+		rows.Close()
+	}
+
+	limit := r.cfg.MaxLimit
+	for _, report := range r.getMatchingEvents([]Filter{{Kinds: []int{1984}, Authors: reporters, Limit: &limit}}) {
+		for _, tag := range report.Tags {
+			if len(tag) < 3 || tag[2] != "spam" || !isHex64(tag[1]) {
+				continue
+			}
+			target := strings.ToLower(tag[1])
+			switch {
+			case tag[0] == "e" && dismissed[target] < report.CreatedAt:
+				events[target] = true
+			case tag[0] == "p":
+				authors[target] = true
+			}
+		}
+	}
+	return events, authors
+}
+
+// searchEvents answers a search filter from every event database, best
+// match first. FTS5 ranks with bm25, whose scores are close enough across
+// partitions to merge on. Filters with only extensions are ordered by time.
+func (r *Relay) searchEvents(filter Filter, limit int) ([]Event, error) {
+	q := parseSearch(filter.Search)
+	plain := filter
+	plain.Search = ""
+	where, args := r.filterConditions(plain)
+	condition, searchArgs := r.searchConditions(q, true)
+	where += " AND " + condition
+	args = append(args, searchArgs...)
+
+	query := "SELECT id, pubkey, created_at, kind, tags, content, sig, 0 FROM relay_events WHERE " + where +
+		" ORDER BY created_at DESC LIMIT ?"
+	if len(q.words) > 0 {
+		query = `SELECT id, pubkey, created_at, kind, tags, relay_events.content, sig, found.rank
+			FROM relay_events JOIN (SELECT event_id, rank FROM event_search WHERE event_search MATCH ?) AS found
+			ON found.event_id = relay_events.id
+			WHERE ` + where + ` ORDER BY found.rank, created_at DESC LIMIT ?`
+		args = append([]interface{}{q.match()}, args...)
+	}
+
+	type rankedEvent struct {
+		event Event
+		rank  float64
+	}
+	var found []rankedEvent
+	for _, db := range r.eventDBs(filter.Since, filter.Until) {
+		r.faults.dbDelay()
+		rows, err := db.Query(query, append(args, limit)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var e rankedEvent
+			var tagsJSON string
+			if rows.Scan(&e.event.ID, &e.event.PubKey, &e.event.CreatedAt, &e.event.Kind, &tagsJSON,
+				&e.event.Content, &e.event.Sig, &e.rank) != nil {
+				continue
+			}
+			json.Unmarshal([]byte(tagsJSON), &e.event.Tags)
+			found = append(found, e)
+		}
+		rows.Close()
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].rank != found[j].rank {
+			return found[i].rank < found[j].rank
+		}
+		return found[i].event.CreatedAt > found[j].event.CreatedAt
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	events := make([]Event, len(found))
+	for i := range found {
+		events[i] = found[i].event
+	}
+	return events, nil
+}
+
+// matchesWords reports whether every word occurs in the text, compared the
+// way the tokenizer does but for diacritics; it allocates nothing
+func matchesWords(text string, words []string) bool {
+	for _, word := range words {
+		found := false
+		for start := 0; start < len(text) && !found; {
+			r, size := utf8.DecodeRuneInString(text[start:])
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				start += size
+				continue
+			}
+			end := start + size
+			for end < len(text) {
+				r, size := utf8.DecodeRuneInString(text[end:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			found = strings.EqualFold(text[start:end], word)
+			start = end
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
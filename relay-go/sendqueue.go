@@ -0,0 +1,282 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Outgoing messages wait in a per-client queue bounded by bytes rather than
+// message count, so one subscription replaying large long-form events cannot
+// hold as much memory as thousands of small ones. A global budget caps what
+// all queues hold together; when it runs out, the client with the largest
+// backlog is disconnected. The owner's connections get a priority queue
+// instead (see prioritize), which neither limit sheds.
+
+// sendOverhead is charged per queued message on top of its size, so floods
+// of tiny messages are bounded too
+const sendOverhead = 64
+
+// Overflow policies (RELAY_SEND_OVERFLOW) for a client whose queue is full
+const (
+	overflowDisconnect = "disconnect"  // close the connection
+	overflowDropOldest = "drop_oldest" // drop its oldest queued EVENTs to make room
+)
+
+// queuedMessage is one message waiting to be written
+type queuedMessage struct {
+	data []byte
+	// droppable messages (EVENTs) may be dropped by the drop_oldest policy;
+	// OK, EOSE, CLOSED and NOTICE are always delivered
+	droppable bool
+}
+
+// sendQueue is a client's outgoing message queue
+type sendQueue struct {
+	budget *sendBudget
+	limit  int
+	// priority is set once the owner authenticates on the connection
+	priority bool
+
+	mu          sync.Mutex
+	items       []queuedMessage
+	bytes       int
+	closed      bool
+	closeReason string
+	ready       chan struct{}
+}
+
+// sendBudget accounts the memory held by every send queue
+type sendBudget struct {
+	limit    int64
+	perQueue int
+	policy   string
+
+	// mu guards queues only; it may be held while taking a queue's lock,
+	// never the other way around
+	mu     sync.Mutex
+	queues map[*sendQueue]bool
+
+	bytes     int64
+	peak      int64
+	dropped   int64 // messages dropped under drop_oldest
+	overflows int64 // clients disconnected for a full queue
+	evictions int64 // clients disconnected to stay within the global budget
+}
+
+// newSendBudget creates the global accounting from the configuration
+func newSendBudget(cfg *Config) *sendBudget {
+	return &sendBudget{
+		limit:    cfg.SendMemory,
+		perQueue: cfg.ClientSendBuffer,
+		policy:   cfg.SendOverflow,
+		queues:   make(map[*sendQueue]bool),
+	}
+}
+
+// newQueue creates a send queue for a new client
+func (b *sendBudget) newQueue() *sendQueue {
+	q := &sendQueue{budget: b, limit: b.perQueue, ready: make(chan struct{}, 1)}
+	b.mu.Lock()
+	b.queues[q] = true
+	b.mu.Unlock()
+	return q
+}
+
+// charge adds n bytes to the global total and returns it
+func (b *sendBudget) charge(n int) int64 {
+	total := atomic.AddInt64(&b.bytes, int64(n))
+	for {
+		peak := atomic.LoadInt64(&b.peak)
+		if total <= peak || atomic.CompareAndSwapInt64(&b.peak, peak, total) {
+			return total
+		}
+	}
+}
+
+// evictLargest disconnects the client with the largest backlog
+func (b *sendBudget) evictLargest() {
+	b.mu.Lock()
+	var largest *sendQueue
+	largestBytes := 0
+	for q := range b.queues {
+		if n, priority := q.usage(); n > largestBytes && !priority {
+			largest, largestBytes = q, n
+		}
+	}
+	b.mu.Unlock()
+
+	if largest != nil {
+		atomic.AddInt64(&b.evictions, 1)
+		largest.close("relay send memory exhausted")
+	}
+}
+
+// stats reports the memory held by send queues and what the policies did
+func (b *sendBudget) stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	largest, priority := 0, 0
+	for q := range b.queues {
+		n, isPriority := q.usage()
+		if n > largest {
+			largest = n
+		}
+		if isPriority {
+			priority++
+		}
+	}
+	return map[string]interface{}{
+		"bytes":         atomic.LoadInt64(&b.bytes),
+		"peak_bytes":    atomic.LoadInt64(&b.peak),
+		"limit_bytes":   b.limit,
+		"client_limit":  b.perQueue,
+		"policy":        b.policy,
+		"queues":        len(b.queues),
+		"priority":      priority,
+		"largest_queue": largest,
+		"dropped":       atomic.LoadInt64(&b.dropped),
+		"overflows":     atomic.LoadInt64(&b.overflows),
+		"evictions":     atomic.LoadInt64(&b.evictions),
+	}
+}
+
+// push queues a message, reporting whether it was accepted. A full queue
+// either drops older EVENTs or closes the queue, depending on the policy.
+func (q *sendQueue) push(data []byte, droppable bool) bool {
+	cost := len(data) + sendOverhead
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	if q.priority {
+		droppable = false
+	}
+	if q.bytes+cost > q.limit && q.budget.policy == overflowDropOldest {
+		q.dropOldest(q.bytes + cost - q.limit)
+	}
+	if q.bytes+cost > q.limit {
+		q.mu.Unlock()
+		atomic.AddInt64(&q.budget.overflows, 1)
+		q.close("send buffer full; client too slow")
+		return false
+	}
+	q.items = append(q.items, queuedMessage{data: data, droppable: droppable})
+	q.bytes += cost
+	q.mu.Unlock()
+
+	if total := q.budget.charge(cost); q.budget.limit > 0 && total > q.budget.limit {
+		q.budget.evictLargest()
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// dropOldest drops droppable messages, oldest first, until need bytes are
+// freed or none are left; q.mu must be held
+func (q *sendQueue) dropOldest(need int) {
+	freed := 0
+	kept := q.items[:0]
+	for _, m := range q.items {
+		if freed < need && m.droppable {
+			freed += len(m.data) + sendOverhead
+			atomic.AddInt64(&q.budget.dropped, 1)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	for i := len(kept); i < len(q.items); i++ {
+		q.items[i] = queuedMessage{}
+	}
+	q.items = kept
+	q.bytes -= freed
+	q.budget.charge(-freed)
+}
+
+// pop takes the oldest message off the queue
+func (q *sendQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	m := q.items[0]
+	q.items[0] = queuedMessage{}
+	q.items = q.items[1:]
+	cost := len(m.data) + sendOverhead
+	q.bytes -= cost
+	q.budget.charge(-cost)
+	return m.data, true
+}
+
+// close discards the queued messages and tells the write pump to close the
+// connection with reason (empty for a normal disconnect)
+func (q *sendQueue) close(reason string) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	q.closeReason = reason
+	freed := q.bytes
+	q.items = nil
+	q.bytes = 0
+	q.mu.Unlock()
+
+	q.budget.charge(-freed)
+	q.budget.mu.Lock()
+	delete(q.budget.queues, q)
+	q.budget.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// isClosed reports whether the queue was closed, and why
+func (q *sendQueue) isClosed() (bool, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed, q.closeReason
+}
+
+// size returns the bytes held by the queue
+func (q *sendQueue) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// usage returns the bytes held by the queue and whether it is a priority queue
+func (q *sendQueue) usage() (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes, q.priority
+}
+
+// prioritize makes the queue the owner's lane: its EVENTs are never dropped
+// under drop_oldest, it is never evicted to stay within the global budget,
+// and it may hold up to limit bytes. Overflowing even that still closes it,
+// as the memory must stay bounded.
+func (q *sendQueue) prioritize(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.priority = true
+	if limit > q.limit {
+		q.limit = limit
+	}
+}
+
+// len returns the number of queued messages
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
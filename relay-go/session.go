@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// suspendedSubscription is a subscription kept after its connection dropped
+type suspendedSubscription struct {
+	ID      string
+	Filters []Filter
+	Cursor  int64
+}
+
+// suspendedSession holds the subscriptions of a disconnected client until it
+// resumes or the resumption window expires
+type suspendedSession struct {
+	subscriptions []suspendedSubscription
+	expires       time.Time
+	// pubkey is the pubkey the connection had authenticated as, which a
+	// resuming connection must be authenticated as too
+	pubkey string
+	// private is set for sessions opened on /ws-private, which only resume there
+	private bool
+}
+
+// sessionStore tracks suspended sessions by token
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*suspendedSession
+	window   time.Duration
+}
+
+func newSessionStore(window time.Duration) *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*suspendedSession),
+		window:   window,
+	}
+}
+
+// newSessionToken returns a random resumption token
+func newSessionToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// session returns the client's session token, or "" before SESSION
+func (c *Client) session() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sessionToken
+}
+
+// suspended captures a client's session as if its connection dropped now
+func (c *Client) suspended(window time.Duration) (string, *suspendedSession) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var subs []suspendedSubscription
+	for _, sub := range c.Subscriptions {
+		subs = append(subs, suspendedSubscription{
+			ID:      sub.ID,
+			Filters: sub.Filters,
+			Cursor:  atomic.LoadInt64(&sub.cursor),
+		})
+	}
+	return c.sessionToken, &suspendedSession{
+		subscriptions: subs,
+		expires:       time.Now().Add(window),
+		pubkey:        c.authed,
+		private:       c.private,
+	}
+}
+
+// suspend records a disconnected client's subscriptions and cursors
+func (s *sessionStore) suspend(c *Client) {
+	token, session := c.suspended(s.window)
+
+	s.mu.Lock()
+	s.sessions[token] = session
+	s.mu.Unlock()
+}
+
+// take removes and returns a suspended session that has not expired. A
+// session is only given to a connection on the endpoint it was opened on and,
+// if it was opened after AUTH, authenticated as the same pubkey; anyone else
+// leaves it in place.
+func (s *sessionStore) take(token, pubkey string, private bool) *suspendedSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[token]
+	if !ok || session.private != private || (session.pubkey != "" && session.pubkey != pubkey) {
+		return nil
+	}
+	delete(s.sessions, token)
+
+	if time.Now().After(session.expires) {
+		return nil
+	}
+	return session
+}
+
+// expire drops sessions whose resumption window has passed
+func (s *sessionStore) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		for token, session := range s.sessions {
+			if time.Now().After(session.expires) {
+				delete(s.sessions, token)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handleSession processes ["SESSION"] (start a resumable session) and
+// ["SESSION", token] (resume a dropped one). The relay answers with
+// ["SESSION", token, {"resumed": bool, ...}] and, when resuming, replays the
+// events each subscription missed followed by its EOSE. A session opened
+// after AUTH can only be resumed after authenticating as the same pubkey, and
+// resumed subscriptions pass the same endpoint and read checks as a new REQ.
+func (c *Client) handleSession(raw []json.RawMessage) {
+	var token string
+	if len(raw) >= 2 {
+		json.Unmarshal(raw[1], &token)
+	}
+
+	var session *suspendedSession
+	if token != "" {
+		session = c.Relay.sessions.take(token, c.authedPubkey(), c.private)
+	}
+
+	if session == nil {
+		token = newSessionToken()
+		c.mu.Lock()
+		c.sessionToken = token
+		c.mu.Unlock()
+		c.sendJSON([]interface{}{"SESSION", token, map[string]interface{}{
+			"resumed":        false,
+			"window_seconds": int(c.Relay.sessions.window.Seconds()),
+		}})
+		return
+	}
+
+	c.mu.Lock()
+	c.sessionToken = token
+	c.mu.Unlock()
+	ids := make([]string, 0, len(session.subscriptions))
+	for _, s := range session.subscriptions {
+		ids = append(ids, s.ID)
+	}
+	c.sendJSON([]interface{}{"SESSION", token, map[string]interface{}{
+		"resumed":       true,
+		"subscriptions": ids,
+	}})
+
+	replayed := 0
+	authed := c.authedPubkey()
+	for _, s := range session.subscriptions {
+		filters, reason := c.endpointFilters(s.Filters)
+		if reason == "" {
+			reason = c.authRequiredToRead(filters)
+		}
+		if reason != "" {
+			if !c.sendJSON([]interface{}{"CLOSED", s.ID, reason}) {
+				return
+			}
+			continue
+		}
+
+		subscription := &Subscription{
+			ID:        s.ID,
+			Filters:   filters,
+			matcher:   compileFilters(filters),
+			Client:    c,
+			cursor:    time.Now().Unix(),
+			createdAt: time.Now(),
+		}
+
+		c.mu.Lock()
+		c.Subscriptions[s.ID] = subscription
+		c.mu.Unlock()
+
+		for _, event := range c.Relay.getEventsReceivedSince(filters, s.Cursor) {
+			if !c.Relay.auth.canRead(&event, authed) || !c.Relay.canReadGroup(&event, authed) {
+				continue
+			}
+			if !c.sendJSON([]interface{}{"EVENT", s.ID, event}) {
+				return
+			}
+			atomic.AddInt64(&subscription.delivered, 1)
+			replayed++
+		}
+		if !c.sendJSON([]interface{}{"EOSE", s.ID}) {
+			return
+		}
+	}
+
+	c.logf("🔁 Resumed session with %d subscriptions (%d events replayed)", len(ids), replayed)
+}
+
+// getEventsReceivedSince returns events matching the filters that the relay
+// received at or after the cursor, oldest first, bounded by the replay limit
+func (r *Relay) getEventsReceivedSince(filters []Filter, cursor int64) []Event {
+	var events []Event
+	seen := make(map[string]bool)
+
+	for _, filter := range filters {
+		where, args := r.filterConditions(filter)
+		query := "SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE " + where +
+			" AND received_at >= ? ORDER BY received_at ASC LIMIT ?"
+		args = append(args, cursor, r.cfg.SessionReplayLimit)
+
+		// Late arrivals can belong to any month, so every partition is checked
+		for _, db := range r.eventDBs(nil, nil) {
+			rows, err := db.Query(query, args...)
+			if err != nil {
+				log.Printf("Replay query error: %v", err)
+				continue
+			}
+			for _, event := range scanEvents(rows) {
+				if !seen[event.ID] && len(events) < r.cfg.SessionReplayLimit {
+					seen[event.ID] = true
+					events = append(events, event)
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	return events
+}
+
+// sendJSON queues a message for the client, reporting false when the client
+// could not keep up and is being disconnected. EVENTs may be dropped under
+// the drop_oldest overflow policy.
+func (c *Client) sendJSON(message []interface{}) bool {
+	data, _ := json.Marshal(message)
+	return c.Send.push(data, message[0] == "EVENT")
+}
+
+const sessionSchema = `
+	CREATE TABLE IF NOT EXISTS relay_sessions (
+		token TEXT PRIMARY KEY,
+		subscriptions TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+`
+
+// snapshot returns every resumable session: suspended ones as stored, and
+// live ones as if their connection dropped now with the given grace window
+func (s *sessionStore) snapshot(clients []*Client, grace time.Duration) map[string]*suspendedSession {
+	result := make(map[string]*suspendedSession)
+
+	s.mu.Lock()
+	for token, session := range s.sessions {
+		result[token] = session
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		if token, session := c.suspended(grace); token != "" {
+			result[token] = session
+		}
+	}
+
+	return result
+}
+
+// persistSessions writes all resumable sessions to the database so they
+// survive a relay restart
+func (r *Relay) persistSessions() error {
+	r.clientsMutex.RLock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.clientsMutex.RUnlock()
+
+	sessions := r.sessions.snapshot(clients, r.cfg.RestartGrace)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM relay_sessions"); err != nil {
+		return err
+	}
+	for token, session := range sessions {
+		subs, _ := json.Marshal(session.subscriptions)
+		if _, err := tx.Exec(
+			"INSERT INTO relay_sessions (token, subscriptions, expires_at, pubkey, private) VALUES (?, ?, ?, ?, ?)",
+			token, string(subs), session.expires.Unix(), session.pubkey, session.private,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// loadSessions restores sessions persisted before the last shutdown
+func (r *Relay) loadSessions() error {
+	rows, err := r.db.Query("SELECT token, subscriptions, expires_at, pubkey, private FROM relay_sessions WHERE expires_at > ?", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	restored := 0
+	r.sessions.mu.Lock()
+	for rows.Next() {
+		var token, subsJSON, pubkey string
+		var expiresAt int64
+		var private bool
+		if err := rows.Scan(&token, &subsJSON, &expiresAt, &pubkey, &private); err != nil {
+			continue
+		}
+
+		var subs []suspendedSubscription
+		if err := json.Unmarshal([]byte(subsJSON), &subs); err != nil {
+			continue
+		}
+		r.sessions.sessions[token] = &suspendedSession{
+			subscriptions: subs,
+			expires:       time.Unix(expiresAt, 0),
+			pubkey:        pubkey,
+			private:       private,
+		}
+		restored++
+	}
+	r.sessions.mu.Unlock()
+
+	if restored > 0 {
+		log.Printf("🔁 Restored %d resumable sessions", restored)
+	}
+	return nil
+}
+
+// persistSessionsPeriodically snapshots sessions so a crash loses at most one interval
+func (r *Relay) persistSessionsPeriodically() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// During an upgrade both processes share the table; the old one hands
+		// its sessions over instead, so neither overwrites the other's
+		if r.feed.Load() != nil {
+			continue
+		}
+		if err := r.persistSessions(); err != nil {
+			log.Printf("❌ Failed to persist sessions: %v", err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !purego
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the database/sql driver backing every SQLite database.
+// The default build uses mattn/go-sqlite3, which needs CGO.
+const sqliteDriver = "sqlite3"
+
+// sqliteDSN returns the connection string for a database file in WAL mode
+func sqliteDSN(path string) string {
+	return path + "?_journal_mode=WAL"
+}
+
+// sqliteQueryOnlyDSN returns the connection string for a database every
+// write to fails, for a relay in read-only mode
+func sqliteQueryOnlyDSN(path string) string {
+	return "file:" + path + "?_query_only=true"
+}
+
+// sqliteReadOnlyDSN returns the connection string for opening someone else's
+// database file read-only, without changing its journal mode
+func sqliteReadOnlyDSN(path string) string {
+	return "file:" + path + "?mode=ro"
+}
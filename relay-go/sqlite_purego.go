@@ -0,0 +1,30 @@
+//go:build purego
+
+package main
+
+import (
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDriver is the database/sql driver backing every SQLite database.
+// Building with -tags purego uses modernc.org/sqlite so the relay can be
+// cross-compiled with CGO_ENABLED=0 (Raspberry Pi, Windows).
+const sqliteDriver = "sqlite"
+
+// sqliteDSN returns the connection string for a database file in WAL mode,
+// waiting up to 5s for locks like the mattn driver does by default
+func sqliteDSN(path string) string {
+	return "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+}
+
+// sqliteQueryOnlyDSN returns the connection string for a database every
+// write to fails, for a relay in read-only mode
+func sqliteQueryOnlyDSN(path string) string {
+	return "file:" + path + "?_pragma=query_only(1)&_pragma=busy_timeout(5000)"
+}
+
+// sqliteReadOnlyDSN returns the connection string for opening someone else's
+// database file read-only, without changing its journal mode
+func sqliteReadOnlyDSN(path string) string {
+	return "file:" + path + "?mode=ro&_pragma=busy_timeout(5000)"
+}
@@ -42,7 +42,7 @@ check_binary() {
         log_info "Building relay binary..."
         
         cd "$RELAY_DIR"
-        if ! go build -o "$BINARY_NAME" main.go; then
+        if ! go build -tags sqlite_fts5 -o "$BINARY_NAME" .; then
             log_error "Failed to build relay binary"
             exit 1
         fi
@@ -154,7 +154,7 @@ build_relay() {
     log_info "Building relay binary..."
     cd "$RELAY_DIR"
     
-    if go build -o "$BINARY_NAME" main.go; then
+    if go build -tags sqlite_fts5 -o "$BINARY_NAME" .; then
         log_success "Relay binary built successfully: $BINARY_PATH"
     else
         log_error "Failed to build relay binary"
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"nostr-relay/pkg/nostr"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userStatus is a NIP-38 status (kind 30315) as the home page's "now" widget
+// shows it
+type userStatus struct {
+	Type      string `json:"type"` // the d tag: general, music, ...
+	Content   string `json:"content"`
+	Link      string `json:"link,omitempty"` // r tag, or a nostr: URI for e, a and p tags
+	EventID   string `json:"event_id"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// statusLink returns where a status points: a URL, or a nostr: URI for the
+// event, address or profile it references
+func statusLink(event *Event) string {
+	if r := event.TagValue("r"); r != "" {
+		return r
+	}
+	if id := event.TagValue("e"); isHex64(id) {
+		if note, err := nostr.EncodeNote(strings.ToLower(id)); err == nil {
+			return "nostr:" + note
+		}
+	}
+	if addr, ok := parseAddress(event.TagValue("a")); ok {
+		if naddr, err := nostr.EncodeAddress(nostr.AddressPointer{Kind: addr.Kind, PubKey: addr.Pubkey, Identifier: addr.D}); err == nil {
+			return "nostr:" + naddr
+		}
+	}
+	if p := event.TagValue("p"); isHex64(p) {
+		if npub, err := nostr.EncodePublicKey(strings.ToLower(p)); err == nil {
+			return "nostr:" + npub
+		}
+	}
+	return ""
+}
+
+// currentStatuses returns a pubkey's live statuses by type. Only the latest
+// event of each type counts; it is left out when it is empty, which clears
+// the status, or past its NIP-40 expiration.
+func (r *Relay) currentStatuses(pubkey string) map[string]userStatus {
+	latest := map[string]Event{}
+	for _, db := range r.eventDBs(nil, nil) {
+		rows, err := db.Query("SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE pubkey = ? AND kind = 30315", pubkey)
+		if err != nil {
+			continue
+		}
+		for _, event := range scanEvents(rows) {
+			d := event.TagValue("d")
+			if prev, seen := latest[d]; !seen || event.CreatedAt > prev.CreatedAt {
+				latest[d] = event
+			}
+		}
+		rows.Close()
+	}
+
+	now := time.Now().Unix()
+	statuses := map[string]userStatus{}
+	for d, event := range latest {
+		expiresAt, _ := strconv.ParseInt(event.TagValue("expiration"), 10, 64)
+		if event.Content == "" || (expiresAt > 0 && expiresAt <= now) {
+			continue
+		}
+		statuses[d] = userStatus{
+			Type:      d,
+			Content:   event.Content,
+			Link:      statusLink(&event),
+			EventID:   event.ID,
+			CreatedAt: event.CreatedAt,
+			ExpiresAt: expiresAt,
+		}
+	}
+	return statuses
+}
+
+// handleStatus returns the owner's current statuses, e.g. what they are
+// doing (general) and listening to (music); ?pubkey= (hex or npub) asks for
+// someone else's
+func handleStatus(c *gin.Context) {
+	pubkey := relay.cfg.OwnerPubkey
+	if p := c.Query("pubkey"); p != "" {
+		decoded, err := nostr.DecodePublicKey(p)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid pubkey"})
+			return
+		}
+		pubkey = decoded
+	}
+	if pubkey == "" {
+		c.JSON(400, gin.H{"error": "no owner configured; pass ?pubkey="})
+		return
+	}
+
+	// Statuses change often, so caches should not hold them for long
+	c.Header("Cache-Control", "public, max-age=30")
+	c.JSON(200, gin.H{"pubkey": pubkey, "statuses": relay.currentStatuses(pubkey)})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// subscriptionStats is one live subscription's match counters
+type subscriptionStats struct {
+	Client     string   `json:"client"`
+	UserAgent  string   `json:"user_agent"`
+	ID         string   `json:"id"`
+	Filters    []Filter `json:"filters"`
+	AgeSeconds int64    `json:"age_seconds"`
+	Evaluated  int64    `json:"evaluated"`
+	Matched    int64    `json:"matched"`
+	Delivered  int64    `json:"delivered"`
+	// MatchRate is the share of live events the filters matched; close to 1
+	// means the subscription receives nearly everything the relay sees
+	MatchRate float64 `json:"match_rate"`
+}
+
+// subscriptionStats collects counters for every live subscription
+func (r *Relay) subscriptionStats() []subscriptionStats {
+	var stats []subscriptionStats
+
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+
+	for _, client := range r.clients {
+		client.mu.RLock()
+		for _, sub := range client.Subscriptions {
+			s := subscriptionStats{
+				Client:     client.ID,
+				UserAgent:  client.userAgent,
+				ID:         sub.ID,
+				Filters:    sub.Filters,
+				AgeSeconds: int64(time.Since(sub.createdAt).Seconds()),
+				Evaluated:  atomic.LoadInt64(&sub.evaluated),
+				Matched:    atomic.LoadInt64(&sub.matched),
+				Delivered:  atomic.LoadInt64(&sub.delivered),
+			}
+			if s.Evaluated > 0 {
+				s.MatchRate = float64(s.Matched) / float64(s.Evaluated)
+			}
+			stats = append(stats, s)
+		}
+		client.mu.RUnlock()
+	}
+	return stats
+}
+
+// handleSubscriptionStats ranks live subscriptions by fan-out cost
+// (?sort=matched|delivered|rate, ?limit=N)
+func handleSubscriptionStats(c *gin.Context) {
+	stats := relay.subscriptionStats()
+
+	var less func(a, b *subscriptionStats) bool
+	switch c.DefaultQuery("sort", "matched") {
+	case "matched":
+		less = func(a, b *subscriptionStats) bool { return a.Matched > b.Matched }
+	case "delivered":
+		less = func(a, b *subscriptionStats) bool { return a.Delivered > b.Delivered }
+	case "rate":
+		less = func(a, b *subscriptionStats) bool { return a.MatchRate > b.MatchRate }
+	default:
+		c.JSON(400, gin.H{"error": "sort must be matched, delivered or rate"})
+		return
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return less(&stats[i], &stats[j]) })
+
+	total := len(stats)
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit > 0 && limit < total {
+		stats = stats[:limit]
+	}
+	if stats == nil {
+		stats = []subscriptionStats{}
+	}
+
+	c.JSON(200, gin.H{"total": total, "subscriptions": stats})
+}
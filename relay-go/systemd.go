@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdListenFDsStart is the first file descriptor passed by socket activation
+const systemdListenFDsStart = 3
+
+// systemdListener returns the socket inherited from systemd socket activation,
+// or nil when the relay was not socket-activated
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil, nil
+	}
+
+	// Keep child processes from thinking the sockets are theirs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if fds > 1 {
+		log.Printf("⚠️  systemd passed %d sockets, only the first is used", fds)
+	}
+
+	file := os.NewFile(systemdListenFDsStart, "systemd-socket")
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("inherited socket is not a listener: %v", err)
+	}
+	return listener, nil
+}
+
+// listen returns the socket handed over by an upgrade or activated by systemd
+// when there is one, otherwise it listens on the configured address
+func listen(addr string) (net.Listener, error) {
+	if listener, err := inheritedListener(); err != nil || listener != nil {
+		if listener != nil {
+			log.Printf("🔌 Using socket from the previous relay process: %s", listener.Addr())
+		}
+		return listener, err
+	}
+
+	listener, err := systemdListener()
+	if err != nil || listener != nil {
+		if listener != nil {
+			log.Printf("🔌 Using socket from systemd: %s", listener.Addr())
+		}
+		return listener, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+// sdNotify sends a state string such as "READY=1" to the systemd notify socket;
+// it is a no-op when the relay is not run under systemd with Type=notify
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog, or 0 when
+// WatchdogSec is not configured for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// Ping at half the timeout, as recommended by sd_watchdog_enabled(3)
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the systemd watchdog while the database still answers,
+// so a wedged relay is restarted by systemd
+func (r *Relay) runWatchdog(interval time.Duration) {
+	log.Printf("🐕 systemd watchdog enabled, pinging every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := r.db.Ping(); err != nil {
+			log.Printf("❌ Database unresponsive, withholding watchdog ping: %v", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("⚠️  Failed to ping systemd watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagSchema indexes the single-letter tags of events for "#x" filters, as
+// NIP-01 asks of relays; it is one of the eventIndexes. #a filters use
+// event_atags instead, which matches equivalent spellings of an address.
+const tagSchema = `
+	CREATE TABLE IF NOT EXISTS event_tags (
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		PRIMARY KEY (name, value, event_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tags_event ON event_tags(event_id);
+`
+
+// indexTags records the first value of an event's single-letter tags
+func indexTags(db sqlExecer, event *Event) error {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || len(tag[0]) != 1 {
+			continue
+		}
+		if _, err := db.Exec("INSERT OR IGNORE INTO event_tags (name, value, event_id) VALUES (?, ?, ?)",
+			tag[0], tag[1], event.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagConditions builds the WHERE clause for one "#x" filter entry; an empty
+// list of values matches nothing
+func tagConditions(name string, values []string) (string, []interface{}) {
+	if len(values) == 0 {
+		return "0", nil
+	}
+	args := make([]interface{}, 0, len(values)+1)
+	args = append(args, name)
+	for _, value := range values {
+		args = append(args, value)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(values)), ",")
+	return "id IN (SELECT event_id FROM event_tags WHERE name = ? AND value IN (" + placeholders + "))", args
+}
+
+// sortedTagNames returns a filter's tag names in order, so the same filter
+// always builds the same SQL
+func sortedTagNames(tags map[string][]string) []string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// checkCreatedAt returns an OK rejection message when an event's created_at
+// falls outside RELAY_CREATED_AT_MAX_FUTURE and RELAY_CREATED_AT_MAX_AGE
+// (NIP-22), or "" when it may be stored
+func (r *Relay) checkCreatedAt(event *Event) string {
+	now := time.Now()
+	createdAt := time.Unix(event.CreatedAt, 0)
+
+	if r.cfg.CreatedAtMaxFuture > 0 && createdAt.After(now.Add(r.cfg.CreatedAtMaxFuture)) {
+		return fmt.Sprintf("invalid: created_at is %s in the future, the limit is %s",
+			createdAt.Sub(now).Round(time.Second), r.cfg.CreatedAtMaxFuture)
+	}
+	if r.cfg.CreatedAtMaxAge > 0 && createdAt.Before(now.Add(-r.cfg.CreatedAtMaxAge)) {
+		return fmt.Sprintf("invalid: created_at is older than %s", r.cfg.CreatedAtMaxAge)
+	}
+	return ""
+}
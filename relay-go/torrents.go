@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NIP-35 torrents (kind 2003) are indexed with their info hash, trackers and
+// files, so owners who publish datasets or media this way can have them
+// searched and turned into magnet links.
+
+const torrentSchema = `
+	CREATE TABLE IF NOT EXISTS event_torrents (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		info_hash TEXT NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		trackers TEXT NOT NULL,
+		files TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_torrents_hash ON event_torrents(info_hash);
+`
+
+// torrentFile is one file of a torrent
+type torrentFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// torrentInfo is a torrent as stored in event_torrents
+type torrentInfo struct {
+	EventID     string        `json:"event_id"`
+	PubKey      string        `json:"pubkey"`
+	CreatedAt   int64         `json:"created_at"`
+	InfoHash    string        `json:"info_hash"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Size        int64         `json:"size"`
+	Trackers    []string      `json:"trackers"`
+	Files       []torrentFile `json:"files"`
+	Magnet      string        `json:"magnet"`
+}
+
+// isInfoHash reports whether s is a hex BitTorrent v1 info hash
+func isInfoHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// indexTorrent records a torrent; events without a valid x tag are left out
+func indexTorrent(db sqlExecer, event *Event) error {
+	infoHash := strings.ToLower(event.TagValue("x"))
+	if event.Kind != 2003 || !isInfoHash(infoHash) {
+		return nil
+	}
+	files := []torrentFile{}
+	var size int64
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "file" || tag[1] == "" {
+			continue
+		}
+		f := torrentFile{Name: tag[1]}
+		if len(tag) >= 3 {
+			f.Size, _ = strconv.ParseInt(tag[2], 10, 64)
+		}
+		size += f.Size
+		files = append(files, f)
+	}
+	trackers, _ := json.Marshal(tagList(event, "tracker"))
+	data, _ := json.Marshal(files)
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_torrents (event_id, pubkey, created_at, info_hash, title, description, size, trackers, files)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, event.ID, event.PubKey, event.CreatedAt, infoHash,
+		event.TagValue("title"), event.Content, size, string(trackers), string(data))
+	return err
+}
+
+// magnetLink builds a magnet URI with the torrent's name and trackers
+func magnetLink(t *torrentInfo) string {
+	link := "magnet:?xt=urn:btih:" + t.InfoHash
+	if t.Title != "" {
+		link += "&dn=" + url.QueryEscape(t.Title)
+	}
+	for _, tracker := range t.Trackers {
+		link += "&tr=" + url.QueryEscape(tracker)
+	}
+	return link
+}
+
+// handleTorrents searches torrents, newest first. ?q= matches words in the
+// title, description and file names, ?hash= one info hash, ?author= one
+// publisher.
+func handleTorrents(c *gin.Context) {
+	where, args := "1=1", []interface{}{}
+	like := strings.NewReplacer("%", "\\%", "_", "\\_")
+	for _, word := range strings.Fields(c.Query("q")) {
+		where += " AND (title LIKE ? ESCAPE '\\' OR description LIKE ? ESCAPE '\\' OR files LIKE ? ESCAPE '\\')"
+		pattern := "%" + like.Replace(word) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	if hash := strings.ToLower(c.Query("hash")); hash != "" {
+		where += " AND info_hash = ?"
+		args = append(args, hash)
+	}
+	where, args = authorCondition(c, where, args)
+
+	torrents := []torrentInfo{}
+	err := queryPayloads("SELECT event_id, pubkey, created_at, info_hash, title, description, size, trackers, files FROM event_torrents WHERE "+where,
+		args, func(rows *sql.Rows) {
+			var t torrentInfo
+			var trackers, files string
+			if rows.Scan(&t.EventID, &t.PubKey, &t.CreatedAt, &t.InfoHash, &t.Title, &t.Description, &t.Size, &trackers, &files) != nil {
+				return
+			}
+			json.Unmarshal([]byte(trackers), &t.Trackers)
+			json.Unmarshal([]byte(files), &t.Files)
+			t.Magnet = magnetLink(&t)
+			torrents = append(torrents, t)
+		})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].CreatedAt > torrents[j].CreatedAt })
+	if limit := payloadLimit(c); len(torrents) > limit {
+		torrents = torrents[:limit]
+	}
+	c.JSON(200, gin.H{"torrents": torrents})
+}
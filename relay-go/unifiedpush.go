@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// alertPriorities maps alert types to ntfy priorities (1 = min, 5 = urgent)
+var alertPriorities = map[string]int{
+	"dm":       5,
+	"zap":      4,
+	"mention":  4,
+	"keyword":  3,
+	"reaction": 2,
+}
+
+// webPushUrgency maps ntfy priorities to RFC 8030 Urgency values for UnifiedPush
+func webPushUrgency(priority int) string {
+	switch {
+	case priority >= 5:
+		return "high"
+	case priority >= 3:
+		return "normal"
+	default:
+		return "low"
+	}
+}
+
+// selfHostedPush publishes owner alerts to an ntfy topic and/or a UnifiedPush endpoint
+type selfHostedPush struct {
+	client     *http.Client
+	ntfyURL    string
+	ntfyToken  string
+	upEndpoint string
+}
+
+// newSelfHostedPush returns nil when neither ntfy nor UnifiedPush is configured
+func newSelfHostedPush(cfg *Config) *selfHostedPush {
+	if cfg.NtfyURL == "" && cfg.UnifiedPushEndpoint == "" {
+		return nil
+	}
+
+	return &selfHostedPush{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		ntfyURL:    cfg.NtfyURL,
+		ntfyToken:  cfg.NtfyToken,
+		upEndpoint: cfg.UnifiedPushEndpoint,
+	}
+}
+
+// send delivers an alert to every configured self-hosted channel
+func (p *selfHostedPush) send(alert *ownerAlert) {
+	priority := alertPriorities[alert.Type]
+
+	if p.ntfyURL != "" {
+		if err := p.sendNtfy(alert, priority); err != nil {
+			log.Printf("❌ ntfy notification failed: %v", err)
+		}
+	}
+
+	if p.upEndpoint != "" {
+		if err := p.sendUnifiedPush(alert, priority); err != nil {
+			log.Printf("❌ UnifiedPush notification failed: %v", err)
+		}
+	}
+}
+
+// sendNtfy publishes a plain-text message using ntfy's header-based API
+func (p *selfHostedPush) sendNtfy(alert *ownerAlert, priority int) error {
+	body := fmt.Sprintf("Event %s (kind %d)", alert.EventID, alert.Kind)
+	req, _ := http.NewRequest("POST", p.ntfyURL, bytes.NewBufferString(body))
+	req.Header.Set("Title", alertTitles[alert.Type])
+	req.Header.Set("Priority", fmt.Sprint(priority))
+	req.Header.Set("Tags", "nostr,"+alert.Type)
+	if p.ntfyToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.ntfyToken)
+	}
+
+	return p.do(req)
+}
+
+// sendUnifiedPush posts the alert JSON to the distributor endpoint registered by the app
+func (p *selfHostedPush) sendUnifiedPush(alert *ownerAlert, priority int) error {
+	payload, _ := json.Marshal(alert)
+	req, _ := http.NewRequest("POST", p.upEndpoint, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Urgency", webPushUrgency(priority))
+
+	return p.do(req)
+}
+
+func (p *selfHostedPush) do(req *http.Request) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
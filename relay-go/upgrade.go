@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// File descriptors passed to the new process during an upgrade
+const (
+	upgradeListenerFD = 3 // the listening socket
+	upgradeReadyFD    = 4 // written by the new process once it serves
+	upgradeHandoverFD = 5 // sessions from the old process, closed when it exits
+)
+
+// upgradeTimeout is how long the new process has to start serving
+const upgradeTimeout = time.Minute
+
+// handedSession is a resumable session passed from the old process
+type handedSession struct {
+	Subscriptions []suspendedSubscription `json:"subscriptions"`
+	Expires       int64                   `json:"expires"`
+	Pubkey        string                  `json:"pubkey,omitempty"`
+	Private       bool                    `json:"private,omitempty"`
+}
+
+// isUpgradeChild reports whether this process was started by an upgrade
+func isUpgradeChild() bool {
+	return os.Getenv("RELAY_UPGRADE") == "1"
+}
+
+// inheritedListener returns the socket passed by the process being upgraded,
+// or nil when this process was started normally
+func inheritedListener() (net.Listener, error) {
+	if !isUpgradeChild() {
+		return nil, nil
+	}
+	file := os.NewFile(upgradeListenerFD, "upgrade-listener")
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("inherited socket is not a listener: %v", err)
+	}
+	return listener, nil
+}
+
+// peerFeed relays events stored by another process sharing the database,
+// while an old and a new relay process serve side by side
+type peerFeed struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	stop chan struct{}
+}
+
+// mark records an event as already broadcast by this process
+func (f *peerFeed) mark(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.seen[id]; ok {
+		return false
+	}
+	f.seen[id] = time.Now()
+	return true
+}
+
+// startPeerFeed polls for events received by the other process once a second
+// and broadcasts the ones this process has not seen
+func (r *Relay) startPeerFeed() {
+	feed := &peerFeed{seen: make(map[string]time.Time), stop: make(chan struct{})}
+	r.feed.Store(feed)
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-feed.stop:
+				return
+			case <-ticker.C:
+			}
+
+			for _, event := range r.getEventsReceivedSince([]Filter{{}}, time.Now().Unix()-2) {
+				if feed.mark(event.ID) {
+					event := event
+					r.broadcastEvent(&event)
+				}
+			}
+
+			feed.mu.Lock()
+			for id, at := range feed.seen {
+				if time.Since(at) > time.Minute {
+					delete(feed.seen, id)
+				}
+			}
+			feed.mu.Unlock()
+		}
+	}()
+}
+
+// stopPeerFeed stops relaying the other process's events
+func (r *Relay) stopPeerFeed() {
+	if feed := r.feed.Swap(nil); feed != nil {
+		close(feed.stop)
+	}
+}
+
+// announceUpgradeReady tells the old process this one is serving, then takes
+// over its sessions once it finishes draining
+func (r *Relay) announceUpgradeReady() {
+	if !isUpgradeChild() {
+		return
+	}
+	os.Unsetenv("RELAY_UPGRADE")
+	r.upgrading.Store(true)
+	r.startPeerFeed()
+
+	ready := os.NewFile(upgradeReadyFD, "upgrade-ready")
+	ready.Write([]byte("ready\n"))
+	ready.Close()
+
+	go func() {
+		defer r.upgrading.Store(false)
+		defer r.stopPeerFeed()
+
+		handover := os.NewFile(upgradeHandoverFD, "upgrade-handover")
+		data, err := io.ReadAll(handover)
+		handover.Close()
+		var sessions map[string]handedSession
+		if err != nil || len(data) == 0 || json.Unmarshal(data, &sessions) != nil {
+			log.Printf("⚠️  Previous process exited without handing over sessions")
+			return
+		}
+
+		r.sessions.mu.Lock()
+		for token, session := range sessions {
+			r.sessions.sessions[token] = &suspendedSession{
+				subscriptions: session.Subscriptions,
+				expires:       time.Unix(session.Expires, 0),
+				pubkey:        session.Pubkey,
+				private:       session.Private,
+			}
+		}
+		r.sessions.mu.Unlock()
+		log.Printf("🔄 Took over %d resumable sessions from the previous process", len(sessions))
+	}()
+}
+
+// upgrade starts the relay binary again on the same listening socket and waits
+// for it to serve. On success it returns the pipe the sessions are handed
+// over on; on failure the new process is killed and this one keeps serving.
+func (r *Relay) upgrade(listener net.Listener) (*os.File, error) {
+	if !r.upgrading.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("an upgrade is already in progress")
+	}
+	defer r.upgrading.Store(false)
+
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %T cannot be passed on", listener)
+	}
+	socket, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer socket.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	handR, handW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "RELAY_UPGRADE=1")
+	cmd.ExtraFiles = []*os.File{socket, readyW, handR}
+	err = cmd.Start()
+	readyW.Close()
+	handR.Close()
+	if err != nil {
+		handW.Close()
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		line := make([]byte, 6)
+		_, err := io.ReadFull(readyR, line)
+		ready <- err
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err = <-ready:
+	case err = <-exited:
+		err = fmt.Errorf("new process exited: %v", err)
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("new process did not start serving within %v", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		handW.Close()
+		return nil, err
+	}
+
+	log.Printf("🔄 New relay process %d is serving", cmd.Process.Pid)
+	sdNotify(fmt.Sprintf("MAINPID=%d\nSTATUS=Upgraded to process %d", cmd.Process.Pid, cmd.Process.Pid))
+	return handW, nil
+}
+
+// drainAfterUpgrade stops accepting connections and keeps serving the open
+// ones until they close or RELAY_UPGRADE_DRAIN passes. The remaining sessions
+// are then handed to the new process and their clients asked to reconnect:
+// connections themselves do not survive the restart, only the listener does.
+func (r *Relay) drainAfterUpgrade(server *http.Server, handover *os.File) {
+	r.startPeerFeed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	server.Shutdown(ctx)
+	cancel()
+
+	deadline := time.Now().Add(r.cfg.UpgradeDrain)
+	log.Printf("🔄 Draining %d connections for up to %v", r.clientCount(), r.cfg.UpgradeDrain)
+	for r.clientCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+
+	r.clientsMutex.RLock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.clientsMutex.RUnlock()
+
+	sessions := make(map[string]handedSession)
+	for token, session := range r.sessions.snapshot(clients, r.cfg.RestartGrace) {
+		sessions[token] = handedSession{Subscriptions: session.subscriptions, Expires: session.expires.Unix(), Pubkey: session.pubkey, Private: session.private}
+	}
+	data, _ := json.Marshal(sessions)
+	if _, err := handover.Write(data); err != nil {
+		log.Printf("❌ Failed to hand over sessions: %v", err)
+	}
+	handover.Close()
+
+	// 1012 (service restart) tells clients to reconnect, where they resume
+	closing := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "relay upgraded")
+	for _, c := range clients {
+		c.Conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(time.Second))
+		c.Conn.Close()
+	}
+
+	r.stopPeerFeed()
+	log.Printf("🔄 Handed over %d sessions, %d connections closed; exiting", len(sessions), len(clients))
+	r.closeStorage()
+}
+
+// clientCount returns the number of connected clients
+func (r *Relay) clientCount() int {
+	r.clientsMutex.RLock()
+	defer r.clientsMutex.RUnlock()
+	return len(r.clients)
+}
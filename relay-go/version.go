@@ -0,0 +1,114 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version and commit identify the build; set them at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD)".
+// The commit Go stamps itself takes precedence when the build had git.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildInfo describes the running binary for operators and bug reports
+type buildInfo struct {
+	Version   string            `json:"version"`
+	Commit    string            `json:"commit,omitempty"`
+	CommitAt  string            `json:"commit_time,omitempty"`
+	Modified  bool              `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	GoVersion string            `json:"go_version"`
+	Platform  string            `json:"platform"`
+	Flags     map[string]string `json:"build_flags"`
+	Storage   gin.H             `json:"storage"`
+	NIPs      []int             `json:"supported_nips"`
+	Features  []string          `json:"features"`
+}
+
+// readBuildInfo collects the VCS stamp and build settings the Go toolchain
+// embeds in the binary
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Flags:     map[string]string{},
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.time":
+			info.CommitAt = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		case "-tags", "-ldflags", "-trimpath", "-race", "CGO_ENABLED", "GOARM", "GOAMD64":
+			info.Flags[s.Key] = s.Value
+		}
+	}
+	if info.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	return info
+}
+
+// enabledFeatures lists the optional subsystems this configuration turns on
+func (r *Relay) enabledFeatures() []string {
+	cfg := r.cfg
+	features := []string{}
+	add := func(name string, on bool) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	for _, flag := range featureRegistry {
+		add(flag.Name, r.features.enabled(flag.Name))
+	}
+	add("persistent_sessions", cfg.PersistSessions)
+	add("push", r.push != nil)
+	add("self_hosted_push", r.selfHostedPush != nil)
+	add("crosspost", len(r.crossPostTargets) > 0)
+	add("mirrors", len(cfg.MirrorRelays) > 0)
+	add("automation", r.automation != nil)
+	add("webhook_ingest", r.ingest != nil)
+	add("visitor_reports", r.reports != nil)
+	add("cache_notify", r.notify != nil)
+	add("nip65_auto_publish", cfg.NIP65AutoPublish)
+	add("protocol_error_budget", cfg.ProtocolErrorBudget > 0)
+	add("nip42_auth", r.auth.required())
+	add("adaptive_indexes", cfg.AdaptiveIndexes)
+	add("litestream", r.replicator != nil)
+	add("read_verification", r.verifier != nil)
+	add("fault_injection", r.faults != nil)
+	add("connection_limit", r.gate != nil)
+	add("cache_ttl", len(r.cacheTTLs) > 0)
+	add("proof_of_work", r.pow != nil)
+	add("version_history", cfg.VersionHistory > 0)
+	add("media_uploads", cfg.MediaMaxBytes > 0)
+	add("public_stats", cfg.PublicStats)
+	add("nip98_payload_required", cfg.NIP98RequirePayload)
+	return features
+}
+
+// handleVersion reports the build and the enabled features of the running
+// relay
+func handleVersion(c *gin.Context) {
+	info := readBuildInfo()
+	partitioning := relay.cfg.Partitioning
+	if partitioning == "" {
+		partitioning = "single"
+	}
+	info.Storage = gin.H{"driver": sqliteDriver, "partitioning": partitioning}
+	info.NIPs = relay.relayInfo().SupportedNIPs
+	info.Features = relay.enabledFeatures()
+	c.JSON(200, info)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Only the newest version of a replaceable or addressable event is served,
+// but the owner's superseded versions are kept in version_history, up to
+// RELAY_VERSION_HISTORY per kind and d tag, so the owner can see how their
+// profile, contact list or an article looked at a past date. A version the
+// owner deletes (NIP-09) leaves the history too.
+
+// versionHistorySchema holds the owner's superseded versions as event JSON
+const versionHistorySchema = `
+	CREATE TABLE IF NOT EXISTS version_history (
+		id TEXT PRIMARY KEY,
+		kind INTEGER NOT NULL,
+		pubkey TEXT NOT NULL,
+		d TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		superseded_at INTEGER NOT NULL,
+		event TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_version_history_key ON version_history(pubkey, kind, d, created_at);
+`
+
+// keepsHistory reports whether the versions an event supersedes are kept
+func (r *Relay) keepsHistory(event *Event) bool {
+	return r.cfg.VersionHistory > 0 && r.cfg.OwnerPubkey != "" && event.PubKey == r.cfg.OwnerPubkey
+}
+
+// archiveVersion copies a superseded version, read through the transaction
+// that removes it, into the history in the transaction that stores its
+// replacement, and drops the oldest versions past the limit
+func (r *Relay) archiveVersion(tx, from sqlExecer, key address, id string, supersededAt int64) error {
+	var event Event
+	var tagsJSON string
+	if err := from.QueryRow("SELECT id, pubkey, created_at, kind, tags, content, sig FROM relay_events WHERE id = ?", id).Scan(
+		&event.ID, &event.PubKey, &event.CreatedAt, &event.Kind, &tagsJSON, &event.Content, &event.Sig); err != nil {
+		return err
+	}
+	json.Unmarshal([]byte(tagsJSON), &event.Tags)
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO version_history (id, kind, pubkey, d, created_at, superseded_at, event)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, event.ID, key.Kind, key.Pubkey, key.D, event.CreatedAt, supersededAt, string(eventJSON)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM version_history WHERE pubkey = ? AND kind = ? AND d = ? AND id NOT IN (
+		SELECT id FROM version_history WHERE pubkey = ? AND kind = ? AND d = ? ORDER BY created_at DESC LIMIT ?)`,
+		key.Pubkey, key.Kind, key.D, key.Pubkey, key.Kind, key.D, r.cfg.VersionHistory)
+	return err
+}
+
+// forgetVersions removes deleted versions from the history: by ID, or every
+// version of an address up to a time
+func (r *Relay) forgetVersions(condition string, args ...interface{}) {
+	if _, err := r.db.Exec("DELETE FROM version_history WHERE "+condition, args...); err != nil {
+		log.Printf("❌ Failed to remove deleted versions from the history: %v", err)
+	}
+}
+
+// versionEntry is one version of a replaceable or addressable event
+type versionEntry struct {
+	Event        Event  `json:"event"`
+	SupersededAt *int64 `json:"superseded_at"`
+}
+
+// ownerVersions returns the current version and the kept history of one of
+// the owner's replaceable or addressable events, newest first
+func (r *Relay) ownerVersions(kind int, d string) ([]versionEntry, error) {
+	key := address{Kind: kind, Pubkey: r.cfg.OwnerPubkey, D: d}
+	var versions []versionEntry
+
+	current, err := r.storedVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(current))
+	for i, v := range current {
+		ids[i] = v.id
+	}
+	for _, event := range r.eventsByID(ids) {
+		versions = append(versions, versionEntry{Event: event})
+	}
+
+	rows, err := r.db.Query("SELECT event, superseded_at FROM version_history WHERE pubkey = ? AND kind = ? AND d = ? ORDER BY created_at DESC",
+		key.Pubkey, key.Kind, key.D)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventJSON string
+		var supersededAt int64
+		if rows.Scan(&eventJSON, &supersededAt) != nil {
+			continue
+		}
+		entry := versionEntry{SupersededAt: &supersededAt}
+		if json.Unmarshal([]byte(eventJSON), &entry.Event) == nil {
+			versions = append(versions, entry)
+		}
+	}
+	return versions, rows.Err()
+}
+
+// versionParams reads the kind and, for addressable kinds, ?d=
+func versionParams(c *gin.Context) (int, string, bool) {
+	kind, err := strconv.Atoi(c.Param("kind"))
+	class, _ := relay.kinds.classify(kind)
+	if err != nil || (class != kindReplaceable && class != kindAddressable) {
+		c.JSON(400, gin.H{"error": "kind must be replaceable or addressable"})
+		return 0, "", false
+	}
+	if class == kindAddressable {
+		return kind, c.Query("d"), true
+	}
+	return kind, "", true
+}
+
+// handleVersionAsOf serves the owner's version of a replaceable or
+// addressable kind that was current at ?as_of=<unix>, or the current one
+func handleVersionAsOf(c *gin.Context) {
+	kind, d, ok := versionParams(c)
+	if !ok {
+		return
+	}
+	var asOf *int64
+	if value := c.Query("as_of"); value != "" {
+		t, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "as_of must be a unix timestamp"})
+			return
+		}
+		asOf = &t
+	}
+
+	versions, err := relay.ownerVersions(kind, d)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	for _, v := range versions {
+		if asOf == nil || v.Event.CreatedAt <= *asOf {
+			c.JSON(200, gin.H{"kind": kind, "d": d, "as_of": asOf, "event": v.Event, "superseded_at": v.SupersededAt})
+			return
+		}
+	}
+	c.JSON(404, gin.H{"error": "no version from that time is kept"})
+}
+
+// handleVersionHistory lists the owner's kept versions of a replaceable or
+// addressable kind, newest first
+func handleVersionHistory(c *gin.Context) {
+	kind, d, ok := versionParams(c)
+	if !ok {
+		return
+	}
+	versions, err := relay.ownerVersions(kind, d)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if versions == nil {
+		versions = []versionEntry{}
+	}
+	c.JSON(200, gin.H{"kind": kind, "d": d, "kept": relay.cfg.VersionHistory, "versions": versions})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NIP-54 wiki articles (kind 30818) and NIP-32 labels are indexed next to the
+// events, so the owner's knowledge base can be browsed and filtered by label.
+// Labels come from kind 1985 label events and from the l tags an event puts
+// on itself.
+
+const wikiSchema = `
+	CREATE TABLE IF NOT EXISTS event_wiki (
+		event_id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		d TEXT NOT NULL,
+		title TEXT NOT NULL,
+		summary TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_wiki_d ON event_wiki(d, created_at);
+`
+
+// nip32LabelSchema has a row per label and target; targets are event IDs (e),
+// addresses (a), pubkeys (p), URLs (r) or topics (t)
+const nip32LabelSchema = `
+	CREATE TABLE IF NOT EXISTS nip32_labels (
+		event_id TEXT NOT NULL,
+		labeler TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		namespace TEXT NOT NULL,
+		label TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target TEXT NOT NULL,
+		PRIMARY KEY (event_id, namespace, label, target_type, target)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_nip32_labels_label ON nip32_labels(namespace, label);
+	CREATE INDEX IF NOT EXISTS idx_nip32_labels_target ON nip32_labels(target_type, target);
+`
+
+// wikiArticle is the latest version of an article, with its labels
+type wikiArticle struct {
+	EventID   string       `json:"event_id"`
+	PubKey    string       `json:"pubkey"`
+	CreatedAt int64        `json:"created_at"`
+	D         string       `json:"d"`
+	Title     string       `json:"title"`
+	Summary   string       `json:"summary"`
+	Labels    []nip32Label `json:"labels"`
+	Content   string       `json:"content,omitempty"`
+}
+
+// nip32Label is a label with its namespace; ugc is the NIP-32 default
+type nip32Label struct {
+	Namespace string `json:"namespace"`
+	Label     string `json:"label"`
+}
+
+// address returns the kind:pubkey:d address of an article
+func (a *wikiArticle) address() string {
+	return address{Kind: 30818, Pubkey: a.PubKey, D: a.D}.String()
+}
+
+// indexWiki records a wiki article
+func indexWiki(db sqlExecer, event *Event) error {
+	if event.Kind != 30818 {
+		return nil
+	}
+	title := event.TagValue("title")
+	if title == "" {
+		title = event.TagValue("d")
+	}
+	_, err := db.Exec(`INSERT OR IGNORE INTO event_wiki (event_id, pubkey, created_at, d, title, summary)
+		VALUES (?, ?, ?, ?, ?, ?)`, event.ID, event.PubKey, event.CreatedAt, event.TagValue("d"), title, event.TagValue("summary"))
+	return err
+}
+
+// labelTargets lists what an event labels: the targets of a kind 1985 event,
+// or the event itself (by address when addressable) for self-labels
+func labelTargets(event *Event) [][2]string {
+	var targets [][2]string
+	if event.Kind == 1985 {
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[1] == "" {
+				continue
+			}
+			switch tag[0] {
+			case "e", "p":
+				if isHex64(tag[1]) {
+					targets = append(targets, [2]string{tag[0], strings.ToLower(tag[1])})
+				}
+			case "a":
+				if addr, ok := parseAddress(tag[1]); ok {
+					targets = append(targets, [2]string{"a", addr.String()})
+				}
+			case "r", "t":
+				targets = append(targets, [2]string{tag[0], tag[1]})
+			}
+		}
+		return targets
+	}
+	if event.Kind >= 30000 && event.Kind < 40000 {
+		return [][2]string{{"a", address{Kind: event.Kind, Pubkey: event.PubKey, D: event.TagValue("d")}.String()}}
+	}
+	return [][2]string{{"e", event.ID}}
+}
+
+// indexNIP32Labels records the l tags of an event against its targets
+func indexNIP32Labels(db sqlExecer, event *Event) error {
+	var labels []nip32Label
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "l" || tag[1] == "" {
+			continue
+		}
+		namespace := "ugc"
+		if len(tag) >= 3 && tag[2] != "" {
+			namespace = tag[2]
+		}
+		labels = append(labels, nip32Label{namespace, tag[1]})
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	for _, target := range labelTargets(event) {
+		for _, l := range labels {
+			if _, err := db.Exec(`INSERT OR IGNORE INTO nip32_labels
+				(event_id, labeler, created_at, namespace, label, target_type, target) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				event.ID, event.PubKey, event.CreatedAt, l.Namespace, l.Label, target[0], target[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trustedLabelers returns whose labels count: ?labeler= when given, else the
+// owner; nil means anyone when there is no owner. Articles always show their
+// author's labels too.
+func trustedLabelers(c *gin.Context) map[string]bool {
+	if labeler := strings.ToLower(c.Query("labeler")); labeler != "" {
+		return map[string]bool{labeler: true}
+	}
+	if relay.cfg.OwnerPubkey == "" {
+		return nil
+	}
+	return map[string]bool{relay.cfg.OwnerPubkey: true}
+}
+
+// labelRow is one label on a target, with the event and pubkey that set it
+type labelRow struct {
+	nip32Label
+	EventID, Labeler string
+}
+
+// labelsOf loads the labels on the given targets, keyed by target
+func labelsOf(targetType string, targets []string) (map[string][]labelRow, error) {
+	labels := map[string][]labelRow{}
+	if len(targets) == 0 {
+		return labels, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(targets)), ",")
+	args := []interface{}{targetType}
+	for _, target := range targets {
+		args = append(args, target)
+	}
+	err := queryPayloads("SELECT target, namespace, label, event_id, labeler FROM nip32_labels WHERE target_type = ? AND target IN ("+placeholders+")",
+		args, func(rows *sql.Rows) {
+			var target string
+			var l labelRow
+			if rows.Scan(&target, &l.Namespace, &l.Label, &l.EventID, &l.Labeler) == nil {
+				labels[target] = append(labels[target], l)
+			}
+		})
+	return labels, err
+}
+
+// queryWiki returns the latest version of each matching article, with the
+// labels trusted labelers (plus the article's author) put on it. Self-labels
+// of older versions no longer apply.
+func queryWiki(where string, args []interface{}, trusted map[string]bool) ([]wikiArticle, error) {
+	latest := map[string]wikiArticle{}
+	versions := map[string]bool{}
+	err := queryPayloads("SELECT event_id, pubkey, created_at, d, title, summary FROM event_wiki WHERE "+where, args, func(rows *sql.Rows) {
+		var a wikiArticle
+		if rows.Scan(&a.EventID, &a.PubKey, &a.CreatedAt, &a.D, &a.Title, &a.Summary) != nil {
+			return
+		}
+		versions[a.EventID] = true
+		if a.CreatedAt >= latest[a.address()].CreatedAt {
+			latest[a.address()] = a
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(latest))
+	for addr := range latest {
+		addrs = append(addrs, addr)
+	}
+	labels, err := labelsOf("a", addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	articles := make([]wikiArticle, 0, len(latest))
+	for addr, a := range latest {
+		a.Labels = []nip32Label{}
+		seen := map[nip32Label]bool{}
+		for _, l := range labels[addr] {
+			superseded := versions[l.EventID] && l.EventID != a.EventID
+			trustedBy := trusted == nil || trusted[l.Labeler] || l.Labeler == a.PubKey
+			if trustedBy && !superseded && !seen[l.nip32Label] {
+				seen[l.nip32Label] = true
+				a.Labels = append(a.Labels, l.nip32Label)
+			}
+		}
+		articles = append(articles, a)
+	}
+	sort.Slice(articles, func(i, j int) bool { return articles[i].CreatedAt > articles[j].CreatedAt })
+	return articles, nil
+}
+
+// hasLabel reports whether an article carries a label, in any namespace when
+// namespace is empty
+func (a *wikiArticle) hasLabel(label, namespace string) bool {
+	for _, l := range a.Labels {
+		if l.Label == label && (namespace == "" || l.Namespace == namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWiki lists the latest version of each wiki article, newest first.
+// ?label= (and ?namespace=) keep articles with that label, ?author= one
+// writer's articles.
+func handleWiki(c *gin.Context) {
+	where, args := authorCondition(c, "1=1", []interface{}{})
+	articles, err := queryWiki(where, args, trustedLabelers(c))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	label, namespace := c.Query("label"), c.Query("namespace")
+	filtered := []wikiArticle{}
+	for _, a := range articles {
+		if label == "" || a.hasLabel(label, namespace) {
+			filtered = append(filtered, a)
+		}
+	}
+	if limit := payloadLimit(c); len(filtered) > limit {
+		filtered = filtered[:limit]
+	}
+	c.JSON(200, gin.H{"articles": filtered})
+}
+
+// handleWikiArticle returns the latest version of every article on a topic
+// (its d tag), with content; ?author= picks one writer's
+func handleWikiArticle(c *gin.Context) {
+	where, args := authorCondition(c, "d = ?", []interface{}{c.Param("d")})
+	articles, err := queryWiki(where, args, trustedLabelers(c))
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if len(articles) == 0 {
+		c.JSON(404, gin.H{"error": "article not found"})
+		return
+	}
+
+	ids := make([]string, len(articles))
+	for i, a := range articles {
+		ids[i] = a.EventID
+	}
+	stored := relay.eventsByID(ids)
+	for i := range articles {
+		articles[i].Content = stored[articles[i].EventID].Content
+	}
+	c.JSON(200, gin.H{"articles": articles})
+}
+
+// handleNIP32Labels lists the labels in use with how many targets carry each,
+// or with ?label= (and ?namespace=) the targets carrying that label
+func handleNIP32Labels(c *gin.Context) {
+	trusted := trustedLabelers(c)
+	label, namespace := c.Query("label"), c.Query("namespace")
+	where, args := "1=1", []interface{}{}
+	if label != "" {
+		where += " AND label = ?"
+		args = append(args, label)
+	}
+	if namespace != "" {
+		where += " AND namespace = ?"
+		args = append(args, namespace)
+	}
+
+	type target struct{ Type, Target string }
+	counts := map[nip32Label]map[target]bool{}
+	err := queryPayloads("SELECT labeler, namespace, label, target_type, target FROM nip32_labels WHERE "+where, args, func(rows *sql.Rows) {
+		var labeler string
+		var l nip32Label
+		var t target
+		if rows.Scan(&labeler, &l.Namespace, &l.Label, &t.Type, &t.Target) != nil || (trusted != nil && !trusted[labeler]) {
+			return
+		}
+		if counts[l] == nil {
+			counts[l] = map[target]bool{}
+		}
+		counts[l][t] = true
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if label != "" {
+		targets := []gin.H{}
+		for l, set := range counts {
+			for t := range set {
+				targets = append(targets, gin.H{"namespace": l.Namespace, "label": l.Label, "type": t.Type, "target": t.Target})
+			}
+		}
+		c.JSON(200, gin.H{"targets": targets})
+		return
+	}
+
+	labels := []gin.H{}
+	for l, set := range counts {
+		labels = append(labels, gin.H{"namespace": l.Namespace, "label": l.Label, "targets": len(set)})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i]["targets"].(int) > labels[j]["targets"].(int) })
+	c.JSON(200, gin.H{"labels": labels})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// bolt11Multipliers converts a bolt11 amount unit into millisatoshis per unit
+var bolt11Multipliers = map[byte]float64{
+	'm': 1e8,
+	'u': 1e5,
+	'n': 1e2,
+	'p': 1e-1,
+}
+
+// bolt11AmountMsat extracts the amount encoded in a bolt11 invoice's
+// human-readable part, returning 0 for amountless or malformed invoices
+func bolt11AmountMsat(invoice string) int64 {
+	invoice = strings.ToLower(invoice)
+	sep := strings.LastIndexByte(invoice, '1')
+	if !strings.HasPrefix(invoice, "ln") || sep < 0 {
+		return 0
+	}
+
+	// Skip the currency prefix (bc, tb, bcrt, ...) to reach the amount
+	hrp := invoice[2:sep]
+	start := strings.IndexAny(hrp, "0123456789")
+	if start < 0 {
+		return 0
+	}
+	amount := hrp[start:]
+
+	multiplier := 1e11 // whole bitcoin
+	if last := amount[len(amount)-1]; last < '0' || last > '9' {
+		m, ok := bolt11Multipliers[last]
+		if !ok {
+			return 0
+		}
+		multiplier = m
+		amount = amount[:len(amount)-1]
+	}
+
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return int64(float64(n) * multiplier)
+}
+
+// zapRequest returns the embedded kind 9734 zap request of a zap receipt
+func zapRequest(receipt *Event) *Event {
+	description := receipt.TagValue("description")
+	if description == "" {
+		return nil
+	}
+
+	var request Event
+	if err := json.Unmarshal([]byte(description), &request); err != nil {
+		return nil
+	}
+	return &request
+}
+
+// zapAmountMsat returns the amount paid by a kind 9735 zap receipt
+func zapAmountMsat(receipt *Event) int64 {
+	if amount := bolt11AmountMsat(receipt.TagValue("bolt11")); amount > 0 {
+		return amount
+	}
+
+	if request := zapRequest(receipt); request != nil {
+		amount, _ := strconv.ParseInt(request.TagValue("amount"), 10, 64)
+		return amount
+	}
+	return 0
+}
+
+// zapSender returns the pubkey that paid a zap receipt
+func zapSender(receipt *Event) string {
+	if sender := receipt.TagValue("P"); sender != "" {
+		return sender
+	}
+	if request := zapRequest(receipt); request != nil {
+		return request.PubKey
+	}
+	return ""
+}